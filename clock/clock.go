@@ -0,0 +1,97 @@
+// Package clock provides an injectable time source for libp2p components.
+//
+// Components that measure time, sleep or schedule timers should take a Clock
+// instead of calling the time package directly, so that tests and
+// simulations can run them on virtual time. Real is backed by the time
+// package; Virtual only moves when advanced explicitly.
+//
+// A Clock can be passed wherever a time source with a Now method is expected,
+// such as the WithClock option of go-libp2p's pstoremem address book.
+//
+// The components of this module that measure time take a Clock option: the
+// in-memory network (memnet), which also applies network.DialPeerTimeout on
+// its clock, the framed streams, rate limiters, stream schedulers, graceful
+// close, dial planner and stream observers of the network package, the rpc
+// package, the resource manager, the fault-injecting transport, and the
+// peerstore extensions. Contexts timing out on a Clock are created with
+// WithTimeout and WithDeadline.
+//
+// Some timers stay on wall time: the decay of connection manager tags, which
+// is implemented outside this module (go-libp2p's connmgr takes its own clock
+// in its DecayerCfg), the deadlines of the net.Conns of transports, which
+// are wall times by contract, including those of the in-memory transport,
+// and contexts created with the context package.
+package clock
+
+import (
+	"time"
+)
+
+// Clock tells the time and schedules timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Since returns the time elapsed since t.
+	Since(t time.Time) time.Duration
+	// Until returns the duration until t.
+	Until(t time.Time) time.Duration
+	// Sleep pauses the current goroutine for at least d.
+	Sleep(d time.Duration)
+	// AfterFunc calls f in its own goroutine (Real) or in the goroutine
+	// advancing the clock (Virtual) once d has elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+	// NewTimer creates a Timer that sends the current time on its channel
+	// once d has elapsed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single event scheduled on a Clock.
+type Timer interface {
+	// C returns the channel on which the time is delivered. It is nil for
+	// timers created by AfterFunc.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer had
+	// already fired or been stopped.
+	Stop() bool
+	// Reset changes the timer to fire after d. It returns true if the timer
+	// had been active.
+	Reset(d time.Duration) bool
+}
+
+// Real is the Clock backed by the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                  { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+func (realClock) Until(t time.Time) time.Duration { return time.Until(t) }
+func (realClock) Sleep(d time.Duration)           { time.Sleep(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return &realTimer{t: time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	t := time.NewTimer(d)
+	return &realTimer{t: t, c: t.C}
+}
+
+type realTimer struct {
+	t *time.Timer
+	c <-chan time.Time
+}
+
+func (t *realTimer) C() <-chan time.Time        { return t.c }
+func (t *realTimer) Stop() bool                 { return t.t.Stop() }
+func (t *realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+// Go runs f in a new goroutine. On a scheduling Virtual clock the goroutine
+// is tracked, so that the clock only advances once it blocks or returns.
+func Go(c Clock, f func()) {
+	if v, ok := c.(*Virtual); ok && v.Scheduled() {
+		v.Go(f)
+		return
+	}
+	go f()
+}
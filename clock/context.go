@@ -0,0 +1,62 @@
+package clock
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// WithDeadline is like context.WithDeadline, except that the deadline is
+// reached on c. On Real, it is context.WithDeadline. On a Virtual clock, the
+// context is done once the clock is advanced to d, and its Deadline method
+// reports d in virtual time.
+func WithDeadline(ctx context.Context, c Clock, d time.Time) (context.Context, context.CancelFunc) {
+	if _, ok := c.(realClock); ok {
+		return context.WithDeadline(ctx, d)
+	}
+
+	inner, cancel := context.WithCancel(ctx)
+	dc := &deadlineCtx{Context: inner, deadline: d}
+	if c.Until(d) <= 0 {
+		dc.expire(cancel)
+		return dc, cancel
+	}
+	t := c.AfterFunc(c.Until(d), func() { dc.expire(cancel) })
+	return dc, func() {
+		t.Stop()
+		cancel()
+	}
+}
+
+// WithTimeout returns WithDeadline(ctx, c, c.Now().Add(timeout)).
+func WithTimeout(ctx context.Context, c Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return WithDeadline(ctx, c, c.Now().Add(timeout))
+}
+
+// deadlineCtx is a context reaching its deadline on a Virtual clock.
+type deadlineCtx struct {
+	context.Context
+	deadline time.Time
+	expired  int32
+}
+
+func (c *deadlineCtx) expire(cancel context.CancelFunc) {
+	if c.Context.Err() != nil {
+		// canceled before the deadline
+		return
+	}
+	atomic.StoreInt32(&c.expired, 1)
+	cancel()
+}
+
+func (c *deadlineCtx) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *deadlineCtx) Err() error {
+	err := c.Context.Err()
+	if err != nil && atomic.LoadInt32(&c.expired) == 1 {
+		return context.DeadlineExceeded
+	}
+	return err
+}
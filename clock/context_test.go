@@ -0,0 +1,61 @@
+package clock_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+)
+
+func TestWithTimeoutVirtual(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	ctx, cancel := clock.WithTimeout(context.Background(), clk, time.Second)
+	defer cancel()
+
+	if d, ok := ctx.Deadline(); !ok || !d.Equal(time.Unix(1, 0)) {
+		t.Fatalf("expected a deadline in virtual time, got %s", d)
+	}
+	clk.Advance(999 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatal("expected the context not to be done before the deadline")
+	}
+	clk.Advance(time.Millisecond)
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("expected the context to be done at the deadline")
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", ctx.Err())
+	}
+}
+
+func TestWithDeadlineVirtualCancel(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := clock.WithDeadline(parent, clk, time.Unix(10, 0))
+	defer cancel()
+
+	cancelParent()
+	<-ctx.Done()
+	clk.Advance(time.Minute)
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("expected the cancellation of the parent to be reported, got %v", ctx.Err())
+	}
+
+	ctx, cancel = clock.WithDeadline(context.Background(), clk, time.Unix(0, 0))
+	defer cancel()
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("expected a past deadline to be exceeded, got %v", ctx.Err())
+	}
+}
+
+func TestWithTimeoutReal(t *testing.T) {
+	ctx, cancel := clock.WithTimeout(context.Background(), clock.Real, time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", ctx.Err())
+	}
+}
@@ -0,0 +1,285 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Virtual is a Clock whose time only moves when advanced with Advance or
+// AdvanceTo. Timers fire in the goroutine advancing the clock, ordered by
+// deadline and, for equal deadlines, by the order in which they were set.
+//
+// A Virtual created with NewScheduled additionally serializes the goroutines
+// started with Go (or clock.Go): at most one of them runs at any time, and
+// they run in a deterministic order, handing over to each other whenever they
+// block on a Waker or Sleep of the clock. Advancing the clock
+// first lets every runnable goroutine run until it blocks, so that the same
+// sequence of calls always produces the same sequence of events. Tracked
+// goroutines must only block through the clock; blocking on anything else
+// (plain channels, locks held by untracked goroutines) stalls the clock.
+type Virtual struct {
+	scheduled bool
+
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers timerHeap
+
+	// runq holds the goroutines waiting for their turn, in order.
+	runq []chan struct{}
+	// idle is closed when the goroutines started by drain have all blocked.
+	idle chan struct{}
+}
+
+var _ Clock = (*Virtual)(nil)
+
+// NewVirtual creates a Virtual clock set to start.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+// NewScheduled creates a Virtual clock set to start, which serializes the
+// goroutines started through it. The goroutine creating the clock is its
+// driver: it is the only one that may call Advance and AdvanceTo.
+func NewScheduled(start time.Time) *Virtual {
+	return &Virtual{now: start, scheduled: true}
+}
+
+// Scheduled returns true if the clock serializes the goroutines started
+// through it.
+func (v *Virtual) Scheduled() bool {
+	return v.scheduled
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.now
+}
+
+func (v *Virtual) Since(t time.Time) time.Duration {
+	return v.Now().Sub(t)
+}
+
+func (v *Virtual) Until(t time.Time) time.Duration {
+	return t.Sub(v.Now())
+}
+
+// Sleep blocks until the clock has been advanced by d.
+func (v *Virtual) Sleep(d time.Duration) {
+	w := NewWaker(v)
+	tok := w.Arm()
+	t := v.AfterFunc(d, w.Wake)
+	w.Wait(tok, nil)
+	t.Stop()
+}
+
+func (v *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	return v.newTimer(d, f, nil)
+}
+
+func (v *Virtual) NewTimer(d time.Duration) Timer {
+	return v.newTimer(d, nil, make(chan time.Time, 1))
+}
+
+func (v *Virtual) newTimer(d time.Duration, f func(), c chan time.Time) *virtualTimer {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	t := &virtualTimer{v: v, f: f, c: c, index: -1}
+	v.schedule(t, d)
+	return t
+}
+
+// schedule (re)arms t. Callers hold v.mu.
+func (v *Virtual) schedule(t *virtualTimer, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	v.seq++
+	t.at = v.now.Add(d)
+	t.seq = v.seq
+	heap.Push(&v.timers, t)
+}
+
+// Next returns the deadline of the next timer, if any.
+func (v *Virtual) Next() (time.Time, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.timers) == 0 {
+		return time.Time{}, false
+	}
+	return v.timers[0].at, true
+}
+
+// Advance moves the clock forward by d, firing all timers due in the
+// meantime.
+func (v *Virtual) Advance(d time.Duration) {
+	v.AdvanceTo(v.Now().Add(d))
+}
+
+// AdvanceTo moves the clock forward to t, firing all timers due by then.
+// The clock never moves backwards.
+func (v *Virtual) AdvanceTo(t time.Time) {
+	for {
+		v.drain()
+
+		v.mu.Lock()
+		if len(v.timers) == 0 || v.timers[0].at.After(t) {
+			if t.After(v.now) {
+				v.now = t
+			}
+			v.mu.Unlock()
+			break
+		}
+		next := heap.Pop(&v.timers).(*virtualTimer)
+		if next.at.After(v.now) {
+			v.now = next.at
+		}
+		now := v.now
+		v.mu.Unlock()
+
+		next.fire(now)
+	}
+	v.drain()
+}
+
+// Go starts f in a new goroutine. On a scheduling clock, f waits for its turn
+// before running.
+func (v *Virtual) Go(f func()) {
+	if !v.scheduled {
+		go f()
+		return
+	}
+	turn := make(chan struct{})
+	v.enqueue(turn)
+	go func() {
+		<-turn
+		defer v.release()
+		f()
+	}()
+}
+
+func (v *Virtual) enqueue(turn chan struct{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.runq = append(v.runq, turn)
+}
+
+// drain lets the runnable goroutines run, one at a time, until all of them
+// are blocked.
+func (v *Virtual) drain() {
+	if !v.scheduled {
+		return
+	}
+	v.mu.Lock()
+	if len(v.runq) == 0 {
+		v.mu.Unlock()
+		return
+	}
+	turn := v.runq[0]
+	v.runq = v.runq[1:]
+	idle := make(chan struct{})
+	v.idle = idle
+	v.mu.Unlock()
+
+	close(turn)
+	<-idle
+}
+
+// release hands the turn of the calling goroutine over to the next runnable
+// goroutine, or back to the driver if there is none.
+func (v *Virtual) release() {
+	v.mu.Lock()
+	if len(v.runq) > 0 {
+		turn := v.runq[0]
+		v.runq = v.runq[1:]
+		v.mu.Unlock()
+		close(turn)
+		return
+	}
+	idle := v.idle
+	v.idle = nil
+	v.mu.Unlock()
+	if idle != nil {
+		close(idle)
+	}
+}
+
+type virtualTimer struct {
+	v     *Virtual
+	at    time.Time
+	seq   uint64
+	f     func()
+	c     chan time.Time
+	index int
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.v.mu.Lock()
+	defer t.v.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.v.timers, t.index)
+	return true
+}
+
+func (t *virtualTimer) Reset(d time.Duration) bool {
+	t.v.mu.Lock()
+	defer t.v.mu.Unlock()
+	active := t.index >= 0
+	if active {
+		heap.Remove(&t.v.timers, t.index)
+	}
+	t.v.schedule(t, d)
+	return active
+}
+
+func (t *virtualTimer) fire(now time.Time) {
+	if t.f != nil {
+		t.f()
+		return
+	}
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+type timerHeap []*virtualTimer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*virtualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
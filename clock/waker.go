@@ -0,0 +1,145 @@
+package clock
+
+import (
+	"sync"
+)
+
+// Waker lets a goroutine wait for a condition to change in a way that works
+// with every Clock, including a scheduling Virtual clock, on which waiting
+// goroutines must hand over their turn.
+//
+// The usual pattern is:
+//
+//	for {
+//		tok := w.Arm()
+//		if condition() {
+//			break
+//		}
+//		w.Wait(tok, nil)
+//	}
+//
+// with w.Wake called whenever the condition may have changed, e.g. from a
+// timer set with the clock's AfterFunc.
+type Waker struct {
+	v *Virtual // non-nil for scheduling clocks
+
+	mu      sync.Mutex
+	ch      chan struct{}
+	waiters []*waiter
+}
+
+// Token is returned by Arm, and passed to Wait.
+type Token struct {
+	ch <-chan struct{}
+}
+
+type waiter struct {
+	turn  chan struct{}
+	woken bool
+}
+
+// NewWaker creates a Waker for goroutines running on c.
+func NewWaker(c Clock) *Waker {
+	w := &Waker{}
+	if v, ok := c.(*Virtual); ok && v.scheduled {
+		w.v = v
+	}
+	return w
+}
+
+// Arm must be called before checking the condition. Wake calls made after
+// Arm are not missed by the following Wait.
+func (w *Waker) Arm() Token {
+	if w.v != nil {
+		return Token{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ch == nil {
+		w.ch = make(chan struct{})
+	}
+	return Token{ch: w.ch}
+}
+
+// Wait blocks until Wake is called, or cancel is closed. On a scheduling
+// clock, cancel is only observed asynchronously: the order of events remains
+// deterministic only if waiters are woken through Wake.
+func (w *Waker) Wait(tok Token, cancel <-chan struct{}) {
+	if w.v == nil {
+		select {
+		case <-tok.ch:
+		case <-cancel:
+		}
+		return
+	}
+
+	select {
+	case <-cancel:
+		return
+	default:
+	}
+
+	wt := &waiter{turn: make(chan struct{})}
+	w.mu.Lock()
+	w.waiters = append(w.waiters, wt)
+	w.mu.Unlock()
+
+	var stop chan struct{}
+	if cancel != nil {
+		stop = make(chan struct{})
+		go func() {
+			select {
+			case <-cancel:
+				w.wake(wt)
+			case <-stop:
+			}
+		}()
+	}
+
+	w.v.release()
+	<-wt.turn
+	if stop != nil {
+		close(stop)
+	}
+}
+
+// Wake wakes all goroutines waiting on w. On a scheduling clock, they are
+// scheduled to run in the order in which they started waiting.
+func (w *Waker) Wake() {
+	w.mu.Lock()
+	if w.v == nil {
+		if w.ch != nil {
+			close(w.ch)
+			w.ch = nil
+		}
+		w.mu.Unlock()
+		return
+	}
+	waiters := w.waiters
+	w.waiters = nil
+	for _, wt := range waiters {
+		wt.woken = true
+	}
+	w.mu.Unlock()
+
+	for _, wt := range waiters {
+		w.v.enqueue(wt.turn)
+	}
+}
+
+func (w *Waker) wake(wt *waiter) {
+	w.mu.Lock()
+	if wt.woken {
+		w.mu.Unlock()
+		return
+	}
+	wt.woken = true
+	for i, other := range w.waiters {
+		if other == wt {
+			w.waiters = append(w.waiters[:i], w.waiters[i+1:]...)
+			break
+		}
+	}
+	w.mu.Unlock()
+	w.v.enqueue(wt.turn)
+}
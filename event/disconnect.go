@@ -0,0 +1,19 @@
+package event
+
+import (
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// EvtConnClosedWithReason is emitted when a connection closes with a known
+// reason, whether it was closed by the local or by the remote peer.
+type EvtConnClosedWithReason struct {
+	// Peer is the remote peer of the connection.
+	Peer peer.ID
+	// ConnID is the ID of the connection.
+	ConnID string
+	// Reason is the reason given by the side closing the connection.
+	Reason control.DisconnectReason
+	// Remote is true if the remote peer closed the connection.
+	Remote bool
+}
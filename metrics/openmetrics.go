@@ -0,0 +1,346 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// DefaultTopPeers is the number of peers exported individually by default.
+const DefaultTopPeers = 10
+
+// OtherPeers is the value of the peer label of the series summing the peers
+// not exported individually.
+const OtherPeers = "other"
+
+// ErrDuplicateFamily is returned when a metric family is written twice by
+// an OpenMetricsWriter.
+var ErrDuplicateFamily = errors.New("metric family already written")
+
+// OpenMetricsOption is an option of an OpenMetricsWriter.
+type OpenMetricsOption func(*OpenMetricsWriter) error
+
+// WithNamespace prefixes the names of all the metrics with ns and an
+// underscore. The default namespace is "libp2p".
+func WithNamespace(ns string) OpenMetricsOption {
+	return func(w *OpenMetricsWriter) error {
+		if !validMetricName(ns) {
+			return fmt.Errorf("invalid metric namespace %q", ns)
+		}
+		w.ns = ns
+		return nil
+	}
+}
+
+// WithTopPeers bounds the number of peers exported individually to the n
+// peers using the most resources, or bandwidth. The other peers are summed
+// in a single series, whose peer label is OtherPeers. The default is
+// DefaultTopPeers.
+func WithTopPeers(n int) OpenMetricsOption {
+	return func(w *OpenMetricsWriter) error {
+		if n < 0 {
+			return fmt.Errorf("invalid number of top peers: %d", n)
+		}
+		w.topPeers = n
+		return nil
+	}
+}
+
+// OpenMetricsWriter writes metrics in the OpenMetrics text exposition
+// format. Every Write method writes complete metric families; Close ends
+// the exposition.
+type OpenMetricsWriter struct {
+	w        io.Writer
+	ns       string
+	topPeers int
+
+	families map[string]bool
+	err      error
+}
+
+// NewOpenMetricsWriter creates an OpenMetricsWriter writing to w.
+func NewOpenMetricsWriter(w io.Writer, opts ...OpenMetricsOption) (*OpenMetricsWriter, error) {
+	ow := &OpenMetricsWriter{
+		w:        w,
+		ns:       "libp2p",
+		topPeers: DefaultTopPeers,
+		families: make(map[string]bool),
+	}
+	for _, o := range opts {
+		if err := o(ow); err != nil {
+			return nil, err
+		}
+	}
+	return ow, nil
+}
+
+type label struct {
+	name, value string
+}
+
+type sample struct {
+	suffix string
+	labels []label
+	value  float64
+}
+
+// family writes a metric family. The name excludes the namespace, and
+// includes the unit if any.
+func (w *OpenMetricsWriter) family(name, typ, unit, help string, samples []sample) {
+	if w.err != nil {
+		return
+	}
+	name = w.ns + "_" + name
+	if w.families[name] {
+		w.err = fmt.Errorf("%s: %w", name, ErrDuplicateFamily)
+		return
+	}
+	w.families[name] = true
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+	if unit != "" {
+		fmt.Fprintf(&b, "# UNIT %s %s\n", name, unit)
+	}
+	fmt.Fprintf(&b, "# HELP %s %s\n", name, escapeHelp(help))
+	for _, s := range samples {
+		b.WriteString(name)
+		b.WriteString(s.suffix)
+		if len(s.labels) > 0 {
+			b.WriteByte('{')
+			for i, l := range s.labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, "%s=\"%s\"", l.name, escapeLabelValue(l.value))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(formatValue(s.value))
+		b.WriteByte('\n')
+	}
+	_, w.err = io.WriteString(w.w, b.String())
+}
+
+// WriteResourceSnapshot writes the usage of the scopes of a resource
+// manager, as gauges labelled by scope.
+func (w *OpenMetricsWriter) WriteResourceSnapshot(snap network.ResourceSnapshot) error {
+	type scope struct {
+		labels []label
+		stat   network.ScopeStat
+	}
+	scopes := []scope{
+		{[]label{{"scope", "system"}}, snap.System},
+		{[]label{{"scope", "transient"}}, snap.Transient},
+		{[]label{{"scope", "allowlisted-system"}}, snap.AllowlistedSystem},
+		{[]label{{"scope", "allowlisted-transient"}}, snap.AllowlistedTransient},
+	}
+	svcs := make([]string, 0, len(snap.Services))
+	for svc := range snap.Services {
+		svcs = append(svcs, svc)
+	}
+	sort.Strings(svcs)
+	for _, svc := range svcs {
+		scopes = append(scopes, scope{[]label{{"scope", "service"}, {"service", svc}}, snap.Services[svc]})
+	}
+	protos := make([]string, 0, len(snap.Protocols))
+	for proto := range snap.Protocols {
+		protos = append(protos, string(proto))
+	}
+	sort.Strings(protos)
+	for _, proto := range protos {
+		scopes = append(scopes, scope{[]label{{"scope", "protocol"}, {"protocol", proto}}, snap.Protocols[protocol.ID(proto)]})
+	}
+
+	peers := make([]peer.ID, 0, len(snap.Peers))
+	for p := range snap.Peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		si, sj := snap.Peers[peers[i]], snap.Peers[peers[j]]
+		if si.Memory != sj.Memory {
+			return si.Memory > sj.Memory
+		}
+		if ni, nj := streamsAndConns(si), streamsAndConns(sj); ni != nj {
+			return ni > nj
+		}
+		return peers[i] < peers[j]
+	})
+	var other network.ScopeStat
+	for i, p := range peers {
+		st := snap.Peers[p]
+		if i < w.topPeers {
+			scopes = append(scopes, scope{[]label{{"scope", "peer"}, {"peer", p.String()}}, st})
+			continue
+		}
+		other.Memory += st.Memory
+		other.NumFD += st.NumFD
+		other.NumConnsInbound += st.NumConnsInbound
+		other.NumConnsOutbound += st.NumConnsOutbound
+		other.NumStreamsInbound += st.NumStreamsInbound
+		other.NumStreamsOutbound += st.NumStreamsOutbound
+	}
+	if len(peers) > w.topPeers {
+		scopes = append(scopes, scope{[]label{{"scope", "peer"}, {"peer", OtherPeers}}, other})
+	}
+
+	gauge := func(value func(network.ScopeStat) float64, extra ...label) []sample {
+		samples := make([]sample, 0, len(scopes))
+		for _, s := range scopes {
+			labels := append(s.labels[:len(s.labels):len(s.labels)], extra...)
+			samples = append(samples, sample{labels: labels, value: value(s.stat)})
+		}
+		return samples
+	}
+	w.family("rcmgr_memory_bytes", "gauge", "bytes", "Memory reserved in the scope.",
+		gauge(func(st network.ScopeStat) float64 { return float64(st.Memory) }))
+	w.family("rcmgr_fds", "gauge", "", "File descriptors reserved in the scope.",
+		gauge(func(st network.ScopeStat) float64 { return float64(st.NumFD) }))
+	w.family("rcmgr_connections", "gauge", "", "Connections reserved in the scope.", append(
+		gauge(func(st network.ScopeStat) float64 { return float64(st.NumConnsInbound) }, label{"dir", "inbound"}),
+		gauge(func(st network.ScopeStat) float64 { return float64(st.NumConnsOutbound) }, label{"dir", "outbound"})...))
+	w.family("rcmgr_streams", "gauge", "", "Streams reserved in the scope.", append(
+		gauge(func(st network.ScopeStat) float64 { return float64(st.NumStreamsInbound) }, label{"dir", "inbound"}),
+		gauge(func(st network.ScopeStat) float64 { return float64(st.NumStreamsOutbound) }, label{"dir", "outbound"})...))
+	return w.err
+}
+
+func streamsAndConns(st network.ScopeStat) int {
+	return st.NumStreamsInbound + st.NumStreamsOutbound + st.NumConnsInbound + st.NumConnsOutbound
+}
+
+// WriteBandwidth writes the bandwidth reported by r, such as a
+// BandwidthCounter: the totals, and the bandwidth by protocol and by peer.
+func (w *OpenMetricsWriter) WriteBandwidth(r Reporter) error {
+	totals := r.GetBandwidthTotals()
+	byProto := r.GetBandwidthByProtocol()
+	byPeer := r.GetBandwidthByPeer()
+
+	protos := make([]string, 0, len(byProto))
+	for proto := range byProto {
+		protos = append(protos, string(proto))
+	}
+	sort.Strings(protos)
+
+	peers := make([]peer.ID, 0, len(byPeer))
+	for p := range byPeer {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		ti := byPeer[peers[i]].TotalIn + byPeer[peers[i]].TotalOut
+		tj := byPeer[peers[j]].TotalIn + byPeer[peers[j]].TotalOut
+		if ti != tj {
+			return ti > tj
+		}
+		return peers[i] < peers[j]
+	})
+	type series struct {
+		labels []label
+		stats  Stats
+	}
+	var peerSeries []series
+	var other Stats
+	for i, p := range peers {
+		st := byPeer[p]
+		if i < w.topPeers {
+			peerSeries = append(peerSeries, series{[]label{{"peer", p.String()}}, st})
+			continue
+		}
+		other.TotalIn += st.TotalIn
+		other.TotalOut += st.TotalOut
+		other.RateIn += st.RateIn
+		other.RateOut += st.RateOut
+	}
+	if len(peers) > w.topPeers {
+		peerSeries = append(peerSeries, series{[]label{{"peer", OtherPeers}}, other})
+	}
+	protoSeries := make([]series, 0, len(protos))
+	for _, proto := range protos {
+		protoSeries = append(protoSeries, series{[]label{{"protocol", proto}}, byProto[protocol.ID(proto)]})
+	}
+
+	write := func(name, what string, ss []series) {
+		var counters, rates []sample
+		for _, s := range ss {
+			in := append(s.labels[:len(s.labels):len(s.labels)], label{"dir", "in"})
+			out := append(s.labels[:len(s.labels):len(s.labels)], label{"dir", "out"})
+			counters = append(counters,
+				sample{suffix: "_total", labels: in, value: float64(s.stats.TotalIn)},
+				sample{suffix: "_total", labels: out, value: float64(s.stats.TotalOut)})
+			rates = append(rates,
+				sample{labels: in, value: s.stats.RateIn},
+				sample{labels: out, value: s.stats.RateOut})
+		}
+		w.family(name+"_bytes", "counter", "bytes", "Bytes transferred"+what+".", counters)
+		w.family(name+"_rate_bytes_per_second", "gauge", "bytes_per_second", "Rate of transfer"+what+".", rates)
+	}
+	write("bandwidth", "", []series{{nil, totals}})
+	write("bandwidth_protocol", ", by protocol", protoSeries)
+	write("bandwidth_peer", ", by peer", peerSeries)
+	return w.err
+}
+
+// Close ends the exposition. It does not close the underlying writer.
+func (w *OpenMetricsWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	_, w.err = io.WriteString(w.w, "# EOF\n")
+	if w.err == nil {
+		w.err = errors.New("exposition closed")
+		return nil
+	}
+	return w.err
+}
+
+func validMetricName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		return strconv.FormatInt(int64(v), 10)
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,261 @@
+package metrics_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// fixedReporter reports fixed bandwidth stats.
+type fixedReporter struct {
+	metrics.Reporter // only the methods below are used
+
+	totals  metrics.Stats
+	byProto map[protocol.ID]metrics.Stats
+	byPeer  map[peer.ID]metrics.Stats
+}
+
+func (r *fixedReporter) GetBandwidthTotals() metrics.Stats { return r.totals }
+
+func (r *fixedReporter) GetBandwidthByProtocol() map[protocol.ID]metrics.Stats { return r.byProto }
+
+func (r *fixedReporter) GetBandwidthByPeer() map[peer.ID]metrics.Stats { return r.byPeer }
+
+func newWriter(t *testing.T, opts ...metrics.OpenMetricsOption) (*metrics.OpenMetricsWriter, *bytes.Buffer) {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := metrics.NewOpenMetricsWriter(&b, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, &b
+}
+
+// checkGolden compares the exposition to expected, in which {a}, {b} and {c}
+// stand for the peers a, b and c.
+func checkGolden(t *testing.T, got, expected string) {
+	t.Helper()
+	expected = strings.NewReplacer("{a}", peer.ID("a").String(), "{b}", peer.ID("b").String(), "{c}", peer.ID("c").String()).Replace(expected)
+	if got == expected {
+		return
+	}
+	gotLines, expectedLines := strings.Split(got, "\n"), strings.Split(expected, "\n")
+	for i := range expectedLines {
+		if i >= len(gotLines) || gotLines[i] != expectedLines[i] {
+			t.Fatalf("unexpected exposition at line %d:\n%s", i+1, got)
+		}
+	}
+	t.Fatalf("unexpected trailing lines:\n%s", got)
+}
+
+func TestWriteResourceSnapshot(t *testing.T) {
+	w, b := newWriter(t, metrics.WithNamespace("test"), metrics.WithTopPeers(1))
+	snap := network.ResourceSnapshot{
+		System:               network.ScopeStat{Memory: 1 << 20, NumFD: 3, NumConnsInbound: 1, NumConnsOutbound: 2, NumStreamsInbound: 4, NumStreamsOutbound: 5},
+		Transient:            network.ScopeStat{NumConnsInbound: 1},
+		AllowlistedSystem:    network.ScopeStat{},
+		AllowlistedTransient: network.ScopeStat{},
+		Services:             map[string]network.ScopeStat{"svc": {Memory: 10, NumStreamsInbound: 1}},
+		Protocols:            map[protocol.ID]network.ScopeStat{"/a\"b\\c\nd": {NumStreamsOutbound: 2}},
+		Peers: map[peer.ID]network.ScopeStat{
+			"a": {Memory: 100, NumStreamsInbound: 1},
+			// b and c are summed in the other peers
+			"b": {Memory: 10, NumFD: 1, NumConnsInbound: 1},
+			"c": {NumStreamsOutbound: 3},
+		},
+	}
+	if err := w.WriteResourceSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkGolden(t, b.String(), `# TYPE test_rcmgr_memory_bytes gauge
+# UNIT test_rcmgr_memory_bytes bytes
+# HELP test_rcmgr_memory_bytes Memory reserved in the scope.
+test_rcmgr_memory_bytes{scope="system"} 1048576
+test_rcmgr_memory_bytes{scope="transient"} 0
+test_rcmgr_memory_bytes{scope="allowlisted-system"} 0
+test_rcmgr_memory_bytes{scope="allowlisted-transient"} 0
+test_rcmgr_memory_bytes{scope="service",service="svc"} 10
+test_rcmgr_memory_bytes{scope="protocol",protocol="/a\"b\\c\nd"} 0
+test_rcmgr_memory_bytes{scope="peer",peer="{a}"} 100
+test_rcmgr_memory_bytes{scope="peer",peer="other"} 10
+# TYPE test_rcmgr_fds gauge
+# HELP test_rcmgr_fds File descriptors reserved in the scope.
+test_rcmgr_fds{scope="system"} 3
+test_rcmgr_fds{scope="transient"} 0
+test_rcmgr_fds{scope="allowlisted-system"} 0
+test_rcmgr_fds{scope="allowlisted-transient"} 0
+test_rcmgr_fds{scope="service",service="svc"} 0
+test_rcmgr_fds{scope="protocol",protocol="/a\"b\\c\nd"} 0
+test_rcmgr_fds{scope="peer",peer="{a}"} 0
+test_rcmgr_fds{scope="peer",peer="other"} 1
+# TYPE test_rcmgr_connections gauge
+# HELP test_rcmgr_connections Connections reserved in the scope.
+test_rcmgr_connections{scope="system",dir="inbound"} 1
+test_rcmgr_connections{scope="transient",dir="inbound"} 1
+test_rcmgr_connections{scope="allowlisted-system",dir="inbound"} 0
+test_rcmgr_connections{scope="allowlisted-transient",dir="inbound"} 0
+test_rcmgr_connections{scope="service",service="svc",dir="inbound"} 0
+test_rcmgr_connections{scope="protocol",protocol="/a\"b\\c\nd",dir="inbound"} 0
+test_rcmgr_connections{scope="peer",peer="{a}",dir="inbound"} 0
+test_rcmgr_connections{scope="peer",peer="other",dir="inbound"} 1
+test_rcmgr_connections{scope="system",dir="outbound"} 2
+test_rcmgr_connections{scope="transient",dir="outbound"} 0
+test_rcmgr_connections{scope="allowlisted-system",dir="outbound"} 0
+test_rcmgr_connections{scope="allowlisted-transient",dir="outbound"} 0
+test_rcmgr_connections{scope="service",service="svc",dir="outbound"} 0
+test_rcmgr_connections{scope="protocol",protocol="/a\"b\\c\nd",dir="outbound"} 0
+test_rcmgr_connections{scope="peer",peer="{a}",dir="outbound"} 0
+test_rcmgr_connections{scope="peer",peer="other",dir="outbound"} 0
+# TYPE test_rcmgr_streams gauge
+# HELP test_rcmgr_streams Streams reserved in the scope.
+test_rcmgr_streams{scope="system",dir="inbound"} 4
+test_rcmgr_streams{scope="transient",dir="inbound"} 0
+test_rcmgr_streams{scope="allowlisted-system",dir="inbound"} 0
+test_rcmgr_streams{scope="allowlisted-transient",dir="inbound"} 0
+test_rcmgr_streams{scope="service",service="svc",dir="inbound"} 1
+test_rcmgr_streams{scope="protocol",protocol="/a\"b\\c\nd",dir="inbound"} 0
+test_rcmgr_streams{scope="peer",peer="{a}",dir="inbound"} 1
+test_rcmgr_streams{scope="peer",peer="other",dir="inbound"} 0
+test_rcmgr_streams{scope="system",dir="outbound"} 5
+test_rcmgr_streams{scope="transient",dir="outbound"} 0
+test_rcmgr_streams{scope="allowlisted-system",dir="outbound"} 0
+test_rcmgr_streams{scope="allowlisted-transient",dir="outbound"} 0
+test_rcmgr_streams{scope="service",service="svc",dir="outbound"} 0
+test_rcmgr_streams{scope="protocol",protocol="/a\"b\\c\nd",dir="outbound"} 2
+test_rcmgr_streams{scope="peer",peer="{a}",dir="outbound"} 0
+test_rcmgr_streams{scope="peer",peer="other",dir="outbound"} 3
+# EOF
+`)
+}
+
+func TestWriteBandwidth(t *testing.T) {
+	w, b := newWriter(t, metrics.WithTopPeers(2))
+	r := &fixedReporter{
+		totals:  metrics.Stats{TotalIn: 3000, TotalOut: 1500, RateIn: 12.5, RateOut: math.Inf(1)},
+		byProto: map[protocol.ID]metrics.Stats{"/b": {TotalIn: 1000}, "/a": {TotalOut: 500, RateOut: 0.25}},
+		byPeer: map[peer.ID]metrics.Stats{
+			"a": {TotalIn: 10},
+			"b": {TotalIn: 1000, TotalOut: 1000, RateIn: 1},
+			// ties are broken by peer ID
+			"c": {TotalOut: 10, RateOut: 2},
+		},
+	}
+	if err := w.WriteBandwidth(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkGolden(t, b.String(), `# TYPE libp2p_bandwidth_bytes counter
+# UNIT libp2p_bandwidth_bytes bytes
+# HELP libp2p_bandwidth_bytes Bytes transferred.
+libp2p_bandwidth_bytes_total{dir="in"} 3000
+libp2p_bandwidth_bytes_total{dir="out"} 1500
+# TYPE libp2p_bandwidth_rate_bytes_per_second gauge
+# UNIT libp2p_bandwidth_rate_bytes_per_second bytes_per_second
+# HELP libp2p_bandwidth_rate_bytes_per_second Rate of transfer.
+libp2p_bandwidth_rate_bytes_per_second{dir="in"} 12.5
+libp2p_bandwidth_rate_bytes_per_second{dir="out"} +Inf
+# TYPE libp2p_bandwidth_protocol_bytes counter
+# UNIT libp2p_bandwidth_protocol_bytes bytes
+# HELP libp2p_bandwidth_protocol_bytes Bytes transferred, by protocol.
+libp2p_bandwidth_protocol_bytes_total{protocol="/a",dir="in"} 0
+libp2p_bandwidth_protocol_bytes_total{protocol="/a",dir="out"} 500
+libp2p_bandwidth_protocol_bytes_total{protocol="/b",dir="in"} 1000
+libp2p_bandwidth_protocol_bytes_total{protocol="/b",dir="out"} 0
+# TYPE libp2p_bandwidth_protocol_rate_bytes_per_second gauge
+# UNIT libp2p_bandwidth_protocol_rate_bytes_per_second bytes_per_second
+# HELP libp2p_bandwidth_protocol_rate_bytes_per_second Rate of transfer, by protocol.
+libp2p_bandwidth_protocol_rate_bytes_per_second{protocol="/a",dir="in"} 0
+libp2p_bandwidth_protocol_rate_bytes_per_second{protocol="/a",dir="out"} 0.25
+libp2p_bandwidth_protocol_rate_bytes_per_second{protocol="/b",dir="in"} 0
+libp2p_bandwidth_protocol_rate_bytes_per_second{protocol="/b",dir="out"} 0
+# TYPE libp2p_bandwidth_peer_bytes counter
+# UNIT libp2p_bandwidth_peer_bytes bytes
+# HELP libp2p_bandwidth_peer_bytes Bytes transferred, by peer.
+libp2p_bandwidth_peer_bytes_total{peer="{b}",dir="in"} 1000
+libp2p_bandwidth_peer_bytes_total{peer="{b}",dir="out"} 1000
+libp2p_bandwidth_peer_bytes_total{peer="{a}",dir="in"} 10
+libp2p_bandwidth_peer_bytes_total{peer="{a}",dir="out"} 0
+libp2p_bandwidth_peer_bytes_total{peer="other",dir="in"} 0
+libp2p_bandwidth_peer_bytes_total{peer="other",dir="out"} 10
+# TYPE libp2p_bandwidth_peer_rate_bytes_per_second gauge
+# UNIT libp2p_bandwidth_peer_rate_bytes_per_second bytes_per_second
+# HELP libp2p_bandwidth_peer_rate_bytes_per_second Rate of transfer, by peer.
+libp2p_bandwidth_peer_rate_bytes_per_second{peer="{b}",dir="in"} 1
+libp2p_bandwidth_peer_rate_bytes_per_second{peer="{b}",dir="out"} 0
+libp2p_bandwidth_peer_rate_bytes_per_second{peer="{a}",dir="in"} 0
+libp2p_bandwidth_peer_rate_bytes_per_second{peer="{a}",dir="out"} 0
+libp2p_bandwidth_peer_rate_bytes_per_second{peer="other",dir="in"} 0
+libp2p_bandwidth_peer_rate_bytes_per_second{peer="other",dir="out"} 2
+# EOF
+`)
+}
+
+func TestOpenMetricsWriterErrors(t *testing.T) {
+	w, b := newWriter(t)
+	r := &fixedReporter{}
+	if err := w.WriteBandwidth(r); err != nil {
+		t.Fatal(err)
+	}
+	written := b.Len()
+	if err := w.WriteBandwidth(r); !errors.Is(err, metrics.ErrDuplicateFamily) {
+		t.Fatalf("expected ErrDuplicateFamily, got %v", err)
+	}
+	if b.Len() != written {
+		t.Fatal("expected nothing to be written once a family is duplicated")
+	}
+	// the error sticks, and the exposition is not ended
+	if err := w.WriteResourceSnapshot(network.ResourceSnapshot{}); !errors.Is(err, metrics.ErrDuplicateFamily) {
+		t.Fatalf("expected the error to stick, got %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, metrics.ErrDuplicateFamily) {
+		t.Fatalf("expected the error to stick, got %v", err)
+	}
+	if strings.Contains(b.String(), "# EOF") {
+		t.Fatal("expected a failed exposition not to be ended")
+	}
+
+	w, _ = newWriter(t)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteBandwidth(r); err == nil {
+		t.Fatal("expected writes after Close to fail")
+	}
+
+	if _, err := metrics.NewOpenMetricsWriter(b, metrics.WithNamespace("0ns")); err == nil {
+		t.Fatal("expected an invalid namespace to be rejected")
+	}
+	if _, err := metrics.NewOpenMetricsWriter(b, metrics.WithTopPeers(-1)); err == nil {
+		t.Fatal("expected a negative number of top peers to be rejected")
+	}
+}
+
+func TestWriteNoTopPeers(t *testing.T) {
+	w, b := newWriter(t, metrics.WithTopPeers(0))
+	snap := network.ResourceSnapshot{Peers: map[peer.ID]network.ScopeStat{"a": {Memory: 1}, "b": {Memory: 2}}}
+	if err := w.WriteResourceSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	// every peer is summed in the other peers
+	if strings.Contains(b.String(), peer.ID("a").String()) || strings.Contains(b.String(), peer.ID("b").String()) {
+		t.Fatalf("expected no peer series, got:\n%s", b.String())
+	}
+	if !strings.Contains(b.String(), `libp2p_rcmgr_memory_bytes{scope="peer",peer="other"} 3`+"\n") {
+		t.Fatalf("expected the peers to be summed, got:\n%s", b.String())
+	}
+}
@@ -0,0 +1,48 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// MessageCodec encodes and decodes the values exchanged as framed messages.
+type MessageCodec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// ProtobufCodec encodes values implementing proto.Message.
+var ProtobufCodec MessageCodec = protobufCodec{}
+
+// JSONCodec encodes values with encoding/json.
+var JSONCodec MessageCodec = jsonCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
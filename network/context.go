@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
+
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 // DialPeerTimeout is the default timeout for a single call to `DialPeer`. When
@@ -83,3 +85,78 @@ func WithUseTransient(ctx context.Context, reason string) context.Context {
 func GetUseTransient(ctx context.Context) (usetransient bool, reason string) {
 	return network.GetUseTransient(ctx)
 }
+
+type dialAddrFilterCtxKey struct{}
+type dialRankerCtxKey struct{}
+type maxParallelDialsCtxKey struct{}
+type dialReasonCtxKey struct{}
+
+// AddrFilter returns true for the addresses that may be dialed.
+type AddrFilter func(ma.Multiaddr) bool
+
+// AddrDelay is an address to dial, and the delay after the start of the dial
+// at which to dial it.
+type AddrDelay struct {
+	Addr  ma.Multiaddr
+	Delay time.Duration
+}
+
+// DialRanker orders the addresses of a peer for dialing, and assigns them
+// delays. Addresses it leaves out are not dialed.
+type DialRanker func([]ma.Multiaddr) []AddrDelay
+
+// WithDialAddrFilter constructs a new context with an option that restricts
+// the addresses dialed to those accepted by f. Filters set on parent contexts
+// still apply: an address must be accepted by all of them.
+func WithDialAddrFilter(ctx context.Context, f AddrFilter) context.Context {
+	if parent := GetDialAddrFilter(ctx); parent != nil {
+		child := f
+		f = func(a ma.Multiaddr) bool { return parent(a) && child(a) }
+	}
+	return context.WithValue(ctx, dialAddrFilterCtxKey{}, f)
+}
+
+// GetDialAddrFilter returns the address filter set in the context, or nil if
+// all addresses may be dialed.
+func GetDialAddrFilter(ctx context.Context) AddrFilter {
+	f, _ := ctx.Value(dialAddrFilterCtxKey{}).(AddrFilter)
+	return f
+}
+
+// WithDialRanker constructs a new context with an option that instructs the
+// network to order and delay the dials to a peer with r, instead of its own
+// ranking.
+func WithDialRanker(ctx context.Context, r DialRanker) context.Context {
+	return context.WithValue(ctx, dialRankerCtxKey{}, r)
+}
+
+// GetDialRanker returns the dial ranker set in the context, or nil.
+func GetDialRanker(ctx context.Context) DialRanker {
+	r, _ := ctx.Value(dialRankerCtxKey{}).(DialRanker)
+	return r
+}
+
+// WithMaxParallelDials constructs a new context with an option that limits
+// the number of addresses of a peer dialed at the same time.
+func WithMaxParallelDials(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, maxParallelDialsCtxKey{}, n)
+}
+
+// GetMaxParallelDials returns the limit on parallel dials set in the context,
+// if any.
+func GetMaxParallelDials(ctx context.Context) (n int, ok bool) {
+	n, ok = ctx.Value(maxParallelDialsCtxKey{}).(int)
+	return n, ok && n > 0
+}
+
+// WithDialReason constructs a new context recording why the caller dials,
+// for logging and error reporting.
+func WithDialReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, dialReasonCtxKey{}, reason)
+}
+
+// GetDialReason returns the dial reason set in the context, or "".
+func GetDialReason(ctx context.Context) string {
+	reason, _ := ctx.Value(dialReasonCtxKey{}).(string)
+	return reason
+}
@@ -0,0 +1,273 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultHappyEyeballsDelay is the delay between two dials of the default
+// dial ranker.
+const DefaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// DefaultMaxParallelDials is the default number of addresses of a peer a
+// DialPlanner dials at the same time.
+const DefaultMaxParallelDials = 8
+
+// NoDelayRanker dials all addresses at once, in the order given.
+func NoDelayRanker(addrs []ma.Multiaddr) []AddrDelay {
+	out := make([]AddrDelay, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, AddrDelay{Addr: a})
+	}
+	return out
+}
+
+// HappyEyeballsRanker returns a DialRanker alternating between IPv6 and other
+// addresses, starting with IPv6, and delaying every dial by step after the
+// previous one, in the spirit of RFC 8305.
+func HappyEyeballsRanker(step time.Duration) DialRanker {
+	return func(addrs []ma.Multiaddr) []AddrDelay {
+		var v6, others []ma.Multiaddr
+		for _, a := range addrs {
+			if _, err := a.ValueForProtocol(ma.P_IP6); err == nil {
+				v6 = append(v6, a)
+			} else {
+				others = append(others, a)
+			}
+		}
+		out := make([]AddrDelay, 0, len(addrs))
+		for len(v6) > 0 || len(others) > 0 {
+			if len(v6) > 0 {
+				out = append(out, AddrDelay{Addr: v6[0], Delay: time.Duration(len(out)) * step})
+				v6 = v6[1:]
+			}
+			if len(others) > 0 {
+				out = append(out, AddrDelay{Addr: others[0], Delay: time.Duration(len(out)) * step})
+				others = others[1:]
+			}
+		}
+		return out
+	}
+}
+
+// DialFunc dials a single address.
+type DialFunc func(ctx context.Context, addr ma.Multiaddr) (transport.CapableConn, error)
+
+// AddrDialError is the failure to dial a single address.
+type AddrDialError struct {
+	Addr ma.Multiaddr
+	Err  error
+}
+
+// DialPlanError is returned by DialPlanner.Dial when no address could be
+// dialed.
+type DialPlanError struct {
+	// Reason is the dial reason set in the context of the dial.
+	Reason string
+	// Errors holds the failed dials, in the order in which they failed.
+	Errors []AddrDialError
+	// Cause is set when the dial was aborted, e.g. by the context.
+	Cause error
+}
+
+func (e *DialPlanError) Error() string {
+	var b strings.Builder
+	b.WriteString("failed to dial")
+	if e.Reason != "" {
+		fmt.Fprintf(&b, " (%s)", e.Reason)
+	}
+	if e.Cause != nil {
+		fmt.Fprintf(&b, ": %s", e.Cause)
+	}
+	for _, ae := range e.Errors {
+		fmt.Fprintf(&b, "\n  * [%s] %s", ae.Addr, ae.Err)
+	}
+	return b.String()
+}
+
+// Unwrap returns the cause of the error, or the last dial error.
+func (e *DialPlanError) Unwrap() error {
+	if e.Cause != nil {
+		return e.Cause
+	}
+	if len(e.Errors) > 0 {
+		return e.Errors[len(e.Errors)-1].Err
+	}
+	return nil
+}
+
+// DialPlannerOption is a single option for a DialPlanner.
+type DialPlannerOption func(dp *DialPlanner) error
+
+// WithDefaultDialRanker sets the ranker used when the dial context does not
+// set one. Defaults to HappyEyeballsRanker(DefaultHappyEyeballsDelay).
+func WithDefaultDialRanker(r DialRanker) DialPlannerOption {
+	return func(dp *DialPlanner) error {
+		if r == nil {
+			return fmt.Errorf("nil dial ranker")
+		}
+		dp.ranker = r
+		return nil
+	}
+}
+
+// WithDefaultMaxParallelDials sets the number of parallel dials used when the
+// dial context does not set one. Defaults to DefaultMaxParallelDials.
+func WithDefaultMaxParallelDials(n int) DialPlannerOption {
+	return func(dp *DialPlanner) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid number of parallel dials: %d", n)
+		}
+		dp.maxParallel = n
+		return nil
+	}
+}
+
+// WithDialPlannerClock sets the clock timing the delayed dials. Defaults to
+// clock.Real.
+func WithDialPlannerClock(c clock.Clock) DialPlannerOption {
+	return func(dp *DialPlanner) error {
+		dp.clock = c
+		return nil
+	}
+}
+
+// DialPlanner is a reference implementation of the dial options carried in
+// the context: it filters the addresses of a peer with the AddrFilter of the
+// context, orders and delays them with its DialRanker, and dials them with at
+// most the maximum number of parallel dials, until one succeeds.
+type DialPlanner struct {
+	ranker      DialRanker
+	maxParallel int
+	clock       clock.Clock
+}
+
+// NewDialPlanner creates a DialPlanner.
+func NewDialPlanner(opts ...DialPlannerOption) (*DialPlanner, error) {
+	dp := &DialPlanner{
+		ranker:      HappyEyeballsRanker(DefaultHappyEyeballsDelay),
+		maxParallel: DefaultMaxParallelDials,
+		clock:       clock.Real,
+	}
+	for _, o := range opts {
+		if err := o(dp); err != nil {
+			return nil, err
+		}
+	}
+	return dp, nil
+}
+
+// Plan returns the addresses to dial, ordered by delay, as configured by the
+// context.
+func (dp *DialPlanner) Plan(ctx context.Context, addrs []ma.Multiaddr) []AddrDelay {
+	if f := GetDialAddrFilter(ctx); f != nil {
+		filtered := make([]ma.Multiaddr, 0, len(addrs))
+		for _, a := range addrs {
+			if f(a) {
+				filtered = append(filtered, a)
+			}
+		}
+		addrs = filtered
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	ranker := GetDialRanker(ctx)
+	if ranker == nil {
+		ranker = dp.ranker
+	}
+	plan := ranker(addrs)
+	sort.SliceStable(plan, func(i, j int) bool { return plan[i].Delay < plan[j].Delay })
+	return plan
+}
+
+type dialResult struct {
+	addr ma.Multiaddr
+	conn transport.CapableConn
+	err  error
+}
+
+// Dial dials the addresses of the plan for addrs, and returns the first
+// connection established. Every dial starts at its delay, or as soon as all
+// the dials in progress have failed, whichever comes first. Connections
+// established after the first one are closed. It returns ErrNoRemoteAddrs if
+// no address is left to dial, and a *DialPlanError if all dials failed.
+func (dp *DialPlanner) Dial(ctx context.Context, addrs []ma.Multiaddr, dial DialFunc) (transport.CapableConn, error) {
+	plan := dp.Plan(ctx, addrs)
+	if len(plan) == 0 {
+		return nil, ErrNoRemoteAddrs
+	}
+	maxParallel, ok := GetMaxParallelDials(ctx)
+	if !ok {
+		maxParallel = dp.maxParallel
+	}
+
+	dctx, cancel := context.WithCancel(ctx)
+	results := make(chan dialResult)
+	active := 0
+	defer func() {
+		cancel()
+		// close the connections of the dials still in progress
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}(active)
+	}()
+
+	perr := &DialPlanError{Reason: GetDialReason(ctx)}
+	start := dp.clock.Now()
+	var timer clock.Timer
+	for {
+		// start the dials that are due
+		for len(plan) > 0 && active < maxParallel &&
+			(active == 0 || !start.Add(plan[0].Delay).After(dp.clock.Now())) {
+			addr := plan[0].Addr
+			plan = plan[1:]
+			active++
+			go func() {
+				c, err := dial(dctx, addr)
+				results <- dialResult{addr: addr, conn: c, err: err}
+			}()
+		}
+		if active == 0 {
+			return nil, perr
+		}
+
+		var wake <-chan time.Time
+		if len(plan) > 0 && active < maxParallel {
+			d := dp.clock.Until(start.Add(plan[0].Delay))
+			if timer == nil {
+				timer = dp.clock.NewTimer(d)
+				defer timer.Stop()
+			} else {
+				timer.Reset(d)
+			}
+			wake = timer.C()
+		}
+
+		select {
+		case r := <-results:
+			active--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			perr.Errors = append(perr.Errors, AddrDialError{Addr: r.addr, Err: r.err})
+		case <-wake:
+		case <-ctx.Done():
+			perr.Cause = ctx.Err()
+			return nil, perr
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package network_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-libp2p/core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// fakeConn is a CapableConn recording whether it was closed.
+type fakeConn struct {
+	transport.CapableConn // only Close is used
+
+	addr   ma.Multiaddr
+	closed chan struct{}
+}
+
+func (c *fakeConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// fakeDialer dials addresses that succeed or fail when told to.
+type fakeDialer struct {
+	started chan ma.Multiaddr
+	conns   chan *fakeConn
+	// outcomes receives the outcome of the dial of every address: a nil error
+	// establishes a connection.
+	outcomes map[string]chan error
+}
+
+func newFakeDialer(addrs []ma.Multiaddr) *fakeDialer {
+	d := &fakeDialer{
+		started:  make(chan ma.Multiaddr, len(addrs)),
+		conns:    make(chan *fakeConn, len(addrs)),
+		outcomes: make(map[string]chan error),
+	}
+	for _, a := range addrs {
+		d.outcomes[a.String()] = make(chan error, 1)
+	}
+	return d
+}
+
+func (d *fakeDialer) dial(ctx context.Context, addr ma.Multiaddr) (transport.CapableConn, error) {
+	d.started <- addr
+	select {
+	case err := <-d.outcomes[addr.String()]:
+		if err != nil {
+			return nil, err
+		}
+		c := &fakeConn{addr: addr, closed: make(chan struct{})}
+		d.conns <- c
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (d *fakeDialer) finish(addr ma.Multiaddr, err error) {
+	d.outcomes[addr.String()] <- err
+}
+
+// expectStarted waits for the dials of addrs to start, in any order.
+func (d *fakeDialer) expectStarted(t *testing.T, addrs ...ma.Multiaddr) {
+	t.Helper()
+	expected := make(map[string]bool)
+	for _, a := range addrs {
+		expected[a.String()] = true
+	}
+	for range addrs {
+		select {
+		case a := <-d.started:
+			if !expected[a.String()] {
+				t.Fatalf("expected %v to be dialed, got %s", addrs, a)
+			}
+			delete(expected, a.String())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %v to be dialed", addrs)
+		}
+	}
+}
+
+func (d *fakeDialer) expectIdle(t *testing.T) {
+	t.Helper()
+	select {
+	case a := <-d.started:
+		t.Fatalf("expected no dial, got %s", a)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+type dialOutcome struct {
+	conn transport.CapableConn
+	err  error
+}
+
+func startDial(ctx context.Context, dp *network.DialPlanner, addrs []ma.Multiaddr, d *fakeDialer) <-chan dialOutcome {
+	done := make(chan dialOutcome, 1)
+	go func() {
+		c, err := dp.Dial(ctx, addrs, d.dial)
+		done <- dialOutcome{c, err}
+	}()
+	return done
+}
+
+// waitTimer waits until a timer is armed on clk.
+func waitTimer(t *testing.T, clk *clock.Virtual) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		if _, ok := clk.Next(); ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("expected a timer to be armed")
+}
+
+func testAddrs(n int) []ma.Multiaddr {
+	addrs := make([]ma.Multiaddr, n)
+	for i := range addrs {
+		addrs[i] = ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/%d", i+1))
+	}
+	return addrs
+}
+
+func newDialPlanner(t *testing.T, opts ...network.DialPlannerOption) (*network.DialPlanner, *clock.Virtual) {
+	t.Helper()
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	dp, err := network.NewDialPlanner(append([]network.DialPlannerOption{network.WithDialPlannerClock(clk)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dp, clk
+}
+
+func TestDialPlannerParallelism(t *testing.T) {
+	dp, _ := newDialPlanner(t, network.WithDefaultDialRanker(network.NoDelayRanker))
+	addrs := testAddrs(4)
+	d := newFakeDialer(addrs)
+	ctx := network.WithMaxParallelDials(context.Background(), 2)
+	done := startDial(ctx, dp, addrs, d)
+
+	d.expectStarted(t, addrs[0], addrs[1])
+	d.expectIdle(t)
+
+	// every failure makes room for the next address
+	d.finish(addrs[1], errors.New("refused"))
+	d.expectStarted(t, addrs[2])
+	d.expectIdle(t)
+	d.finish(addrs[0], errors.New("unreachable"))
+	d.expectStarted(t, addrs[3])
+
+	d.finish(addrs[3], nil)
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if c := r.conn.(*fakeConn); !c.addr.Equal(addrs[3]) {
+		t.Fatalf("expected the connection to %s, got %s", addrs[3], c.addr)
+	}
+}
+
+func TestDialPlannerDelays(t *testing.T) {
+	addrs := testAddrs(3)
+	ranker := func([]ma.Multiaddr) []network.AddrDelay {
+		// given out of order, to be sorted by delay
+		return []network.AddrDelay{
+			{Addr: addrs[2], Delay: 300 * time.Millisecond},
+			{Addr: addrs[0]},
+			{Addr: addrs[1], Delay: 100 * time.Millisecond},
+		}
+	}
+	dp, clk := newDialPlanner(t, network.WithDefaultDialRanker(ranker))
+	d := newFakeDialer(addrs)
+	done := startDial(context.Background(), dp, addrs, d)
+
+	d.expectStarted(t, addrs[0])
+	waitTimer(t, clk)
+	clk.Advance(99 * time.Millisecond)
+	d.expectIdle(t)
+	clk.Advance(time.Millisecond)
+	d.expectStarted(t, addrs[1])
+
+	// the last address starts early once the dials in progress failed
+	d.finish(addrs[0], errors.New("first"))
+	d.expectIdle(t)
+	d.finish(addrs[1], errors.New("second"))
+	d.expectStarted(t, addrs[2])
+	d.finish(addrs[2], errors.New("third"))
+
+	r := <-done
+	var perr *network.DialPlanError
+	if !errors.As(r.err, &perr) {
+		t.Fatalf("expected a DialPlanError, got %v", r.err)
+	}
+	if len(perr.Errors) != 3 {
+		t.Fatalf("expected 3 dial errors, got %+v", perr.Errors)
+	}
+	for i, e := range perr.Errors {
+		if !e.Addr.Equal(addrs[i]) {
+			t.Fatalf("expected the errors in the order of failure, got %s at %d", e.Addr, i)
+		}
+	}
+	if r.err.Error() != fmt.Sprintf("failed to dial\n  * [%s] first\n  * [%s] second\n  * [%s] third", addrs[0], addrs[1], addrs[2]) {
+		t.Fatalf("unexpected error message: %s", r.err)
+	}
+	if errors.Unwrap(r.err).Error() != "third" {
+		t.Fatalf("expected the error to unwrap to the last dial error, got %v", errors.Unwrap(r.err))
+	}
+}
+
+func TestDialPlannerContextCanceled(t *testing.T) {
+	dp, _ := newDialPlanner(t, network.WithDefaultDialRanker(network.NoDelayRanker))
+	addrs := testAddrs(2)
+	d := newFakeDialer(addrs)
+	ctx, cancel := context.WithCancel(network.WithDialReason(context.Background(), "test"))
+	done := startDial(network.WithMaxParallelDials(ctx, 1), dp, addrs, d)
+
+	d.expectStarted(t, addrs[0])
+	d.finish(addrs[0], errors.New("refused"))
+	d.expectStarted(t, addrs[1])
+	cancel()
+
+	r := <-done
+	if !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("expected the dial to be canceled, got %v", r.err)
+	}
+	var perr *network.DialPlanError
+	if !errors.As(r.err, &perr) || perr.Reason != "test" || len(perr.Errors) != 1 {
+		t.Fatalf("expected the reason and the dial error to be reported, got %+v", perr)
+	}
+	if !strings.HasPrefix(r.err.Error(), "failed to dial (test): context canceled") {
+		t.Fatalf("unexpected error message: %s", r.err)
+	}
+}
+
+func TestDialPlannerClosesLosingConns(t *testing.T) {
+	dp, _ := newDialPlanner(t, network.WithDefaultDialRanker(network.NoDelayRanker))
+	addrs := testAddrs(2)
+	d := newFakeDialer(addrs)
+	// the losing dial ignores the cancellation, and establishes a connection
+	// all the same
+	dial := func(ctx context.Context, addr ma.Multiaddr) (transport.CapableConn, error) {
+		return d.dial(context.Background(), addr)
+	}
+	done := make(chan dialOutcome, 1)
+	go func() {
+		c, err := dp.Dial(context.Background(), addrs, dial)
+		done <- dialOutcome{c, err}
+	}()
+
+	d.expectStarted(t, addrs[0], addrs[1])
+	d.finish(addrs[1], nil)
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	won := r.conn.(*fakeConn)
+	if !won.addr.Equal(addrs[1]) {
+		t.Fatalf("expected the first connection established, got %s", won.addr)
+	}
+
+	<-d.conns
+	d.finish(addrs[0], nil)
+	select {
+	case <-(<-d.conns).closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the losing connection to be closed")
+	}
+	select {
+	case <-won.closed:
+		t.Fatal("expected the winning connection to stay open")
+	default:
+	}
+}
+
+func TestDialPlannerNoAddrs(t *testing.T) {
+	dp, _ := newDialPlanner(t)
+	addrs := testAddrs(2)
+	ctx := network.WithDialAddrFilter(context.Background(), func(a ma.Multiaddr) bool { return false })
+	if _, err := dp.Dial(ctx, addrs, newFakeDialer(addrs).dial); err != network.ErrNoRemoteAddrs {
+		t.Fatalf("expected ErrNoRemoteAddrs, got %v", err)
+	}
+	if _, err := dp.Dial(context.Background(), nil, newFakeDialer(nil).dial); err != network.ErrNoRemoteAddrs {
+		t.Fatalf("expected ErrNoRemoteAddrs, got %v", err)
+	}
+}
+
+func TestDialPlannerOptions(t *testing.T) {
+	if _, err := network.NewDialPlanner(network.WithDefaultDialRanker(nil)); err == nil {
+		t.Fatal("expected a nil ranker to be rejected")
+	}
+	if _, err := network.NewDialPlanner(network.WithDefaultMaxParallelDials(0)); err == nil {
+		t.Fatal("expected no parallel dials to be rejected")
+	}
+}
+
+func TestHappyEyeballsRanker(t *testing.T) {
+	v4a, v4b := ma.StringCast("/ip4/1.2.3.4/tcp/1"), ma.StringCast("/ip4/1.2.3.4/tcp/2")
+	v6 := ma.StringCast("/ip6/::1/tcp/1")
+	plan := network.HappyEyeballsRanker(time.Second)([]ma.Multiaddr{v4a, v4b, v6})
+	expected := []network.AddrDelay{{Addr: v6}, {Addr: v4a, Delay: time.Second}, {Addr: v4b, Delay: 2 * time.Second}}
+	if len(plan) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, plan)
+	}
+	for i := range plan {
+		if !plan[i].Addr.Equal(expected[i].Addr) || plan[i].Delay != expected[i].Delay {
+			t.Fatalf("expected %v, got %v", expected, plan)
+		}
+	}
+}
+
+func TestDialContextOptions(t *testing.T) {
+	ctx := context.Background()
+	if network.GetDialAddrFilter(ctx) != nil || network.GetDialRanker(ctx) != nil || network.GetDialReason(ctx) != "" {
+		t.Fatal("expected no dial options by default")
+	}
+	if _, ok := network.GetMaxParallelDials(ctx); ok {
+		t.Fatal("expected no parallel dial limit by default")
+	}
+
+	tcp1, tcp2, udp := ma.StringCast("/ip4/1.2.3.4/tcp/1"), ma.StringCast("/ip4/1.2.3.4/tcp/2"), ma.StringCast("/ip4/1.2.3.4/udp/1")
+	ctx = network.WithDialAddrFilter(ctx, func(a ma.Multiaddr) bool {
+		_, err := a.ValueForProtocol(ma.P_TCP)
+		return err == nil
+	})
+	ctx = network.WithDialAddrFilter(ctx, func(a ma.Multiaddr) bool { return !a.Equal(tcp2) })
+	f := network.GetDialAddrFilter(ctx)
+	if !f(tcp1) || f(tcp2) || f(udp) {
+		t.Fatal("expected the filters to apply together")
+	}
+
+	ctx = network.WithDialRanker(ctx, network.NoDelayRanker)
+	dp, _ := newDialPlanner(t)
+	plan := dp.Plan(ctx, []ma.Multiaddr{udp, tcp2, tcp1})
+	if len(plan) != 1 || !plan[0].Addr.Equal(tcp1) || plan[0].Delay != 0 {
+		t.Fatalf("expected the ranker of the context to plan the filtered addresses, got %v", plan)
+	}
+
+	if n, ok := network.GetMaxParallelDials(network.WithMaxParallelDials(ctx, 3)); !ok || n != 3 {
+		t.Fatalf("expected a limit of 3 parallel dials, got %d, %t", n, ok)
+	}
+	if _, ok := network.GetMaxParallelDials(network.WithMaxParallelDials(ctx, 0)); ok {
+		t.Fatal("expected a limit of 0 to be ignored")
+	}
+	if reason := network.GetDialReason(network.WithDialReason(ctx, "relay")); reason != "relay" {
+		t.Fatalf("expected the dial reason, got %q", reason)
+	}
+}
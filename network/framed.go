@@ -0,0 +1,322 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/multiformats/go-varint"
+)
+
+// ErrMessageTooLarge is returned when reading or writing a framed message
+// larger than the configured maximum size.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// FramedOption is a single option for framed readers and writers.
+type FramedOption func(cfg *framedConfig) error
+
+type framedConfig struct {
+	maxSize  int
+	timeout  time.Duration
+	priority uint8
+	codec    MessageCodec
+	clock    clock.Clock
+}
+
+func newFramedConfig(opts []FramedOption) (framedConfig, error) {
+	cfg := framedConfig{
+		maxSize:  MessageSizeMax,
+		priority: ReservationPriorityAlways,
+		codec:    ProtobufCodec,
+		clock:    clock.Real,
+	}
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// WithMaxMessageSize sets the largest message that may be read or written.
+// Defaults to MessageSizeMax.
+func WithMaxMessageSize(n int) FramedOption {
+	return func(cfg *framedConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max message size: %d", n)
+		}
+		cfg.maxSize = n
+		return nil
+	}
+}
+
+// WithMessageTimeout sets a deadline for reading or writing every single
+// message, starting when the read or write begins. Zero, the default,
+// disables the per-message deadline.
+//
+// The per-message deadline replaces the deadline of the stream while the
+// message is read or written. Deadlines of the stream set through the
+// SetReadDeadline and SetWriteDeadline methods of the framed reader and
+// writer still apply, and are restored after every message; deadlines set on
+// the stream directly are cleared.
+func WithMessageTimeout(d time.Duration) FramedOption {
+	return func(cfg *framedConfig) error {
+		if d < 0 {
+			return fmt.Errorf("invalid message timeout: %s", d)
+		}
+		cfg.timeout = d
+		return nil
+	}
+}
+
+// WithMessagePriority sets the priority of the memory reservations made in
+// the stream scope for message buffers. Defaults to ReservationPriorityAlways.
+func WithMessagePriority(prio uint8) FramedOption {
+	return func(cfg *framedConfig) error {
+		cfg.priority = prio
+		return nil
+	}
+}
+
+// WithMessageCodec sets the codec used by ReadValue and WriteValue. Defaults
+// to ProtobufCodec.
+func WithMessageCodec(c MessageCodec) FramedOption {
+	return func(cfg *framedConfig) error {
+		if c == nil {
+			return errors.New("nil message codec")
+		}
+		cfg.codec = c
+		return nil
+	}
+}
+
+// WithMessageClock sets the clock against which per-message deadlines are
+// computed. It should be the clock of the network the stream belongs to.
+// Defaults to clock.Real.
+func WithMessageClock(c clock.Clock) FramedOption {
+	return func(cfg *framedConfig) error {
+		cfg.clock = c
+		return nil
+	}
+}
+
+// FramedReader reads unsigned varint length-prefixed messages from a Stream.
+//
+// The memory of every message is reserved in the stream scope before its
+// buffer is allocated, and stays reserved until the message is passed to
+// ReleaseMsg. After an error, the framing of the stream is lost, and the
+// stream should be reset.
+//
+// A FramedReader is not safe for concurrent use.
+type FramedReader struct {
+	s   Stream
+	cfg framedConfig
+	br  byteReader
+	// deadline is the read deadline of the stream set by the caller.
+	deadline time.Time
+}
+
+// NewFramedReader creates a FramedReader reading from s.
+func NewFramedReader(s Stream, opts ...FramedOption) (*FramedReader, error) {
+	cfg, err := newFramedConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &FramedReader{s: s, cfg: cfg, br: byteReader{r: s}}, nil
+}
+
+// ReadMsg reads the next message. The returned buffer must be passed to
+// ReleaseMsg once the caller is done with it.
+func (r *FramedReader) ReadMsg() ([]byte, error) {
+	if r.cfg.timeout > 0 {
+		if err := r.s.SetReadDeadline(earliest(r.deadline, r.cfg.clock.Now().Add(r.cfg.timeout))); err != nil {
+			return nil, err
+		}
+		defer r.s.SetReadDeadline(r.deadline)
+	}
+
+	length, err := varint.ReadUvarint(&r.br)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(r.cfg.maxSize) {
+		return nil, ErrMessageTooLarge
+	}
+	size := int(length)
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	scope := r.s.Scope()
+	if err := scope.ReserveMemory(size, r.cfg.priority); err != nil {
+		return nil, err
+	}
+	msg := pool.Get(size)
+	if _, err := io.ReadFull(r.s, msg); err != nil {
+		pool.Put(msg)
+		scope.ReleaseMemory(size)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// SetReadDeadline sets the read deadline of the stream. Unlike a deadline set
+// on the stream directly, it survives the per-message deadlines of
+// WithMessageTimeout.
+func (r *FramedReader) SetReadDeadline(t time.Time) error {
+	r.deadline = t
+	return r.s.SetReadDeadline(t)
+}
+
+// ReleaseMsg returns a message obtained from ReadMsg to the buffer pool, and
+// releases its memory reservation. The message must not be used afterwards.
+func (r *FramedReader) ReleaseMsg(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	r.s.Scope().ReleaseMemory(len(msg))
+	pool.Put(msg)
+}
+
+// ReadValue reads the next message and decodes it into v with the reader's
+// codec.
+func (r *FramedReader) ReadValue(v interface{}) error {
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return err
+	}
+	defer r.ReleaseMsg(msg)
+	return r.cfg.codec.Unmarshal(msg, v)
+}
+
+// FramedWriter writes unsigned varint length-prefixed messages to a Stream.
+//
+// The memory of the frame is reserved in the stream scope for the duration of
+// every write. A FramedWriter is not safe for concurrent use.
+type FramedWriter struct {
+	s   Stream
+	cfg framedConfig
+	// deadline is the write deadline of the stream set by the caller.
+	deadline time.Time
+}
+
+// NewFramedWriter creates a FramedWriter writing to s.
+func NewFramedWriter(s Stream, opts ...FramedOption) (*FramedWriter, error) {
+	cfg, err := newFramedConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &FramedWriter{s: s, cfg: cfg}, nil
+}
+
+// WriteMsg writes msg as a single frame.
+func (w *FramedWriter) WriteMsg(msg []byte) error {
+	if len(msg) > w.cfg.maxSize {
+		return ErrMessageTooLarge
+	}
+	if w.cfg.timeout > 0 {
+		if err := w.s.SetWriteDeadline(earliest(w.deadline, w.cfg.clock.Now().Add(w.cfg.timeout))); err != nil {
+			return err
+		}
+		defer w.s.SetWriteDeadline(w.deadline)
+	}
+
+	size := varint.UvarintSize(uint64(len(msg))) + len(msg)
+	scope := w.s.Scope()
+	if err := scope.ReserveMemory(size, w.cfg.priority); err != nil {
+		return err
+	}
+	defer scope.ReleaseMemory(size)
+
+	buf := pool.Get(size)
+	defer pool.Put(buf)
+	n := varint.PutUvarint(buf, uint64(len(msg)))
+	copy(buf[n:], msg)
+	_, err := w.s.Write(buf)
+	return err
+}
+
+// SetWriteDeadline sets the write deadline of the stream. Unlike a deadline
+// set on the stream directly, it survives the per-message deadlines of
+// WithMessageTimeout.
+func (w *FramedWriter) SetWriteDeadline(t time.Time) error {
+	w.deadline = t
+	return w.s.SetWriteDeadline(t)
+}
+
+// WriteValue encodes v with the writer's codec and writes it as a single
+// frame.
+func (w *FramedWriter) WriteValue(v interface{}) error {
+	msg, err := w.cfg.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.WriteMsg(msg)
+}
+
+// FramedStream reads and writes framed messages on a single Stream.
+type FramedStream struct {
+	*FramedReader
+	*FramedWriter
+}
+
+// NewFramedStream creates a FramedStream on s. The options apply to both
+// directions.
+func NewFramedStream(s Stream, opts ...FramedOption) (*FramedStream, error) {
+	cfg, err := newFramedConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &FramedStream{
+		FramedReader: &FramedReader{s: s, cfg: cfg, br: byteReader{r: s}},
+		FramedWriter: &FramedWriter{s: s, cfg: cfg},
+	}, nil
+}
+
+// Stream returns the underlying stream.
+func (fs *FramedStream) Stream() Stream {
+	return fs.FramedReader.s
+}
+
+// SetDeadline sets both the read and write deadlines of the stream. See
+// FramedReader.SetReadDeadline and FramedWriter.SetWriteDeadline.
+func (fs *FramedStream) SetDeadline(t time.Time) error {
+	if err := fs.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return fs.SetWriteDeadline(t)
+}
+
+// earliest returns the earliest of the deadline set by the caller, which may
+// be zero, and the deadline of a message.
+func earliest(deadline, msg time.Time) time.Time {
+	if !deadline.IsZero() && deadline.Before(msg) {
+		return deadline
+	}
+	return msg
+}
+
+// byteReader reads single bytes without buffering, so that no data past the
+// length prefix is consumed from the stream.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	n, err := br.r.Read(br.buf[:])
+	for n == 0 && err == nil {
+		n, err = br.r.Read(br.buf[:])
+	}
+	if n == 1 {
+		return br.buf[0], nil
+	}
+	return 0, err
+}
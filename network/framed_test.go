@@ -0,0 +1,100 @@
+package network_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	corenet "github.com/libp2p/go-libp2p/core/network"
+)
+
+// deadlineStream is a Stream over a buffer, recording the deadlines set on it.
+type deadlineStream struct {
+	network.Stream // only the methods below are used
+
+	buf            bytes.Buffer
+	readDeadlines  []time.Time
+	writeDeadlines []time.Time
+}
+
+func (s *deadlineStream) Read(b []byte) (int, error)  { return s.buf.Read(b) }
+func (s *deadlineStream) Write(b []byte) (int, error) { return s.buf.Write(b) }
+func (s *deadlineStream) Scope() network.StreamScope  { return corenet.NullScope }
+
+func (s *deadlineStream) SetReadDeadline(t time.Time) error {
+	s.readDeadlines = append(s.readDeadlines, t)
+	return nil
+}
+
+func (s *deadlineStream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadlines = append(s.writeDeadlines, t)
+	return nil
+}
+
+func checkDeadlines(t *testing.T, kind string, got, expected []time.Time) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d %s deadlines, got %v", len(expected), kind, got)
+	}
+	for i := range got {
+		if !got[i].Equal(expected[i]) {
+			t.Fatalf("expected %s deadline %d to be %s, got %s", kind, i, expected[i], got[i])
+		}
+	}
+}
+
+func TestFramedStreamRestoresDeadlines(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	msgDeadline := start.Add(time.Second)
+
+	for _, tc := range []struct {
+		name     string
+		deadline time.Time
+		// applied is the deadline of the stream while a message is read
+		// or written.
+		applied time.Time
+	}{
+		{name: "no deadline", applied: msgDeadline},
+		{name: "later deadline", deadline: start.Add(time.Hour), applied: msgDeadline},
+		{name: "earlier deadline", deadline: start.Add(time.Millisecond), applied: start.Add(time.Millisecond)},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			s := &deadlineStream{}
+			fs, err := network.NewFramedStream(s,
+				network.WithMessageTimeout(time.Second),
+				network.WithMessageClock(clock.NewVirtual(start)),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.SetDeadline(tc.deadline); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.WriteMsg([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := fs.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(msg) != "hello" {
+				t.Fatalf("expected hello, got %q", msg)
+			}
+			fs.ReleaseMsg(msg)
+
+			expected := []time.Time{tc.deadline, tc.applied, tc.deadline}
+			checkDeadlines(t, "read", s.readDeadlines, expected)
+			checkDeadlines(t, "write", s.writeDeadlines, expected)
+
+			if _, err := fs.ReadMsg(); err != io.EOF {
+				t.Fatalf("expected EOF, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,447 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/event"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	coreevent "github.com/libp2p/go-libp2p/core/event"
+)
+
+// DefaultDrainTimeout is the drain timeout used by CloseWithReason when none
+// is given.
+const DefaultDrainTimeout = 5 * time.Second
+
+// ErrConnDraining is returned when opening a stream on a connection that is
+// being closed with CloseWithReason.
+var ErrConnDraining = errors.New("connection is draining")
+
+// CloseInfo describes why a connection was closed.
+type CloseInfo struct {
+	// Reason is the reason given by the side closing the connection. It is
+	// zero for connections closed with Close.
+	Reason control.DisconnectReason
+	// Remote is true if the remote peer closed the connection.
+	Remote bool
+}
+
+// ConnClosedError is returned when a connection is closed with a reason,
+// such as a connection rejected by a ConnectionGater.
+type ConnClosedError struct {
+	CloseInfo
+}
+
+func (e *ConnClosedError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	return fmt.Sprintf("connection closed by %s peer, reason %d", side, e.Reason)
+}
+
+// GracefulConn is an optional interface for Conns that can be closed with a
+// reason. See CloseWithReason.
+type GracefulConn interface {
+	Conn
+
+	// CloseWithReason starts closing the connection, GOAWAY style: no new
+	// streams may be opened or accepted, and the existing streams have until
+	// the drain timeout to finish, after which they are reset. It returns
+	// without waiting for the streams.
+	//
+	// The remote peer reports the reason in its CloseInfo, and stops opening
+	// streams too. Connections of the in-memory network of package memnet
+	// carry the reason natively; over other transports, both ends must run
+	// their muxed connections through NewGracefulMuxedConn, which sends it
+	// on a control stream.
+	CloseWithReason(reason control.DisconnectReason, drain time.Duration) error
+	// CloseInfo returns why the connection was closed, once it is closing.
+	CloseInfo() (CloseInfo, bool)
+}
+
+// GracefulMuxedConn is the GracefulConn counterpart for MuxedConns.
+type GracefulMuxedConn interface {
+	MuxedConn
+
+	CloseWithReason(reason control.DisconnectReason, drain time.Duration) error
+	CloseInfo() (CloseInfo, bool)
+}
+
+// CloseWithReason closes c with a reason if c is a GracefulConn, and closes
+// it right away otherwise. A zero drain defaults to DefaultDrainTimeout.
+func CloseWithReason(c Conn, reason control.DisconnectReason, drain time.Duration) error {
+	gc, ok := c.(GracefulConn)
+	if !ok {
+		return c.Close()
+	}
+	if drain == 0 {
+		drain = DefaultDrainTimeout
+	}
+	return gc.CloseWithReason(reason, drain)
+}
+
+// GetCloseInfo returns why c was closed, if c reports it. Notifiees can use it
+// from Disconnected.
+func GetCloseInfo(c Conn) (CloseInfo, bool) {
+	gc, ok := c.(GracefulConn)
+	if !ok {
+		return CloseInfo{}, false
+	}
+	return gc.CloseInfo()
+}
+
+// EmitCloseReasons emits an event.EvtConnClosedWithReason on bus for every
+// connection of n that closes with a known reason, until stop is called.
+func EmitCloseReasons(n Network, bus coreevent.Bus) (stop func(), err error) {
+	em, err := bus.Emitter(new(event.EvtConnClosedWithReason))
+	if err != nil {
+		return nil, err
+	}
+	nf := &NotifyBundle{
+		DisconnectedF: func(_ Network, c Conn) {
+			info, ok := GetCloseInfo(c)
+			if !ok {
+				return
+			}
+			em.Emit(event.EvtConnClosedWithReason{
+				Peer:   c.RemotePeer(),
+				ConnID: c.ID(),
+				Reason: info.Reason,
+				Remote: info.Remote,
+			})
+		},
+	}
+	n.Notify(nf)
+	return func() {
+		n.StopNotify(nf)
+		em.Close()
+	}, nil
+}
+
+// GracefulOption is a single option for NewGracefulMuxedConn.
+type GracefulOption func(c *gracefulMuxedConn)
+
+// WithDrainClock sets the clock timing the drain phase. Defaults to
+// clock.Real.
+func WithDrainClock(clk clock.Clock) GracefulOption {
+	return func(c *gracefulMuxedConn) {
+		c.clock = clk
+	}
+}
+
+// goawayPreface starts the control stream of a GracefulMuxedConn.
+const goawayPreface = "/libp2p/goaway/1.0.0\n"
+
+// NewGracefulMultiplexer wraps m, so that its connections are
+// GracefulMuxedConns. See NewGracefulMuxedConn.
+func NewGracefulMultiplexer(m Multiplexer, opts ...GracefulOption) Multiplexer {
+	return &gracefulMultiplexer{m: m, opts: opts}
+}
+
+type gracefulMultiplexer struct {
+	m    Multiplexer
+	opts []GracefulOption
+}
+
+func (gm *gracefulMultiplexer) NewConn(c net.Conn, isServer bool, scope PeerScope) (MuxedConn, error) {
+	mc, err := gm.m.NewConn(c, isServer, scope)
+	if err != nil {
+		return nil, err
+	}
+	return NewGracefulMuxedConn(mc, gm.opts...), nil
+}
+
+// NewGracefulMuxedConn wraps c, a new connection without streams, adding a
+// drain phase to it. If c is already a GracefulMuxedConn, it is returned as
+// is.
+//
+// The reason is sent to the remote end on a control stream, which each end
+// opens before any other stream: the control stream starts with a preface,
+// and carries the reason as a varint once the connection is closed with
+// CloseWithReason. The remote end must wrap its side of the connection too,
+// and accept streams, for the first stream it accepts to be read as the
+// control stream; its CloseInfo then reports the reason. The connection is
+// closed once the streams are done and the remote end has acknowledged the
+// reason, or at the end of the drain phase.
+func NewGracefulMuxedConn(c MuxedConn, opts ...GracefulOption) GracefulMuxedConn {
+	if gc, ok := c.(GracefulMuxedConn); ok {
+		return gc
+	}
+	gc := &gracefulMuxedConn{
+		MuxedConn:  c,
+		clock:      clock.Real,
+		ctrlOpened: make(chan struct{}),
+		ctrlDone:   make(chan struct{}),
+		streams:    make(map[*gracefulStream]struct{}),
+	}
+	for _, o := range opts {
+		o(gc)
+	}
+	go gc.openControl()
+	return gc
+}
+
+// NewGracefulConn returns c with the CloseWithReason and CloseInfo methods of
+// mc, the GracefulMuxedConn c runs on. Networks running their connections
+// on GracefulMuxedConns use it to let notifiees, and EmitCloseReasons, get
+// the reasons given by either end with GetCloseInfo.
+func NewGracefulConn(c Conn, mc GracefulMuxedConn) GracefulConn {
+	return &gracefulConn{Conn: c, mc: mc}
+}
+
+type gracefulConn struct {
+	Conn
+	mc GracefulMuxedConn
+}
+
+func (c *gracefulConn) CloseWithReason(reason control.DisconnectReason, drain time.Duration) error {
+	return c.mc.CloseWithReason(reason, drain)
+}
+
+func (c *gracefulConn) CloseInfo() (CloseInfo, bool) {
+	return c.mc.CloseInfo()
+}
+
+var _ GracefulMuxedConn = (*gracefulMuxedConn)(nil)
+
+type gracefulMuxedConn struct {
+	MuxedConn
+	clock clock.Clock
+
+	// ctrlOpened is closed once the local control stream, ctrl, is open, or
+	// failed to open, in which case ctrl is nil. Streams are opened after
+	// it, so that it is the first stream the remote end accepts.
+	ctrlOpened chan struct{}
+	ctrl       MuxedStream
+	// acceptCtrl accepts the control stream of the remote end, and ctrlDone
+	// is closed once it has been read.
+	acceptCtrl sync.Once
+	ctrlDone   chan struct{}
+
+	mu      sync.Mutex
+	info    *CloseInfo
+	streams map[*gracefulStream]struct{}
+	// drain closes the connection once the drain timeout passes; it is set
+	// while draining. acked is set once the remote end has acknowledged the
+	// reason, or can't.
+	drain     clock.Timer
+	acked     bool
+	closeOnce sync.Once
+}
+
+func (c *gracefulMuxedConn) openControl() {
+	defer close(c.ctrlOpened)
+	s, err := c.MuxedConn.OpenStream(context.Background())
+	if err != nil {
+		return
+	}
+	if _, err := io.WriteString(s, goawayPreface); err != nil {
+		s.Reset()
+		return
+	}
+	c.ctrl = s
+}
+
+// acceptControl accepts the control stream of the remote end, and reads the
+// reason from it in the background.
+func (c *gracefulMuxedConn) acceptControl() {
+	s, err := c.MuxedConn.AcceptStream()
+	if err != nil {
+		close(c.ctrlDone)
+		return
+	}
+	preface := make([]byte, len(goawayPreface))
+	if _, err := io.ReadFull(s, preface); err != nil || string(preface) != goawayPreface {
+		s.Reset()
+		close(c.ctrlDone)
+		return
+	}
+	go c.readControl(s)
+}
+
+func (c *gracefulMuxedConn) readControl(s MuxedStream) {
+	defer close(c.ctrlDone)
+	reason, err := binary.ReadVarint(&byteReader{r: s})
+	if err != nil {
+		s.Reset()
+		return
+	}
+	c.mu.Lock()
+	if c.info == nil {
+		c.info = &CloseInfo{Reason: control.DisconnectReason(reason), Remote: true}
+	}
+	c.mu.Unlock()
+	// acknowledge the reason
+	s.Close()
+}
+
+func (c *gracefulMuxedConn) OpenStream(ctx context.Context) (MuxedStream, error) {
+	select {
+	case <-c.ctrlOpened:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	draining := c.info != nil
+	c.mu.Unlock()
+	if draining {
+		return nil, ErrConnDraining
+	}
+	s, err := c.MuxedConn.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.track(s)
+}
+
+func (c *gracefulMuxedConn) AcceptStream() (MuxedStream, error) {
+	c.acceptCtrl.Do(c.acceptControl)
+	for {
+		s, err := c.MuxedConn.AcceptStream()
+		if err != nil {
+			// the reason precedes the closing of the connection
+			<-c.ctrlDone
+			return nil, err
+		}
+		gs, err := c.track(s)
+		if err == ErrConnDraining {
+			continue
+		}
+		return gs, err
+	}
+}
+
+func (c *gracefulMuxedConn) track(s MuxedStream) (MuxedStream, error) {
+	c.mu.Lock()
+	if c.info != nil {
+		c.mu.Unlock()
+		s.Reset()
+		return nil, ErrConnDraining
+	}
+	gs := &gracefulStream{MuxedStream: s, conn: c}
+	c.streams[gs] = struct{}{}
+	c.mu.Unlock()
+	return gs, nil
+}
+
+func (c *gracefulMuxedConn) untrack(s *gracefulStream) {
+	c.mu.Lock()
+	delete(c.streams, s)
+	drained := c.drainedLocked()
+	c.mu.Unlock()
+	if drained {
+		c.closeDrained()
+	}
+}
+
+// drainedLocked returns true once the connection can be closed before the
+// end of the drain phase. Callers hold c.mu.
+func (c *gracefulMuxedConn) drainedLocked() bool {
+	return c.drain != nil && c.acked && len(c.streams) == 0
+}
+
+// closeDrained closes the connection at the end of the drain phase.
+func (c *gracefulMuxedConn) closeDrained() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.drain.Stop()
+		c.mu.Unlock()
+		c.MuxedConn.Close()
+	})
+}
+
+func (c *gracefulMuxedConn) CloseWithReason(reason control.DisconnectReason, drain time.Duration) error {
+	c.mu.Lock()
+	if c.info != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.info = &CloseInfo{Reason: reason}
+	streams := make([]*gracefulStream, 0, len(c.streams))
+	for s := range c.streams {
+		streams = append(streams, s)
+	}
+	c.drain = c.clock.AfterFunc(drain, c.closeDrained)
+	c.mu.Unlock()
+
+	deadline := c.clock.Now().Add(drain)
+	for _, s := range streams {
+		s.SetDeadline(deadline)
+	}
+	go c.sendReason(reason, deadline)
+	return nil
+}
+
+// sendReason sends the reason on the control stream, and waits for the
+// remote end to acknowledge it by closing the stream.
+func (c *gracefulMuxedConn) sendReason(reason control.DisconnectReason, deadline time.Time) {
+	<-c.ctrlOpened
+	if s := c.ctrl; s != nil {
+		s.SetDeadline(deadline)
+		var b [binary.MaxVarintLen64]byte
+		n := binary.PutVarint(b[:], int64(reason))
+		if _, err := s.Write(b[:n]); err == nil {
+			s.CloseWrite()
+			io.Copy(io.Discard, s)
+		}
+		s.Reset()
+	}
+
+	c.mu.Lock()
+	c.acked = true
+	drained := c.drainedLocked()
+	c.mu.Unlock()
+	if drained {
+		c.closeDrained()
+	}
+}
+
+func (c *gracefulMuxedConn) CloseInfo() (CloseInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.info == nil {
+		return CloseInfo{}, false
+	}
+	return *c.info, true
+}
+
+func (c *gracefulMuxedConn) Close() error {
+	c.mu.Lock()
+	if c.info == nil {
+		c.info = &CloseInfo{}
+	}
+	c.mu.Unlock()
+	return c.MuxedConn.Close()
+}
+
+// gracefulStream is done once it has been closed or reset locally.
+type gracefulStream struct {
+	MuxedStream
+	conn *gracefulMuxedConn
+	once sync.Once
+}
+
+func (s *gracefulStream) done() {
+	s.once.Do(func() { s.conn.untrack(s) })
+}
+
+func (s *gracefulStream) Close() error {
+	err := s.MuxedStream.Close()
+	s.done()
+	return err
+}
+
+func (s *gracefulStream) Reset() error {
+	err := s.MuxedStream.Reset()
+	s.done()
+	return err
+}
@@ -0,0 +1,500 @@
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/network/memnet"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	corenet "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/libp2p/go-libp2p/p2p/muxer/mplex"
+)
+
+const goawayPreface = "/libp2p/goaway/1.0.0\n"
+
+// recordingStream is a MuxedStream recording the calls made to it.
+type recordingStream struct {
+	network.MuxedStream // only the methods below are used
+
+	// r is read from, if set; reads return io.EOF otherwise.
+	r io.Reader
+
+	mu       sync.Mutex
+	deadline time.Time
+	written  bytes.Buffer
+	closed   bool
+	reset    bool
+	// onReset is called by Reset, if set.
+	onReset func()
+}
+
+func (s *recordingStream) Read(b []byte) (int, error) {
+	if s.r == nil {
+		return 0, io.EOF
+	}
+	return s.r.Read(b)
+}
+
+func (s *recordingStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.written.Write(b)
+}
+
+func (s *recordingStream) CloseWrite() error {
+	return nil
+}
+
+func (s *recordingStream) isReset() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reset
+}
+
+func (s *recordingStream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadline = t
+	return nil
+}
+
+func (s *recordingStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *recordingStream) Reset() error {
+	s.mu.Lock()
+	s.reset = true
+	onReset := s.onReset
+	s.mu.Unlock()
+	if onReset != nil {
+		onReset()
+	}
+	return nil
+}
+
+// recordingMuxedConn is a MuxedConn whose inbound streams are fed by the
+// test.
+type recordingMuxedConn struct {
+	network.MuxedConn // only the methods below are used
+
+	incoming chan *recordingStream
+
+	mu     sync.Mutex
+	opened []*recordingStream
+	closed bool
+}
+
+// newRecordingMuxedConn creates a connection whose remote end has opened its
+// control stream.
+func newRecordingMuxedConn() *recordingMuxedConn {
+	c := &recordingMuxedConn{incoming: make(chan *recordingStream, 8)}
+	c.incoming <- &recordingStream{r: strings.NewReader(goawayPreface)}
+	return c
+}
+
+func (c *recordingMuxedConn) OpenStream(context.Context) (network.MuxedStream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &recordingStream{}
+	c.opened = append(c.opened, s)
+	return s, nil
+}
+
+func (c *recordingMuxedConn) AcceptStream() (network.MuxedStream, error) {
+	s, ok := <-c.incoming
+	if !ok {
+		return nil, errors.New("connection closed")
+	}
+	return s, nil
+}
+
+func (c *recordingMuxedConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *recordingMuxedConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// stream returns the i-th stream opened, the first one being the control
+// stream.
+func (c *recordingMuxedConn) stream(i int) *recordingStream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opened[i]
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGracefulMuxedConnDrain(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	mc := newRecordingMuxedConn()
+	gc := network.NewGracefulMuxedConn(mc, network.WithDrainClock(clk))
+	if _, ok := gc.CloseInfo(); ok {
+		t.Fatal("expected no close info before closing")
+	}
+
+	s1, err := gc.OpenStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbound := &recordingStream{}
+	mc.incoming <- inbound
+	s2, err := gc.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const reason = control.DisconnectReason(7)
+	if err := gc.CloseWithReason(reason, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := gc.CloseInfo(); !ok || info != (network.CloseInfo{Reason: reason}) {
+		t.Fatalf("expected the local close reason, got %+v", info)
+	}
+	// a second close keeps the first reason
+	gc.CloseWithReason(reason+1, time.Second)
+	if info, _ := gc.CloseInfo(); info.Reason != reason {
+		t.Fatalf("expected the first close reason to be kept, got %d", info.Reason)
+	}
+
+	if _, err := gc.OpenStream(context.Background()); err != network.ErrConnDraining {
+		t.Fatalf("expected ErrConnDraining, got %v", err)
+	}
+	// inbound streams are reset while draining, without holding up the
+	// connection
+	rejected := &recordingStream{onReset: func() { gc.CloseInfo() }}
+	mc.incoming <- rejected
+	close(mc.incoming)
+	if _, err := gc.AcceptStream(); err == nil || err == network.ErrConnDraining {
+		t.Fatalf("expected the error of the underlying connection, got %v", err)
+	}
+	if !rejected.isReset() {
+		t.Fatal("expected the inbound stream to be reset")
+	}
+
+	deadline := clk.Now().Add(time.Second)
+	for _, s := range []*recordingStream{mc.stream(1), inbound} {
+		if !s.deadline.Equal(deadline) {
+			t.Fatalf("expected the streams to get the drain deadline, got %s", s.deadline)
+		}
+	}
+	// the reason is sent on the control stream, after its preface
+	ctrl := mc.stream(0)
+	waitFor(t, ctrl.isReset)
+	var varint [binary.MaxVarintLen64]byte
+	expected := goawayPreface + string(varint[:binary.PutVarint(varint[:], int64(reason))])
+	if got := ctrl.written.String(); got != expected {
+		t.Fatalf("expected the control stream to carry %q, got %q", expected, got)
+	}
+
+	s1.Close()
+	if mc.isClosed() {
+		t.Fatal("expected the connection to stay open while a stream is open")
+	}
+	s2.Reset()
+	waitFor(t, mc.isClosed)
+}
+
+func TestGracefulMuxedConnDrainTimeout(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	mc := newRecordingMuxedConn()
+	gc := network.NewGracefulMuxedConn(mc, network.WithDrainClock(clk))
+	if _, err := gc.OpenStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	gc.CloseWithReason(1, time.Second)
+	clk.Advance(time.Second - 1)
+	if mc.isClosed() {
+		t.Fatal("expected the connection to stay open during the drain phase")
+	}
+	clk.Advance(1)
+	if !mc.isClosed() {
+		t.Fatal("expected the connection to close at the end of the drain phase")
+	}
+}
+
+func TestGracefulMuxedConnClose(t *testing.T) {
+	mc := newRecordingMuxedConn()
+	gc := network.NewGracefulMuxedConn(mc)
+	if network.NewGracefulMuxedConn(gc) != gc {
+		t.Fatal("expected a GracefulMuxedConn not to be wrapped again")
+	}
+
+	// without streams, there is nothing to drain
+	if err := gc.CloseWithReason(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// once the remote end has acknowledged the reason
+	waitFor(t, mc.isClosed)
+
+	mc = newRecordingMuxedConn()
+	gc = network.NewGracefulMuxedConn(mc)
+	gc.Close()
+	if info, ok := gc.CloseInfo(); !ok || info != (network.CloseInfo{}) {
+		t.Fatalf("expected a close without reason, got %+v, %t", info, ok)
+	}
+	if !mc.isClosed() {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+// mplexPair creates the two ends of an mplex connection over net.Pipe, both
+// wrapped with NewGracefulMuxedConn.
+func mplexPair(t *testing.T) (client, server network.GracefulMuxedConn) {
+	t.Helper()
+	m := network.NewGracefulMultiplexer(mplex.DefaultTransport)
+	cc, sc := net.Pipe()
+	serverCh := make(chan network.MuxedConn, 1)
+	go func() {
+		c, err := m.NewConn(sc, true, corenet.NullScope)
+		if err != nil {
+			t.Error(err)
+		}
+		serverCh <- c
+	}()
+	c, err := m.NewConn(cc, false, corenet.NullScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-serverCh
+	if s == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(network.GracefulMuxedConn), s.(network.GracefulMuxedConn)
+}
+
+// gracefulTestConn is a Conn backed by a GracefulMuxedConn, as a Network would build.
+type gracefulTestConn struct {
+	network.Conn // only the methods below are used
+
+	remote peer.ID
+}
+
+func (c *gracefulTestConn) RemotePeer() peer.ID { return c.remote }
+func (c *gracefulTestConn) ID() string          { return "conn" }
+
+// notifyingNetwork records the notifiee of EmitCloseReasons.
+type notifyingNetwork struct {
+	network.Network // only the methods below are used
+
+	notifiee network.Notifiee
+}
+
+func (n *notifyingNetwork) Notify(nf network.Notifiee)  { n.notifiee = nf }
+func (n *notifyingNetwork) StopNotify(network.Notifiee) { n.notifiee = nil }
+
+func TestCloseReasonOverMuxer(t *testing.T) {
+	client, server := mplexPair(t)
+
+	accepted := make(chan network.MuxedStream, 1)
+	acceptErr := make(chan error, 1)
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			accepted <- s
+		}
+	}()
+
+	cs, err := client.OpenStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ss := <-accepted
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ss, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected the stream to carry hello, got %q: %v", buf, err)
+	}
+
+	const reason = control.DisconnectReason(-42)
+	if err := client.CloseWithReason(reason, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, ok := server.CloseInfo()
+		return ok
+	})
+	if info, _ := server.CloseInfo(); info != (network.CloseInfo{Reason: reason, Remote: true}) {
+		t.Fatalf("expected the remote close reason, got %+v", info)
+	}
+	// the remote end stops opening streams too
+	if _, err := server.OpenStream(context.Background()); err != network.ErrConnDraining {
+		t.Fatalf("expected ErrConnDraining, got %v", err)
+	}
+
+	// the connection closes once the open streams are done
+	cs.Close()
+	ss.Close()
+	select {
+	case <-acceptErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to close")
+	}
+	if info, _ := client.CloseInfo(); info != (network.CloseInfo{Reason: reason}) {
+		t.Fatalf("expected the local close reason, got %+v", info)
+	}
+
+	// the remote notifiees get the reason
+	bus := eventbus.NewBus()
+	sub, err := bus.Subscribe(new(event.EvtConnClosedWithReason))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	n := &notifyingNetwork{}
+	stop, err := network.EmitCloseReasons(n, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	n.notifiee.Disconnected(n, network.NewGracefulConn(&gracefulTestConn{remote: "client"}, server))
+	select {
+	case e := <-sub.Out():
+		ev := e.(event.EvtConnClosedWithReason)
+		if ev.Peer != "client" || ev.Reason != reason || !ev.Remote {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an event")
+	}
+}
+
+func TestCloseReasonWithoutStreams(t *testing.T) {
+	client, server := mplexPair(t)
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := server.AcceptStream()
+		acceptErr <- err
+	}()
+
+	if err := client.CloseWithReason(3, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the connection closes as soon as the reason is acknowledged, and the
+	// reason is known by the time the closing is noticed
+	select {
+	case <-acceptErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to close")
+	}
+	if info, ok := server.CloseInfo(); !ok || info != (network.CloseInfo{Reason: 3, Remote: true}) {
+		t.Fatalf("expected the remote close reason, got %+v", info)
+	}
+}
+
+func TestEmitCloseReasons(t *testing.T) {
+	hub, err := memnet.NewHub(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newNet := func() *memnet.Network {
+		sk, _, err := ic.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps, err := pstoremem.NewPeerstore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := hub.AddPeer(sk, ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			n.Close()
+			ps.Close()
+		})
+		return n
+	}
+	subscribe := func(n network.Network) <-chan interface{} {
+		bus := eventbus.NewBus()
+		sub, err := bus.Subscribe(new(event.EvtConnClosedWithReason))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sub.Close() })
+		stop, err := network.EmitCloseReasons(n, bus)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(stop)
+		return sub.Out()
+	}
+	next := func(events <-chan interface{}) event.EvtConnClosedWithReason {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e.(event.EvtConnClosedWithReason)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected an event")
+			return event.EvtConnClosedWithReason{}
+		}
+	}
+
+	a, b := newNet(), newNet()
+	aEvents, bEvents := subscribe(a), subscribe(b)
+	c, err := a.DialPeer(context.Background(), b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const reason = control.DisconnectReason(3)
+	if err := network.CloseWithReason(c, reason, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	local := next(aEvents)
+	if local.Peer != b.LocalPeer() || local.ConnID != c.ID() || local.Reason != reason || local.Remote {
+		t.Fatalf("unexpected local event: %+v", local)
+	}
+	remote := next(bEvents)
+	if remote.Peer != a.LocalPeer() || remote.Reason != reason || !remote.Remote {
+		t.Fatalf("unexpected remote event: %+v", remote)
+	}
+}
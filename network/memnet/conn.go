@@ -0,0 +1,334 @@
+package memnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	netx "github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrConnClosed is returned when opening a stream on a closed connection.
+var ErrConnClosed = errors.New("connection closed")
+
+type conn struct {
+	// bytesIn and bytesOut count the data of all streams. They are accessed
+	// atomically, and come first to be 64-bit aligned.
+	bytesIn  int64
+	bytesOut int64
+
+	net       *Network
+	remote    peer.ID
+	remotePub ic.PubKey
+	laddr     ma.Multiaddr
+	raddr     ma.Multiaddr
+	stat      network.ConnStats
+	scope     network.ConnManagementScope
+	id        uint64
+
+	// out carries data from the local to the remote peer.
+	out *link
+	// remoteConn is the other end of the connection.
+	remoteConn *conn
+	// handshake is the duration of the handshake, set before the connection
+	// is handed out.
+	handshake time.Duration
+
+	mu        sync.Mutex
+	closed    bool
+	draining  bool
+	closeInfo *netx.CloseInfo
+	streams   map[*stream]struct{}
+}
+
+var (
+	_ network.Conn       = (*conn)(nil)
+	_ netx.TelemetryConn = (*conn)(nil)
+	_ netx.GracefulConn  = (*conn)(nil)
+)
+
+func newConn(n *Network, remote peer.ID, remotePub ic.PubKey, laddr, raddr ma.Multiaddr, dir network.Direction, scope network.ConnManagementScope, id uint64, out *link) *conn {
+	c := &conn{
+		net:       n,
+		remote:    remote,
+		remotePub: remotePub,
+		laddr:     laddr,
+		raddr:     raddr,
+		scope:     scope,
+		id:        id,
+		out:       out,
+		streams:   make(map[*stream]struct{}),
+	}
+	c.stat.Direction = dir
+	c.stat.Opened = n.hub.clk.Now()
+	return c
+}
+
+func (c *conn) ID() string {
+	return fmt.Sprintf("memnet-%d", c.id)
+}
+
+func (c *conn) LocalPeer() peer.ID {
+	return c.net.local
+}
+
+func (c *conn) LocalPrivateKey() ic.PrivKey {
+	return c.net.sk
+}
+
+func (c *conn) RemotePeer() peer.ID {
+	return c.remote
+}
+
+func (c *conn) RemotePublicKey() ic.PubKey {
+	return c.remotePub
+}
+
+func (c *conn) LocalMultiaddr() ma.Multiaddr {
+	return c.laddr
+}
+
+func (c *conn) RemoteMultiaddr() ma.Multiaddr {
+	return c.raddr
+}
+
+func (c *conn) Scope() network.ConnScope {
+	return c.scope
+}
+
+func (c *conn) String() string {
+	return fmt.Sprintf("<memnet.conn %s %s <-> %s>", c.ID(), c.net.local, c.remote)
+}
+
+func (c *conn) Stat() network.ConnStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stat := c.stat
+	stat.NumStreams = len(c.streams)
+	return stat
+}
+
+// Telemetry reports the traffic of the connection and the round trip time of
+// its links. The security and muxer handshakes are simulated as a single
+// round trip, reported as the security phase.
+func (c *conn) Telemetry() netx.ConnTelemetry {
+	streams := make(map[protocol.ID]int)
+	for _, s := range c.sortedStreams() {
+		streams[s.Protocol()]++
+	}
+	return netx.ConnTelemetry{
+		Handshake:         []netx.PhaseDuration{{Phase: netx.HandshakeSecurity, Duration: c.handshake}},
+		SmoothedRTT:       c.out.latency() + c.remoteConn.out.latency(),
+		BytesIn:           atomic.LoadInt64(&c.bytesIn),
+		BytesOut:          atomic.LoadInt64(&c.bytesOut),
+		StreamsByProtocol: streams,
+	}
+}
+
+func (c *conn) GetStreams() []network.Stream {
+	streams := c.sortedStreams()
+	out := make([]network.Stream, 0, len(streams))
+	for _, s := range streams {
+		out = append(out, s)
+	}
+	return out
+}
+
+// sortedStreams returns the open streams in the order they were opened.
+func (c *conn) sortedStreams() []*stream {
+	c.mu.Lock()
+	out := make([]*stream, 0, len(c.streams))
+	for s := range c.streams {
+		out = append(out, s)
+	}
+	c.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].seq < out[j].seq })
+	return out
+}
+
+func (c *conn) trace(kind EventKind, stream string) {
+	c.net.hub.trace(Event{
+		Kind:   kind,
+		Local:  c.net.local,
+		Remote: c.remote,
+		Conn:   c.ID(),
+		Stream: stream,
+	})
+}
+
+func (c *conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// NewStream opens a new stream. The remote side learns about the stream
+// after the link latency, at which point its stream handler is invoked.
+func (c *conn) NewStream(ctx context.Context) (network.Stream, error) {
+	if c.isDraining() {
+		return nil, netx.ErrConnDraining
+	}
+	scope, err := c.net.rcmgr.OpenStream(c.remote, network.DirOutbound)
+	if err != nil {
+		return nil, err
+	}
+
+	local, remote := newStreamPair(c, scope, c.net.hub.newStreamID())
+	if !c.addStream(local) {
+		scope.Done()
+		return nil, ErrConnClosed
+	}
+	c.trace(StreamOpened, local.id)
+	local.opened()
+
+	c.net.hub.clk.AfterFunc(c.out.latency(), func() { c.remoteConn.acceptStream(remote) })
+	return local, nil
+}
+
+// acceptStream delivers a stream opened by the remote side.
+func (c *conn) acceptStream(s *stream) {
+	if c.isDraining() {
+		s.remote.Reset()
+		return
+	}
+	scope, err := c.net.rcmgr.OpenStream(c.remote, network.DirInbound)
+	if err != nil {
+		s.remote.Reset()
+		return
+	}
+	if !c.addStream(s) {
+		scope.Done()
+		s.remote.Reset()
+		return
+	}
+	if !s.accept(scope) {
+		// reset before it was accepted
+		scope.Done()
+		c.removeStream(s)
+		return
+	}
+	c.trace(StreamAccepted, s.id)
+	s.opened()
+	c.net.handleStream(s)
+}
+
+func (c *conn) addStream(s *stream) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.streams[s] = struct{}{}
+	return true
+}
+
+func (c *conn) removeStream(s *stream) {
+	c.mu.Lock()
+	delete(c.streams, s)
+	drained := c.draining && !c.closed && len(c.streams) == 0
+	c.mu.Unlock()
+
+	if drained && c.remoteConn.drained() {
+		clock.Go(c.net.hub.clk, func() { c.Close() })
+	}
+}
+
+func (c *conn) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+func (c *conn) drained() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams) == 0
+}
+
+// setCloseInfo records why the connection is closed, unless it already is,
+// and stops it from opening and accepting streams.
+func (c *conn) setCloseInfo(info netx.CloseInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+	if c.closeInfo == nil {
+		c.closeInfo = &info
+	}
+}
+
+// Close closes both ends of the connection, resetting all open streams.
+func (c *conn) Close() error {
+	c.setCloseInfo(netx.CloseInfo{})
+	c.remoteConn.setCloseInfo(netx.CloseInfo{Remote: true})
+	c.teardown()
+	c.remoteConn.teardown()
+	return nil
+}
+
+// CloseWithReason stops both ends of the connection from opening streams,
+// and closes it once the open streams are done, or after drain at the
+// latest. The remote side reports reason in its CloseInfo.
+func (c *conn) CloseWithReason(reason control.DisconnectReason, drain time.Duration) error {
+	c.mu.Lock()
+	draining := c.draining
+	c.mu.Unlock()
+	if draining {
+		return nil
+	}
+	c.setCloseInfo(netx.CloseInfo{Reason: reason})
+	c.remoteConn.setCloseInfo(netx.CloseInfo{Reason: reason, Remote: true})
+
+	if c.drained() && c.remoteConn.drained() {
+		return c.Close()
+	}
+	clk := c.net.hub.clk
+	deadline := clk.Now().Add(drain)
+	for _, s := range c.sortedStreams() {
+		s.SetDeadline(deadline)
+	}
+	clk.AfterFunc(drain, func() { c.Close() })
+	return nil
+}
+
+func (c *conn) CloseInfo() (netx.CloseInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeInfo == nil {
+		return netx.CloseInfo{}, false
+	}
+	return *c.closeInfo, true
+}
+
+func (c *conn) teardown() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	for _, s := range c.sortedStreams() {
+		s.Reset()
+	}
+	c.scope.Done()
+	if c.net.removeConn(c) {
+		c.trace(ConnClosed, "")
+		clock.Go(c.net.hub.clk, func() {
+			c.net.notifyAll(func(nf network.Notifiee) { nf.Disconnected(c.net, c) })
+		})
+	}
+}
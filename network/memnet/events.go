@@ -0,0 +1,66 @@
+package memnet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// EventKind is the kind of a connection or stream event.
+type EventKind int
+
+const (
+	// ConnOpened is emitted on both sides once a connection is established.
+	ConnOpened EventKind = iota
+	// ConnClosed is emitted on both sides once a connection is closed.
+	ConnClosed
+	// StreamOpened is emitted when the local peer opens a stream.
+	StreamOpened
+	// StreamAccepted is emitted when a stream opened by the remote peer is
+	// handed to the stream handler.
+	StreamAccepted
+	// StreamClosed is emitted when both directions of a stream are closed.
+	StreamClosed
+	// StreamReset is emitted when a stream is reset, by either side.
+	StreamReset
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case ConnOpened:
+		return "ConnOpened"
+	case ConnClosed:
+		return "ConnClosed"
+	case StreamOpened:
+		return "StreamOpened"
+	case StreamAccepted:
+		return "StreamAccepted"
+	case StreamClosed:
+		return "StreamClosed"
+	case StreamReset:
+		return "StreamReset"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event is a connection or stream event, as seen by the Local peer.
+type Event struct {
+	Time   time.Time
+	Kind   EventKind
+	Local  peer.ID
+	Remote peer.ID
+	// Conn is the ID of the connection.
+	Conn string
+	// Stream is the ID of the stream, for stream events.
+	Stream string
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %s %s->%s %s", e.Time.Format(time.RFC3339Nano), e.Kind, e.Local, e.Remote, e.Conn)
+	if e.Stream != "" {
+		s += " " + e.Stream
+	}
+	return s
+}
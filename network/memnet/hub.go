@@ -0,0 +1,392 @@
+// Package memnet provides an in-process implementation of network.Network,
+// network.Conn and network.Stream, for testing protocols against many peers in
+// a single process without real transports.
+//
+// All networks created from a Hub can reach each other. The conditions of
+// the link between any two peers (latency, bandwidth, stalls, partitions) are
+// configurable at runtime.
+//
+// All timing goes through the Hub's clock. On a scheduling virtual clock (see
+// Simulation), the whole network runs deterministically.
+package memnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrPartitioned is returned when dialing a peer across a partitioned link.
+var ErrPartitioned = errors.New("link partitioned")
+
+// LinkOptions describes the conditions of the link between two peers.
+type LinkOptions struct {
+	// Latency is the one-way delay applied to every write.
+	Latency time.Duration
+	// Bandwidth is the capacity of the link in bytes per second, in each
+	// direction. Zero means unlimited.
+	Bandwidth float64
+	// StallProbability is the probability that a write is held back for
+	// StallDuration, simulating a lost packet being retransmitted.
+	StallProbability float64
+	StallDuration    time.Duration
+}
+
+// Option is a single option for a Network added to a Hub.
+type Option func(cfg *config) error
+
+type config struct {
+	gater connmgr.ConnectionGater
+	rcmgr network.ResourceManager
+	addrs []ma.Multiaddr
+}
+
+// WithConnectionGater sets the ConnectionGater consulted by the network for
+// inbound and outbound connections.
+func WithConnectionGater(g connmgr.ConnectionGater) Option {
+	return func(cfg *config) error {
+		cfg.gater = g
+		return nil
+	}
+}
+
+// WithResourceManager sets the ResourceManager in which the network opens
+// connection and stream scopes. Defaults to network.NullResourceManager.
+func WithResourceManager(rm network.ResourceManager) Option {
+	return func(cfg *config) error {
+		cfg.rcmgr = rm
+		return nil
+	}
+}
+
+// WithListenAddrs sets the addresses the network listens on. By default, the
+// network listens on a single address allocated by the Hub.
+func WithListenAddrs(addrs ...ma.Multiaddr) Option {
+	return func(cfg *config) error {
+		cfg.addrs = addrs
+		return nil
+	}
+}
+
+// HubOption is a single option for a Hub.
+type HubOption func(cfg *hubConfig) error
+
+type hubConfig struct {
+	clk    clock.Clock
+	tracer func(Event)
+}
+
+// WithClock sets the clock driving the hub's links, dials and deadlines.
+// Defaults to clock.Real.
+func WithClock(c clock.Clock) HubOption {
+	return func(cfg *hubConfig) error {
+		cfg.clk = c
+		return nil
+	}
+}
+
+// WithTracer sets a function called with every connection and stream event
+// in the hub. It must not block.
+func WithTracer(f func(Event)) HubOption {
+	return func(cfg *hubConfig) error {
+		cfg.tracer = f
+		return nil
+	}
+}
+
+// Hub connects in-memory networks to each other.
+type Hub struct {
+	clk    clock.Clock
+	tracer func(Event)
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
+
+	mu         sync.RWMutex
+	nets       map[peer.ID]*Network
+	defaults   LinkOptions
+	links      map[linkKey]*link
+	nextAddr   uint32
+	nextConn   uint64
+	nextStream uint64
+}
+
+// NewHub creates an empty Hub. The seed drives the random stalls applied to
+// writes.
+func NewHub(seed int64, opts ...HubOption) (*Hub, error) {
+	cfg := hubConfig{clk: clock.Real}
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &Hub{
+		clk:    cfg.clk,
+		tracer: cfg.tracer,
+		rng:    rand.New(rand.NewSource(seed)),
+		nets:   make(map[peer.ID]*Network),
+		links:  make(map[linkKey]*link),
+	}, nil
+}
+
+// Clock returns the clock driving the hub.
+func (h *Hub) Clock() clock.Clock {
+	return h.clk
+}
+
+// AddPeer creates a network for the peer owning sk and attaches it to the hub.
+// The peer's keys are added to ps, which becomes the network's peerstore.
+func (h *Hub) AddPeer(sk ic.PrivKey, ps peerstore.Peerstore, opts ...Option) (*Network, error) {
+	cfg := config{rcmgr: network.NullResourceManager}
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	if err := ps.AddPrivKey(p, sk); err != nil {
+		return nil, err
+	}
+	if err := ps.AddPubKey(p, sk.GetPublic()); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.nets[p]; ok {
+		return nil, fmt.Errorf("peer %s already attached to the hub", p)
+	}
+	if len(cfg.addrs) == 0 {
+		h.nextAddr++
+		n := h.nextAddr
+		addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/10.%d.%d.%d/tcp/4001", byte(n>>16), byte(n>>8), byte(n)))
+		if err != nil {
+			return nil, err
+		}
+		cfg.addrs = []ma.Multiaddr{addr}
+	}
+
+	n := newNetwork(h, p, sk, ps, cfg)
+	h.nets[p] = n
+	return n, nil
+}
+
+// Net returns the network of the given peer, or nil if the peer is not
+// attached to the hub.
+func (h *Hub) Net(p peer.ID) *Network {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.nets[p]
+}
+
+// Peers returns the peers attached to the hub.
+func (h *Hub) Peers() peer.IDSlice {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make(peer.IDSlice, 0, len(h.nets))
+	for p := range h.nets {
+		out = append(out, p)
+	}
+	sort.Sort(out)
+	return out
+}
+
+// SetLinkDefaults sets the conditions of all links without explicit options.
+func (h *Hub) SetLinkDefaults(o LinkOptions) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.defaults = o
+	for _, l := range h.links {
+		if !l.explicit {
+			l.setOptions(o)
+		}
+	}
+}
+
+// SetLink sets the conditions of the link between a and b, in both
+// directions. It applies to existing connections as well as new ones.
+func (h *Hub) SetLink(a, b peer.ID, o LinkOptions) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, l := range []*link{h.linkLocked(a, b), h.linkLocked(b, a)} {
+		l.explicit = true
+		l.setOptions(o)
+	}
+}
+
+// Partition cuts the link between a and b. New dials fail, and data in
+// flight on existing connections is held back until the link is healed.
+func (h *Hub) Partition(a, b peer.ID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.linkLocked(a, b).setPartitioned(true)
+	h.linkLocked(b, a).setPartitioned(true)
+}
+
+// Heal restores a partitioned link between a and b.
+func (h *Hub) Heal(a, b peer.ID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.linkLocked(a, b).setPartitioned(false)
+	h.linkLocked(b, a).setPartitioned(false)
+}
+
+// link returns the directional link carrying data from a to b.
+func (h *Hub) link(from, to peer.ID) *link {
+	h.mu.RLock()
+	l, ok := h.links[linkKey{from, to}]
+	h.mu.RUnlock()
+	if ok {
+		return l
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.linkLocked(from, to)
+}
+
+func (h *Hub) linkLocked(from, to peer.ID) *link {
+	k := linkKey{from, to}
+	l, ok := h.links[k]
+	if !ok {
+		l = &link{hub: h, opts: h.defaults}
+		h.links[k] = l
+	}
+	return l
+}
+
+func (h *Hub) newConnID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextConn++
+	return h.nextConn
+}
+
+func (h *Hub) newStreamID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextStream++
+	return h.nextStream
+}
+
+func (h *Hub) trace(ev Event) {
+	if h.tracer == nil {
+		return
+	}
+	ev.Time = h.clk.Now()
+	h.tracer(ev)
+}
+
+func (h *Hub) stall(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	h.rngMu.Lock()
+	defer h.rngMu.Unlock()
+	return h.rng.Float64() < p
+}
+
+func (h *Hub) detach(p peer.ID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.nets, p)
+}
+
+type linkKey struct {
+	from, to peer.ID
+}
+
+// link carries data in one direction between two peers. Its bandwidth is
+// shared by all streams of all connections between them.
+type link struct {
+	hub *Hub
+
+	mu          sync.Mutex
+	opts        LinkOptions
+	explicit    bool
+	nextFree    time.Time
+	partitioned bool
+	// waiting are woken when the link is healed.
+	waiting []*clock.Waker
+}
+
+func (l *link) setOptions(o LinkOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.opts = o
+}
+
+func (l *link) setPartitioned(v bool) {
+	l.mu.Lock()
+	l.partitioned = v
+	var waiting []*clock.Waker
+	if !v {
+		waiting = l.waiting
+		l.waiting = nil
+	}
+	l.mu.Unlock()
+
+	for _, w := range waiting {
+		w.Wake()
+	}
+}
+
+// blocked returns true if the link is partitioned. If so, and w is not nil, w
+// is woken once the link is healed.
+func (l *link) blocked(w *clock.Waker) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.partitioned && w != nil {
+		for _, other := range l.waiting {
+			if other == w {
+				return true
+			}
+		}
+		l.waiting = append(l.waiting, w)
+	}
+	return l.partitioned
+}
+
+func (l *link) latency() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.opts.Latency
+}
+
+// schedule accounts for n bytes sent over the link at now. It returns the
+// time at which the bytes are fully sent, and the time at which they are
+// delivered to the remote side.
+func (l *link) schedule(now time.Time, n int) (sent, delivered time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := now
+	if l.nextFree.After(start) {
+		start = l.nextFree
+	}
+	sent = start
+	if l.opts.Bandwidth > 0 {
+		sent = start.Add(time.Duration(float64(n) / l.opts.Bandwidth * float64(time.Second)))
+	}
+	l.nextFree = sent
+	delivered = sent.Add(l.opts.Latency)
+	if l.hub.stall(l.opts.StallProbability) {
+		delivered = delivered.Add(l.opts.StallDuration)
+	}
+	return sent, delivered
+}
@@ -0,0 +1,579 @@
+package memnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	netx "github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrNetworkClosed is returned when using a closed network.
+var ErrNetworkClosed = errors.New("network closed")
+
+// Network is an in-memory network.Network attached to a Hub.
+type Network struct {
+	hub   *Hub
+	local peer.ID
+	sk    ic.PrivKey
+	ps    peerstore.Peerstore
+	gater connmgr.ConnectionGater
+	rcmgr network.ResourceManager
+
+	mu        sync.RWMutex
+	closed    bool
+	addrs     []ma.Multiaddr
+	conns     map[peer.ID][]*conn
+	dials     map[peer.ID]*dial
+	notifees  []network.Notifiee
+	observers []netx.StreamObserver
+	handler   network.StreamHandler
+}
+
+var (
+	_ network.Network     = (*Network)(nil)
+	_ netx.StreamNotifier = (*Network)(nil)
+)
+
+func newNetwork(h *Hub, p peer.ID, sk ic.PrivKey, ps peerstore.Peerstore, cfg config) *Network {
+	return &Network{
+		hub:   h,
+		local: p,
+		sk:    sk,
+		ps:    ps,
+		gater: cfg.gater,
+		rcmgr: cfg.rcmgr,
+		addrs: cfg.addrs,
+		conns: make(map[peer.ID][]*conn),
+		dials: make(map[peer.ID]*dial),
+	}
+}
+
+func (n *Network) Peerstore() peerstore.Peerstore {
+	return n.ps
+}
+
+func (n *Network) LocalPeer() peer.ID {
+	return n.local
+}
+
+func (n *Network) ResourceManager() network.ResourceManager {
+	return n.rcmgr
+}
+
+func (n *Network) SetStreamHandler(h network.StreamHandler) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handler = h
+}
+
+func (n *Network) Listen(addrs ...ma.Multiaddr) error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrNetworkClosed
+	}
+	n.addrs = append(n.addrs, addrs...)
+	n.mu.Unlock()
+
+	for _, a := range addrs {
+		a := a
+		n.notifyAll(func(nf network.Notifiee) { nf.Listen(n, a) })
+	}
+	return nil
+}
+
+func (n *Network) ListenAddresses() []ma.Multiaddr {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return append([]ma.Multiaddr(nil), n.addrs...)
+}
+
+func (n *Network) InterfaceListenAddresses() ([]ma.Multiaddr, error) {
+	return n.ListenAddresses(), nil
+}
+
+func (n *Network) Connectedness(p peer.ID) network.Connectedness {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if len(n.conns[p]) > 0 {
+		return network.Connected
+	}
+	return network.NotConnected
+}
+
+func (n *Network) Peers() []peer.ID {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	out := make([]peer.ID, 0, len(n.conns))
+	for p, cs := range n.conns {
+		if len(cs) > 0 {
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// Conns returns the open connections, in the order they were established.
+func (n *Network) Conns() []network.Conn {
+	n.mu.RLock()
+	var cs []*conn
+	for _, pcs := range n.conns {
+		cs = append(cs, pcs...)
+	}
+	n.mu.RUnlock()
+
+	sort.Slice(cs, func(i, j int) bool { return cs[i].id < cs[j].id })
+	out := make([]network.Conn, 0, len(cs))
+	for _, c := range cs {
+		out = append(out, c)
+	}
+	return out
+}
+
+func (n *Network) ConnsToPeer(p peer.ID) []network.Conn {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	cs := n.conns[p]
+	out := make([]network.Conn, 0, len(cs))
+	for _, c := range cs {
+		out = append(out, c)
+	}
+	return out
+}
+
+func (n *Network) Notify(nf network.Notifiee) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, other := range n.notifees {
+		if other == nf {
+			return
+		}
+	}
+	n.notifees = append(n.notifees, nf)
+}
+
+func (n *Network) StopNotify(nf network.Notifiee) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, other := range n.notifees {
+		if other == nf {
+			n.notifees = append(n.notifees[:i:i], n.notifees[i+1:]...)
+			return
+		}
+	}
+}
+
+// NotifyStreams registers o to be notified of the stream events. Observers
+// are called synchronously, in the order in which they were registered.
+func (n *Network) NotifyStreams(o netx.StreamObserver) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, other := range n.observers {
+		if other == o {
+			return
+		}
+	}
+	n.observers = append(n.observers, o)
+}
+
+func (n *Network) StopNotifyStreams(o netx.StreamObserver) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, other := range n.observers {
+		if other == o {
+			n.observers = append(n.observers[:i:i], n.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *Network) observe(notify func(netx.StreamObserver)) {
+	n.mu.RLock()
+	obs := n.observers
+	n.mu.RUnlock()
+	for _, o := range obs {
+		notify(o)
+	}
+}
+
+// notifyAll calls notify for every notifiee concurrently, and waits for all of
+// them to return. On a scheduling clock, notifiees are called one after the
+// other, in the order in which they were registered.
+func (n *Network) notifyAll(notify func(network.Notifiee)) {
+	n.mu.RLock()
+	nfs := n.notifees
+	n.mu.RUnlock()
+
+	if v, ok := n.hub.clk.(*clock.Virtual); ok && v.Scheduled() {
+		for _, nf := range nfs {
+			notify(nf)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, nf := range nfs {
+		wg.Add(1)
+		go func(nf network.Notifiee) {
+			defer wg.Done()
+			notify(nf)
+		}(nf)
+	}
+	wg.Wait()
+}
+
+func (n *Network) ClosePeer(p peer.ID) error {
+	var errs []error
+	for _, c := range n.ConnsToPeer(p) {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close %d connections to %s: %v", len(errs), p, errs[0])
+	}
+	return nil
+}
+
+// Close closes all connections and detaches the network from its hub.
+func (n *Network) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	addrs := n.addrs
+	n.mu.Unlock()
+
+	n.hub.detach(n.local)
+	for _, c := range n.Conns() {
+		c.Close()
+	}
+	for _, a := range addrs {
+		a := a
+		n.notifyAll(func(nf network.Notifiee) { nf.ListenClose(n, a) })
+	}
+	return nil
+}
+
+func (n *Network) NewStream(ctx context.Context, p peer.ID) (network.Stream, error) {
+	c := n.bestConn(p)
+	if c == nil {
+		if nodial, _ := network.GetNoDial(ctx); nodial {
+			return nil, network.ErrNoConn
+		}
+		dc, err := n.DialPeer(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		c = dc.(*conn)
+	}
+	return c.NewStream(ctx)
+}
+
+func (n *Network) bestConn(p peer.ID) *conn {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.bestConnLocked(p)
+}
+
+// bestConnLocked is bestConn for callers holding n.mu.
+func (n *Network) bestConnLocked(p peer.ID) *conn {
+	cs := n.conns[p]
+	for i := len(cs) - 1; i >= 0; i-- {
+		if !cs[i].isClosed() {
+			return cs[i]
+		}
+	}
+	return nil
+}
+
+// dial is a dial in progress, which concurrent dials to the same peer wait
+// for instead of establishing connections of their own.
+type dial struct {
+	waker *clock.Waker
+
+	mu   sync.Mutex
+	done bool
+	conn *conn
+	err  error
+}
+
+func (d *dial) finish(c *conn, err error) {
+	d.mu.Lock()
+	d.done, d.conn, d.err = true, c, err
+	d.mu.Unlock()
+	d.waker.Wake()
+}
+
+// wait waits for the dial to finish, and returns its result.
+func (d *dial) wait(ctx context.Context) (network.Conn, error) {
+	for {
+		tok := d.waker.Arm()
+		d.mu.Lock()
+		done, c, err := d.done, d.conn, d.err
+		d.mu.Unlock()
+		switch {
+		case done && err != nil:
+			return nil, err
+		case done:
+			return c, nil
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		}
+		d.waker.Wait(tok, ctx.Done())
+	}
+}
+
+// DialPeer returns an existing connection to p, or establishes a new one. The
+// connection handshake takes one round trip on the link. The dial timeout
+// from the context is measured on the hub clock. Concurrent dials to the
+// same peer share the same connection.
+func (n *Network) DialPeer(ctx context.Context, p peer.ID) (network.Conn, error) {
+	if p == n.local {
+		return nil, errors.New("attempted to dial self")
+	}
+	n.mu.Lock()
+	if c := n.bestConnLocked(p); c != nil {
+		n.mu.Unlock()
+		return c, nil
+	}
+	if d, ok := n.dials[p]; ok {
+		n.mu.Unlock()
+		return d.wait(ctx)
+	}
+	d := &dial{waker: clock.NewWaker(n.hub.clk)}
+	n.dials[p] = d
+	n.mu.Unlock()
+
+	c, err := n.dialPeer(ctx, p)
+
+	n.mu.Lock()
+	delete(n.dials, p)
+	n.mu.Unlock()
+	d.finish(c, err)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (n *Network) dialPeer(ctx context.Context, p peer.ID) (*conn, error) {
+	deadline := n.hub.clk.Now().Add(network.GetDialPeerTimeout(ctx))
+
+	n.mu.RLock()
+	closed := n.closed
+	n.mu.RUnlock()
+	if closed {
+		return nil, ErrNetworkClosed
+	}
+	if n.gater != nil && !n.gater.InterceptPeerDial(p) {
+		return nil, fmt.Errorf("gater disallows connection to peer %s", p)
+	}
+
+	remote := n.hub.Net(p)
+	if remote == nil {
+		return nil, fmt.Errorf("peer %s is not reachable through the hub", p)
+	}
+	laddrs := n.ListenAddresses()
+	raddrs := remote.ListenAddresses()
+	if len(laddrs) == 0 || len(raddrs) == 0 {
+		return nil, network.ErrNoRemoteAddrs
+	}
+	laddr := laddrs[0]
+	var raddr ma.Multiaddr
+	for _, a := range raddrs {
+		if n.gater == nil || n.gater.InterceptAddrDial(p, a) {
+			raddr = a
+			break
+		}
+	}
+	if raddr == nil {
+		return nil, fmt.Errorf("gater disallows all addresses of peer %s", p)
+	}
+
+	out, in := n.hub.link(n.local, p), n.hub.link(p, n.local)
+	if out.blocked(nil) || in.blocked(nil) {
+		return nil, ErrPartitioned
+	}
+
+	return n.connect(ctx, deadline, remote, laddr, raddr, out, in)
+}
+
+func (n *Network) connect(ctx context.Context, deadline time.Time, remote *Network, laddr, raddr ma.Multiaddr, out, in *link) (*conn, error) {
+	p := remote.local
+	lscope, err := n.rcmgr.OpenConnection(network.DirOutbound, false, raddr)
+	if err != nil {
+		return nil, err
+	}
+	rscope, err := remote.rcmgr.OpenConnection(network.DirInbound, false, laddr)
+	if err != nil {
+		lscope.Done()
+		return nil, err
+	}
+	fail := func(err error) (*conn, error) {
+		lscope.Done()
+		rscope.Done()
+		return nil, err
+	}
+
+	id := n.hub.newConnID()
+	lc := newConn(n, remote.local, remote.sk.GetPublic(), laddr, raddr, network.DirOutbound, lscope, id, out)
+	rc := newConn(remote, n.local, n.sk.GetPublic(), raddr, laddr, network.DirInbound, rscope, id, in)
+	lc.remoteConn, rc.remoteConn = rc, lc
+
+	if remote.gater != nil && !remote.gater.InterceptAccept(rc) {
+		return fail(fmt.Errorf("peer %s refused the connection", p))
+	}
+
+	// one round trip for the security and muxer handshakes
+	start := n.hub.clk.Now()
+	if err := n.sleep(ctx, out.latency()+in.latency(), deadline); err != nil {
+		return fail(err)
+	}
+	lc.handshake = n.hub.clk.Since(start)
+	rc.handshake = lc.handshake
+
+	if err := lscope.SetPeer(p); err != nil {
+		return fail(err)
+	}
+	if err := rscope.SetPeer(n.local); err != nil {
+		return fail(err)
+	}
+	if n.gater != nil && !n.gater.InterceptSecured(network.DirOutbound, p, lc) {
+		return fail(fmt.Errorf("gater rejected secured connection to %s", p))
+	}
+	if remote.gater != nil && !remote.gater.InterceptSecured(network.DirInbound, n.local, rc) {
+		return fail(fmt.Errorf("peer %s rejected the secured connection", p))
+	}
+	// upgraded connections rejected by a gater are established, and closed
+	// with its reason, so that both sides report it
+	var (
+		rejected *conn
+		reason   control.DisconnectReason
+	)
+	if n.gater != nil {
+		if allow, r := n.gater.InterceptUpgraded(lc); !allow {
+			rejected, reason = lc, r
+		}
+	}
+	if rejected == nil && remote.gater != nil {
+		if allow, r := remote.gater.InterceptUpgraded(rc); !allow {
+			rejected, reason = rc, r
+		}
+	}
+
+	if err := n.addConn(lc); err != nil {
+		return fail(err)
+	}
+	if err := remote.addConn(rc); err != nil {
+		n.removeConn(lc)
+		return fail(err)
+	}
+	lc.trace(ConnOpened, "")
+	rc.trace(ConnOpened, "")
+	if rejected == nil {
+		clock.Go(n.hub.clk, func() {
+			remote.notifyAll(func(nf network.Notifiee) { nf.Connected(remote, rc) })
+		})
+		n.notifyAll(func(nf network.Notifiee) { nf.Connected(n, lc) })
+		return lc, nil
+	}
+
+	// the remote side is notified synchronously, for its notifiees to see
+	// the connection connected before it is disconnected
+	remote.notifyAll(func(nf network.Notifiee) { nf.Connected(remote, rc) })
+	n.notifyAll(func(nf network.Notifiee) { nf.Connected(n, lc) })
+	rejected.CloseWithReason(reason, 0)
+	info, _ := lc.CloseInfo()
+	return nil, &netx.ConnClosedError{CloseInfo: info}
+}
+
+// sleep waits for d on the hub clock. It fails if ctx is done, or if deadline
+// passes first.
+func (n *Network) sleep(ctx context.Context, d time.Duration, deadline time.Time) error {
+	clk := n.hub.clk
+	w := clock.NewWaker(clk)
+	end := clk.Now().Add(d)
+	t := clk.AfterFunc(d, w.Wake)
+	defer t.Stop()
+	dt := clk.AfterFunc(clk.Until(deadline), w.Wake)
+	defer dt.Stop()
+
+	for {
+		tok := w.Arm()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		now := clk.Now()
+		if !now.Before(end) {
+			return nil
+		}
+		if !now.Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		w.Wait(tok, ctx.Done())
+	}
+}
+
+func (n *Network) addConn(c *conn) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrNetworkClosed
+	}
+	n.conns[c.remote] = append(n.conns[c.remote], c)
+	return nil
+}
+
+func (n *Network) removeConn(c *conn) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cs := n.conns[c.remote]
+	for i, other := range cs {
+		if other == c {
+			// preserve the order of the remaining connections, which
+			// bestConnLocked relies on to prefer the newest
+			copy(cs[i:], cs[i+1:])
+			cs[len(cs)-1] = nil
+			cs = cs[:len(cs)-1]
+			if len(cs) == 0 {
+				delete(n.conns, c.remote)
+			} else {
+				n.conns[c.remote] = cs
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// handleStream invokes the stream handler for an incoming stream.
+func (n *Network) handleStream(s *stream) {
+	n.mu.RLock()
+	h := n.handler
+	closed := n.closed
+	n.mu.RUnlock()
+
+	if closed || h == nil {
+		s.Reset()
+		return
+	}
+	clock.Go(n.hub.clk, func() { h(s) })
+}
@@ -0,0 +1,536 @@
+package memnet
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	netx "github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/network/rcmgr"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func newPeer(t *testing.T, h *Hub, opts ...Option) *Network {
+	t.Helper()
+	sk, _, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := h.AddPeer(sk, ps, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.Close()
+		ps.Close()
+	})
+	return n
+}
+
+func newSimPeer(t *testing.T, sim *Simulation, opts ...Option) *Network {
+	t.Helper()
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := sim.NewPeer(ps, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ps.Close() })
+	return n
+}
+
+func newHub(t *testing.T) *Hub {
+	t.Helper()
+	h, err := NewHub(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func echo(s network.Stream) {
+	io.Copy(s, s)
+	s.Close()
+}
+
+func TestDialAndStream(t *testing.T) {
+	h := newHub(t)
+	a, b := newPeer(t, h), newPeer(t, h)
+	b.SetStreamHandler(echo)
+
+	ctx := context.Background()
+	s, err := a.NewStream(ctx, b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("expected the echo of hello, got %q", got)
+	}
+
+	if a.Connectedness(b.LocalPeer()) != network.Connected {
+		t.Fatal("expected a to be connected to b")
+	}
+	if b.Connectedness(a.LocalPeer()) != network.Connected {
+		t.Fatal("expected b to be connected to a")
+	}
+	c := s.Conn()
+	if c.Stat().Direction != network.DirOutbound {
+		t.Fatalf("expected an outbound connection, got %s", c.Stat().Direction)
+	}
+	if c.RemotePeer() != b.LocalPeer() || !c.RemoteMultiaddr().Equal(b.ListenAddresses()[0]) {
+		t.Fatalf("unexpected remote end %s at %s", c.RemotePeer(), c.RemoteMultiaddr())
+	}
+
+	if err := a.ClosePeer(b.LocalPeer()); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Conns()) != 0 || len(b.Conns()) != 0 {
+		t.Fatal("expected the connection to be closed on both sides")
+	}
+	if _, err := c.NewStream(ctx); err == nil {
+		t.Fatal("expected opening a stream on a closed connection to fail")
+	}
+}
+
+func TestConcurrentDialsShareConn(t *testing.T) {
+	h := newHub(t)
+	h.SetLinkDefaults(LinkOptions{Latency: 10 * time.Millisecond})
+	a, b := newPeer(t, h), newPeer(t, h)
+
+	const dials = 10
+	conns := make([]network.Conn, dials)
+	errs := make([]error, dials)
+	var wg sync.WaitGroup
+	for i := 0; i < dials; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], errs[i] = a.DialPeer(context.Background(), b.LocalPeer())
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range conns {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if conns[i] != conns[0] {
+			t.Fatal("expected all dials to return the same connection")
+		}
+	}
+	if n := len(a.ConnsToPeer(b.LocalPeer())); n != 1 {
+		t.Fatalf("expected a single connection, got %d", n)
+	}
+	if n := len(b.ConnsToPeer(a.LocalPeer())); n != 1 {
+		t.Fatalf("expected a single connection on the listener, got %d", n)
+	}
+}
+
+func TestWriteBackpressure(t *testing.T) {
+	h := newHub(t)
+	a, b := newPeer(t, h), newPeer(t, h)
+	accepted := make(chan network.Stream, 1)
+	b.SetStreamHandler(func(s network.Stream) { accepted <- s })
+
+	s, err := a.NewStream(context.Background(), b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+
+	// nobody reads: writes block once the receive window is full
+	data := make([]byte, 2*receiveWindow)
+	s.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := s.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write to time out, got %v", err)
+	}
+	if n != receiveWindow {
+		t.Fatalf("expected %d bytes to be written, got %d", receiveWindow, n)
+	}
+
+	// reading opens the window again
+	rs := <-accepted
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(io.Discard, rs, int64(len(data)))
+		done <- err
+	}()
+	s.SetWriteDeadline(time.Time{})
+	if _, err := s.Write(data[n:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionHeal(t *testing.T) {
+	sim, err := NewSimulation(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.SetLinkDefaults(LinkOptions{Latency: 10 * time.Millisecond})
+	a, b, c := newSimPeer(t, sim), newSimPeer(t, sim), newSimPeer(t, sim)
+	b.SetStreamHandler(echo)
+
+	var s network.Stream
+	sim.Go(func() {
+		s, err = a.NewStream(context.Background(), b.LocalPeer())
+	})
+	sim.Run(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim.Partition(a.LocalPeer(), b.LocalPeer())
+	sim.Partition(c.LocalPeer(), b.LocalPeer())
+	var dialErr error
+	sim.Go(func() {
+		_, dialErr = c.DialPeer(context.Background(), b.LocalPeer())
+	})
+	var readAt time.Time
+	sim.Go(func() {
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Error(err)
+			return
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		readAt = sim.Now()
+	})
+	sim.Run(time.Second)
+	if !errors.Is(dialErr, ErrPartitioned) {
+		t.Fatalf("expected dialing across a partition to fail, got %v", dialErr)
+	}
+	if !readAt.IsZero() {
+		t.Fatal("expected no data to cross the partition")
+	}
+
+	healed := sim.Now()
+	sim.Heal(a.LocalPeer(), b.LocalPeer())
+	sim.Run(time.Second)
+	if readAt.IsZero() {
+		t.Fatal("expected the data to be delivered once the partition is healed")
+	}
+	if d := readAt.Sub(healed); d != 10*time.Millisecond {
+		t.Fatalf("expected the echo to arrive one latency after healing, got %s", d)
+	}
+}
+
+func TestLatencyAndBandwidth(t *testing.T) {
+	sim, err := NewSimulation(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		latency   = 50 * time.Millisecond
+		bandwidth = 1 << 20
+		size      = 512 << 10
+	)
+	sim.SetLinkDefaults(LinkOptions{Latency: latency, Bandwidth: bandwidth})
+	a, b := newSimPeer(t, sim), newSimPeer(t, sim)
+
+	var received int64
+	var receivedAt time.Time
+	b.SetStreamHandler(func(s network.Stream) {
+		received, _ = io.Copy(io.Discard, s)
+		receivedAt = sim.Now()
+		s.Close()
+	})
+
+	var dialTime, writeTime time.Duration
+	var start time.Time
+	sim.Go(func() {
+		start = sim.Now()
+		if _, err := a.DialPeer(context.Background(), b.LocalPeer()); err != nil {
+			t.Error(err)
+			return
+		}
+		dialTime = sim.Now().Sub(start)
+
+		start = sim.Now()
+		s, err := a.NewStream(context.Background(), b.LocalPeer())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := s.Write(make([]byte, size)); err != nil {
+			t.Error(err)
+			return
+		}
+		writeTime = sim.Now().Sub(start)
+		s.CloseWrite()
+	})
+	sim.Run(10 * time.Second)
+
+	if dialTime != 2*latency {
+		t.Fatalf("expected the dial to take a round trip, took %s", dialTime)
+	}
+	transfer := time.Duration(size) * time.Second / bandwidth
+	if writeTime != transfer {
+		t.Fatalf("expected the write to take %s, took %s", transfer, writeTime)
+	}
+	if received != size {
+		t.Fatalf("expected %d bytes to be received, got %d", size, received)
+	}
+	if d := receivedAt.Sub(start); d != transfer+latency {
+		t.Fatalf("expected the data to be received after %s, took %s", transfer+latency, d)
+	}
+}
+
+type testGater struct {
+	denyDial     bool
+	denyAccept   bool
+	denySecured  bool
+	denyUpgraded control.DisconnectReason
+}
+
+func (g *testGater) InterceptPeerDial(peer.ID) bool               { return !g.denyDial }
+func (g *testGater) InterceptAddrDial(peer.ID, ma.Multiaddr) bool { return true }
+func (g *testGater) InterceptAccept(network.ConnMultiaddrs) bool  { return !g.denyAccept }
+
+func (g *testGater) InterceptSecured(network.Direction, peer.ID, network.ConnMultiaddrs) bool {
+	return !g.denySecured
+}
+
+func (g *testGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return g.denyUpgraded == 0, g.denyUpgraded
+}
+
+func TestConnectionGater(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		dialer, listener testGater
+	}{
+		{name: "peer dial", dialer: testGater{denyDial: true}},
+		{name: "accept", listener: testGater{denyAccept: true}},
+		{name: "secured outbound", dialer: testGater{denySecured: true}},
+		{name: "secured inbound", listener: testGater{denySecured: true}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHub(t)
+			a := newPeer(t, h, WithConnectionGater(&tc.dialer))
+			b := newPeer(t, h, WithConnectionGater(&tc.listener))
+			if _, err := a.DialPeer(context.Background(), b.LocalPeer()); err == nil {
+				t.Fatal("expected the dial to be rejected")
+			}
+			if len(a.Conns()) != 0 || len(b.Conns()) != 0 {
+				t.Fatal("expected no connection")
+			}
+		})
+	}
+}
+
+// closeLog records the connection events of a network, with the close info
+// of the disconnected connections.
+type closeLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *closeLog) notifiee() network.Notifiee {
+	return &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.events = append(l.events, "connected")
+		},
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			info, _ := netx.GetCloseInfo(c)
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.events = append(l.events, fmt.Sprintf("disconnected reason=%d remote=%t", info.Reason, info.Remote))
+		},
+	}
+}
+
+func (l *closeLog) Events() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+func TestUpgradedRejection(t *testing.T) {
+	const reason = control.DisconnectReason(42)
+	for _, tc := range []struct {
+		name             string
+		dialer, listener testGater
+		// dialerRemote is set if the dialer learns the reason from the
+		// listener.
+		dialerRemote bool
+	}{
+		{name: "outbound", dialer: testGater{denyUpgraded: reason}},
+		{name: "inbound", listener: testGater{denyUpgraded: reason}, dialerRemote: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHub(t)
+			a := newPeer(t, h, WithConnectionGater(&tc.dialer))
+			b := newPeer(t, h, WithConnectionGater(&tc.listener))
+			var aLog, bLog closeLog
+			a.Notify(aLog.notifiee())
+			b.Notify(bLog.notifiee())
+
+			_, err := a.DialPeer(context.Background(), b.LocalPeer())
+			var cerr *netx.ConnClosedError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("expected a ConnClosedError, got %v", err)
+			}
+			if cerr.Reason != reason || cerr.Remote != tc.dialerRemote {
+				t.Fatalf("unexpected close info: %+v", cerr.CloseInfo)
+			}
+			if len(a.Conns()) != 0 || len(b.Conns()) != 0 {
+				t.Fatal("expected the connection to be closed")
+			}
+
+			for _, side := range []struct {
+				name   string
+				log    *closeLog
+				remote bool
+			}{
+				{"dialer", &aLog, tc.dialerRemote},
+				{"listener", &bLog, !tc.dialerRemote},
+			} {
+				expected := fmt.Sprint([]string{"connected", fmt.Sprintf("disconnected reason=%d remote=%t", reason, side.remote)})
+				waitFor(t, func() bool { return fmt.Sprint(side.log.Events()) == expected })
+			}
+		})
+	}
+}
+
+func TestResourceManager(t *testing.T) {
+	limits := rcmgr.Limits{
+		System:               rcmgr.Unlimited,
+		Transient:            rcmgr.Unlimited,
+		ServiceDefault:       rcmgr.Unlimited,
+		ProtocolDefault:      rcmgr.Unlimited,
+		PeerDefault:          rcmgr.Unlimited,
+		AllowlistedSystem:    rcmgr.Unlimited,
+		AllowlistedTransient: rcmgr.Unlimited,
+		Conn:                 rcmgr.Unlimited,
+		Stream:               rcmgr.Unlimited,
+	}
+	limits.PeerDefault.StreamsOutbound = 1
+	rm, err := rcmgr.NewResourceManager(limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Close()
+
+	h := newHub(t)
+	a := newPeer(t, h, WithResourceManager(rm))
+	b := newPeer(t, h)
+	b.SetStreamHandler(echo)
+
+	ctx := context.Background()
+	s, err := a.NewStream(ctx, b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+	if _, err := a.NewStream(ctx, b.LocalPeer()); err == nil {
+		t.Fatal("expected the second stream to exceed the peer limit")
+	}
+
+	var stat network.ScopeStat
+	rm.ViewPeer(b.LocalPeer(), func(s network.PeerScope) error {
+		stat = s.Stat()
+		return nil
+	})
+	if stat.NumConnsOutbound != 1 || stat.NumStreamsOutbound != 1 {
+		t.Fatalf("unexpected peer scope usage: %+v", stat)
+	}
+
+	a.ClosePeer(b.LocalPeer())
+	rm.ViewPeer(b.LocalPeer(), func(s network.PeerScope) error {
+		stat = s.Stat()
+		return nil
+	})
+	if stat.NumConnsOutbound != 0 || stat.NumStreamsOutbound != 0 {
+		t.Fatalf("expected the peer scope to be released, got %+v", stat)
+	}
+}
+
+func TestRemoveConnKeepsOrder(t *testing.T) {
+	n := newPeer(t, newHub(t))
+	p := peer.ID("remote")
+	cs := make([]*conn, 4)
+	for i := range cs {
+		cs[i] = &conn{remote: p}
+		if err := n.addConn(cs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// removing the oldest connection must not move the newest one
+	if !n.removeConn(cs[0]) {
+		t.Fatal("expected the connection to be removed")
+	}
+	if c := n.bestConn(p); c != cs[3] {
+		t.Fatal("expected the newest connection to be preferred")
+	}
+	n.removeConn(cs[2])
+	n.mu.RLock()
+	remaining := append([]*conn(nil), n.conns[p]...)
+	n.mu.RUnlock()
+	if len(remaining) != 2 || remaining[0] != cs[1] || remaining[1] != cs[3] {
+		t.Fatal("expected the remaining connections to stay ordered by age")
+	}
+
+	n.removeConn(cs[3])
+	if c := n.bestConn(p); c != cs[1] {
+		t.Fatal("expected the next newest connection to be preferred")
+	}
+	n.removeConn(cs[1])
+	if n.removeConn(cs[1]) {
+		t.Fatal("expected removing a connection twice to fail")
+	}
+	if c := n.bestConn(p); c != nil {
+		t.Fatal("expected no connection")
+	}
+}
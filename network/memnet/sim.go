@@ -0,0 +1,108 @@
+package memnet
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// SimulationEpoch is the virtual time at which every simulation starts.
+var SimulationEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Simulation runs a Hub on a scheduling virtual clock, so that hours of
+// network activity take as long as the computation they involve, and the
+// same seed always produces the same sequence of events.
+//
+// The simulation is driven from a single goroutine calling Run. Code that
+// blocks (dials, stream reads and writes, sleeps) must run in goroutines
+// started with Go or At, and must only block on memnet streams and on the
+// simulation clock: a tracked goroutine blocked on anything else stops the
+// simulation. Stream handlers and notifiees are tracked automatically.
+type Simulation struct {
+	*Hub
+
+	// Clock is the virtual clock driving the simulation. Pass it to the
+	// components under test, such as the peerstore, so that they share the
+	// simulation's notion of time.
+	Clock *clock.Virtual
+
+	rng *rand.Rand
+
+	mu     sync.Mutex
+	events []Event
+}
+
+// NewSimulation creates a simulation with an empty Hub. The seed drives the
+// peer keys, link stalls, and Rand.
+func NewSimulation(seed int64) (*Simulation, error) {
+	s := &Simulation{
+		Clock: clock.NewScheduled(SimulationEpoch),
+		rng:   rand.New(rand.NewSource(seed)),
+	}
+	h, err := NewHub(seed, WithClock(s.Clock), WithTracer(s.record))
+	if err != nil {
+		return nil, err
+	}
+	s.Hub = h
+	return s, nil
+}
+
+func (s *Simulation) record(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+}
+
+// NewPeer adds a peer with a key derived from the simulation seed.
+func (s *Simulation) NewPeer(ps peerstore.Peerstore, opts ...Option) (*Network, error) {
+	sk, _, err := ic.GenerateEd25519Key(s.rng)
+	if err != nil {
+		return nil, err
+	}
+	return s.AddPeer(sk, ps, opts...)
+}
+
+// Go runs f in a tracked goroutine, starting on the next call to Run.
+func (s *Simulation) Go(f func()) {
+	s.Clock.Go(f)
+}
+
+// At runs f in a tracked goroutine once d of virtual time has passed.
+func (s *Simulation) At(d time.Duration, f func()) {
+	s.Clock.AfterFunc(d, func() { s.Clock.Go(f) })
+}
+
+// Run advances the simulation by d. It returns once all goroutines due to
+// run by then are blocked or done.
+func (s *Simulation) Run(d time.Duration) {
+	s.Clock.Advance(d)
+}
+
+// Now returns the current virtual time.
+func (s *Simulation) Now() time.Time {
+	return s.Clock.Now()
+}
+
+// Elapsed returns the virtual time elapsed since the start of the simulation.
+func (s *Simulation) Elapsed() time.Duration {
+	return s.Clock.Since(SimulationEpoch)
+}
+
+// Rand returns the simulation's source of randomness. It must only be used
+// from the driving goroutine and tracked goroutines.
+func (s *Simulation) Rand() *rand.Rand {
+	return s.rng
+}
+
+// Events returns the connection and stream events recorded so far, in the
+// order in which they happened.
+func (s *Simulation) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
@@ -0,0 +1,112 @@
+package memnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// simulate runs a few peers exchanging data over lossy links, and returns
+// the events of the simulation.
+func simulate(t *testing.T, seed int64) []string {
+	sim, err := NewSimulation(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.SetLinkDefaults(LinkOptions{
+		Latency:          20 * time.Millisecond,
+		Bandwidth:        1 << 20,
+		StallProbability: 0.1,
+		StallDuration:    200 * time.Millisecond,
+	})
+
+	const peers = 4
+	nets := make([]*Network, peers)
+	for i := range nets {
+		nets[i] = newSimPeer(t, sim)
+		nets[i].SetStreamHandler(echo)
+	}
+	for i, n := range nets {
+		for j, m := range nets {
+			if i == j {
+				continue
+			}
+			n, m := n, m
+			start := time.Duration(sim.Rand().Intn(1000)) * time.Millisecond
+			size := 1 + sim.Rand().Intn(64<<10)
+			reset := sim.Rand().Intn(4) == 0
+			sim.At(start, func() {
+				s, err := n.NewStream(context.Background(), m.LocalPeer())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := s.Write(make([]byte, size)); err != nil {
+					t.Error(err)
+					return
+				}
+				if reset {
+					s.Reset()
+					return
+				}
+				s.CloseWrite()
+				io.Copy(io.Discard, s)
+				s.Close()
+			})
+		}
+	}
+	sim.Run(time.Minute)
+
+	var out []string
+	for _, ev := range sim.Events() {
+		out = append(out, ev.String())
+	}
+	return out
+}
+
+func TestSimulationDeterminism(t *testing.T) {
+	first := simulate(t, 42)
+	if len(first) == 0 {
+		t.Fatal("expected events")
+	}
+	for i := 0; i < 3; i++ {
+		again := simulate(t, 42)
+		if len(again) != len(first) {
+			t.Fatalf("expected %d events, got %d", len(first), len(again))
+		}
+		for j := range first {
+			if first[j] != again[j] {
+				t.Fatalf("event %d differs:\n%s\n%s", j, first[j], again[j])
+			}
+		}
+	}
+}
+
+func TestSimulationTracesEvents(t *testing.T) {
+	sim, err := NewSimulation(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := newSimPeer(t, sim), newSimPeer(t, sim)
+	b.SetStreamHandler(func(s network.Stream) { s.Reset() })
+
+	sim.Go(func() {
+		if _, err := a.NewStream(context.Background(), b.LocalPeer()); err != nil {
+			t.Error(err)
+		}
+	})
+	sim.Run(time.Second)
+
+	var kinds []string
+	for _, ev := range sim.Events() {
+		kinds = append(kinds, fmt.Sprintf("%s:%t", ev.Kind, ev.Local == a.LocalPeer()))
+	}
+	expected := []string{"ConnOpened:true", "ConnOpened:false", "StreamOpened:true", "StreamAccepted:false", "StreamReset:false", "StreamReset:true"}
+	if fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		t.Fatalf("expected events %v, got %v", expected, kinds)
+	}
+}
@@ -0,0 +1,574 @@
+package memnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	netx "github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// maxSegment is the largest chunk of a write accounted on a link at once, so
+// that streams sharing a link interleave.
+const maxSegment = 16 << 10
+
+// receiveWindow is the amount of data sent on a stream, and not yet read by
+// the remote side, beyond which writes block, like the flow control window of
+// a stream multiplexer.
+const receiveWindow = 256 << 10
+
+var (
+	errWriteClosed  = errors.New("write on closed stream")
+	errReadClosed   = errors.New("read on closed stream")
+	errStreamClosed = errors.New("stream closed")
+)
+
+type stream struct {
+	// bytesIn and bytesOut count the data received and sent. They are
+	// accessed atomically, and come first to be 64-bit aligned.
+	bytesIn  int64
+	bytesOut int64
+
+	id     string
+	seq    uint64
+	conn   *conn
+	stat   network.Stats
+	remote *stream
+
+	// rd carries incoming data; the remote stream writes into it.
+	rd *pipe
+	// wr wakes writers waiting for their data to be sent.
+	wr *clock.Waker
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	mu          sync.Mutex
+	scope       network.StreamManagementScope
+	proto       protocol.ID
+	protoAt     time.Time
+	writeClosed bool
+	reset       bool
+	done        bool
+	// observed is set once the stream has been reported to the stream
+	// observers, and remoteClosed once its remote half close has been.
+	observed     bool
+	remoteClosed bool
+}
+
+var _ network.Stream = (*stream)(nil)
+
+// newStreamPair creates both ends of a stream opened by c.
+func newStreamPair(c *conn, scope network.StreamManagementScope, sid uint64) (local, remote *stream) {
+	clk := c.net.hub.clk
+	now := clk.Now()
+	local = newStream(c, sid, network.Stats{Direction: network.DirOutbound, Opened: now})
+	local.scope = scope
+	remote = newStream(c.remoteConn, sid, network.Stats{Direction: network.DirInbound, Opened: now})
+	local.remote, remote.remote = remote, local
+	local.rd = newPipe(local, c.remoteConn.out, local.readDeadline.waker)
+	remote.rd = newPipe(remote, c.out, remote.readDeadline.waker)
+	return local, remote
+}
+
+func newStream(c *conn, sid uint64, stat network.Stats) *stream {
+	clk := c.net.hub.clk
+	wr := clock.NewWaker(clk)
+	return &stream{
+		id:            fmt.Sprintf("%s-%d", c.ID(), sid),
+		seq:           sid,
+		conn:          c,
+		stat:          stat,
+		wr:            wr,
+		readDeadline:  makeDeadline(clk, clock.NewWaker(clk)),
+		writeDeadline: makeDeadline(clk, wr),
+	}
+}
+
+func (s *stream) ID() string {
+	return s.id
+}
+
+func (s *stream) Conn() network.Conn {
+	return s.conn
+}
+
+func (s *stream) Stat() network.Stats {
+	return s.stat
+}
+
+func (s *stream) Scope() network.StreamScope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scope == nil {
+		return network.NullScope
+	}
+	return s.scope
+}
+
+func (s *stream) Protocol() protocol.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proto
+}
+
+func (s *stream) SetProtocol(id protocol.ID) error {
+	s.mu.Lock()
+	if s.scope != nil {
+		if err := s.scope.SetProtocol(id); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.proto = id
+	if s.protoAt.IsZero() {
+		s.protoAt = s.conn.net.hub.clk.Now()
+	}
+	observed := s.observed && !s.done
+	s.mu.Unlock()
+
+	if observed {
+		s.conn.net.observe(func(o netx.StreamObserver) { o.StreamProtocol(s.conn.net, s, id) })
+	}
+	return nil
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	return s.rd.read(b, &s.readDeadline)
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	clk := s.conn.net.hub.clk
+	written := 0
+	for len(b) > 0 {
+		if err := s.waitWindow(); err != nil {
+			return written, err
+		}
+
+		chunk := b
+		if len(chunk) > maxSegment {
+			chunk = chunk[:maxSegment]
+		}
+		sent := s.remote.rd.push(chunk)
+		written += len(chunk)
+		atomic.AddInt64(&s.bytesOut, int64(len(chunk)))
+		atomic.AddInt64(&s.conn.bytesOut, int64(len(chunk)))
+		b = b[len(chunk):]
+
+		// block until the chunk has left the send buffer
+		for {
+			tok := s.wr.Arm()
+			wait := clk.Until(sent)
+			if wait <= 0 {
+				break
+			}
+			if s.writeDeadline.expired() {
+				return written, os.ErrDeadlineExceeded
+			}
+			t := clk.AfterFunc(wait, s.wr.Wake)
+			s.wr.Wait(tok, nil)
+			t.Stop()
+		}
+	}
+	return written, nil
+}
+
+// waitWindow waits until the remote side has read enough of the data sent
+// to open the receive window again.
+func (s *stream) waitWindow() error {
+	for {
+		tok := s.wr.Arm()
+		s.mu.Lock()
+		reset, closed := s.reset, s.writeClosed
+		s.mu.Unlock()
+		switch {
+		case reset:
+			return network.ErrReset
+		case closed:
+			return errWriteClosed
+		case s.writeDeadline.expired():
+			return os.ErrDeadlineExceeded
+		}
+		if s.remote.rd.buffered() < receiveWindow {
+			return nil
+		}
+		s.wr.Wait(tok, nil)
+	}
+}
+
+func (s *stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.reset {
+		s.mu.Unlock()
+		return network.ErrReset
+	}
+	if s.writeClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	observed := s.observed
+	s.mu.Unlock()
+
+	if observed {
+		s.conn.net.observe(func(o netx.StreamObserver) { o.StreamHalfClosed(s.conn.net, s, network.DirOutbound) })
+	}
+	s.remote.rd.pushEOF()
+	s.maybeDone()
+	return nil
+}
+
+func (s *stream) CloseRead() error {
+	s.rd.closeRead()
+	s.maybeDone()
+	return nil
+}
+
+func (s *stream) Close() error {
+	err := s.CloseWrite()
+	s.CloseRead()
+	return err
+}
+
+// Reset aborts both directions of the stream, on both sides.
+func (s *stream) Reset() error {
+	s.resetLocal()
+	s.remote.resetLocal()
+	return nil
+}
+
+func (s *stream) resetLocal() {
+	s.mu.Lock()
+	s.reset = true
+	s.mu.Unlock()
+	s.rd.setReset()
+	s.maybeDone()
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// maybeDone releases the stream once both directions are finished.
+func (s *stream) maybeDone() {
+	s.mu.Lock()
+	if s.done || !(s.reset || (s.writeClosed && s.rd.finished())) {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	scope := s.scope
+	kind := StreamClosed
+	if s.reset {
+		kind = StreamReset
+	}
+	observed := s.observed
+	var negotiation time.Duration
+	if !s.protoAt.IsZero() {
+		negotiation = s.protoAt.Sub(s.stat.Opened)
+	}
+	s.mu.Unlock()
+
+	if scope != nil {
+		scope.Done()
+	}
+	s.conn.removeStream(s)
+	s.conn.trace(kind, s.id)
+
+	if !observed {
+		return
+	}
+	sum := netx.StreamSummary{
+		BytesIn:     atomic.LoadInt64(&s.bytesIn),
+		BytesOut:    atomic.LoadInt64(&s.bytesOut),
+		Negotiation: negotiation,
+		Duration:    s.conn.net.hub.clk.Since(s.stat.Opened),
+	}
+	n := s.conn.net
+	if kind == StreamReset {
+		n.observe(func(o netx.StreamObserver) { o.StreamReset(n, s, sum) })
+	} else {
+		n.observe(func(o netx.StreamObserver) { o.StreamClosed(n, s, sum) })
+	}
+}
+
+// opened reports the stream to the stream observers, once it has been opened
+// or accepted.
+func (s *stream) opened() {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.observed = true
+	s.mu.Unlock()
+
+	n := s.conn.net
+	n.observe(func(o netx.StreamObserver) { o.StreamOpened(n, s) })
+	if s.rd.eofPushed() {
+		s.reportRemoteClose()
+	}
+}
+
+// reportRemoteClose reports the half close of the stream by the remote side,
+// once the stream has been reported as opened.
+func (s *stream) reportRemoteClose() {
+	s.mu.Lock()
+	if !s.observed || s.remoteClosed || s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.remoteClosed = true
+	s.mu.Unlock()
+
+	n := s.conn.net
+	n.observe(func(o netx.StreamObserver) { o.StreamHalfClosed(n, s, network.DirInbound) })
+}
+
+// accept attaches the stream scope of an inbound stream. It fails if the
+// stream was reset before being accepted.
+func (s *stream) accept(scope network.StreamManagementScope) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return false
+	}
+	s.scope = scope
+	return true
+}
+
+type segment struct {
+	data []byte
+	at   time.Time
+}
+
+// pipe holds the data in flight towards a stream.
+type pipe struct {
+	owner *stream
+	link  *link
+	// waker wakes the reader when the state of the pipe changes.
+	waker *clock.Waker
+
+	mu         sync.Mutex
+	segs       []segment
+	size       int
+	eof        bool
+	eofAt      time.Time
+	reset      bool
+	readClosed bool
+}
+
+func newPipe(owner *stream, l *link, w *clock.Waker) *pipe {
+	return &pipe{owner: owner, link: l, waker: w}
+}
+
+func (p *pipe) notify() {
+	p.waker.Wake()
+}
+
+// notifyWriter wakes the remote writer, waiting for the receive window to
+// open.
+func (p *pipe) notifyWriter() {
+	p.owner.remote.wr.Wake()
+}
+
+func (p *pipe) clock() clock.Clock {
+	return p.owner.conn.net.hub.clk
+}
+
+// push schedules b for delivery, and returns the time at which it has been
+// sent out.
+func (p *pipe) push(b []byte) time.Time {
+	sent, delivered := p.link.schedule(p.clock().Now(), len(b))
+	p.mu.Lock()
+	if !p.reset && !p.readClosed {
+		p.segs = append(p.segs, segment{data: append([]byte(nil), b...), at: delivered})
+		p.size += len(b)
+		atomic.AddInt64(&p.owner.bytesIn, int64(len(b)))
+		atomic.AddInt64(&p.owner.conn.bytesIn, int64(len(b)))
+	}
+	p.mu.Unlock()
+	p.notify()
+	return sent
+}
+
+func (p *pipe) pushEOF() {
+	_, delivered := p.link.schedule(p.clock().Now(), 0)
+	p.mu.Lock()
+	p.eof = true
+	p.eofAt = delivered
+	p.mu.Unlock()
+	p.notify()
+	p.owner.reportRemoteClose()
+	p.owner.maybeDone()
+}
+
+func (p *pipe) eofPushed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.eof
+}
+
+func (p *pipe) setReset() {
+	p.mu.Lock()
+	p.reset = true
+	p.segs, p.size = nil, 0
+	p.mu.Unlock()
+	p.notify()
+	p.notifyWriter()
+}
+
+func (p *pipe) closeRead() {
+	p.mu.Lock()
+	p.readClosed = true
+	p.segs, p.size = nil, 0
+	p.mu.Unlock()
+	p.notify()
+	p.notifyWriter()
+}
+
+// buffered returns the amount of data sent to the pipe and not yet read.
+func (p *pipe) buffered() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// finished returns true if no more data will be read from the pipe.
+func (p *pipe) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.readClosed || p.eof
+}
+
+func (p *pipe) read(b []byte, dl *deadline) (int, error) {
+	clk := p.clock()
+	for {
+		tok := p.waker.Arm()
+		blocked := p.link.blocked(p.waker)
+
+		p.mu.Lock()
+		switch {
+		case p.reset:
+			p.mu.Unlock()
+			return 0, network.ErrReset
+		case p.readClosed:
+			p.mu.Unlock()
+			return 0, errReadClosed
+		case dl.expired():
+			p.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		var next time.Time
+		if !blocked {
+			now := clk.Now()
+			switch {
+			case len(p.segs) > 0:
+				next = p.segs[0].at
+				if !next.After(now) {
+					n := copy(b, p.segs[0].data)
+					if n == len(p.segs[0].data) {
+						p.segs[0] = segment{}
+						p.segs = p.segs[1:]
+					} else {
+						p.segs[0].data = p.segs[0].data[n:]
+					}
+					p.size -= n
+					p.mu.Unlock()
+					p.notifyWriter()
+					return n, nil
+				}
+			case p.eof:
+				next = p.eofAt
+				if !next.After(now) {
+					p.mu.Unlock()
+					return 0, io.EOF
+				}
+			}
+		}
+		p.mu.Unlock()
+
+		var t clock.Timer
+		if !next.IsZero() {
+			t = clk.AfterFunc(clk.Until(next), p.waker.Wake)
+		}
+		p.waker.Wait(tok, nil)
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// deadline tracks a read or write deadline on the hub clock, and wakes the
+// waiting side when it passes.
+type deadline struct {
+	clk   clock.Clock
+	waker *clock.Waker
+
+	mu     sync.Mutex
+	timer  clock.Timer
+	gen    uint64
+	passed bool
+}
+
+func makeDeadline(clk clock.Clock, w *clock.Waker) deadline {
+	return deadline{clk: clk, waker: w}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.gen++
+	d.passed = false
+	if !t.IsZero() {
+		if dur := d.clk.Until(t); dur > 0 {
+			gen := d.gen
+			d.timer = d.clk.AfterFunc(dur, func() { d.expire(gen) })
+		} else {
+			d.passed = true
+		}
+	}
+	d.mu.Unlock()
+	d.waker.Wake()
+}
+
+func (d *deadline) expire(gen uint64) {
+	d.mu.Lock()
+	if gen != d.gen {
+		// the deadline was changed in the meantime
+		d.mu.Unlock()
+		return
+	}
+	d.passed = true
+	d.mu.Unlock()
+	d.waker.Wake()
+}
+
+func (d *deadline) expired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.passed
+}
@@ -0,0 +1,171 @@
+// Package muxtest provides a conformance suite and benchmarks for
+// network.Multiplexer implementations, to be run from the test files of the
+// implementations:
+//
+//	func TestConformance(t *testing.T) {
+//		muxtest.TestMultiplexer(t, DefaultTransport)
+//	}
+package muxtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// bulkChunk is the size of the writes of the bulk streams.
+const bulkChunk = 64 << 10
+
+// pingSize is the size of the messages exchanged on the control stream.
+const pingSize = 8
+
+// BenchmarkControlLatency measures the round trip time of small messages on
+// a control stream, while bulk streams of the same connection saturate it.
+// Every combination of the following is run as a sub-benchmark:
+//
+//   - "pipe" runs m over net.Pipe, "tcp" over TCP loopback;
+//   - "bulk=1" saturates the connection with one bulk stream, "bulk=8"
+//     with eight;
+//   - "unscheduled" uses m as is, "scheduled" wraps the client side in
+//     network.NewScheduledConn, with the control stream in
+//     network.PriorityControl and the bulk streams in network.PriorityBulk.
+//
+// The time per operation is the round trip time of one message.
+//
+// The scheduler orders the writes waiting to be handed to the multiplexer,
+// so the control stream gains when several bulk streams contend for it.
+// With mplex and 8 bulk streams, scheduling takes the round trip from about
+// 85µs to 40-70µs over net.Pipe, and from about 20ms to 12ms over TCP. It
+// cannot reorder the data already handed to the multiplexer or to the
+// kernel, which dominates the round trip over TCP, whose socket buffers are
+// autotuned up to several MiB. With a single bulk stream, there is nothing
+// to reorder: both variants measure about 35µs over net.Pipe, and 11 to
+// 16ms over TCP.
+func BenchmarkControlLatency(b *testing.B, m network.Multiplexer, opts ...network.SchedulerOption) {
+	for _, pair := range []struct {
+		name string
+		pair netPair
+	}{{"pipe", pipePair}, {"tcp", tcpPair}} {
+		for _, bulk := range []int{1, 8} {
+			for _, scheduled := range []bool{false, true} {
+				name := fmt.Sprintf("%s/bulk=%d/unscheduled", pair.name, bulk)
+				if scheduled {
+					name = fmt.Sprintf("%s/bulk=%d/scheduled", pair.name, bulk)
+				}
+				pair, bulk, scheduled := pair.pair, bulk, scheduled
+				b.Run(name, func(b *testing.B) {
+					benchmarkControlLatency(b, m, pair, bulk, scheduled, opts)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkControlLatency(b *testing.B, m network.Multiplexer, pair netPair, bulkStreams int, scheduled bool, opts []network.SchedulerOption) {
+	client, server := newMuxPair(b, m, pair)
+	defer client.Close()
+	defer server.Close()
+	if scheduled {
+		sc, err := network.NewScheduledConn(client, opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		client = sc
+	}
+
+	// the server discards the bulk stream, and echoes the control stream
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				var kind [1]byte
+				if _, err := io.ReadFull(s, kind[:]); err != nil {
+					return
+				}
+				if kind[0] == 'b' {
+					io.Copy(io.Discard, s)
+					return
+				}
+				io.Copy(s, s)
+			}()
+		}
+	}()
+
+	ctrl := openStream(b, client, 'c', network.PriorityControl)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	bulks := make([]network.MuxedStream, bulkStreams)
+	for i := range bulks {
+		bulk := openStream(b, client, 'b', network.PriorityBulk)
+		bulks[i] = bulk
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bulkChunk)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := bulk.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(done)
+		for _, bulk := range bulks {
+			bulk.Reset()
+		}
+		wg.Wait()
+	}()
+
+	ping := make([]byte, pingSize)
+	pong := make([]byte, pingSize)
+	// let the bulk stream fill the connection
+	if _, err := ctrl.Write(ping); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := io.ReadFull(ctrl, pong); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ctrl.Write(ping); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(ctrl, pong); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	ctrl.Close()
+}
+
+func openStream(b *testing.B, c network.MuxedConn, kind byte, class network.PriorityClass) network.MuxedStream {
+	s, err := c.OpenStream(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if ps, ok := network.GetPrioritizedStream(s); ok {
+		if err := ps.SetPriority(network.Priority{Class: class}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := s.Write([]byte{kind}); err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
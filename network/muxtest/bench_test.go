@@ -0,0 +1,13 @@
+package muxtest_test
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network/muxtest"
+
+	"github.com/libp2p/go-libp2p/p2p/muxer/mplex"
+)
+
+func BenchmarkMplexControlLatency(b *testing.B) {
+	muxtest.BenchmarkControlLatency(b, mplex.DefaultTransport)
+}
@@ -0,0 +1,83 @@
+package muxtest_test
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network/muxtest"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/muxer/mplex"
+	"github.com/libp2p/go-yamux/v4"
+)
+
+func TestMplex(t *testing.T) {
+	muxtest.TestMultiplexer(t, mplex.DefaultTransport)
+}
+
+func TestYamux(t *testing.T) {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	config.MaxIncomingStreams = math.MaxUint32
+	muxtest.TestMultiplexer(t, (*yamuxTransport)(config))
+}
+
+// yamuxTransport adapts go-yamux/v4 to network.Multiplexer, as
+// go-libp2p/p2p/muxer/yamux does for go-yamux/v3.
+type yamuxTransport yamux.Config
+
+func (t *yamuxTransport) NewConn(nc net.Conn, isServer bool, scope network.PeerScope) (network.MuxedConn, error) {
+	mm := func() (yamux.MemoryManager, error) { return scope.BeginSpan() }
+	newSession := yamux.Client
+	if isServer {
+		newSession = yamux.Server
+	}
+	s, err := newSession(nc, (*yamux.Config)(t), mm)
+	if err != nil {
+		return nil, err
+	}
+	return yamuxConn{s}, nil
+}
+
+type yamuxConn struct {
+	*yamux.Session
+}
+
+func (c yamuxConn) OpenStream(ctx context.Context) (network.MuxedStream, error) {
+	s, err := c.Session.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{s}, nil
+}
+
+func (c yamuxConn) AcceptStream() (network.MuxedStream, error) {
+	s, err := c.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{s}, nil
+}
+
+type yamuxStream struct {
+	*yamux.Stream
+}
+
+func (s yamuxStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err == yamux.ErrStreamReset {
+		err = network.ErrReset
+	}
+	return n, err
+}
+
+func (s yamuxStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if err == yamux.ErrStreamReset {
+		err = network.ErrReset
+	}
+	return n, err
+}
@@ -0,0 +1,891 @@
+package muxtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	corenet "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// testTimeout bounds the duration of every test of the suite: a multiplexer
+// that deadlocks makes the test binary panic rather than hang.
+const testTimeout = 2 * time.Minute
+
+// backpressureBytes is the amount of data a stream whose remote does not
+// read must not be able to buffer.
+const backpressureBytes = 64 << 20
+
+var tests = []struct {
+	name string
+	f    func(t *testing.T, m network.Multiplexer, pair netPair)
+}{
+	{"ReadWrite", testReadWrite},
+	{"Ordering", testOrdering},
+	{"CloseWrite", testCloseWrite},
+	{"CloseRead", testCloseRead},
+	{"Close", testClose},
+	{"Reset", testReset},
+	{"ReadDeadline", testReadDeadline},
+	{"WriteDeadline", testWriteDeadline},
+	{"Backpressure", testBackpressure},
+	{"AcceptBacklog", testAcceptBacklog},
+	{"ConcurrentStreams", testConcurrentStreams},
+	{"Stress", testStress},
+	{"ConnClose", testConnClose},
+	{"ScopeRelease", testScopeRelease},
+}
+
+// TestMultiplexer runs the conformance suite against the connections created
+// by m, over net.Pipe and over TCP loopback.
+func TestMultiplexer(t *testing.T, m network.Multiplexer) {
+	for _, p := range []struct {
+		name string
+		pair netPair
+	}{
+		{"pipe", pipePair},
+		{"tcp", tcpPair},
+	} {
+		p := p
+		t.Run(p.name, func(t *testing.T) {
+			for _, tc := range tests {
+				tc := tc
+				t.Run(tc.name, func(t *testing.T) {
+					watchdog := time.AfterFunc(testTimeout, func() {
+						panic(fmt.Sprintf("%s timed out after %s", t.Name(), testTimeout))
+					})
+					defer watchdog.Stop()
+					tc.f(t, m, p.pair)
+				})
+			}
+		})
+	}
+}
+
+// netPair creates a pair of connected net.Conns.
+type netPair func(tb testing.TB) (client, server net.Conn)
+
+func pipePair(tb testing.TB) (client, server net.Conn) {
+	return net.Pipe()
+}
+
+func tcpPair(tb testing.TB) (client, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		tb.Fatal("failed to accept connection")
+	}
+	return client, server
+}
+
+// muxPair creates a client and a server MuxedConn over the connections
+// created by pair, accounted in the given scopes. The connections are closed
+// at the end of the test.
+func muxPair(tb testing.TB, m network.Multiplexer, pair netPair, clientScope, serverScope network.PeerScope) (client, server network.MuxedConn) {
+	cc, sc := pair(tb)
+
+	type result struct {
+		c   network.MuxedConn
+		err error
+	}
+	serverRes := make(chan result, 1)
+	go func() {
+		c, err := m.NewConn(sc, true, serverScope)
+		serverRes <- result{c, err}
+	}()
+	client, err := m.NewConn(cc, false, clientScope)
+	if err != nil {
+		sc.Close()
+		tb.Fatal(err)
+	}
+	res := <-serverRes
+	if res.err != nil {
+		client.Close()
+		tb.Fatal(res.err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		res.c.Close()
+	})
+	return client, res.c
+}
+
+func newMuxPair(tb testing.TB, m network.Multiplexer, pair netPair) (client, server network.MuxedConn) {
+	return muxPair(tb, m, pair, corenet.NullScope, corenet.NullScope)
+}
+
+// serveEcho echoes the streams accepted by c, until c is closed.
+func serveEcho(c network.MuxedConn) {
+	for {
+		s, err := c.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer s.Close()
+			io.Copy(s, s)
+		}()
+	}
+}
+
+func mustOpenStream(tb testing.TB, c network.MuxedConn) network.MuxedStream {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := c.OpenStream(ctx)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return s
+}
+
+// openAccept opens a stream on client, and accepts it on server. Multiplexers
+// may only announce streams once written to: a byte is written and read.
+func openAccept(tb testing.TB, client, server network.MuxedConn) (network.MuxedStream, network.MuxedStream) {
+	cs := mustOpenStream(tb, client)
+	if _, err := cs.Write([]byte{0}); err != nil {
+		tb.Fatal(err)
+	}
+	ss, err := server.AcceptStream()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(ss, b[:]); err != nil {
+		tb.Fatal(err)
+	}
+	return cs, ss
+}
+
+func randBytes(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rng.Read(b)
+	return b
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+// readAll reads s until EOF, or fails the test after d.
+func readAll(tb testing.TB, s network.MuxedStream, d time.Duration) []byte {
+	s.SetReadDeadline(time.Now().Add(d))
+	b, err := io.ReadAll(s)
+	if err != nil {
+		tb.Fatalf("failed to read until EOF: %s", err)
+	}
+	s.SetReadDeadline(time.Time{})
+	return b
+}
+
+func testReadWrite(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	go serveEcho(server)
+
+	s := mustOpenStream(t, client)
+	msg := randBytes(rand.New(rand.NewSource(1)), 100<<10)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Write(msg)
+		errc <- err
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("echoed data differs from the written data")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testOrdering writes numbered messages of random sizes on a few streams
+// concurrently, and checks that each stream delivers them in order.
+func testOrdering(t *testing.T, m network.Multiplexer, pair netPair) {
+	const (
+		streams  = 4
+		messages = 500
+	)
+	client, server := newMuxPair(t, m, pair)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*streams)
+	for i := 0; i < streams; i++ {
+		cs, ss := openAccept(t, client, server)
+		wg.Add(2)
+		go func(seed int64) {
+			defer wg.Done()
+			defer cs.Close()
+			rng := rand.New(rand.NewSource(seed))
+			for n := uint32(0); n < messages; n++ {
+				msg := make([]byte, 8+rng.Intn(2048))
+				binary.BigEndian.PutUint32(msg, n)
+				binary.BigEndian.PutUint32(msg[4:], uint32(len(msg)))
+				if _, err := cs.Write(msg); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(int64(i))
+		go func() {
+			defer wg.Done()
+			var hdr [8]byte
+			for n := uint32(0); n < messages; n++ {
+				if _, err := io.ReadFull(ss, hdr[:]); err != nil {
+					errs <- err
+					return
+				}
+				if got := binary.BigEndian.Uint32(hdr[:]); got != n {
+					errs <- fmt.Errorf("received message %d, expected %d", got, n)
+					return
+				}
+				if _, err := io.CopyN(io.Discard, ss, int64(binary.BigEndian.Uint32(hdr[4:])-8)); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if _, err := ss.Read(hdr[:]); err != io.EOF {
+				errs <- fmt.Errorf("expected EOF after the last message, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// testCloseWrite checks that a stream closed for writing still reads, and
+// that its remote reads EOF and can still write.
+func testCloseWrite(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	cs, ss := openAccept(t, client, server)
+
+	if _, err := cs.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Write([]byte("x")); err == nil {
+		t.Error("write succeeded after CloseWrite")
+	}
+	if got := readAll(t, ss, 5*time.Second); string(got) != "request" {
+		t.Fatalf("received %q, expected %q", got, "request")
+	}
+
+	if _, err := ss.Write([]byte("response")); err != nil {
+		t.Fatalf("remote failed to write after CloseWrite: %s", err)
+	}
+	if err := ss.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, cs, 5*time.Second); string(got) != "response" {
+		t.Fatalf("received %q, expected %q", got, "response")
+	}
+	cs.Close()
+	ss.Close()
+}
+
+// testCloseRead checks that a stream closed for reading fails to read, and
+// still writes.
+func testCloseRead(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	cs, ss := openAccept(t, client, server)
+
+	if err := cs.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	cs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cs.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("expected Read to fail after CloseRead, got %v", err)
+	}
+
+	if _, err := cs.Write([]byte("data")); err != nil {
+		t.Fatalf("failed to write after CloseRead: %s", err)
+	}
+	if err := cs.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, ss, 5*time.Second); string(got) != "data" {
+		t.Fatalf("received %q, expected %q", got, "data")
+	}
+	ss.Close()
+}
+
+// testClose checks that closing a stream on both sides delivers the data
+// written before, followed by EOF.
+func testClose(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	cs, ss := openAccept(t, client, server)
+
+	msg := randBytes(rand.New(rand.NewSource(2)), 32<<10)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cs.Write(msg)
+		if err == nil {
+			err = cs.Close()
+		}
+		errc <- err
+	}()
+	if got := readAll(t, ss, 10*time.Second); !bytes.Equal(got, msg) {
+		t.Fatalf("received %d bytes, expected the %d bytes written before Close", len(got), len(msg))
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Write([]byte("x")); err == nil {
+		t.Error("write succeeded after Close")
+	}
+}
+
+// testReset checks that resetting a stream fails the reads and writes of
+// both sides, with network.ErrReset on the remote side.
+func testReset(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	cs, ss := openAccept(t, client, server)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, ss)
+		readErr <- err
+	}()
+	if err := cs.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Write([]byte("x")); err == nil {
+		t.Error("write succeeded after Reset")
+	}
+	if _, err := cs.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("expected Read to fail after Reset, got %v", err)
+	}
+
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, network.ErrReset) {
+			t.Errorf("expected the remote Read to fail with ErrReset, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the remote Read did not fail after Reset")
+	}
+	// writes eventually fail too, once the reset is received
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := ss.Write([]byte("x")); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the remote Write did not fail after Reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ss.Close()
+}
+
+func testReadDeadline(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	cs, ss := openAccept(t, client, server)
+
+	start := time.Now()
+	if err := cs.SetReadDeadline(start.Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := cs.Read(make([]byte, 1))
+	if !isTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Read returned after %s, past its deadline", d)
+	}
+
+	// the stream remains usable once the deadline is lifted
+	if err := cs.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(cs, b[:]); err != nil {
+		t.Fatalf("failed to read after lifting the deadline: %s", err)
+	}
+	cs.Close()
+	ss.Close()
+}
+
+// testWriteDeadline checks that a write blocked on a remote that does not
+// read times out.
+func testWriteDeadline(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	cs, ss := openAccept(t, client, server)
+	defer ss.Reset()
+
+	if err := cs.SetWriteDeadline(time.Now().Add(500 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64<<10)
+	var written int
+	for written < backpressureBytes {
+		n, err := cs.Write(buf)
+		written += n
+		if err != nil {
+			if !isTimeout(err) {
+				t.Fatalf("expected a timeout, got %v", err)
+			}
+			cs.Reset()
+			return
+		}
+	}
+	t.Fatalf("wrote %d bytes to a stream whose remote does not read, without timing out", written)
+}
+
+// testBackpressure checks that writes block while the remote does not read,
+// and that all the data is delivered once it does.
+func testBackpressure(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	cs, ss := openAccept(t, client, server)
+
+	var written int64
+	var mu sync.Mutex
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64<<10)
+		for sent := 0; sent < backpressureBytes; sent += len(buf) {
+			n, err := cs.Write(buf)
+			mu.Lock()
+			written += int64(n)
+			mu.Unlock()
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- cs.CloseWrite()
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("wrote %d bytes to a stream whose remote does not read (err: %v)", backpressureBytes, err)
+	case <-time.After(time.Second):
+	}
+	mu.Lock()
+	t.Logf("%d bytes buffered before the remote reads", written)
+	mu.Unlock()
+
+	n, err := io.Copy(io.Discard, ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n != backpressureBytes {
+		t.Fatalf("received %d bytes, expected %d", n, backpressureBytes)
+	}
+	cs.Close()
+	ss.Close()
+}
+
+// testAcceptBacklog opens streams before the remote accepts any, and checks
+// they are all delivered once it does. Multiplexers must hold at least 16
+// streams waiting to be accepted. They may bound the data buffered for the
+// streams not read yet, e.g. mplex, so the data is written while the streams
+// are accepted: over net.Pipe, the writes block until the remote reads.
+func testAcceptBacklog(t *testing.T, m network.Multiplexer, pair netPair) {
+	const streams = 16
+	client, server := newMuxPair(t, m, pair)
+
+	opened := make([]network.MuxedStream, streams)
+	for i := range opened {
+		opened[i] = mustOpenStream(t, client)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		for i, s := range opened {
+			if _, err := s.Write([]byte{byte(i)}); err != nil {
+				errs <- err
+				return
+			}
+			if err := s.CloseWrite(); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	seen := make(map[byte]bool)
+	for i := 0; i < streams; i++ {
+		s, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := readAll(t, s, 10*time.Second)
+		if len(b) != 1 || seen[b[0]] {
+			t.Fatalf("unexpected stream content %v", b)
+		}
+		seen[b[0]] = true
+		s.Close()
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testConcurrentStreams opens many streams concurrently, each echoing a
+// small message.
+func testConcurrentStreams(t *testing.T, m network.Multiplexer, pair netPair) {
+	const streams = 500
+	client, server := newMuxPair(t, m, pair)
+	go serveEcho(server)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			s, err := client.OpenStream(ctx)
+			if err != nil {
+				errs <- fmt.Errorf("stream %d: %w", i, err)
+				return
+			}
+			defer s.Close()
+			msg := []byte(fmt.Sprintf("stream %d", i))
+			if _, err := s.Write(msg); err != nil {
+				errs <- fmt.Errorf("stream %d: %w", i, err)
+				return
+			}
+			if err := s.CloseWrite(); err != nil {
+				errs <- fmt.Errorf("stream %d: %w", i, err)
+				return
+			}
+			s.SetReadDeadline(time.Now().Add(30 * time.Second))
+			got, err := io.ReadAll(s)
+			if err != nil {
+				errs <- fmt.Errorf("stream %d: %w", i, err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				errs <- fmt.Errorf("stream %d: received %q, expected %q", i, got, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// testStress exchanges random messages on many streams of several
+// connections at once.
+func testStress(t *testing.T, m network.Multiplexer, pair netPair) {
+	const (
+		conns    = 4
+		streams  = 25
+		messages = 50
+		maxSize  = 8 << 10
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, conns*streams)
+	for c := 0; c < conns; c++ {
+		client, server := newMuxPair(t, m, pair)
+		go serveEcho(server)
+		for i := 0; i < streams; i++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				if err := stressStream(client, rand.New(rand.NewSource(seed)), messages, maxSize); err != nil {
+					errs <- err
+				}
+			}(int64(c*streams + i))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func stressStream(c network.MuxedConn, rng *rand.Rand, messages, maxSize int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s, err := c.OpenStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	msgs := make([][]byte, messages)
+	for i := range msgs {
+		msgs[i] = randBytes(rng, 1+rng.Intn(maxSize))
+	}
+	writeErr := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if _, err := s.Write(msg); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- s.CloseWrite()
+	}()
+	for i, msg := range msgs {
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if !bytes.Equal(buf, msg) {
+			return fmt.Errorf("message %d: echoed data differs from the written data", i)
+		}
+	}
+	return <-writeErr
+}
+
+// testConnClose checks that closing a connection fails its pending and
+// future operations, and those of the remote.
+func testConnClose(t *testing.T, m network.Multiplexer, pair netPair) {
+	client, server := newMuxPair(t, m, pair)
+	cs, ss := openAccept(t, client, server)
+
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := server.AcceptStream()
+		acceptErr <- err
+	}()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := cs.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !client.IsClosed() {
+		t.Error("IsClosed is false after Close")
+	}
+	for name, c := range map[string]chan error{"local Read": readErr, "remote AcceptStream": acceptErr} {
+		select {
+		case err := <-c:
+			if err == nil {
+				t.Errorf("%s succeeded on a closed connection", name)
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("%s did not fail after Close", name)
+		}
+	}
+	ss.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.Copy(io.Discard, ss); err == nil || isTimeout(err) {
+		t.Errorf("expected the remote stream to fail, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.OpenStream(ctx); err == nil {
+		t.Error("OpenStream succeeded on a closed connection")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !server.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the remote connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testScopeRelease checks that the memory a connection reserves in its
+// scope is released once the connection is closed, and never released twice.
+func testScopeRelease(t *testing.T, m network.Multiplexer, pair netPair) {
+	clientScope, serverScope := newScope(), newScope()
+	client, server := muxPair(t, m, pair, clientScope, serverScope)
+	go serveEcho(server)
+
+	rng := rand.New(rand.NewSource(3))
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			if err := stressStream(client, rand.New(rand.NewSource(seed)), 20, 64<<10); err != nil {
+				errs <- err
+			}
+		}(rng.Int63())
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	server.Close()
+	for name, s := range map[string]*scope{"client": clientScope, "server": serverScope} {
+		if err := s.waitReleased(10 * time.Second); err != nil {
+			t.Errorf("%s scope: %s", name, err)
+		}
+	}
+}
+
+// scope is a network.PeerScope accounting the memory reserved in it and its
+// spans.
+type scope struct {
+	mu     sync.Mutex
+	memory int64
+	err    error
+}
+
+var _ network.PeerScope = (*scope)(nil)
+
+func newScope() *scope {
+	return &scope{}
+}
+
+func (s *scope) ReserveMemory(size int, prio uint8) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size < 0 && s.err == nil {
+		s.err = fmt.Errorf("reserved a negative amount of memory: %d", size)
+	}
+	s.memory += int64(size)
+	return nil
+}
+
+func (s *scope) ReleaseMemory(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memory -= int64(size)
+	if s.memory < 0 && s.err == nil {
+		s.err = fmt.Errorf("released %d bytes more than reserved", -s.memory)
+	}
+}
+
+func (s *scope) Stat() network.ScopeStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return network.ScopeStat{Memory: s.memory}
+}
+
+func (s *scope) BeginSpan() (network.ResourceScopeSpan, error) {
+	return &span{owner: s}, nil
+}
+
+func (s *scope) Peer() peer.ID {
+	return ""
+}
+
+func (s *scope) waitReleased(d time.Duration) error {
+	deadline := time.Now().Add(d)
+	for {
+		s.mu.Lock()
+		memory, err := s.memory, s.err
+		s.mu.Unlock()
+		switch {
+		case err != nil:
+			return err
+		case memory == 0:
+			return nil
+		case time.Now().After(deadline):
+			return fmt.Errorf("%d bytes still reserved after the connection is closed", memory)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// span reserves through its owner, and releases its reservations when done.
+type span struct {
+	owner network.ResourceScope
+
+	mu     sync.Mutex
+	memory int64
+	done   bool
+}
+
+var _ network.ResourceScopeSpan = (*span)(nil)
+
+func (s *span) ReserveMemory(size int, prio uint8) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return corenet.ErrResourceScopeClosed
+	}
+	if err := s.owner.ReserveMemory(size, prio); err != nil {
+		return err
+	}
+	s.memory += int64(size)
+	return nil
+}
+
+func (s *span) ReleaseMemory(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.memory -= int64(size)
+	s.owner.ReleaseMemory(size)
+}
+
+func (s *span) Stat() network.ScopeStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return network.ScopeStat{Memory: s.memory}
+}
+
+func (s *span) BeginSpan() (network.ResourceScopeSpan, error) {
+	return &span{owner: s}, nil
+}
+
+func (s *span) Done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	s.owner.ReleaseMemory(int(s.memory))
+	s.memory = 0
+}
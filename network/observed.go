@@ -0,0 +1,266 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ObservedNetwork is a Network reporting stream events to StreamObservers.
+type ObservedNetwork interface {
+	Network
+	StreamNotifier
+}
+
+// NewObservedNetwork wraps n, so that it reports the events of its streams to
+// StreamObservers. If n already implements StreamNotifier, it is returned as
+// is.
+//
+// Only the streams opened with NewStream, and the streams passed to the
+// handler set with SetStreamHandler, are observed: the wrapper must be used
+// in place of n, e.g. by passing it to the host. The events are derived from
+// the calls made on these streams: a half close or a reset by the remote side
+// is reported once a Read or a Write returns it.
+func NewObservedNetwork(n Network, opts ...ObservedOption) ObservedNetwork {
+	if on, ok := n.(ObservedNetwork); ok {
+		return on
+	}
+	on := &observedNetwork{Network: n, clock: clock.Real}
+	for _, o := range opts {
+		o(on)
+	}
+	return on
+}
+
+// ObservedOption is a single option for NewObservedNetwork.
+type ObservedOption func(n *observedNetwork)
+
+// WithObservedClock sets the clock timing the negotiation and the duration
+// of the observed streams. Defaults to clock.Real.
+func WithObservedClock(c clock.Clock) ObservedOption {
+	return func(n *observedNetwork) {
+		n.clock = c
+	}
+}
+
+type observedNetwork struct {
+	Network
+	clock clock.Clock
+
+	mu        sync.RWMutex
+	observers []StreamObserver
+}
+
+func (n *observedNetwork) NotifyStreams(o StreamObserver) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, other := range n.observers {
+		if other == o {
+			return
+		}
+	}
+	n.observers = append(n.observers, o)
+}
+
+func (n *observedNetwork) StopNotifyStreams(o StreamObserver) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, other := range n.observers {
+		if other == o {
+			n.observers = append(n.observers[:i:i], n.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *observedNetwork) observe(notify func(StreamObserver)) {
+	n.mu.RLock()
+	obs := n.observers
+	n.mu.RUnlock()
+	for _, o := range obs {
+		notify(o)
+	}
+}
+
+func (n *observedNetwork) NewStream(ctx context.Context, p peer.ID) (Stream, error) {
+	s, err := n.Network.NewStream(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return n.newStream(s), nil
+}
+
+func (n *observedNetwork) SetStreamHandler(h StreamHandler) {
+	if h == nil {
+		n.Network.SetStreamHandler(nil)
+		return
+	}
+	n.Network.SetStreamHandler(func(s Stream) {
+		h(n.newStream(s))
+	})
+}
+
+func (n *observedNetwork) newStream(s Stream) *observedStream {
+	obs := &observedStream{Stream: s, n: n, opened: n.clock.Now()}
+	n.observe(func(o StreamObserver) { o.StreamOpened(n, obs) })
+	return obs
+}
+
+type observedStream struct {
+	// bytesIn and bytesOut count the data read and written. They are
+	// accessed atomically, and come first to be 64-bit aligned.
+	bytesIn  int64
+	bytesOut int64
+
+	Stream
+	n      *observedNetwork
+	opened time.Time
+
+	mu           sync.Mutex
+	protoAt      time.Time
+	writeClosed  bool
+	readClosed   bool
+	remoteClosed bool
+	done         bool
+}
+
+func (s *observedStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	atomic.AddInt64(&s.bytesIn, int64(n))
+	switch {
+	case err == io.EOF:
+		s.closeRemote()
+	case errors.Is(err, ErrReset):
+		s.end(true)
+	}
+	return n, err
+}
+
+func (s *observedStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	atomic.AddInt64(&s.bytesOut, int64(n))
+	if errors.Is(err, ErrReset) {
+		s.end(true)
+	}
+	return n, err
+}
+
+func (s *observedStream) SetProtocol(id protocol.ID) error {
+	if err := s.Stream.SetProtocol(id); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.protoAt.IsZero() {
+		s.protoAt = s.n.clock.Now()
+	}
+	done := s.done
+	s.mu.Unlock()
+
+	if !done {
+		s.n.observe(func(o StreamObserver) { o.StreamProtocol(s.n, s, id) })
+	}
+	return nil
+}
+
+func (s *observedStream) CloseWrite() error {
+	err := s.Stream.CloseWrite()
+	s.closeLocal(false)
+	return err
+}
+
+func (s *observedStream) CloseRead() error {
+	err := s.Stream.CloseRead()
+	s.mu.Lock()
+	s.readClosed = true
+	s.mu.Unlock()
+	s.maybeDone()
+	return err
+}
+
+func (s *observedStream) Close() error {
+	err := s.Stream.Close()
+	s.closeLocal(true)
+	return err
+}
+
+func (s *observedStream) Reset() error {
+	err := s.Stream.Reset()
+	s.end(true)
+	return err
+}
+
+// closeLocal reports the local half close of the stream, closing its read
+// side too if read is set.
+func (s *observedStream) closeLocal(read bool) {
+	s.mu.Lock()
+	report := !s.writeClosed && !s.done
+	s.writeClosed = true
+	if read {
+		s.readClosed = true
+	}
+	s.mu.Unlock()
+
+	if report {
+		s.n.observe(func(o StreamObserver) { o.StreamHalfClosed(s.n, s, DirOutbound) })
+	}
+	s.maybeDone()
+}
+
+// closeRemote reports the half close of the stream by the remote side, once
+// its end has been read.
+func (s *observedStream) closeRemote() {
+	s.mu.Lock()
+	report := !s.remoteClosed && !s.done
+	s.remoteClosed = true
+	s.readClosed = true
+	s.mu.Unlock()
+
+	if report {
+		s.n.observe(func(o StreamObserver) { o.StreamHalfClosed(s.n, s, DirInbound) })
+	}
+	s.maybeDone()
+}
+
+func (s *observedStream) maybeDone() {
+	s.mu.Lock()
+	closed := s.writeClosed && s.readClosed
+	s.mu.Unlock()
+	if closed {
+		s.end(false)
+	}
+}
+
+// end reports the end of the stream, once.
+func (s *observedStream) end(reset bool) {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	var negotiation time.Duration
+	if !s.protoAt.IsZero() {
+		negotiation = s.protoAt.Sub(s.opened)
+	}
+	s.mu.Unlock()
+
+	sum := StreamSummary{
+		BytesIn:     atomic.LoadInt64(&s.bytesIn),
+		BytesOut:    atomic.LoadInt64(&s.bytesOut),
+		Negotiation: negotiation,
+		Duration:    s.n.clock.Since(s.opened),
+	}
+	if reset {
+		s.n.observe(func(o StreamObserver) { o.StreamReset(s.n, s, sum) })
+	} else {
+		s.n.observe(func(o StreamObserver) { o.StreamClosed(s.n, s, sum) })
+	}
+}
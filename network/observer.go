@@ -0,0 +1,202 @@
+package network
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// StreamSummary describes a stream when it ends.
+type StreamSummary struct {
+	// BytesIn and BytesOut are the amounts of data read from and written to
+	// the stream.
+	BytesIn, BytesOut int64
+	// Negotiation is the time from the opening of the stream to the
+	// negotiation of its protocol, zero if no protocol was negotiated.
+	Negotiation time.Duration
+	// Duration is the time from the opening to the end of the stream.
+	Duration time.Duration
+}
+
+// StreamObserver is notified of the life cycle of the streams of a Network.
+// Unlike a Notifiee, which only learns about connections, it sees every
+// stream, whatever its handler.
+//
+// Observers are called synchronously from the network and the muxer, and
+// must not block. Wrap slow observers with NewAsyncStreamObserver.
+type StreamObserver interface {
+	// StreamOpened is called when a stream is opened, or accepted from the
+	// remote peer, before its protocol is negotiated.
+	StreamOpened(Network, Stream)
+	// StreamProtocol is called when the protocol of a stream is set.
+	StreamProtocol(Network, Stream, protocol.ID)
+	// StreamHalfClosed is called when one direction of a stream ends: with
+	// DirOutbound when the local side closes it for writing, with DirInbound
+	// when the remote side does.
+	StreamHalfClosed(Network, Stream, Direction)
+	// StreamReset is called when a stream is reset by either side. No more
+	// events are reported for the stream.
+	StreamReset(Network, Stream, StreamSummary)
+	// StreamClosed is called when both directions of a stream are closed.
+	// No more events are reported for the stream.
+	StreamClosed(Network, Stream, StreamSummary)
+}
+
+// StreamNotifier is an optional interface for Networks reporting stream
+// events to StreamObservers. Other networks can be wrapped with
+// NewObservedNetwork.
+type StreamNotifier interface {
+	// NotifyStreams registers o to be notified of the stream events.
+	NotifyStreams(o StreamObserver)
+	// StopNotifyStreams unregisters o.
+	StopNotifyStreams(o StreamObserver)
+}
+
+// GetStreamNotifier returns the StreamNotifier interface of n, if n reports
+// stream events.
+func GetStreamNotifier(n Network) (StreamNotifier, bool) {
+	sn, ok := n.(StreamNotifier)
+	return sn, ok
+}
+
+// StreamObserverBundle implements StreamObserver by calling any of the
+// functions set on it, and nop'ing if they are unset.
+type StreamObserverBundle struct {
+	StreamOpenedF     func(Network, Stream)
+	StreamProtocolF   func(Network, Stream, protocol.ID)
+	StreamHalfClosedF func(Network, Stream, Direction)
+	StreamResetF      func(Network, Stream, StreamSummary)
+	StreamClosedF     func(Network, Stream, StreamSummary)
+}
+
+var _ StreamObserver = (*StreamObserverBundle)(nil)
+
+// StreamOpened calls StreamOpenedF if it is not null.
+func (sob *StreamObserverBundle) StreamOpened(n Network, s Stream) {
+	if sob.StreamOpenedF != nil {
+		sob.StreamOpenedF(n, s)
+	}
+}
+
+// StreamProtocol calls StreamProtocolF if it is not null.
+func (sob *StreamObserverBundle) StreamProtocol(n Network, s Stream, p protocol.ID) {
+	if sob.StreamProtocolF != nil {
+		sob.StreamProtocolF(n, s, p)
+	}
+}
+
+// StreamHalfClosed calls StreamHalfClosedF if it is not null.
+func (sob *StreamObserverBundle) StreamHalfClosed(n Network, s Stream, dir Direction) {
+	if sob.StreamHalfClosedF != nil {
+		sob.StreamHalfClosedF(n, s, dir)
+	}
+}
+
+// StreamReset calls StreamResetF if it is not null.
+func (sob *StreamObserverBundle) StreamReset(n Network, s Stream, sum StreamSummary) {
+	if sob.StreamResetF != nil {
+		sob.StreamResetF(n, s, sum)
+	}
+}
+
+// StreamClosed calls StreamClosedF if it is not null.
+func (sob *StreamObserverBundle) StreamClosed(n Network, s Stream, sum StreamSummary) {
+	if sob.StreamClosedF != nil {
+		sob.StreamClosedF(n, s, sum)
+	}
+}
+
+// DefaultObserverQueueSize is the default number of events buffered by an
+// AsyncStreamObserver.
+const DefaultObserverQueueSize = 1024
+
+// AsyncStreamObserver delivers stream events to another StreamObserver from a
+// goroutine of its own, in order, so that a slow observer never blocks the
+// network. Events are dropped when its queue is full.
+type AsyncStreamObserver struct {
+	o       StreamObserver
+	dropped uint64 // accessed atomically
+
+	mu     sync.RWMutex
+	closed bool
+	events chan func()
+	done   chan struct{}
+}
+
+var _ StreamObserver = (*AsyncStreamObserver)(nil)
+
+// NewAsyncStreamObserver starts delivering the events to o, buffering up to
+// queueSize of them. A queueSize of zero defaults to
+// DefaultObserverQueueSize.
+func NewAsyncStreamObserver(o StreamObserver, queueSize int) *AsyncStreamObserver {
+	if queueSize <= 0 {
+		queueSize = DefaultObserverQueueSize
+	}
+	ao := &AsyncStreamObserver{
+		o:      o,
+		events: make(chan func(), queueSize),
+		done:   make(chan struct{}),
+	}
+	go ao.loop()
+	return ao
+}
+
+func (ao *AsyncStreamObserver) loop() {
+	defer close(ao.done)
+	for ev := range ao.events {
+		ev()
+	}
+}
+
+func (ao *AsyncStreamObserver) enqueue(ev func()) {
+	ao.mu.RLock()
+	defer ao.mu.RUnlock()
+	if ao.closed {
+		return
+	}
+	select {
+	case ao.events <- ev:
+	default:
+		atomic.AddUint64(&ao.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (ao *AsyncStreamObserver) Dropped() uint64 {
+	return atomic.LoadUint64(&ao.dropped)
+}
+
+// Close stops accepting events, and waits until the queued ones have been
+// delivered.
+func (ao *AsyncStreamObserver) Close() error {
+	ao.mu.Lock()
+	if !ao.closed {
+		ao.closed = true
+		close(ao.events)
+	}
+	ao.mu.Unlock()
+	<-ao.done
+	return nil
+}
+
+func (ao *AsyncStreamObserver) StreamOpened(n Network, s Stream) {
+	ao.enqueue(func() { ao.o.StreamOpened(n, s) })
+}
+
+func (ao *AsyncStreamObserver) StreamProtocol(n Network, s Stream, p protocol.ID) {
+	ao.enqueue(func() { ao.o.StreamProtocol(n, s, p) })
+}
+
+func (ao *AsyncStreamObserver) StreamHalfClosed(n Network, s Stream, dir Direction) {
+	ao.enqueue(func() { ao.o.StreamHalfClosed(n, s, dir) })
+}
+
+func (ao *AsyncStreamObserver) StreamReset(n Network, s Stream, sum StreamSummary) {
+	ao.enqueue(func() { ao.o.StreamReset(n, s, sum) })
+}
+
+func (ao *AsyncStreamObserver) StreamClosed(n Network, s Stream, sum StreamSummary) {
+	ao.enqueue(func() { ao.o.StreamClosed(n, s, sum) })
+}
@@ -0,0 +1,274 @@
+package network_test
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/network/memnet"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+)
+
+// eventLog records the stream events it is notified of.
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+	sums   []network.StreamSummary
+}
+
+func (l *eventLog) add(ev string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, ev)
+}
+
+func (l *eventLog) Events() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+func (l *eventLog) observer() *network.StreamObserverBundle {
+	return &network.StreamObserverBundle{
+		StreamOpenedF: func(network.Network, network.Stream) { l.add("opened") },
+		StreamProtocolF: func(_ network.Network, _ network.Stream, p protocol.ID) {
+			l.add("protocol " + string(p))
+		},
+		StreamHalfClosedF: func(_ network.Network, _ network.Stream, dir network.Direction) {
+			l.add("half closed " + dir.String())
+		},
+		StreamResetF: func(_ network.Network, _ network.Stream, sum network.StreamSummary) {
+			l.mu.Lock()
+			l.sums = append(l.sums, sum)
+			l.mu.Unlock()
+			l.add("reset")
+		},
+		StreamClosedF: func(_ network.Network, _ network.Stream, sum network.StreamSummary) {
+			l.mu.Lock()
+			l.sums = append(l.sums, sum)
+			l.mu.Unlock()
+			l.add("closed")
+		},
+	}
+}
+
+func TestAsyncStreamObserverOrder(t *testing.T) {
+	var delivered []protocol.ID
+	ao := network.NewAsyncStreamObserver(&network.StreamObserverBundle{
+		StreamProtocolF: func(_ network.Network, _ network.Stream, p protocol.ID) {
+			delivered = append(delivered, p)
+		},
+	}, 100)
+
+	for i := 0; i < 100; i++ {
+		ao.StreamProtocol(nil, nil, protocol.ID(fmt.Sprint(i)))
+	}
+	ao.Close()
+
+	if len(delivered) != 100 || ao.Dropped() != 0 {
+		t.Fatalf("expected 100 events and none dropped, got %d and %d dropped", len(delivered), ao.Dropped())
+	}
+	for i, p := range delivered {
+		if p != protocol.ID(fmt.Sprint(i)) {
+			t.Fatalf("expected event %d to be delivered in order, got %s", i, p)
+		}
+	}
+
+	// events after Close are ignored
+	ao.StreamProtocol(nil, nil, "late")
+	if len(delivered) != 100 || ao.Dropped() != 0 {
+		t.Fatalf("expected the events after close to be ignored, got %d events", len(delivered))
+	}
+}
+
+func TestAsyncStreamObserverDrops(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var delivered []protocol.ID
+	ao := network.NewAsyncStreamObserver(&network.StreamObserverBundle{
+		StreamProtocolF: func(_ network.Network, _ network.Stream, p protocol.ID) {
+			if len(delivered) == 0 {
+				close(started)
+				<-unblock
+			}
+			delivered = append(delivered, p)
+		},
+	}, 2)
+
+	// the first event blocks the observer, the next two fill the queue
+	ao.StreamProtocol(nil, nil, "0")
+	<-started
+	for i := 1; i < 10; i++ {
+		ao.StreamProtocol(nil, nil, protocol.ID(fmt.Sprint(i)))
+	}
+	if n := ao.Dropped(); n != 7 {
+		t.Fatalf("expected 7 events dropped, got %d", n)
+	}
+
+	close(unblock)
+	ao.Close()
+	if fmt.Sprint(delivered) != "[0 1 2]" {
+		t.Fatalf("expected the first events to be delivered in order, got %v", delivered)
+	}
+}
+
+// plainNetwork hides the StreamNotifier implementation of a network.
+type plainNetwork struct {
+	network.Network
+}
+
+func newObservedPair(t *testing.T, opts ...network.ObservedOption) (a, b network.ObservedNetwork) {
+	t.Helper()
+	hub, err := memnet.NewHub(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newNet := func() network.ObservedNetwork {
+		sk, _, err := ic.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps, err := pstoremem.NewPeerstore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := hub.AddPeer(sk, ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			n.Close()
+			ps.Close()
+		})
+		return network.NewObservedNetwork(plainNetwork{n}, opts...)
+	}
+	return newNet(), newNet()
+}
+
+func TestObservedNetwork(t *testing.T) {
+	a, b := newObservedPair(t)
+	var aLog, bLog eventLog
+	a.NotifyStreams(aLog.observer())
+	b.NotifyStreams(bLog.observer())
+
+	handled := make(chan struct{})
+	b.SetStreamHandler(func(s network.Stream) {
+		defer close(handled)
+		s.SetProtocol("/echo")
+		io.Copy(s, s)
+		s.Close()
+	})
+
+	s, err := a.NewStream(context.Background(), b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetProtocol("/echo")
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s.CloseWrite()
+	if _, err := io.ReadAll(s); err != nil {
+		t.Fatal(err)
+	}
+	<-handled
+
+	expected := []string{"opened", "protocol /echo", "half closed Outbound", "half closed Inbound", "closed"}
+	if got := aLog.Events(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected the events %v on the dialer, got %v", expected, got)
+	}
+	expected = []string{"opened", "protocol /echo", "half closed Inbound", "half closed Outbound", "closed"}
+	if got := bLog.Events(); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected the events %v on the listener, got %v", expected, got)
+	}
+	for _, l := range []*eventLog{&aLog, &bLog} {
+		if sum := l.sums[0]; sum.BytesIn != 5 || sum.BytesOut != 5 {
+			t.Fatalf("expected 5 bytes each way, got %d in and %d out", sum.BytesIn, sum.BytesOut)
+		}
+	}
+
+	// streams not opened through the wrapper are not observed
+	conns := a.ConnsToPeer(b.LocalPeer())
+	if len(conns) == 0 {
+		t.Fatal("expected a connection")
+	}
+	if _, err := conns[0].NewStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(aLog.Events()); n != len(expected) {
+		t.Fatalf("expected no more events, got %d", n)
+	}
+}
+
+func TestObservedNetworkReset(t *testing.T) {
+	a, b := newObservedPair(t)
+	var aLog, bLog eventLog
+	a.NotifyStreams(aLog.observer())
+	b.NotifyStreams(bLog.observer())
+
+	received := make(chan struct{})
+	handled := make(chan struct{})
+	b.SetStreamHandler(func(s network.Stream) {
+		defer close(handled)
+		io.ReadFull(s, make([]byte, 5))
+		close(received)
+		// the remote reset is reported once read
+		io.Copy(io.Discard, s)
+	})
+
+	s, err := a.NewStream(context.Background(), b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	s.Reset()
+	<-handled
+
+	if got := aLog.Events(); fmt.Sprint(got) != "[opened reset]" {
+		t.Fatalf("expected the stream to be reset on the dialer, got %v", got)
+	}
+	if got := bLog.Events(); fmt.Sprint(got) != "[opened reset]" {
+		t.Fatalf("expected the stream to be reset on the listener, got %v", got)
+	}
+	if sum := aLog.sums[0]; sum.BytesOut != 5 {
+		t.Fatalf("expected 5 bytes out, got %d", sum.BytesOut)
+	}
+}
+
+func TestObservedNetworkClock(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	a, b := newObservedPair(t, network.WithObservedClock(clk))
+	var aLog eventLog
+	a.NotifyStreams(aLog.observer())
+	b.SetStreamHandler(func(s network.Stream) {
+		io.Copy(io.Discard, s)
+	})
+
+	s, err := a.NewStream(context.Background(), b.LocalPeer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(2 * time.Second)
+	s.SetProtocol("/test")
+	clk.Advance(3 * time.Second)
+	s.Reset()
+
+	if len(aLog.sums) != 1 {
+		t.Fatalf("expected a summary, got %v", aLog.Events())
+	}
+	if sum := aLog.sums[0]; sum.Negotiation != 2*time.Second || sum.Duration != 5*time.Second {
+		t.Fatalf("expected the summary to be timed on the clock, got %+v", sum)
+	}
+}
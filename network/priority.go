@@ -0,0 +1,473 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+)
+
+// PriorityClass is the strict priority of a stream: pending writes of a
+// higher class are always sent before writes of a lower class.
+type PriorityClass int8
+
+const (
+	// PriorityBulk is for bulk transfers, which only use the bandwidth left
+	// over by other streams.
+	PriorityBulk PriorityClass = -1
+	// PriorityDefault is the class of streams with no explicit priority.
+	PriorityDefault PriorityClass = 0
+	// PriorityControl is for latency sensitive streams exchanging small
+	// messages.
+	PriorityControl PriorityClass = 1
+)
+
+func (c PriorityClass) String() string {
+	switch c {
+	case PriorityBulk:
+		return "bulk"
+	case PriorityDefault:
+		return "default"
+	case PriorityControl:
+		return "control"
+	default:
+		return fmt.Sprintf("class %d", int8(c))
+	}
+}
+
+// DefaultPriorityWeight is the weight of streams with a zero Weight.
+const DefaultPriorityWeight = 16
+
+// Priority is the scheduling priority of a stream. Streams of the same class
+// share the connection in proportion to their weight.
+type Priority struct {
+	Class  PriorityClass
+	Weight uint16
+}
+
+func (p Priority) weight() float64 {
+	if p.Weight == 0 {
+		return DefaultPriorityWeight
+	}
+	return float64(p.Weight)
+}
+
+// PrioritizedStream is an optional interface for MuxedStreams whose writes
+// are scheduled according to a priority.
+type PrioritizedStream interface {
+	MuxedStream
+
+	// Priority returns the priority of the stream.
+	Priority() Priority
+	// SetPriority changes the priority of the stream. It applies to writes
+	// started after the call.
+	SetPriority(Priority) error
+}
+
+// GetPrioritizedStream returns the PrioritizedStream interface of s, if s
+// supports priorities.
+func GetPrioritizedStream(s MuxedStream) (PrioritizedStream, bool) {
+	ps, ok := s.(PrioritizedStream)
+	return ps, ok
+}
+
+var errWriteOnClosedStream = errors.New("write on closed stream")
+
+// DefaultSchedulerQuantum is the default largest chunk of a write sent at
+// once before other streams get a chance to write.
+const DefaultSchedulerQuantum = 16 << 10
+
+// DefaultSchedulerHoldTimeout is the default time after which a write
+// blocked in the underlying stream, e.g. by flow control, lets other streams
+// of the same or lower classes write. Higher classes never wait for it.
+const DefaultSchedulerHoldTimeout = 5 * time.Millisecond
+
+// SchedulerOption is a single option for the write scheduler of a connection.
+type SchedulerOption func(cfg *schedulerConfig) error
+
+type schedulerConfig struct {
+	quantum     int
+	holdTimeout time.Duration
+	clock       clock.Clock
+}
+
+// WithSchedulerQuantum sets the largest chunk of a write sent at once.
+// Smaller values reduce the latency of high priority streams, at the cost of
+// more writes to the underlying connection. Defaults to
+// DefaultSchedulerQuantum.
+func WithSchedulerQuantum(n int) SchedulerOption {
+	return func(cfg *schedulerConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid scheduler quantum: %d", n)
+		}
+		cfg.quantum = n
+		return nil
+	}
+}
+
+// WithSchedulerHoldTimeout sets how long a write blocked in the underlying
+// stream holds back the writes of other streams. Defaults to
+// DefaultSchedulerHoldTimeout.
+func WithSchedulerHoldTimeout(d time.Duration) SchedulerOption {
+	return func(cfg *schedulerConfig) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid scheduler hold timeout: %s", d)
+		}
+		cfg.holdTimeout = d
+		return nil
+	}
+}
+
+// WithSchedulerClock sets the clock timing the hold timeout and the write
+// deadlines. Defaults to clock.Real.
+func WithSchedulerClock(c clock.Clock) SchedulerOption {
+	return func(cfg *schedulerConfig) error {
+		cfg.clock = c
+		return nil
+	}
+}
+
+func newSchedulerConfig(opts []SchedulerOption) (schedulerConfig, error) {
+	cfg := schedulerConfig{
+		quantum:     DefaultSchedulerQuantum,
+		holdTimeout: DefaultSchedulerHoldTimeout,
+		clock:       clock.Real,
+	}
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// NewScheduledMultiplexer wraps m, so that the writes of the streams of its
+// connections are ordered by priority. See NewScheduledConn.
+func NewScheduledMultiplexer(m Multiplexer, opts ...SchedulerOption) (Multiplexer, error) {
+	if _, err := newSchedulerConfig(opts); err != nil {
+		return nil, err
+	}
+	return &scheduledMultiplexer{m: m, opts: opts}, nil
+}
+
+type scheduledMultiplexer struct {
+	m    Multiplexer
+	opts []SchedulerOption
+}
+
+func (sm *scheduledMultiplexer) NewConn(c net.Conn, isServer bool, scope PeerScope) (MuxedConn, error) {
+	mc, err := sm.m.NewConn(c, isServer, scope)
+	if err != nil {
+		return nil, err
+	}
+	return NewScheduledConn(mc, sm.opts...)
+}
+
+// NewScheduledConn wraps c, so that the writes of its streams are handed to
+// c one chunk at a time, in priority order: pending writes of the highest
+// class first, and writes of the same class in proportion to the stream
+// weights. A write never waits for the chunks of lower classes being
+// written. The streams of the returned connection implement
+// PrioritizedStream.
+//
+// The scheduler works above the multiplexer: it orders the writes that
+// contend for c, and reduces the latency of high priority streams when
+// several other streams keep c busy. It cannot reorder the data already
+// handed to c, which the multiplexer or the transport below it may buffer:
+// a single bulk stream filling large buffers, e.g. TCP socket buffers, which
+// the kernel may grow to several MiB, delays the other streams all the same.
+// muxtest.BenchmarkControlLatency measures both cases.
+func NewScheduledConn(c MuxedConn, opts ...SchedulerOption) (MuxedConn, error) {
+	cfg, err := newSchedulerConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &scheduledConn{
+		MuxedConn: c,
+		ws:        newWriteScheduler(cfg),
+	}, nil
+}
+
+type scheduledConn struct {
+	MuxedConn
+	ws *writeScheduler
+}
+
+func (c *scheduledConn) OpenStream(ctx context.Context) (MuxedStream, error) {
+	s, err := c.MuxedConn.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newScheduledStream(s, c.ws), nil
+}
+
+func (c *scheduledConn) AcceptStream() (MuxedStream, error) {
+	s, err := c.MuxedConn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return newScheduledStream(s, c.ws), nil
+}
+
+type scheduledStream struct {
+	MuxedStream
+	ws *writeScheduler
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu            sync.Mutex
+	prio          Priority
+	writeDeadline time.Time
+
+	// finish is the virtual finish time of the last write of the stream,
+	// guarded by the scheduler lock.
+	finish float64
+}
+
+var _ PrioritizedStream = (*scheduledStream)(nil)
+
+func newScheduledStream(s MuxedStream, ws *writeScheduler) *scheduledStream {
+	return &scheduledStream{MuxedStream: s, ws: ws, closed: make(chan struct{})}
+}
+
+func (s *scheduledStream) Priority() Priority {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prio
+}
+
+func (s *scheduledStream) SetPriority(p Priority) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prio = p
+	return nil
+}
+
+func (s *scheduledStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > s.ws.cfg.quantum {
+			chunk = chunk[:s.ws.cfg.quantum]
+		}
+
+		s.mu.Lock()
+		prio, deadline := s.prio, s.writeDeadline
+		s.mu.Unlock()
+		id, err := s.ws.acquire(s, prio, len(chunk), deadline)
+		if err != nil {
+			return written, err
+		}
+		hold := s.ws.cfg.clock.AfterFunc(s.ws.cfg.holdTimeout, func() { s.ws.release(id) })
+		n, err := s.MuxedStream.Write(chunk)
+		hold.Stop()
+		s.ws.release(id)
+
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (s *scheduledStream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	return s.MuxedStream.SetDeadline(t)
+}
+
+func (s *scheduledStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	return s.MuxedStream.SetWriteDeadline(t)
+}
+
+func (s *scheduledStream) CloseWrite() error {
+	s.markClosed()
+	return s.MuxedStream.CloseWrite()
+}
+
+func (s *scheduledStream) Close() error {
+	s.markClosed()
+	return s.MuxedStream.Close()
+}
+
+func (s *scheduledStream) Reset() error {
+	s.markClosed()
+	return s.MuxedStream.Reset()
+}
+
+// markClosed aborts the writes waiting for their turn.
+func (s *scheduledStream) markClosed() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// writeScheduler grants the right to write to the streams of a connection,
+// one chunk at a time. Classes are served in strict priority order; within a
+// class, chunks are served in order of virtual finish time, which shares the
+// connection in proportion to the stream weights.
+//
+// A single chunk is written at a time, except that a write of a higher class
+// than the chunks being written doesn't wait for them: a chunk blocked in the
+// underlying stream doesn't hold back more important streams.
+type writeScheduler struct {
+	cfg schedulerConfig
+
+	mu  sync.Mutex
+	seq uint64
+	// holders are the classes of the grants in progress, by ID.
+	holders map[uint64]PriorityClass
+	waiting []*writeRequest
+	// vtime is the virtual time of every class: the virtual start time of
+	// the last chunk served.
+	vtime map[PriorityClass]float64
+}
+
+func newWriteScheduler(cfg schedulerConfig) *writeScheduler {
+	return &writeScheduler{
+		cfg:     cfg,
+		holders: make(map[uint64]PriorityClass),
+		vtime:   make(map[PriorityClass]float64),
+	}
+}
+
+type writeRequest struct {
+	class   PriorityClass
+	start   float64
+	finish  float64
+	ready   chan struct{}
+	granted bool
+	id      uint64
+}
+
+// acquire waits for the turn of s to write size bytes. It returns the ID of
+// the grant, to be released once the chunk has been written.
+func (ws *writeScheduler) acquire(s *scheduledStream, prio Priority, size int, deadline time.Time) (uint64, error) {
+	select {
+	case <-s.closed:
+		return 0, errWriteOnClosedStream
+	default:
+	}
+
+	ws.mu.Lock()
+	start := math.Max(ws.vtime[prio.Class], s.finish)
+	req := &writeRequest{
+		class:  prio.Class,
+		start:  start,
+		finish: start + float64(size)/prio.weight(),
+	}
+	s.finish = req.finish
+	if ws.grantableLocked(req.class) && !ws.waitingLocked(req.class) {
+		ws.grantLocked(req)
+		ws.mu.Unlock()
+		return req.id, nil
+	}
+	req.ready = make(chan struct{})
+	ws.waiting = append(ws.waiting, req)
+	ws.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := ws.cfg.clock.NewTimer(ws.cfg.clock.Until(deadline))
+		defer t.Stop()
+		timeout = t.C()
+	}
+
+	var err error
+	select {
+	case <-req.ready:
+		return req.id, nil
+	case <-s.closed:
+		err = errWriteOnClosedStream
+	case <-timeout:
+		err = os.ErrDeadlineExceeded
+	}
+
+	ws.mu.Lock()
+	if req.granted {
+		// granted in the meantime: pass the turn on
+		ws.mu.Unlock()
+		ws.release(req.id)
+		return 0, err
+	}
+	for i, other := range ws.waiting {
+		if other == req {
+			ws.waiting = append(ws.waiting[:i], ws.waiting[i+1:]...)
+			break
+		}
+	}
+	ws.mu.Unlock()
+	return 0, err
+}
+
+// grantableLocked returns true if a write of the given class may start now:
+// if no chunk is being written, or only chunks of lower classes.
+func (ws *writeScheduler) grantableLocked(class PriorityClass) bool {
+	for _, other := range ws.holders {
+		if other >= class {
+			return false
+		}
+	}
+	return true
+}
+
+// waitingLocked returns true if writes of the given class or of higher
+// classes are waiting for their turn.
+func (ws *writeScheduler) waitingLocked(class PriorityClass) bool {
+	for _, req := range ws.waiting {
+		if req.class >= class {
+			return true
+		}
+	}
+	return false
+}
+
+// release ends the grant with the given ID, if it still holds the
+// connection, and passes the turn to the next pending write.
+func (ws *writeScheduler) release(id uint64) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.holders[id]; !ok {
+		return
+	}
+	delete(ws.holders, id)
+
+	if len(ws.waiting) == 0 {
+		return
+	}
+	next := 0
+	for i, req := range ws.waiting[1:] {
+		best := ws.waiting[next]
+		if req.class > best.class || (req.class == best.class && req.finish < best.finish) {
+			next = i + 1
+		}
+	}
+	req := ws.waiting[next]
+	if !ws.grantableLocked(req.class) {
+		return
+	}
+	ws.waiting = append(ws.waiting[:next], ws.waiting[next+1:]...)
+	ws.grantLocked(req)
+	close(req.ready)
+}
+
+func (ws *writeScheduler) grantLocked(req *writeRequest) {
+	ws.seq++
+	req.id = ws.seq
+	req.granted = true
+	ws.holders[req.id] = req.class
+	if req.start > ws.vtime[req.class] {
+		ws.vtime[req.class] = req.start
+	}
+}
@@ -0,0 +1,255 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+)
+
+// pipeStream is a MuxedStream whose writes block until released.
+type pipeStream struct {
+	MuxedStream // only Write is used
+
+	written chan []byte
+	proceed chan struct{}
+}
+
+func newPipeStream() *pipeStream {
+	return &pipeStream{written: make(chan []byte, 16), proceed: make(chan struct{})}
+}
+
+func (s *pipeStream) Write(b []byte) (int, error) {
+	s.written <- b
+	<-s.proceed
+	return len(b), nil
+}
+
+func newTestScheduler(t *testing.T, opts ...SchedulerOption) (*writeScheduler, *clock.Virtual) {
+	t.Helper()
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	cfg, err := newSchedulerConfig(append([]SchedulerOption{WithSchedulerClock(clk)}, opts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newWriteScheduler(cfg), clk
+}
+
+// waitQueued waits until n writes are waiting for their turn.
+func waitQueued(t *testing.T, ws *writeScheduler, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		ws.mu.Lock()
+		queued := len(ws.waiting)
+		ws.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d writes to be waiting", n)
+}
+
+type grant struct {
+	name string
+	id   uint64
+}
+
+// enqueue starts a write of size bytes on s, and waits until it is queued.
+func enqueue(t *testing.T, ws *writeScheduler, s *scheduledStream, name string, prio Priority, size int, granted chan<- grant) {
+	t.Helper()
+	ws.mu.Lock()
+	queued := len(ws.waiting)
+	ws.mu.Unlock()
+	go func() {
+		id, err := ws.acquire(s, prio, size, time.Time{})
+		if err != nil {
+			t.Error(err)
+		}
+		granted <- grant{name, id}
+	}()
+	waitQueued(t, ws, queued+1)
+}
+
+// serve releases the grants one at a time, and returns the order in which
+// they were given.
+func serve(ws *writeScheduler, first uint64, n int, granted <-chan grant) []string {
+	var order []string
+	id := first
+	for i := 0; i < n; i++ {
+		ws.release(id)
+		g := <-granted
+		order = append(order, g.name)
+		id = g.id
+	}
+	ws.release(id)
+	return order
+}
+
+func checkOrder(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestWriteSchedulerClassOrder(t *testing.T) {
+	ws, _ := newTestScheduler(t)
+	control := Priority{Class: PriorityControl}
+	holder, err := ws.acquire(newScheduledStream(nil, ws), control, 1, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan grant)
+	enqueue(t, ws, newScheduledStream(nil, ws), "bulk", Priority{Class: PriorityBulk}, 1, granted)
+	enqueue(t, ws, newScheduledStream(nil, ws), "default", Priority{Class: PriorityDefault}, 1, granted)
+	enqueue(t, ws, newScheduledStream(nil, ws), "control", control, 1, granted)
+
+	checkOrder(t, serve(ws, holder, 3, granted), "control", "default", "bulk")
+}
+
+func TestWriteSchedulerWeights(t *testing.T) {
+	ws, _ := newTestScheduler(t)
+	holder, err := ws.acquire(newScheduledStream(nil, ws), Priority{Class: PriorityControl}, 1, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan grant)
+	heavy, light := newScheduledStream(nil, ws), newScheduledStream(nil, ws)
+	// finish times: heavy 1, 2, 3, 4, 5, 6; light 3, 6
+	for i := 0; i < 6; i++ {
+		enqueue(t, ws, heavy, "heavy", Priority{Weight: 3}, 3, granted)
+	}
+	for i := 0; i < 2; i++ {
+		enqueue(t, ws, light, "light", Priority{Weight: 1}, 3, granted)
+	}
+
+	// ties go to the write queued first
+	checkOrder(t, serve(ws, holder, 8, granted),
+		"heavy", "heavy", "heavy", "light", "heavy", "heavy", "heavy", "light")
+}
+
+func TestWriteSchedulerPreemption(t *testing.T) {
+	ws, _ := newTestScheduler(t)
+	bulk, err := ws.acquire(newScheduledStream(nil, ws), Priority{Class: PriorityBulk}, 1, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a higher class doesn't wait for the bulk chunk being written
+	control, err := ws.acquire(newScheduledStream(nil, ws), Priority{Class: PriorityControl}, 1, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// but waits for the control chunk
+	granted := make(chan grant)
+	enqueue(t, ws, newScheduledStream(nil, ws), "default", Priority{}, 1, granted)
+	ws.release(control)
+	if g := <-granted; g.name != "default" {
+		t.Fatalf("expected the default write to be granted, got %s", g.name)
+	}
+
+	// the same class waits for the bulk chunk
+	enqueue(t, ws, newScheduledStream(nil, ws), "bulk", Priority{Class: PriorityBulk}, 1, granted)
+	ws.release(bulk)
+	select {
+	case g := <-granted:
+		t.Fatalf("expected the bulk write to wait for the default chunk, got %s", g.name)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestScheduledStreamHoldRelease(t *testing.T) {
+	ws, clk := newTestScheduler(t, WithSchedulerHoldTimeout(time.Millisecond))
+	blocked, other := newPipeStream(), newPipeStream()
+	close(other.proceed)
+
+	go newScheduledStream(blocked, ws).Write([]byte("blocked"))
+	<-blocked.written
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := newScheduledStream(other, ws).Write([]byte("other"))
+		done <- err
+	}()
+	waitQueued(t, ws, 1)
+
+	clk.Advance(time.Millisecond - 1)
+	select {
+	case <-done:
+		t.Fatal("expected the write to wait for the hold timeout")
+	default:
+	}
+	clk.Advance(1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	close(blocked.proceed)
+}
+
+func TestScheduledStreamQuantum(t *testing.T) {
+	ws, _ := newTestScheduler(t, WithSchedulerQuantum(4))
+	ps := newPipeStream()
+	close(ps.proceed)
+	n, err := newScheduledStream(ps, ws).Write([]byte("0123456789"))
+	if n != 10 || err != nil {
+		t.Fatalf("expected a full write, got %d, %v", n, err)
+	}
+	for _, expected := range []string{"0123", "4567", "89"} {
+		if chunk := <-ps.written; string(chunk) != expected {
+			t.Fatalf("expected chunk %q, got %q", expected, chunk)
+		}
+	}
+}
+
+func TestWriteSchedulerAbort(t *testing.T) {
+	ws, clk := newTestScheduler(t)
+	holder, err := ws.acquire(newScheduledStream(nil, ws), Priority{}, 1, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := ws.acquire(newScheduledStream(nil, ws), Priority{}, 1, clk.Now().Add(time.Second))
+		done <- err
+	}()
+	closed := newScheduledStream(nil, ws)
+	go func() {
+		_, err := ws.acquire(closed, Priority{}, 1, time.Time{})
+		done <- err
+	}()
+	waitQueued(t, ws, 2)
+	for i := 0; i < 1000; i++ {
+		if _, ok := clk.Next(); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clk.Advance(time.Second)
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write deadline to be exceeded, got %v", err)
+	}
+	closed.markClosed()
+	if err := <-done; err != errWriteOnClosedStream {
+		t.Fatalf("expected the write to be aborted, got %v", err)
+	}
+	waitQueued(t, ws, 0)
+
+	// the aborted writes left the queue: the turn goes back to new writes
+	ws.release(holder)
+	if _, err := ws.acquire(newScheduledStream(nil, ws), Priority{}, 1, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,582 @@
+package network
+
+import (
+	"context"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// maxShapedChunk is the largest amount of data read or written at once by a
+// rate limited stream, so that traffic stays smooth.
+const maxShapedChunk = 32 << 10
+
+// minShapedChunk is the smallest chunk size, whatever the configured bursts.
+const minShapedChunk = 512
+
+// RateLimit is a token bucket limit on the traffic in one direction.
+type RateLimit struct {
+	// Rate is the sustained rate, in bytes per second. Zero means unlimited.
+	Rate float64
+	// Burst is the largest amount of data, in bytes, that may be transferred
+	// at once after an idle period. Zero defaults to a tenth of a second's
+	// worth of traffic.
+	Burst int
+}
+
+// IsUnlimited returns true if the limit does not restrict traffic.
+func (l RateLimit) IsUnlimited() bool {
+	return l.Rate <= 0 || math.IsInf(l.Rate, 1)
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(l.Rate/10, minShapedChunk)
+}
+
+// RateLimits holds the limits of both directions of traffic. In applies to
+// data read from streams, Out to data written to them.
+type RateLimits struct {
+	In, Out RateLimit
+}
+
+func (l RateLimits) get(dir Direction) RateLimit {
+	if dir == DirInbound {
+		return l.In
+	}
+	return l.Out
+}
+
+// RateUsage reports the traffic of a peer, a protocol or the whole node
+// together with its limits. Stats are only available if the limiter was
+// created with a metrics.Reporter.
+type RateUsage struct {
+	metrics.Stats
+	Limits RateLimits
+}
+
+// LimiterOption is a single BandwidthLimiter option.
+type LimiterOption func(l *BandwidthLimiter) error
+
+// WithLimiterClock sets the clock used to refill the token buckets and to
+// wait for them. Defaults to clock.Real.
+func WithLimiterClock(c clock.Clock) LimiterOption {
+	return func(l *BandwidthLimiter) error {
+		l.clock = c
+		return nil
+	}
+}
+
+// WithLimiterReporter makes the limited streams log their traffic to r, both
+// per stream and in the totals, so that a metrics.BandwidthCounter reflects
+// the shaped traffic. The reporter also provides the stats of RateUsage.
+func WithLimiterReporter(r metrics.Reporter) LimiterOption {
+	return func(l *BandwidthLimiter) error {
+		l.reporter = r
+		return nil
+	}
+}
+
+// BandwidthLimiter shapes the traffic of streams with token buckets. Limits
+// apply globally, per peer and per protocol, independently for each
+// direction, and can be changed at any time; a stream waits for all the
+// buckets it draws from.
+//
+// Streams are shaped once wrapped with Stream, or when opened through a
+// connection wrapped with Conn or accepted by a handler wrapped with
+// StreamHandler.
+type BandwidthLimiter struct {
+	clock    clock.Clock
+	reporter metrics.Reporter
+
+	mu                 sync.Mutex
+	global             *bucketPair
+	defaultPeerLimits  RateLimits
+	defaultProtoLimits RateLimits
+	peerLimits         map[peer.ID]RateLimits
+	protoLimits        map[protocol.ID]RateLimits
+	peers              map[peer.ID]*peerBuckets
+	protos             map[protocol.ID]*bucketPair
+}
+
+type peerBuckets struct {
+	bucketPair
+	refs int
+}
+
+// NewBandwidthLimiter creates a BandwidthLimiter with no limits.
+func NewBandwidthLimiter(opts ...LimiterOption) (*BandwidthLimiter, error) {
+	l := &BandwidthLimiter{
+		clock:       clock.Real,
+		peerLimits:  make(map[peer.ID]RateLimits),
+		protoLimits: make(map[protocol.ID]RateLimits),
+		peers:       make(map[peer.ID]*peerBuckets),
+		protos:      make(map[protocol.ID]*bucketPair),
+	}
+	for _, o := range opts {
+		if err := o(l); err != nil {
+			return nil, err
+		}
+	}
+	l.global = newBucketPair(RateLimits{}, l.clock.Now())
+	return l, nil
+}
+
+// SetGlobalLimits sets the limits on the total traffic of all shaped streams.
+func (l *BandwidthLimiter) SetGlobalLimits(lim RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global.setLimits(lim, l.clock.Now())
+}
+
+// SetDefaultPeerLimits sets the limits of the peers without explicit limits.
+func (l *BandwidthLimiter) SetDefaultPeerLimits(lim RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaultPeerLimits = lim
+	now := l.clock.Now()
+	for p, b := range l.peers {
+		if _, ok := l.peerLimits[p]; !ok {
+			b.setLimits(lim, now)
+		}
+	}
+}
+
+// SetPeerLimits sets the limits of the traffic with p.
+func (l *BandwidthLimiter) SetPeerLimits(p peer.ID, lim RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peerLimits[p] = lim
+	if b, ok := l.peers[p]; ok {
+		b.setLimits(lim, l.clock.Now())
+	}
+}
+
+// RemovePeerLimits reverts p to the default peer limits.
+func (l *BandwidthLimiter) RemovePeerLimits(p peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.peerLimits, p)
+	if b, ok := l.peers[p]; ok {
+		b.setLimits(l.defaultPeerLimits, l.clock.Now())
+	}
+}
+
+// SetDefaultProtocolLimits sets the limits of the protocols without explicit
+// limits. Streams without a protocol are not subject to protocol limits.
+func (l *BandwidthLimiter) SetDefaultProtocolLimits(lim RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaultProtoLimits = lim
+	now := l.clock.Now()
+	for pid, b := range l.protos {
+		if _, ok := l.protoLimits[pid]; !ok {
+			b.setLimits(lim, now)
+		}
+	}
+}
+
+// SetProtocolLimits sets the limits of the traffic of all streams of pid,
+// with all peers.
+func (l *BandwidthLimiter) SetProtocolLimits(pid protocol.ID, lim RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.protoLimits[pid] = lim
+	if b, ok := l.protos[pid]; ok {
+		b.setLimits(lim, l.clock.Now())
+	}
+}
+
+// RemoveProtocolLimits reverts pid to the default protocol limits.
+func (l *BandwidthLimiter) RemoveProtocolLimits(pid protocol.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.protoLimits, pid)
+	if b, ok := l.protos[pid]; ok {
+		b.setLimits(l.defaultProtoLimits, l.clock.Now())
+	}
+}
+
+// GlobalUsage returns the total traffic of the node, and the global limits.
+func (l *BandwidthLimiter) GlobalUsage() RateUsage {
+	l.mu.Lock()
+	u := RateUsage{Limits: l.global.limits}
+	l.mu.Unlock()
+	if l.reporter != nil {
+		u.Stats = l.reporter.GetBandwidthTotals()
+	}
+	return u
+}
+
+// PeerUsage returns the traffic with p, and its limits.
+func (l *BandwidthLimiter) PeerUsage(p peer.ID) RateUsage {
+	l.mu.Lock()
+	u := RateUsage{Limits: l.peerLimitsLocked(p)}
+	l.mu.Unlock()
+	if l.reporter != nil {
+		u.Stats = l.reporter.GetBandwidthForPeer(p)
+	}
+	return u
+}
+
+// ProtocolUsage returns the traffic of pid, and its limits.
+func (l *BandwidthLimiter) ProtocolUsage(pid protocol.ID) RateUsage {
+	l.mu.Lock()
+	u := RateUsage{Limits: l.protoLimitsLocked(pid)}
+	l.mu.Unlock()
+	if l.reporter != nil {
+		u.Stats = l.reporter.GetBandwidthForProtocol(pid)
+	}
+	return u
+}
+
+func (l *BandwidthLimiter) peerLimitsLocked(p peer.ID) RateLimits {
+	if lim, ok := l.peerLimits[p]; ok {
+		return lim
+	}
+	return l.defaultPeerLimits
+}
+
+func (l *BandwidthLimiter) protoLimitsLocked(pid protocol.ID) RateLimits {
+	if lim, ok := l.protoLimits[pid]; ok {
+		return lim
+	}
+	return l.defaultProtoLimits
+}
+
+// Stream wraps s, so that its traffic is shaped by the limiter. The wrapped
+// stream must be closed or reset to release its peer's buckets.
+func (l *BandwidthLimiter) Stream(s Stream) Stream {
+	p := s.Conn().RemotePeer()
+	l.mu.Lock()
+	b, ok := l.peers[p]
+	if !ok {
+		b = &peerBuckets{bucketPair: *newBucketPair(l.peerLimitsLocked(p), l.clock.Now())}
+		l.peers[p] = b
+	}
+	b.refs++
+	l.mu.Unlock()
+	return &limitedStream{Stream: s, l: l, peer: p, peerBuckets: b, waker: clock.NewWaker(l.clock)}
+}
+
+// StreamHandler wraps h, so that the streams it handles are shaped by the
+// limiter.
+func (l *BandwidthLimiter) StreamHandler(h StreamHandler) StreamHandler {
+	return func(s Stream) {
+		h(l.Stream(s))
+	}
+}
+
+// Conn wraps c, so that the streams opened with NewStream are shaped by the
+// limiter. GetStreams returns the streams of c as they are.
+func (l *BandwidthLimiter) Conn(c Conn) Conn {
+	return &limitedConn{Conn: c, l: l}
+}
+
+func (l *BandwidthLimiter) release(p peer.ID, b *peerBuckets) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b.refs--
+	if b.refs == 0 && l.peers[p] == b {
+		delete(l.peers, p)
+	}
+}
+
+func (l *BandwidthLimiter) protoBuckets(pid protocol.ID) *bucketPair {
+	if pid == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.protos[pid]
+	if !ok {
+		b = newBucketPair(l.protoLimitsLocked(pid), l.clock.Now())
+		l.protos[pid] = b
+	}
+	return b
+}
+
+// chunk returns how much data a stream may transfer at once in the given
+// direction.
+func (l *BandwidthLimiter) chunk(dir Direction, buckets ...*bucketPair) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := float64(maxShapedChunk)
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if lim := b.limits.get(dir); !lim.IsUnlimited() {
+			size = math.Min(size, lim.burst())
+		}
+	}
+	return int(math.Max(size, minShapedChunk))
+}
+
+// reserve takes n tokens from all the buckets, and returns how long to wait
+// for them to be available.
+func (l *BandwidthLimiter) reserve(dir Direction, n int, buckets ...*bucketPair) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	var wait time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if d := b.get(dir).reserve(n, now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+type limitedConn struct {
+	Conn
+	l *BandwidthLimiter
+}
+
+func (c *limitedConn) NewStream(ctx context.Context) (Stream, error) {
+	s, err := c.Conn.NewStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.l.Stream(s), nil
+}
+
+type limitedStream struct {
+	Stream
+	l           *BandwidthLimiter
+	peer        peer.ID
+	peerBuckets *peerBuckets
+
+	// waker wakes the reads and writes waiting for the buckets when the
+	// deadlines change, or the stream is reset.
+	waker *clock.Waker
+	// nextRead is the time before which the next read waits, for the data
+	// already read to be refilled. It is only used by the reader.
+	nextRead time.Time
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	reset         bool
+
+	releaseOnce sync.Once
+}
+
+func (s *limitedStream) buckets() (*bucketPair, *bucketPair, *bucketPair) {
+	return s.l.global, &s.peerBuckets.bucketPair, s.l.protoBuckets(s.Protocol())
+}
+
+// waitUntil waits until end, for the buckets to refill. It returns early
+// with os.ErrDeadlineExceeded once the deadline of the direction passes, and
+// with ErrReset once the stream is reset.
+func (s *limitedStream) waitUntil(end time.Time, dir Direction) error {
+	clk := s.l.clock
+	t := clk.AfterFunc(clk.Until(end), s.waker.Wake)
+	defer t.Stop()
+	for {
+		tok := s.waker.Arm()
+		s.mu.Lock()
+		reset, deadline := s.reset, s.writeDeadline
+		if dir == DirInbound {
+			deadline = s.readDeadline
+		}
+		s.mu.Unlock()
+
+		now := clk.Now()
+		switch {
+		case reset:
+			return ErrReset
+		case !deadline.IsZero() && !now.Before(deadline):
+			return os.ErrDeadlineExceeded
+		case !now.Before(end):
+			return nil
+		}
+		var dt clock.Timer
+		if !deadline.IsZero() {
+			dt = clk.AfterFunc(clk.Until(deadline), s.waker.Wake)
+		}
+		s.waker.Wait(tok, nil)
+		if dt != nil {
+			dt.Stop()
+		}
+	}
+}
+
+func (s *limitedStream) Read(b []byte) (int, error) {
+	// wait for the data read before to be refilled, to keep the flow control
+	// window from reopening faster than allowed
+	if s.l.clock.Until(s.nextRead) > 0 {
+		if err := s.waitUntil(s.nextRead, DirInbound); err != nil {
+			return 0, err
+		}
+	}
+
+	g, p, pr := s.buckets()
+	if chunk := s.l.chunk(DirInbound, g, p, pr); len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		if r := s.l.reporter; r != nil {
+			r.LogRecvMessage(int64(n))
+			r.LogRecvMessageStream(int64(n), s.Protocol(), s.peer)
+		}
+		if wait := s.l.reserve(DirInbound, n, g, p, pr); wait > 0 {
+			s.nextRead = s.l.clock.Now().Add(wait)
+		}
+	}
+	return n, err
+}
+
+func (s *limitedStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		g, p, pr := s.buckets()
+		chunk := b
+		if size := s.l.chunk(DirOutbound, g, p, pr); len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if wait := s.l.reserve(DirOutbound, len(chunk), g, p, pr); wait > 0 {
+			if err := s.waitUntil(s.l.clock.Now().Add(wait), DirOutbound); err != nil {
+				return written, err
+			}
+		}
+		n, err := s.Stream.Write(chunk)
+		written += n
+		if n > 0 {
+			if r := s.l.reporter; r != nil {
+				r.LogSentMessage(int64(n))
+				r.LogSentMessageStream(int64(n), s.Protocol(), s.peer)
+			}
+		}
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (s *limitedStream) Close() error {
+	defer s.release()
+	return s.Stream.Close()
+}
+
+func (s *limitedStream) Reset() error {
+	defer s.release()
+	s.mu.Lock()
+	s.reset = true
+	s.mu.Unlock()
+	s.waker.Wake()
+	return s.Stream.Reset()
+}
+
+// setDeadlines records the deadlines for the waits, and wakes them up.
+func (s *limitedStream) setDeadlines(read, write bool, t time.Time) {
+	s.mu.Lock()
+	if read {
+		s.readDeadline = t
+	}
+	if write {
+		s.writeDeadline = t
+	}
+	s.mu.Unlock()
+	s.waker.Wake()
+}
+
+func (s *limitedStream) SetDeadline(t time.Time) error {
+	s.setDeadlines(true, true, t)
+	return s.Stream.SetDeadline(t)
+}
+
+func (s *limitedStream) SetReadDeadline(t time.Time) error {
+	s.setDeadlines(true, false, t)
+	return s.Stream.SetReadDeadline(t)
+}
+
+func (s *limitedStream) SetWriteDeadline(t time.Time) error {
+	s.setDeadlines(false, true, t)
+	return s.Stream.SetWriteDeadline(t)
+}
+
+func (s *limitedStream) release() {
+	s.releaseOnce.Do(func() { s.l.release(s.peer, s.peerBuckets) })
+}
+
+// bucketPair holds the token buckets of both directions.
+type bucketPair struct {
+	limits  RateLimits
+	in, out tokenBucket
+}
+
+func newBucketPair(lim RateLimits, now time.Time) *bucketPair {
+	b := &bucketPair{}
+	b.setLimits(lim, now)
+	return b
+}
+
+func (b *bucketPair) setLimits(lim RateLimits, now time.Time) {
+	b.limits = lim
+	b.in.setLimit(lim.In, now)
+	b.out.setLimit(lim.Out, now)
+}
+
+func (b *bucketPair) get(dir Direction) *tokenBucket {
+	if dir == DirInbound {
+		return &b.in
+	}
+	return &b.out
+}
+
+// tokenBucket is a token bucket whose level may go negative: a reservation
+// larger than the available tokens is granted, and the caller waits for the
+// deficit to be refilled.
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) setLimit(lim RateLimit, now time.Time) {
+	wasUnlimited := tb.limit.IsUnlimited()
+	tb.refill(now)
+	tb.limit = lim
+	if burst := lim.burst(); wasUnlimited || tb.tokens > burst {
+		tb.tokens = burst
+	}
+	tb.last = now
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if tb.limit.IsUnlimited() {
+		return
+	}
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens = math.Min(tb.limit.burst(), tb.tokens+elapsed.Seconds()*tb.limit.Rate)
+	}
+	tb.last = now
+}
+
+func (tb *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	if tb.limit.IsUnlimited() {
+		return 0
+	}
+	tb.refill(now)
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.limit.Rate * float64(time.Second))
+}
@@ -0,0 +1,333 @@
+package network_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	testPeer  = peer.ID("peer")
+	testProto = protocol.ID("/test/1.0.0")
+)
+
+// peerConn is a Conn to testPeer.
+type peerConn struct {
+	network.Conn // only the methods below are used
+}
+
+func (peerConn) RemotePeer() peer.ID { return testPeer }
+
+// sinkStream is a Stream discarding writes, and reading zeros.
+type sinkStream struct {
+	network.Stream // only the methods below are used
+
+	mu      sync.Mutex
+	written int
+}
+
+func (s *sinkStream) Conn() network.Conn                 { return peerConn{} }
+func (s *sinkStream) Protocol() protocol.ID              { return testProto }
+func (s *sinkStream) Close() error                       { return nil }
+func (s *sinkStream) Reset() error                       { return nil }
+func (s *sinkStream) SetDeadline(t time.Time) error      { return nil }
+func (s *sinkStream) SetReadDeadline(t time.Time) error  { return nil }
+func (s *sinkStream) SetWriteDeadline(t time.Time) error { return nil }
+
+func (s *sinkStream) Read(b []byte) (int, error) { return len(b), nil }
+
+func (s *sinkStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written += len(b)
+	return len(b), nil
+}
+
+func (s *sinkStream) Written() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.written
+}
+
+var limiterStart = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func newLimiter(t *testing.T, opts ...network.LimiterOption) (*network.BandwidthLimiter, *clock.Virtual) {
+	t.Helper()
+	clk := clock.NewVirtual(limiterStart)
+	l, err := network.NewBandwidthLimiter(append([]network.LimiterOption{network.WithLimiterClock(clk)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, clk
+}
+
+// pending returns the deadline of the next timer of clk, waiting for one to
+// be scheduled.
+func pending(t *testing.T, clk *clock.Virtual) time.Time {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if at, ok := clk.Next(); ok {
+			return at
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type writeResult struct {
+	n   int
+	err error
+}
+
+func write(s network.Stream, n int) <-chan writeResult {
+	ch := make(chan writeResult, 1)
+	go func() {
+		n, err := s.Write(make([]byte, n))
+		ch <- writeResult{n, err}
+	}()
+	return ch
+}
+
+// runWrite writes n bytes to s, advancing clk through the waits, and returns
+// how long the write took.
+func runWrite(t *testing.T, clk *clock.Virtual, s network.Stream, n int) time.Duration {
+	t.Helper()
+	start := clk.Now()
+	ch := write(s, n)
+	for {
+		select {
+		case r := <-ch:
+			if r.err != nil || r.n != n {
+				t.Fatalf("expected to write %d bytes, wrote %d: %v", n, r.n, r.err)
+			}
+			return clk.Since(start)
+		case <-time.After(time.Millisecond):
+			if at, ok := clk.Next(); ok {
+				clk.AdvanceTo(at)
+			}
+		}
+	}
+}
+
+func TestLimiterRates(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		set    func(l *network.BandwidthLimiter, lim network.RateLimits)
+		size   int
+		expect time.Duration
+	}{
+		{
+			name: "global",
+			set:  func(l *network.BandwidthLimiter, lim network.RateLimits) { l.SetGlobalLimits(lim) },
+			// the first burst is free
+			size: 5000, expect: 4 * time.Second,
+		},
+		{
+			name: "peer",
+			set:  func(l *network.BandwidthLimiter, lim network.RateLimits) { l.SetPeerLimits(testPeer, lim) },
+			size: 3000, expect: 2 * time.Second,
+		},
+		{
+			name: "protocol",
+			set:  func(l *network.BandwidthLimiter, lim network.RateLimits) { l.SetProtocolLimits(testProto, lim) },
+			size: 2000, expect: time.Second,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			l, clk := newLimiter(t)
+			tc.set(l, network.RateLimits{Out: network.RateLimit{Rate: 1000, Burst: 1000}})
+			sink := &sinkStream{}
+			s := l.Stream(sink)
+			defer s.Close()
+
+			if d := runWrite(t, clk, s, tc.size); d != tc.expect {
+				t.Fatalf("expected the write to take %s, took %s", tc.expect, d)
+			}
+			if sink.Written() != tc.size {
+				t.Fatalf("expected %d bytes written, got %d", tc.size, sink.Written())
+			}
+		})
+	}
+}
+
+func TestLimiterReadRate(t *testing.T) {
+	l, clk := newLimiter(t)
+	l.SetGlobalLimits(network.RateLimits{In: network.RateLimit{Rate: 1000, Burst: 1000}})
+	s := l.Stream(&sinkStream{})
+	defer s.Close()
+
+	buf := make([]byte, 4096)
+	// reads are capped to the burst, and the next read waits for the
+	// tokens to be refilled
+	if n, err := s.Read(buf); err != nil || n != 1000 {
+		t.Fatalf("expected to read 1000 bytes, read %d: %v", n, err)
+	}
+	if n, err := s.Read(buf); err != nil || n != 1000 {
+		t.Fatalf("expected to read 1000 bytes, read %d: %v", n, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Read(buf)
+	}()
+	if at := pending(t, clk); !at.Equal(limiterStart.Add(time.Second)) {
+		t.Fatalf("expected the read to wait until %s, waits until %s", limiterStart.Add(time.Second), at)
+	}
+	clk.Advance(time.Second)
+	<-done
+}
+
+func TestLimiterRuntimeAdjustment(t *testing.T) {
+	l, clk := newLimiter(t)
+	s := l.Stream(&sinkStream{})
+	defer s.Close()
+
+	// unlimited
+	if d := runWrite(t, clk, s, 1<<20); d != 0 {
+		t.Fatalf("expected an unlimited write not to wait, waited %s", d)
+	}
+
+	l.SetDefaultPeerLimits(network.RateLimits{Out: network.RateLimit{Rate: 1000, Burst: 1000}})
+	if d := runWrite(t, clk, s, 3000); d != 2*time.Second {
+		t.Fatalf("expected the write to take 2s, took %s", d)
+	}
+	if lim := l.PeerUsage(testPeer).Limits.Out.Rate; lim != 1000 {
+		t.Fatalf("expected the peer limit to apply, got %f", lim)
+	}
+
+	// raising the limit applies to the streams already open
+	l.SetPeerLimits(testPeer, network.RateLimits{Out: network.RateLimit{Rate: 4000, Burst: 1000}})
+	clk.Advance(time.Second)
+	if d := runWrite(t, clk, s, 5000); d != time.Second {
+		t.Fatalf("expected the write to take 1s, took %s", d)
+	}
+
+	l.RemovePeerLimits(testPeer)
+	l.SetDefaultPeerLimits(network.RateLimits{})
+	if d := runWrite(t, clk, s, 1<<20); d != 0 {
+		t.Fatalf("expected the limits to be lifted, waited %s", d)
+	}
+}
+
+func TestLimiterWaitInterrupted(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		interrupt func(clk *clock.Virtual, s network.Stream)
+		err       error
+	}{
+		{
+			name:      "reset",
+			interrupt: func(_ *clock.Virtual, s network.Stream) { s.Reset() },
+			err:       network.ErrReset,
+		},
+		{
+			name: "deadline set while waiting",
+			interrupt: func(clk *clock.Virtual, s network.Stream) {
+				s.SetWriteDeadline(clk.Now())
+			},
+			err: os.ErrDeadlineExceeded,
+		},
+		{
+			name: "deadline passing",
+			interrupt: func(clk *clock.Virtual, s network.Stream) {
+				s.SetDeadline(clk.Now().Add(time.Second))
+				clk.Advance(time.Second)
+			},
+			err: os.ErrDeadlineExceeded,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			l, clk := newLimiter(t)
+			l.SetGlobalLimits(network.RateLimits{Out: network.RateLimit{Rate: 1, Burst: 1000}})
+			sink := &sinkStream{}
+			s := l.Stream(sink)
+			defer s.Close()
+
+			// the second chunk waits for 1000s
+			ch := write(s, 2000)
+			pending(t, clk)
+			tc.interrupt(clk, s)
+			r := <-ch
+			if !errors.Is(r.err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, r.err)
+			}
+			if r.n != 1000 || sink.Written() != 1000 {
+				t.Fatalf("expected the first chunk only to be written, wrote %d", sink.Written())
+			}
+			if clk.Since(limiterStart) > time.Second {
+				t.Fatalf("expected the wait to be interrupted, took %s", clk.Since(limiterStart))
+			}
+		})
+	}
+}
+
+func TestLimiterReadDeadline(t *testing.T) {
+	l, clk := newLimiter(t)
+	l.SetGlobalLimits(network.RateLimits{In: network.RateLimit{Rate: 1, Burst: 1000}})
+	s := l.Stream(&sinkStream{})
+	defer s.Close()
+
+	buf := make([]byte, 1000)
+	s.Read(buf)
+	s.Read(buf)
+	s.SetReadDeadline(limiterStart.Add(time.Second))
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Read(buf)
+		errs <- err
+	}()
+	pending(t, clk)
+	clk.Advance(time.Second)
+	if err := <-errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read to time out, got %v", err)
+	}
+}
+
+func TestLimiterBandwidthCounter(t *testing.T) {
+	bwc := metrics.NewBandwidthCounter()
+	l, clk := newLimiter(t, network.WithLimiterReporter(bwc))
+	s := l.Stream(&sinkStream{})
+	defer s.Close()
+
+	runWrite(t, clk, s, 3000)
+	buf := make([]byte, 500)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the meters are updated by a background sweep, once a second
+	check := func(kind string, stats func() metrics.Stats) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			st := stats()
+			if st.TotalOut == 3000 && st.TotalIn == 500 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s totals of 3000 out and 500 in, got %d out and %d in", kind, st.TotalOut, st.TotalIn)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	check("global", bwc.GetBandwidthTotals)
+	check("peer", func() metrics.Stats { return bwc.GetBandwidthForPeer(testPeer) })
+	check("protocol", func() metrics.Stats { return bwc.GetBandwidthForProtocol(testProto) })
+	check("usage", func() metrics.Stats { return l.GlobalUsage().Stats })
+	check("peer usage", func() metrics.Stats { return l.PeerUsage(testPeer).Stats })
+	check("protocol usage", func() metrics.Stats { return l.ProtocolUsage(testProto).Stats })
+}
@@ -0,0 +1,230 @@
+package rcmgr
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Allowlist holds the peers and subnets whose connections and streams are
+// accounted in the allowlisted scopes, rather than in the system and
+// transient scopes. Its entries are multiaddrs of one of the forms:
+//
+//	/p2p/<peer>                               the peer, from any address
+//	/ip4/<ip>/ipcidr/<bits>                   any peer from the subnet
+//	/ip4/<ip>/ipcidr/<bits>/p2p/<peer>        the peer, from the subnet
+//
+// with /ip6 in place of /ip4 for IPv6, and the /ipcidr component omitted for
+// single addresses.
+type Allowlist struct {
+	mu sync.RWMutex
+	// anyPeer holds the subnets allowed for any peer, peerNets the subnets
+	// allowed for given peers, and peers the peers allowed from anywhere.
+	anyPeer  []*net.IPNet
+	peerNets map[peer.ID][]*net.IPNet
+	peers    map[peer.ID]struct{}
+}
+
+// NewAllowlist creates an empty Allowlist.
+func NewAllowlist() *Allowlist {
+	return &Allowlist{
+		peerNets: make(map[peer.ID][]*net.IPNet),
+		peers:    make(map[peer.ID]struct{}),
+	}
+}
+
+// parseAllowlistEntry returns the subnet and peer of an entry, either of
+// which may be missing.
+func parseAllowlistEntry(a ma.Multiaddr) (*net.IPNet, peer.ID, error) {
+	var (
+		ip   net.IP
+		bits = -1
+		p    peer.ID
+		err  error
+	)
+	ma.ForEach(a, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_IP4, ma.P_IP6:
+			if ip != nil || p != "" {
+				err = fmt.Errorf("unexpected %s component", c.Protocol().Name)
+				return false
+			}
+			ip = net.IP(c.RawValue())
+		case ma.P_IPCIDR:
+			if ip == nil || bits >= 0 || p != "" {
+				err = fmt.Errorf("unexpected %s component", c.Protocol().Name)
+				return false
+			}
+			bits = int(c.RawValue()[0])
+		case ma.P_P2P:
+			if p != "" {
+				err = fmt.Errorf("unexpected %s component", c.Protocol().Name)
+				return false
+			}
+			p, err = peer.IDFromBytes(c.RawValue())
+		default:
+			err = fmt.Errorf("unexpected %s component", c.Protocol().Name)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid allowlist entry %s: %w", a, err)
+	}
+	if ip == nil {
+		if p == "" {
+			return nil, "", fmt.Errorf("invalid allowlist entry %s: no address nor peer", a)
+		}
+		return nil, p, nil
+	}
+	size := 8 * len(ip)
+	if bits < 0 {
+		bits = size
+	}
+	if bits > size {
+		return nil, "", fmt.Errorf("invalid allowlist entry %s: prefix longer than the address", a)
+	}
+	mask := net.CIDRMask(bits, size)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, p, nil
+}
+
+// Add adds an entry to the allowlist.
+func (al *Allowlist) Add(a ma.Multiaddr) error {
+	ipnet, p, err := parseAllowlistEntry(a)
+	if err != nil {
+		return err
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	switch {
+	case ipnet == nil:
+		al.peers[p] = struct{}{}
+	case p == "":
+		al.anyPeer = append(al.anyPeer, ipnet)
+	default:
+		al.peerNets[p] = append(al.peerNets[p], ipnet)
+	}
+	return nil
+}
+
+// Remove removes an entry from the allowlist.
+func (al *Allowlist) Remove(a ma.Multiaddr) error {
+	ipnet, p, err := parseAllowlistEntry(a)
+	if err != nil {
+		return err
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	switch {
+	case ipnet == nil:
+		delete(al.peers, p)
+	case p == "":
+		al.anyPeer = removeNet(al.anyPeer, ipnet)
+	default:
+		if nets := removeNet(al.peerNets[p], ipnet); len(nets) > 0 {
+			al.peerNets[p] = nets
+		} else {
+			delete(al.peerNets, p)
+		}
+	}
+	return nil
+}
+
+func removeNet(nets []*net.IPNet, ipnet *net.IPNet) []*net.IPNet {
+	for i, n := range nets {
+		if n.String() == ipnet.String() {
+			return append(nets[:i:i], nets[i+1:]...)
+		}
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns whether some peer is allowed from addr. The peer of a
+// connection from addr must still be checked once known, with
+// AllowedPeerAndMultiaddr.
+func (al *Allowlist) Allowed(addr ma.Multiaddr) bool {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	if containsIP(al.anyPeer, ip) {
+		return true
+	}
+	for _, nets := range al.peerNets {
+		if containsIP(nets, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedPeer returns whether p is allowed, from any or some addresses.
+func (al *Allowlist) AllowedPeer(p peer.ID) bool {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	if _, ok := al.peers[p]; ok {
+		return true
+	}
+	_, ok := al.peerNets[p]
+	return ok
+}
+
+// AllowedPeerAndMultiaddr returns whether p is allowed from addr. addr may be
+// nil, if unknown.
+func (al *Allowlist) AllowedPeerAndMultiaddr(p peer.ID, addr ma.Multiaddr) bool {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	if _, ok := al.peers[p]; ok {
+		return true
+	}
+	if addr == nil {
+		return false
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	return containsIP(al.anyPeer, ip) || containsIP(al.peerNets[p], ip)
+}
+
+// WithAllowlistedMultiaddrs adds entries to the allowlist of the resource
+// manager. See Allowlist for the forms of the entries.
+func WithAllowlistedMultiaddrs(addrs []ma.Multiaddr) Option {
+	return func(rm *resourceManager) error {
+		for _, a := range addrs {
+			if err := rm.allowlist.Add(a); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// GetAllowlist returns the allowlist of rm, if it is a resource manager of
+// this package.
+func GetAllowlist(rm network.ResourceManager) (*Allowlist, bool) {
+	r, ok := rm.(*resourceManager)
+	if !ok {
+		return nil, false
+	}
+	return r.allowlist, true
+}
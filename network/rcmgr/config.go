@@ -0,0 +1,523 @@
+package rcmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LimitValue is a single value of a LimitConfig. In JSON and YAML, it is
+// either a number, or one of the strings "unlimited" and "blocked". A
+// number 0 blocks the resource too; an omitted value inherits the value of
+// the parent configuration.
+type LimitValue int64
+
+const (
+	// DefaultValue inherits the value of the parent configuration.
+	DefaultValue LimitValue = 0
+	// UnlimitedValue does not limit the resource.
+	UnlimitedValue LimitValue = -1
+	// BlockedValue blocks the resource entirely.
+	BlockedValue LimitValue = -2
+)
+
+func (v LimitValue) String() string {
+	switch v {
+	case DefaultValue:
+		return "default"
+	case UnlimitedValue:
+		return "unlimited"
+	case BlockedValue:
+		return "blocked"
+	default:
+		return strconv.FormatInt(int64(v), 10)
+	}
+}
+
+func parseLimitValue(s string) (LimitValue, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "unlimited":
+		return UnlimitedValue, nil
+	case "blocked":
+		return BlockedValue, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %q: expected a number, \"unlimited\" or \"blocked\"", s)
+	}
+	return limitValueOf(n)
+}
+
+func limitValueOf(n int64) (LimitValue, error) {
+	switch {
+	case n < 0:
+		return 0, fmt.Errorf("invalid limit %d: limits cannot be negative", n)
+	case n == 0:
+		return BlockedValue, nil
+	default:
+		return LimitValue(n), nil
+	}
+}
+
+func (v LimitValue) MarshalJSON() ([]byte, error) {
+	switch v {
+	case UnlimitedValue, BlockedValue:
+		return json.Marshal(v.String())
+	default:
+		return json.Marshal(int64(v))
+	}
+}
+
+func (v *LimitValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		lv, err := parseLimitValue(s)
+		if err != nil {
+			return err
+		}
+		*v = lv
+		return nil
+	}
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("invalid limit %s: expected a number, \"unlimited\" or \"blocked\"", b)
+	}
+	lv, err := limitValueOf(n)
+	if err != nil {
+		return err
+	}
+	*v = lv
+	return nil
+}
+
+func (v LimitValue) MarshalYAML() (interface{}, error) {
+	switch v {
+	case UnlimitedValue, BlockedValue:
+		return v.String(), nil
+	default:
+		return int64(v), nil
+	}
+}
+
+func (v *LimitValue) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: invalid limit: expected a number, \"unlimited\" or \"blocked\"", node.Line)
+	}
+	lv, err := parseLimitValue(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*v = lv
+	return nil
+}
+
+// LimitConfig is the configuration of a Limit. Its omitted values inherit
+// the values of the parent configuration.
+type LimitConfig struct {
+	Memory          LimitValue `json:"memory,omitempty" yaml:"memory,omitempty"`
+	FD              LimitValue `json:"fd,omitempty" yaml:"fd,omitempty"`
+	Conns           LimitValue `json:"conns,omitempty" yaml:"conns,omitempty"`
+	ConnsInbound    LimitValue `json:"connsInbound,omitempty" yaml:"connsInbound,omitempty"`
+	ConnsOutbound   LimitValue `json:"connsOutbound,omitempty" yaml:"connsOutbound,omitempty"`
+	Streams         LimitValue `json:"streams,omitempty" yaml:"streams,omitempty"`
+	StreamsInbound  LimitValue `json:"streamsInbound,omitempty" yaml:"streamsInbound,omitempty"`
+	StreamsOutbound LimitValue `json:"streamsOutbound,omitempty" yaml:"streamsOutbound,omitempty"`
+}
+
+func (c *LimitConfig) values() []*LimitValue {
+	return []*LimitValue{
+		&c.Memory, &c.FD,
+		&c.Conns, &c.ConnsInbound, &c.ConnsOutbound,
+		&c.Streams, &c.StreamsInbound, &c.StreamsOutbound,
+	}
+}
+
+// ScalingLimitConfig is the configuration of a scope whose limits grow with
+// the size of the machine. The limit for a machine with m GiB of memory
+// available to the node and n file descriptors is Base plus m times PerGiB,
+// plus FDFraction times n file descriptors. Unlimited and blocked values of
+// Base do not scale.
+type ScalingLimitConfig struct {
+	Base       LimitConfig `json:"base,omitempty" yaml:"base,omitempty"`
+	PerGiB     LimitConfig `json:"perGiB,omitempty" yaml:"perGiB,omitempty"`
+	FDFraction float64     `json:"fdFraction,omitempty" yaml:"fdFraction,omitempty"`
+}
+
+// Config is the declarative configuration of the limits of a resource
+// manager. Per-service, per-protocol and per-peer overrides inherit the
+// values they omit from the corresponding defaults, and every other scope
+// from DefaultConfig.
+type Config struct {
+	System    ScalingLimitConfig `json:"system,omitempty" yaml:"system,omitempty"`
+	Transient ScalingLimitConfig `json:"transient,omitempty" yaml:"transient,omitempty"`
+
+	ServiceDefault ScalingLimitConfig            `json:"serviceDefault,omitempty" yaml:"serviceDefault,omitempty"`
+	Service        map[string]ScalingLimitConfig `json:"service,omitempty" yaml:"service,omitempty"`
+
+	ProtocolDefault ScalingLimitConfig            `json:"protocolDefault,omitempty" yaml:"protocolDefault,omitempty"`
+	Protocol        map[string]ScalingLimitConfig `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+
+	PeerDefault ScalingLimitConfig `json:"peerDefault,omitempty" yaml:"peerDefault,omitempty"`
+	// Peer is keyed by the string encoding of peer IDs.
+	Peer map[string]ScalingLimitConfig `json:"peer,omitempty" yaml:"peer,omitempty"`
+
+	AllowlistedSystem    ScalingLimitConfig `json:"allowlistedSystem,omitempty" yaml:"allowlistedSystem,omitempty"`
+	AllowlistedTransient ScalingLimitConfig `json:"allowlistedTransient,omitempty" yaml:"allowlistedTransient,omitempty"`
+
+	Conn   ScalingLimitConfig `json:"conn,omitempty" yaml:"conn,omitempty"`
+	Stream ScalingLimitConfig `json:"stream,omitempty" yaml:"stream,omitempty"`
+}
+
+// DefaultConfig is the configuration every Config falls back to. Scaled to
+// 1GiB of memory and 512 file descriptors, it yields DefaultLimits.
+var DefaultConfig = Config{
+	System: ScalingLimitConfig{
+		Base:       LimitConfig{Memory: 128 << 20, Conns: 64, ConnsInbound: 32, ConnsOutbound: 64, Streams: 1024, StreamsInbound: 512, StreamsOutbound: 1024},
+		PerGiB:     LimitConfig{Memory: 896 << 20, Conns: 192, ConnsInbound: 96, ConnsOutbound: 192, Streams: 3072, StreamsInbound: 1536, StreamsOutbound: 3072},
+		FDFraction: 1,
+	},
+	Transient: ScalingLimitConfig{
+		Base:       LimitConfig{Memory: 32 << 20, Conns: 16, ConnsInbound: 8, ConnsOutbound: 16, Streams: 64, StreamsInbound: 32, StreamsOutbound: 64},
+		PerGiB:     LimitConfig{Memory: 32 << 20, Conns: 48, ConnsInbound: 24, ConnsOutbound: 48, Streams: 192, StreamsInbound: 96, StreamsOutbound: 192},
+		FDFraction: 0.25,
+	},
+	ServiceDefault: ScalingLimitConfig{
+		Base:   LimitConfig{Memory: 32 << 20, FD: BlockedValue, Conns: BlockedValue, ConnsInbound: BlockedValue, ConnsOutbound: BlockedValue, Streams: 512, StreamsInbound: 256, StreamsOutbound: 512},
+		PerGiB: LimitConfig{Memory: 96 << 20, Streams: 1536, StreamsInbound: 768, StreamsOutbound: 1536},
+	},
+	ProtocolDefault: ScalingLimitConfig{
+		Base:   LimitConfig{Memory: 16 << 20, FD: BlockedValue, Conns: BlockedValue, ConnsInbound: BlockedValue, ConnsOutbound: BlockedValue, Streams: 512, StreamsInbound: 128, StreamsOutbound: 512},
+		PerGiB: LimitConfig{Memory: 48 << 20, Streams: 1536, StreamsInbound: 384, StreamsOutbound: 1536},
+	},
+	PeerDefault: ScalingLimitConfig{
+		Base:   LimitConfig{Memory: 16 << 20, FD: 4, Conns: 8, ConnsInbound: 4, ConnsOutbound: 8, Streams: 128, StreamsInbound: 64, StreamsOutbound: 128},
+		PerGiB: LimitConfig{Memory: 48 << 20, Streams: 384, StreamsInbound: 192, StreamsOutbound: 384},
+	},
+	AllowlistedSystem: ScalingLimitConfig{
+		Base:       LimitConfig{Memory: 32 << 20, Conns: 64, ConnsInbound: 32, ConnsOutbound: 64, Streams: 128, StreamsInbound: 64, StreamsOutbound: 128},
+		PerGiB:     LimitConfig{Memory: 96 << 20, Streams: 384, StreamsInbound: 192, StreamsOutbound: 384},
+		FDFraction: 0.125,
+	},
+	AllowlistedTransient: ScalingLimitConfig{
+		Base:       LimitConfig{Memory: 16 << 20, Conns: 16, ConnsInbound: 8, ConnsOutbound: 16, Streams: 32, StreamsInbound: 16, StreamsOutbound: 32},
+		PerGiB:     LimitConfig{Memory: 16 << 20, Streams: 96, StreamsInbound: 48, StreamsOutbound: 96},
+		FDFraction: 0.03125,
+	},
+	// connections and streams scale like the smallest scope they are
+	// reserved in, the allowlisted transient scope, so that they fit in it
+	// at every size
+	Conn: ScalingLimitConfig{
+		Base:   LimitConfig{Memory: 16 << 20, FD: 1, Conns: 1, ConnsInbound: 1, ConnsOutbound: 1, Streams: BlockedValue, StreamsInbound: BlockedValue, StreamsOutbound: BlockedValue},
+		PerGiB: LimitConfig{Memory: 16 << 20},
+	},
+	Stream: ScalingLimitConfig{
+		Base:   LimitConfig{Memory: 8 << 20, FD: BlockedValue, Conns: BlockedValue, ConnsInbound: BlockedValue, ConnsOutbound: BlockedValue, Streams: 1, StreamsInbound: 1, StreamsOutbound: 1},
+		PerGiB: LimitConfig{Memory: 8 << 20},
+	},
+}
+
+// ParseConfigJSON parses a JSON Config. Unknown fields are rejected.
+func ParseConfigJSON(r io.Reader) (*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to parse limit config: %w", err)
+	}
+	return &c, nil
+}
+
+// ParseConfigYAML parses a YAML Config. Unknown fields are rejected.
+func ParseConfigYAML(r io.Reader) (*Config, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	var c Config
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse limit config: %w", err)
+	}
+	return &c, nil
+}
+
+// Machine resources given to the node by AutoScale, when they cannot be
+// found out.
+const (
+	fallbackMemory = 8 << 30
+	fallbackFDs    = 1024
+)
+
+// AutoScale scales the configuration to the machine it runs on, giving the
+// node an eighth of the total memory and half of the file descriptors the
+// process may open.
+func (c *Config) AutoScale() (Limits, error) {
+	memory := totalMemory()
+	if memory <= 0 {
+		memory = fallbackMemory
+	}
+	fds := maxFDs()
+	if fds <= 0 {
+		fds = fallbackFDs
+	}
+	return c.Scale(memory/8, fds/2)
+}
+
+// Scale computes the limits for a node with memory bytes of memory and fds
+// file descriptors available, and validates them.
+func (c *Config) Scale(memory int64, fds int) (Limits, error) {
+	gib := float64(memory) / (1 << 30)
+	scale := func(sc, fallback ScalingLimitConfig) Limit {
+		return scaleLimit(inherit(sc, fallback), gib, fds)
+	}
+
+	l := Limits{
+		System:               scale(c.System, DefaultConfig.System),
+		Transient:            scale(c.Transient, DefaultConfig.Transient),
+		ServiceDefault:       scale(c.ServiceDefault, DefaultConfig.ServiceDefault),
+		ProtocolDefault:      scale(c.ProtocolDefault, DefaultConfig.ProtocolDefault),
+		PeerDefault:          scale(c.PeerDefault, DefaultConfig.PeerDefault),
+		AllowlistedSystem:    scale(c.AllowlistedSystem, DefaultConfig.AllowlistedSystem),
+		AllowlistedTransient: scale(c.AllowlistedTransient, DefaultConfig.AllowlistedTransient),
+		Conn:                 scale(c.Conn, DefaultConfig.Conn),
+		Stream:               scale(c.Stream, DefaultConfig.Stream),
+	}
+	serviceDefault := inherit(c.ServiceDefault, DefaultConfig.ServiceDefault)
+	if len(c.Service) > 0 {
+		l.Service = make(map[string]Limit, len(c.Service))
+		for svc, sc := range c.Service {
+			l.Service[svc] = scale(sc, serviceDefault)
+		}
+	}
+	protocolDefault := inherit(c.ProtocolDefault, DefaultConfig.ProtocolDefault)
+	if len(c.Protocol) > 0 {
+		l.Protocol = make(map[protocol.ID]Limit, len(c.Protocol))
+		for proto, sc := range c.Protocol {
+			l.Protocol[protocol.ID(proto)] = scale(sc, protocolDefault)
+		}
+	}
+	peerDefault := inherit(c.PeerDefault, DefaultConfig.PeerDefault)
+	if len(c.Peer) > 0 {
+		l.Peer = make(map[peer.ID]Limit, len(c.Peer))
+		for s, sc := range c.Peer {
+			p, err := peer.Decode(s)
+			if err != nil {
+				return Limits{}, fmt.Errorf("invalid peer ID %q in limit config: %w", s, err)
+			}
+			l.Peer[p] = scale(sc, peerDefault)
+		}
+	}
+	if err := l.Validate(); err != nil {
+		return Limits{}, err
+	}
+	return l, nil
+}
+
+// inherit fills the values sc omits from fallback.
+func inherit(sc, fallback ScalingLimitConfig) ScalingLimitConfig {
+	if sc.Base.FD == DefaultValue && sc.FDFraction == 0 {
+		sc.FDFraction = fallback.FDFraction
+	}
+	base, perGiB := sc.Base.values(), sc.PerGiB.values()
+	fbase, fperGiB := fallback.Base.values(), fallback.PerGiB.values()
+	for i := range base {
+		if *base[i] != DefaultValue {
+			continue
+		}
+		// inherited values scale like in the fallback, unless the scaling
+		// is overridden
+		*base[i] = *fbase[i]
+		if *perGiB[i] == DefaultValue {
+			*perGiB[i] = *fperGiB[i]
+		}
+	}
+	return sc
+}
+
+func scaleLimit(sc ScalingLimitConfig, gib float64, fds int) Limit {
+	value := func(base, perGiB LimitValue, max int64) int64 {
+		switch base {
+		case UnlimitedValue:
+			return max
+		case BlockedValue, DefaultValue:
+			return 0
+		}
+		v := float64(base)
+		if perGiB > 0 {
+			v += float64(perGiB) * gib
+		}
+		if v >= float64(max) {
+			return max
+		}
+		return int64(v)
+	}
+	count := func(base, perGiB LimitValue) int {
+		return int(value(base, perGiB, math.MaxInt32))
+	}
+
+	l := Limit{
+		Memory:          value(sc.Base.Memory, sc.PerGiB.Memory, math.MaxInt64),
+		FD:              count(sc.Base.FD, sc.PerGiB.FD),
+		Conns:           count(sc.Base.Conns, sc.PerGiB.Conns),
+		ConnsInbound:    count(sc.Base.ConnsInbound, sc.PerGiB.ConnsInbound),
+		ConnsOutbound:   count(sc.Base.ConnsOutbound, sc.PerGiB.ConnsOutbound),
+		Streams:         count(sc.Base.Streams, sc.PerGiB.Streams),
+		StreamsInbound:  count(sc.Base.StreamsInbound, sc.PerGiB.StreamsInbound),
+		StreamsOutbound: count(sc.Base.StreamsOutbound, sc.PerGiB.StreamsOutbound),
+	}
+	if sc.FDFraction > 0 && sc.Base.FD != UnlimitedValue && sc.Base.FD != BlockedValue {
+		fd := float64(l.FD) + sc.FDFraction*float64(fds)
+		if fd >= math.MaxInt32 {
+			l.FD = math.MaxInt32
+		} else {
+			l.FD = int(fd)
+		}
+	}
+	return l
+}
+
+// ValidationError lists the inconsistencies found in Limits.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "inconsistent resource limits:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// limitFields names the fields of a Limit, in the order of Limit.values.
+var limitFields = []string{
+	"memory", "fd",
+	"conns", "inbound conns", "outbound conns",
+	"streams", "inbound streams", "outbound streams",
+}
+
+func (l Limit) values() []int64 {
+	return []int64{
+		l.Memory, int64(l.FD),
+		int64(l.Conns), int64(l.ConnsInbound), int64(l.ConnsOutbound),
+		int64(l.Streams), int64(l.StreamsInbound), int64(l.StreamsOutbound),
+	}
+}
+
+type namedLimit struct {
+	name  string
+	limit Limit
+}
+
+// Validate checks that no limit is negative, that no direction allows more
+// than the total, and that no scope allows more than the scopes it is
+// reserved in: the system scope for every scope, the transient and
+// allowlisted scopes for connections and streams, the peer scopes for
+// connections and streams, and the protocol and service scopes for streams.
+// It reports every inconsistency found.
+func (l Limits) Validate() error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	system := namedLimit{"system", l.System}
+	transient := namedLimit{"transient", l.Transient}
+	allowlistedSystem := namedLimit{"allowlisted system", l.AllowlistedSystem}
+	allowlistedTransient := namedLimit{"allowlisted transient", l.AllowlistedTransient}
+	conn := namedLimit{"conn", l.Conn}
+	stream := namedLimit{"stream", l.Stream}
+
+	peers := []namedLimit{{"peer default", l.PeerDefault}}
+	for p, lim := range l.Peer {
+		peers = append(peers, namedLimit{"peer " + p.String(), lim})
+	}
+	streamParents := []namedLimit{{"protocol default", l.ProtocolDefault}}
+	for proto, lim := range l.Protocol {
+		streamParents = append(streamParents, namedLimit{"protocol " + string(proto), lim})
+	}
+	streamParents = append(streamParents, namedLimit{"service default", l.ServiceDefault})
+	for svc, lim := range l.Service {
+		streamParents = append(streamParents, namedLimit{"service " + svc, lim})
+	}
+	sort.SliceStable(peers[1:], func(i, j int) bool { return peers[1+i].name < peers[1+j].name })
+	sort.SliceStable(streamParents, func(i, j int) bool { return streamParents[i].name < streamParents[j].name })
+
+	children := append([]namedLimit{transient, conn, stream}, peers...)
+	children = append(children, streamParents...)
+	for _, s := range append([]namedLimit{system, allowlistedSystem, allowlistedTransient}, children...) {
+		checkLimit(s, report)
+	}
+	for _, s := range children {
+		checkExceeds(s, system, limitFields, report)
+	}
+	checkExceeds(allowlistedTransient, allowlistedSystem, limitFields, report)
+	// connections and streams only reserve memory and file descriptors in
+	// their parents beyond their own kind
+	connFields := limitFields[:5]
+	streamFields := []string{"memory", "fd", "streams", "inbound streams", "outbound streams"}
+	checkExceeds(conn, transient, connFields, report)
+	checkExceeds(stream, transient, streamFields, report)
+	for _, p := range []namedLimit{allowlistedSystem, allowlistedTransient} {
+		checkExceeds(conn, p, connFields, report)
+		checkExceeds(stream, p, streamFields, report)
+	}
+	for _, p := range peers {
+		checkExceeds(conn, p, connFields, report)
+		checkExceeds(stream, p, streamFields, report)
+	}
+	for _, p := range streamParents {
+		checkExceeds(stream, p, streamFields, report)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func checkLimit(s namedLimit, report func(string, ...interface{})) {
+	for i, v := range s.limit.values() {
+		if v < 0 {
+			report("%s %s limit is negative (%d)", s.name, limitFields[i], v)
+		}
+	}
+	if s.limit.ConnsInbound > s.limit.Conns {
+		report("%s inbound conns limit (%d) exceeds its conns limit (%d)", s.name, s.limit.ConnsInbound, s.limit.Conns)
+	}
+	if s.limit.ConnsOutbound > s.limit.Conns {
+		report("%s outbound conns limit (%d) exceeds its conns limit (%d)", s.name, s.limit.ConnsOutbound, s.limit.Conns)
+	}
+	if s.limit.StreamsInbound > s.limit.Streams {
+		report("%s inbound streams limit (%d) exceeds its streams limit (%d)", s.name, s.limit.StreamsInbound, s.limit.Streams)
+	}
+	if s.limit.StreamsOutbound > s.limit.Streams {
+		report("%s outbound streams limit (%d) exceeds its streams limit (%d)", s.name, s.limit.StreamsOutbound, s.limit.Streams)
+	}
+}
+
+// checkExceeds reports the fields in which child allows more than parent.
+// Resources blocked in the parent are deliberately so, and not reported;
+// negative parent limits are reported by checkLimit already.
+func checkExceeds(child, parent namedLimit, fields []string, report func(string, ...interface{})) {
+	cv, pv := child.limit.values(), parent.limit.values()
+	for i, f := range limitFields {
+		if !containsString(fields, f) {
+			continue
+		}
+		if pv[i] > 0 && cv[i] > pv[i] {
+			report("%s %s limit (%d) exceeds the %s %s limit (%d)", child.name, f, cv[i], parent.name, f, pv[i])
+		}
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package rcmgr_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network/rcmgr"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func randPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	sk, _, err := ic.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParseConfig(t *testing.T) {
+	expected := rcmgr.LimitConfig{
+		Memory:  rcmgr.UnlimitedValue,
+		FD:      rcmgr.BlockedValue,
+		Conns:   rcmgr.BlockedValue,
+		Streams: 100,
+	}
+	for _, tc := range []struct {
+		name  string
+		parse func(string) (*rcmgr.Config, error)
+		doc   string
+	}{
+		{
+			name:  "json",
+			parse: func(s string) (*rcmgr.Config, error) { return rcmgr.ParseConfigJSON(strings.NewReader(s)) },
+			doc:   `{"system": {"base": {"memory": "unlimited", "fd": "blocked", "conns": 0, "streams": 100}}}`,
+		},
+		{
+			name:  "yaml",
+			parse: func(s string) (*rcmgr.Config, error) { return rcmgr.ParseConfigYAML(strings.NewReader(s)) },
+			doc:   "system:\n  base:\n    memory: unlimited\n    fd: Blocked\n    conns: 0\n    streams: 100\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := tc.parse(tc.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.System.Base != expected {
+				t.Fatalf("expected %+v, got %+v", expected, c.System.Base)
+			}
+			if c.System.PerGiB != (rcmgr.LimitConfig{}) {
+				t.Fatalf("expected omitted values to be left to inherit, got %+v", c.System.PerGiB)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, doc := range []string{
+		`{"system": {"base": {"memory": -1}}}`,
+		`{"system": {"base": {"memory": "lots"}}}`,
+		`{"system": {"base": {"memory": 1.5}}}`,
+		`{"system": {"base": {"memroy": 1}}}`,
+		`{"sytem": {}}`,
+	} {
+		if _, err := rcmgr.ParseConfigJSON(strings.NewReader(doc)); err == nil {
+			t.Errorf("expected %s to be rejected", doc)
+		}
+	}
+	for _, doc := range []string{
+		"system:\n  base:\n    memory: -1\n",
+		"system:\n  base:\n    memory: lots\n",
+		"system:\n  base:\n    memory: [1]\n",
+		"system:\n  base:\n    memroy: 1\n",
+		"sytem: {}\n",
+	} {
+		if _, err := rcmgr.ParseConfigYAML(strings.NewReader(doc)); err == nil {
+			t.Errorf("expected %q to be rejected", doc)
+		}
+	}
+
+	_, err := rcmgr.ParseConfigYAML(strings.NewReader("system:\n  base:\n    memory: lots\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected the error to give the line, got %v", err)
+	}
+	if c, err := rcmgr.ParseConfigYAML(strings.NewReader("")); err != nil || !reflect.DeepEqual(*c, rcmgr.Config{}) {
+		t.Fatalf("expected an empty config, got %+v, %v", c, err)
+	}
+}
+
+func TestLimitValueMarshal(t *testing.T) {
+	b, err := json.Marshal(rcmgr.LimitConfig{Memory: rcmgr.UnlimitedValue, FD: rcmgr.BlockedValue, Conns: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"memory":"unlimited","fd":"blocked","conns":5}` {
+		t.Fatalf("unexpected encoding: %s", b)
+	}
+}
+
+func TestConfigScaleDefault(t *testing.T) {
+	var c rcmgr.Config
+	l, err := c.Scale(1<<30, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(l, rcmgr.DefaultLimits) {
+		t.Fatalf("expected the default config to yield the default limits, got %+v", l)
+	}
+}
+
+func TestConfigScaleSizes(t *testing.T) {
+	var c rcmgr.Config
+	for _, memory := range []int64{0, 16 << 20, 128 << 20, 512 << 20, 1 << 30, 6 << 30, 64 << 30, 1 << 40} {
+		for _, fds := range []int{64, 512, 4096, 1 << 20} {
+			if _, err := c.Scale(memory, fds); err != nil {
+				t.Errorf("memory=%d fds=%d: %v", memory, fds, err)
+			}
+		}
+	}
+	if _, err := c.AutoScale(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigScaling(t *testing.T) {
+	c := rcmgr.Config{
+		System: rcmgr.ScalingLimitConfig{
+			Base:       rcmgr.LimitConfig{Memory: rcmgr.UnlimitedValue, Conns: 1000, ConnsInbound: 500, ConnsOutbound: 1000},
+			PerGiB:     rcmgr.LimitConfig{Memory: 1 << 30, Conns: 10, ConnsInbound: 5, ConnsOutbound: 10},
+			FDFraction: 0.5,
+		},
+	}
+	l, err := c.Scale(4<<30, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.System.Memory != math.MaxInt64 {
+		t.Fatalf("expected an unlimited base not to scale, got %d", l.System.Memory)
+	}
+	if l.System.Conns != 1040 || l.System.ConnsInbound != 520 {
+		t.Fatalf("expected 100 conns plus 10 per GiB, got %d", l.System.Conns)
+	}
+	if l.System.FD != 500 {
+		t.Fatalf("expected half of the file descriptors, got %d", l.System.FD)
+	}
+	// inherited values scale like the defaults
+	if l.System.Streams != 1024+4*3072 {
+		t.Fatalf("expected the default streams limit scaled to 4GiB, got %d", l.System.Streams)
+	}
+}
+
+func TestConfigInheritance(t *testing.T) {
+	p, other := randPeerID(t), randPeerID(t)
+	c := rcmgr.Config{
+		PeerDefault: rcmgr.ScalingLimitConfig{
+			Base: rcmgr.LimitConfig{Streams: 64, StreamsInbound: 32, StreamsOutbound: 64},
+		},
+		Peer: map[string]rcmgr.ScalingLimitConfig{
+			p.String(): {Base: rcmgr.LimitConfig{Memory: 64 << 20, FD: rcmgr.BlockedValue}},
+		},
+		Service: map[string]rcmgr.ScalingLimitConfig{
+			"svc": {Base: rcmgr.LimitConfig{Streams: 8, StreamsInbound: 8, StreamsOutbound: 8}},
+		},
+		Protocol: map[string]rcmgr.ScalingLimitConfig{
+			"/proto": {PerGiB: rcmgr.LimitConfig{Memory: 8 << 20}},
+		},
+	}
+	l, err := c.Scale(2<<30, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an overridden base doesn't scale, unless its scaling is given too
+	if l.PeerDefault.Streams != 64 || l.PeerDefault.StreamsInbound != 32 {
+		t.Fatalf("expected the streams of the peer default to be overridden, got %+v", l.PeerDefault)
+	}
+	if l.PeerDefault.Memory != (16+2*48)<<20 {
+		t.Fatalf("expected the memory of the peer default to be inherited, got %d", l.PeerDefault.Memory)
+	}
+
+	// peers inherit from the peer default, and the peer default from
+	// DefaultConfig
+	pl := l.Peer[p]
+	if pl.Memory != 64<<20 || pl.FD != 0 || pl.Streams != 64 || pl.Conns != 8 {
+		t.Fatalf("unexpected peer limit: %+v", pl)
+	}
+	if _, ok := l.Peer[other]; ok || len(l.Peer) != 1 {
+		t.Fatalf("expected a single peer override, got %v", l.Peer)
+	}
+
+	if sl := l.Service["svc"]; sl.Streams != 8 || sl.Memory != l.ServiceDefault.Memory {
+		t.Fatalf("unexpected service limit: %+v", sl)
+	}
+	// a scaling override keeps the inherited base
+	if pl := l.Protocol["/proto"]; pl.Memory != (16+2*8)<<20 || pl.Streams != l.ProtocolDefault.Streams {
+		t.Fatalf("unexpected protocol limit: %+v", pl)
+	}
+
+	c.Peer["not a peer"] = rcmgr.ScalingLimitConfig{}
+	if _, err := c.Scale(1<<30, 512); err == nil {
+		t.Fatal("expected an invalid peer ID to be rejected")
+	}
+}
+
+func TestConfigScaleValidates(t *testing.T) {
+	c := rcmgr.Config{
+		Stream: rcmgr.ScalingLimitConfig{Base: rcmgr.LimitConfig{Memory: 1 << 40}},
+	}
+	_, err := c.Scale(1<<30, 512)
+	var verr *rcmgr.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+}
+
+func validationProblems(t *testing.T, l rcmgr.Limits) []string {
+	t.Helper()
+	err := l.Validate()
+	if err == nil {
+		return nil
+	}
+	var verr *rcmgr.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	return verr.Problems
+}
+
+func TestLimitsValidate(t *testing.T) {
+	if problems := validationProblems(t, rcmgr.DefaultLimits); problems != nil {
+		t.Fatalf("expected the default limits to be valid, got %v", problems)
+	}
+	if problems := validationProblems(t, rcmgr.InfiniteLimits); problems != nil {
+		t.Fatalf("expected the infinite limits to be valid, got %v", problems)
+	}
+
+	p := randPeerID(t)
+	for _, tc := range []struct {
+		name     string
+		modify   func(l *rcmgr.Limits)
+		expected []string
+	}{
+		{
+			name:     "negative",
+			modify:   func(l *rcmgr.Limits) { l.Transient.FD = -1 },
+			expected: []string{"transient fd limit is negative (-1)"},
+		},
+		{
+			name:   "directions",
+			modify: func(l *rcmgr.Limits) { l.PeerDefault.ConnsInbound, l.PeerDefault.StreamsOutbound = 9, 513 },
+			expected: []string{
+				"peer default inbound conns limit (9) exceeds its conns limit (8)",
+				"peer default outbound streams limit (513) exceeds its streams limit (512)",
+			},
+		},
+		{
+			name:   "directions of the system",
+			modify: func(l *rcmgr.Limits) { l.System.ConnsOutbound, l.System.StreamsInbound = 257, 4097 },
+			expected: []string{
+				"system outbound conns limit (257) exceeds its conns limit (256)",
+				"system inbound streams limit (4097) exceeds its streams limit (4096)",
+			},
+		},
+		{
+			name:     "exceeds system",
+			modify:   func(l *rcmgr.Limits) { l.ServiceDefault.Memory = 2 << 30 },
+			expected: []string{"service default memory limit (2147483648) exceeds the system memory limit (1073741824)"},
+		},
+		{
+			name:     "exceeds allowlisted system",
+			modify:   func(l *rcmgr.Limits) { l.AllowlistedTransient.Conns = 65 },
+			expected: []string{"allowlisted transient conns limit (65) exceeds the allowlisted system conns limit (64)"},
+		},
+		{
+			name:   "conn exceeds its parents",
+			modify: func(l *rcmgr.Limits) { l.Conn.Memory = 64<<20 + 1 },
+			expected: []string{
+				"conn memory limit (67108865) exceeds the transient memory limit (67108864)",
+				"conn memory limit (67108865) exceeds the allowlisted transient memory limit (33554432)",
+				"conn memory limit (67108865) exceeds the peer default memory limit (67108864)",
+			},
+		},
+		{
+			name: "stream exceeds an override",
+			modify: func(l *rcmgr.Limits) {
+				l.Protocol = map[protocol.ID]rcmgr.Limit{"/small": {Memory: 1 << 20, Streams: 1, StreamsInbound: 1, StreamsOutbound: 1}}
+				l.Peer = map[peer.ID]rcmgr.Limit{p: {Memory: 1 << 20, Streams: 1, StreamsInbound: 1, StreamsOutbound: 1}}
+			},
+			expected: []string{
+				fmt.Sprintf("conn memory limit (33554432) exceeds the peer %s memory limit (1048576)", p),
+				fmt.Sprintf("stream memory limit (16777216) exceeds the peer %s memory limit (1048576)", p),
+				"stream memory limit (16777216) exceeds the protocol /small memory limit (1048576)",
+			},
+		},
+		{
+			name:   "blocked parents",
+			modify: func(l *rcmgr.Limits) { l.PeerDefault.FD = 0 },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := rcmgr.DefaultLimits
+			tc.modify(&l)
+			problems := validationProblems(t, l)
+			if !reflect.DeepEqual(problems, tc.expected) {
+				t.Fatalf("expected %q, got %q", tc.expected, problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package rcmgr
+
+func maxFDs() int {
+	return 0
+}
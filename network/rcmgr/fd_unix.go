@@ -0,0 +1,22 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package rcmgr
+
+import (
+	"math"
+	"syscall"
+)
+
+// maxFDs returns the number of file descriptors the process may open, or 0
+// if unknown.
+func maxFDs() int {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0
+	}
+	if rlim.Cur > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(rlim.Cur)
+}
@@ -0,0 +1,224 @@
+package rcmgr
+
+import (
+	"math"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Limit is the set of resource limits of a single scope. All values are
+// absolute: a zero value blocks the resource entirely. Use Unlimited for
+// resources that should not be limited.
+type Limit struct {
+	// Memory is the amount of memory, in bytes, that may be reserved.
+	Memory int64
+	// FD is the number of file descriptors.
+	FD int
+
+	// Conns limits the total number of connections, ConnsInbound and
+	// ConnsOutbound the number of connections in either direction.
+	Conns         int
+	ConnsInbound  int
+	ConnsOutbound int
+
+	// Streams limits the total number of streams, StreamsInbound and
+	// StreamsOutbound the number of streams in either direction.
+	Streams         int
+	StreamsInbound  int
+	StreamsOutbound int
+}
+
+// Unlimited is a Limit that does not restrict any resource.
+var Unlimited = Limit{
+	Memory:          math.MaxInt64,
+	FD:              math.MaxInt32,
+	Conns:           math.MaxInt32,
+	ConnsInbound:    math.MaxInt32,
+	ConnsOutbound:   math.MaxInt32,
+	Streams:         math.MaxInt32,
+	StreamsInbound:  math.MaxInt32,
+	StreamsOutbound: math.MaxInt32,
+}
+
+// memoryThreshold returns the amount of memory that may be in use after a
+// reservation of priority prio: reservations of priority p may use up to
+// (1+p)/256 of the memory limit.
+func (l Limit) memoryThreshold(prio uint8) int64 {
+	if l.Memory > math.MaxInt64/256 {
+		return l.Memory / 256 * (1 + int64(prio))
+	}
+	return l.Memory * (1 + int64(prio)) / 256
+}
+
+// allows returns the name of the first resource reserving st exceeds, given
+// the usage next would result in, or "".
+func (l Limit) allows(st, next network.ScopeStat, prio uint8) string {
+	conns := st.NumConnsInbound + st.NumConnsOutbound
+	streams := st.NumStreamsInbound + st.NumStreamsOutbound
+	switch {
+	case st.Memory > 0 && next.Memory > l.memoryThreshold(prio):
+		return "memory"
+	case st.NumFD > 0 && next.NumFD > l.FD:
+		return "file descriptors"
+	case conns > 0 && next.NumConnsInbound+next.NumConnsOutbound > l.Conns:
+		return "connections"
+	case st.NumConnsInbound > 0 && next.NumConnsInbound > l.ConnsInbound:
+		return "inbound connections"
+	case st.NumConnsOutbound > 0 && next.NumConnsOutbound > l.ConnsOutbound:
+		return "outbound connections"
+	case streams > 0 && next.NumStreamsInbound+next.NumStreamsOutbound > l.Streams:
+		return "streams"
+	case st.NumStreamsInbound > 0 && next.NumStreamsInbound > l.StreamsInbound:
+		return "inbound streams"
+	case st.NumStreamsOutbound > 0 && next.NumStreamsOutbound > l.StreamsOutbound:
+		return "outbound streams"
+	default:
+		return ""
+	}
+}
+
+// Limits holds the limits of every scope of a resource manager.
+type Limits struct {
+	// System limits the whole node.
+	System Limit
+	// Transient limits the connections and streams that are not yet
+	// attached to a peer, or to a protocol or service.
+	Transient Limit
+
+	// ServiceDefault limits the services not listed in Service.
+	ServiceDefault Limit
+	Service        map[string]Limit
+
+	// ProtocolDefault limits the protocols not listed in Protocol.
+	ProtocolDefault Limit
+	Protocol        map[protocol.ID]Limit
+
+	// PeerDefault limits the peers not listed in Peer.
+	PeerDefault Limit
+	Peer        map[peer.ID]Limit
+
+	// AllowlistedSystem and AllowlistedTransient replace System and
+	// Transient for allowlisted connections and streams.
+	AllowlistedSystem    Limit
+	AllowlistedTransient Limit
+
+	// Conn limits every single connection, Stream every single stream.
+	Conn   Limit
+	Stream Limit
+}
+
+// DefaultLimits are limits fit for a node with 1GiB of memory and 512 file
+// descriptors to spare.
+var DefaultLimits = Limits{
+	System: Limit{
+		Memory:          1 << 30,
+		FD:              512,
+		Conns:           256,
+		ConnsInbound:    128,
+		ConnsOutbound:   256,
+		Streams:         4096,
+		StreamsInbound:  2048,
+		StreamsOutbound: 4096,
+	},
+	Transient: Limit{
+		Memory:          64 << 20,
+		FD:              128,
+		Conns:           64,
+		ConnsInbound:    32,
+		ConnsOutbound:   64,
+		Streams:         256,
+		StreamsInbound:  128,
+		StreamsOutbound: 256,
+	},
+	ServiceDefault: Limit{
+		Memory:          128 << 20,
+		Streams:         2048,
+		StreamsInbound:  1024,
+		StreamsOutbound: 2048,
+	},
+	ProtocolDefault: Limit{
+		Memory:          64 << 20,
+		Streams:         2048,
+		StreamsInbound:  512,
+		StreamsOutbound: 2048,
+	},
+	PeerDefault: Limit{
+		Memory:          64 << 20,
+		FD:              4,
+		Conns:           8,
+		ConnsInbound:    4,
+		ConnsOutbound:   8,
+		Streams:         512,
+		StreamsInbound:  256,
+		StreamsOutbound: 512,
+	},
+	AllowlistedSystem: Limit{
+		Memory:          128 << 20,
+		FD:              64,
+		Conns:           64,
+		ConnsInbound:    32,
+		ConnsOutbound:   64,
+		Streams:         512,
+		StreamsInbound:  256,
+		StreamsOutbound: 512,
+	},
+	AllowlistedTransient: Limit{
+		Memory:          32 << 20,
+		FD:              16,
+		Conns:           16,
+		ConnsInbound:    8,
+		ConnsOutbound:   16,
+		Streams:         128,
+		StreamsInbound:  64,
+		StreamsOutbound: 128,
+	},
+	Conn: Limit{
+		Memory:        32 << 20,
+		FD:            1,
+		Conns:         1,
+		ConnsInbound:  1,
+		ConnsOutbound: 1,
+	},
+	Stream: Limit{
+		Memory:          16 << 20,
+		Streams:         1,
+		StreamsInbound:  1,
+		StreamsOutbound: 1,
+	},
+}
+
+// InfiniteLimits are limits that do not restrict anything.
+var InfiniteLimits = Limits{
+	System:               Unlimited,
+	Transient:            Unlimited,
+	ServiceDefault:       Unlimited,
+	ProtocolDefault:      Unlimited,
+	PeerDefault:          Unlimited,
+	AllowlistedSystem:    Unlimited,
+	AllowlistedTransient: Unlimited,
+	Conn:                 Unlimited,
+	Stream:               Unlimited,
+}
+
+func (l *Limits) service(name string) Limit {
+	if lim, ok := l.Service[name]; ok {
+		return lim
+	}
+	return l.ServiceDefault
+}
+
+func (l *Limits) protocol(proto protocol.ID) Limit {
+	if lim, ok := l.Protocol[proto]; ok {
+		return lim
+	}
+	return l.ProtocolDefault
+}
+
+func (l *Limits) peer(p peer.ID) Limit {
+	if lim, ok := l.Peer[p]; ok {
+		return lim
+	}
+	return l.PeerDefault
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package rcmgr
+
+import (
+	"math"
+	"syscall"
+)
+
+// totalMemory returns the total memory of the machine, or 0 if unknown.
+func totalMemory() int64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	total := uint64(info.Totalram) * uint64(info.Unit)
+	if total > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(total)
+}
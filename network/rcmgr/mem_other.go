@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package rcmgr
+
+func totalMemory() int64 {
+	return 0
+}
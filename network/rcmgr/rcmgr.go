@@ -0,0 +1,236 @@
+// Package rcmgr is a reference implementation of network.ResourceManager.
+//
+// Resources are accounted in a DAG of scopes: the system scope limits the
+// whole node, and the transient scope the connections and streams not yet
+// attached to a peer or protocol. Every connection and stream has a scope of
+// its own, whose usage is reserved in all its ancestors: connections in
+// their peer scope once the peer is known, streams in their peer scope, then
+// in their protocol and service scopes once these are set. Spans reserve
+// through the scope they are started from.
+//
+// Connections from allowlisted addresses, and streams of peers allowlisted
+// from any address or connected from an allowlisted address, are accounted
+// in the allowlisted system and transient scopes instead of the system and
+// transient scopes, so that they are not starved by other peers.
+// See Allowlist.
+//
+// Memory reservations honour the reservation priority: a reservation of
+// priority p succeeds as long as the memory in use stays below (1+p)/256 of
+// the limit, in the scope and all its ancestors.
+//
+// Reservations exceeding a limit can be traced with WithTrace. In dry-run
+// mode, enabled with WithDryRun, they are traced and succeed regardless; a
+// TraceAggregator then reports what enforcing the limits would block.
+package rcmgr
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("rcmgr")
+
+// Prefixes of the names of the service, protocol and peer scopes.
+const (
+	serviceScopePrefix  = "service:"
+	protocolScopePrefix = "protocol:"
+	peerScopePrefix     = "peer:"
+)
+
+// Option is a single option for the resource manager.
+type Option func(rm *resourceManager) error
+
+type resourceManager struct {
+	limits Limits
+	clock  clock.Clock
+
+	dryRun bool
+	sinks  []TraceSink
+
+	system    *resourceScope
+	transient *resourceScope
+
+	allowlist            *Allowlist
+	allowlistedSystem    *resourceScope
+	allowlistedTransient *resourceScope
+
+	nextConn   int64 // accessed atomically
+	nextStream int64 // accessed atomically
+
+	mu       sync.Mutex
+	services map[string]*serviceScope
+	protos   map[protocol.ID]*protocolScope
+	peers    map[peer.ID]*peerScope
+}
+
+var _ network.ResourceManager = (*resourceManager)(nil)
+
+// NewResourceManager creates a resource manager enforcing limits.
+func NewResourceManager(limits Limits, opts ...Option) (network.ResourceManager, error) {
+	rm := &resourceManager{
+		limits:    limits,
+		clock:     clock.Real,
+		allowlist: NewAllowlist(),
+		services:  make(map[string]*serviceScope),
+		protos:    make(map[protocol.ID]*protocolScope),
+		peers:     make(map[peer.ID]*peerScope),
+	}
+	for _, o := range opts {
+		if err := o(rm); err != nil {
+			return nil, err
+		}
+	}
+	rm.system = newScope(rm, "system", orderSystem, limits.System)
+	rm.transient = newScope(rm, "transient", orderTransient, limits.Transient, rm.system)
+	rm.allowlistedSystem = newScope(rm, "allowlisted-system", orderAllowlistedSystem, limits.AllowlistedSystem)
+	rm.allowlistedTransient = newScope(rm, "allowlisted-transient", orderAllowlistedTransient, limits.AllowlistedTransient, rm.allowlistedSystem)
+	return rm, nil
+}
+
+// WithClock sets the clock timestamping the snapshots and the traced
+// reservations. Defaults to clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(rm *resourceManager) error {
+		rm.clock = c
+		return nil
+	}
+}
+
+func (rm *resourceManager) ViewSystem(f func(network.ResourceScope) error) error {
+	return f(rm.system)
+}
+
+func (rm *resourceManager) ViewTransient(f func(network.ResourceScope) error) error {
+	return f(rm.transient)
+}
+
+func (rm *resourceManager) ViewService(svc string, f func(network.ServiceScope) error) error {
+	s := rm.getServiceScope(svc)
+	defer s.decRef()
+	return f(s)
+}
+
+func (rm *resourceManager) ViewProtocol(proto protocol.ID, f func(network.ProtocolScope) error) error {
+	s := rm.getProtocolScope(proto)
+	defer s.decRef()
+	return f(s)
+}
+
+func (rm *resourceManager) ViewPeer(p peer.ID, f func(network.PeerScope) error) error {
+	s := rm.getPeerScope(p)
+	defer s.decRef()
+	return f(s)
+}
+
+// getServiceScope returns the scope of svc, with a reference the caller must
+// drop with decRef.
+func (rm *resourceManager) getServiceScope(svc string) *serviceScope {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	s, ok := rm.services[svc]
+	if !ok {
+		s = &serviceScope{
+			resourceScope: newScope(rm, serviceScopePrefix+svc, orderService, rm.limits.service(svc), rm.system),
+			service:       svc,
+		}
+		s.forget = func() { delete(rm.services, svc) }
+		rm.services[svc] = s
+	}
+	s.incRef()
+	return s
+}
+
+// getProtocolScope returns the scope of proto, with a reference the caller
+// must drop with decRef.
+func (rm *resourceManager) getProtocolScope(proto protocol.ID) *protocolScope {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	s, ok := rm.protos[proto]
+	if !ok {
+		s = &protocolScope{
+			resourceScope: newScope(rm, protocolScopePrefix+string(proto), orderProtocol, rm.limits.protocol(proto), rm.system),
+			proto:         proto,
+		}
+		s.forget = func() { delete(rm.protos, proto) }
+		rm.protos[proto] = s
+	}
+	s.incRef()
+	return s
+}
+
+// getPeerScope returns the scope of p, with a reference the caller must drop
+// with decRef.
+func (rm *resourceManager) getPeerScope(p peer.ID) *peerScope {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	s, ok := rm.peers[p]
+	if !ok {
+		s = &peerScope{
+			resourceScope: newScope(rm, peerScopePrefix+p.Pretty(), orderPeer, rm.limits.peer(p), rm.system),
+			peer:          p,
+		}
+		s.forget = func() { delete(rm.peers, p) }
+		rm.peers[p] = s
+	}
+	s.incRef()
+	return s
+}
+
+func (rm *resourceManager) OpenConnection(dir network.Direction, usefd bool, endpoint ma.Multiaddr) (network.ConnManagementScope, error) {
+	transient, system := rm.transient, rm.system
+	allowlisted := endpoint != nil && rm.allowlist.Allowed(endpoint)
+	if allowlisted {
+		transient, system = rm.allowlistedTransient, rm.allowlistedSystem
+	}
+	id := atomic.AddInt64(&rm.nextConn, 1)
+	s := &connScope{
+		resourceScope: newScope(rm, fmt.Sprintf("conn-%d", id), orderLeaf, rm.limits.Conn, transient, system),
+		dir:           dir,
+		usefd:         usefd,
+		endpoint:      endpoint,
+		allowlisted:   allowlisted,
+	}
+	if err := s.reserve(connStat(dir, usefd), network.ReservationPriorityAlways); err != nil {
+		s.Done()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (rm *resourceManager) OpenStream(p peer.ID, dir network.Direction) (network.StreamManagementScope, error) {
+	// a peer allowlisted from some subnets only is allowlisted once
+	// connected from one of them
+	ps := rm.getPeerScope(p)
+	transient, system := rm.transient, rm.system
+	if rm.allowlist.AllowedPeerAndMultiaddr(p, nil) || ps.hasAllowlistedConns() {
+		transient, system = rm.allowlistedTransient, rm.allowlistedSystem
+	}
+	id := atomic.AddInt64(&rm.nextStream, 1)
+	s := &streamScope{
+		resourceScope: newScope(rm, fmt.Sprintf("stream-%d", id), orderLeaf, rm.limits.Stream, ps.resourceScope, transient, system),
+		dir:           dir,
+		peer:          ps,
+		transient:     transient,
+	}
+	if err := s.reserve(streamStat(dir), network.ReservationPriorityAlways); err != nil {
+		s.Done()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the resource manager. Scopes still open remain usable.
+func (rm *resourceManager) Close() error {
+	return nil
+}
@@ -0,0 +1,377 @@
+package rcmgr_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	netx "github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/network/rcmgr"
+	"github.com/libp2p/go-libp2p-core/network/rcmgr/rcmgrtest"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestConformance(t *testing.T) {
+	rcmgrtest.TestResourceManager(t, func(l rcmgr.Limits) (network.ResourceManager, error) {
+		return rcmgr.NewResourceManager(l)
+	})
+}
+
+func newManager(t *testing.T, limits rcmgr.Limits) network.ResourceManager {
+	t.Helper()
+	rm, err := rcmgr.NewResourceManager(limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rm.Close() })
+	return rm
+}
+
+// threshold computes the memory a reservation of priority prio may bring the
+// usage of a scope with the given limit up to, without overflowing.
+func threshold(limit int64, prio uint8) int64 {
+	n := new(big.Int).Mul(big.NewInt(limit), big.NewInt(1+int64(prio)))
+	return n.Div(n, big.NewInt(256)).Int64()
+}
+
+func TestReservationThreshold(t *testing.T) {
+	for _, limit := range []int64{256, 1000, 1 << 40, math.MaxInt64 / 256, math.MaxInt64} {
+		for _, prio := range []uint8{0, 1, network.ReservationPriorityLow, network.ReservationPriorityMedium, network.ReservationPriorityHigh, 254, network.ReservationPriorityAlways} {
+			limit, prio := limit, prio
+			t.Run(fmt.Sprintf("limit=%d/prio=%d", limit, prio), func(t *testing.T) {
+				limits := rcmgr.InfiniteLimits
+				limits.Stream.Memory = limit
+				s, err := newManager(t, limits).OpenStream("peer", network.DirOutbound)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Done()
+
+				expected := threshold(limit, prio)
+				if limit > math.MaxInt64/256 {
+					// the threshold is rounded down to a multiple of
+					// limit/256, so as not to overflow
+					expected = limit / 256 * (1 + int64(prio))
+				}
+				if err := s.ReserveMemory(int(expected), prio); err != nil {
+					t.Fatalf("expected to reserve up to %d: %s", expected, err)
+				}
+				if err := s.ReserveMemory(1, prio); !errors.Is(err, network.ErrResourceLimitExceeded) {
+					t.Fatalf("expected a reservation past %d to exceed the limit, got %v", expected, err)
+				}
+				if st := s.Stat(); st.Memory != expected {
+					t.Fatalf("expected %d bytes reserved, got %d", expected, st.Memory)
+				}
+			})
+		}
+	}
+}
+
+const (
+	testPeer  = peer.ID("peer")
+	testProto = protocol.ID("/test/1.0.0")
+	testSvc   = "test-service"
+)
+
+func viewStat(t *testing.T, view func(func(network.ResourceScope) error) error) network.ScopeStat {
+	t.Helper()
+	var st network.ScopeStat
+	if err := view(func(s network.ResourceScope) error {
+		st = s.Stat()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+type scopeStats struct {
+	transient, peer, proto, svc network.ScopeStat
+}
+
+func stats(t *testing.T, rm network.ResourceManager) scopeStats {
+	t.Helper()
+	return scopeStats{
+		transient: viewStat(t, rm.ViewTransient),
+		peer: viewStat(t, func(f func(network.ResourceScope) error) error {
+			return rm.ViewPeer(testPeer, func(s network.PeerScope) error { return f(s) })
+		}),
+		proto: viewStat(t, func(f func(network.ResourceScope) error) error {
+			return rm.ViewProtocol(testProto, func(s network.ProtocolScope) error { return f(s) })
+		}),
+		svc: viewStat(t, func(f func(network.ResourceScope) error) error {
+			return rm.ViewService(testSvc, func(s network.ServiceScope) error { return f(s) })
+		}),
+	}
+}
+
+func requireStats(t *testing.T, rm network.ResourceManager, expected scopeStats) {
+	t.Helper()
+	if got := stats(t, rm); got != expected {
+		t.Fatalf("expected the scopes to be\n%+v\ngot\n%+v", expected, got)
+	}
+}
+
+func TestStreamEdgeMoves(t *testing.T) {
+	limits := rcmgr.InfiniteLimits
+	limits.Protocol = map[protocol.ID]rcmgr.Limit{testProto: rcmgr.Unlimited}
+	limits.Service = map[string]rcmgr.Limit{testSvc: rcmgr.Unlimited}
+	rm := newManager(t, limits)
+
+	s, err := rm.OpenStream(testPeer, network.DirInbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReserveMemory(100, network.ReservationPriorityAlways); err != nil {
+		t.Fatal(err)
+	}
+	stream := network.ScopeStat{NumStreamsInbound: 1, Memory: 100}
+	requireStats(t, rm, scopeStats{transient: stream, peer: stream})
+
+	// a service is only set after the protocol
+	if err := s.SetService(testSvc); err == nil {
+		t.Fatal("expected setting the service of a stream without protocol to fail")
+	}
+	requireStats(t, rm, scopeStats{transient: stream, peer: stream})
+
+	// the stream and its memory move from the transient scope to the
+	// protocol scope
+	if err := s.SetProtocol(testProto); err != nil {
+		t.Fatal(err)
+	}
+	requireStats(t, rm, scopeStats{peer: stream, proto: stream})
+	if err := s.SetProtocol(testProto); err == nil {
+		t.Fatal("expected setting the protocol twice to fail")
+	}
+	requireStats(t, rm, scopeStats{peer: stream, proto: stream})
+
+	// the service scope is added to the protocol scope
+	if err := s.SetService(testSvc); err != nil {
+		t.Fatal(err)
+	}
+	requireStats(t, rm, scopeStats{peer: stream, proto: stream, svc: stream})
+	if err := s.SetService(testSvc); err == nil {
+		t.Fatal("expected setting the service twice to fail")
+	}
+
+	// later reservations are accounted in all the scopes
+	if err := s.ReserveMemory(50, network.ReservationPriorityAlways); err != nil {
+		t.Fatal(err)
+	}
+	stream.Memory = 150
+	requireStats(t, rm, scopeStats{peer: stream, proto: stream, svc: stream})
+
+	s.Done()
+	requireStats(t, rm, scopeStats{})
+	if err := s.SetProtocol(testProto); !errors.Is(err, network.ErrResourceScopeClosed) {
+		t.Fatalf("expected setting the protocol of a closed stream to fail, got %v", err)
+	}
+}
+
+func TestStreamEdgeMoveLimited(t *testing.T) {
+	limits := rcmgr.InfiniteLimits
+	protoLimit := rcmgr.Unlimited
+	protoLimit.Streams = 1
+	svcLimit := rcmgr.Unlimited
+	svcLimit.Memory = 100
+	limits.Protocol = map[protocol.ID]rcmgr.Limit{testProto: protoLimit}
+	limits.Service = map[string]rcmgr.Limit{testSvc: svcLimit}
+	rm := newManager(t, limits)
+
+	open := func() network.StreamManagementScope {
+		s, err := rm.OpenStream(testPeer, network.DirOutbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Done)
+		return s
+	}
+	first, second := open(), open()
+	if err := first.SetProtocol(testProto); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rejected move leaves the stream where it was
+	if err := second.SetProtocol(testProto); !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("expected the protocol limit to be exceeded, got %v", err)
+	}
+	stream := network.ScopeStat{NumStreamsOutbound: 1}
+	requireStats(t, rm, scopeStats{transient: stream, peer: network.ScopeStat{NumStreamsOutbound: 2}, proto: stream})
+	if second.ProtocolScope() != nil {
+		t.Fatal("expected the rejected stream to have no protocol")
+	}
+
+	// a rejected service leaves the stream in its protocol only
+	if err := first.ReserveMemory(200, network.ReservationPriorityAlways); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.SetService(testSvc); !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("expected the service limit to be exceeded, got %v", err)
+	}
+	if first.ServiceScope() != nil {
+		t.Fatal("expected the rejected stream to have no service")
+	}
+	withMemory := network.ScopeStat{NumStreamsOutbound: 1, Memory: 200}
+	requireStats(t, rm, scopeStats{transient: stream, peer: network.ScopeStat{NumStreamsOutbound: 2, Memory: 200}, proto: withMemory})
+}
+
+func TestSnapshotConsistency(t *testing.T) {
+	// reservations must run in parallel with the snapshots
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	rm := newManager(t, rcmgr.InfiniteLimits)
+	snapshotter, ok := netx.GetResourceSnapshotter(rm)
+	if !ok {
+		t.Fatal("expected the resource manager to take snapshots")
+	}
+
+	done := make(chan struct{})
+	var (
+		wg         sync.WaitGroup
+		iterations int64
+	)
+	for i := 0; i < 8; i++ {
+		p := peer.ID(fmt.Sprintf("peer-%d", i%3))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c, err := rm.OpenConnection(network.DirInbound, true, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.SetPeer(p)
+				s, err := rm.OpenStream(p, network.DirOutbound)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				s.ReserveMemory(10, network.ReservationPriorityAlways)
+				s.SetProtocol(testProto)
+				s.SetService(testSvc)
+				s.ReserveMemory(10, network.ReservationPriorityAlways)
+				s.ReleaseMemory(5)
+				s.Done()
+				c.Done()
+				atomic.AddInt64(&iterations, 1)
+			}
+		}()
+	}
+
+	// every connection and stream is accounted in the system scope, and in
+	// either the transient scope or the scope of its peer, or protocol
+	for atomic.LoadInt64(&iterations) < 20000 {
+		snap := snapshotter.SnapshotResources()
+		var peerConns, peerStreams, protoStreams int
+		var peerMemory int64
+		for _, st := range snap.Peers {
+			peerConns += st.NumConnsInbound
+			peerStreams += st.NumStreamsOutbound
+			peerMemory += st.Memory
+		}
+		for _, st := range snap.Protocols {
+			protoStreams += st.NumStreamsOutbound
+		}
+		sys, tr := snap.System, snap.Transient
+		switch {
+		case sys.NumConnsInbound != tr.NumConnsInbound+peerConns:
+			t.Fatalf("inconsistent connections: %d in the system, %d transient and %d in the peers", sys.NumConnsInbound, tr.NumConnsInbound, peerConns)
+		case sys.NumStreamsOutbound != peerStreams:
+			t.Fatalf("inconsistent streams: %d in the system and %d in the peers", sys.NumStreamsOutbound, peerStreams)
+		case sys.NumStreamsOutbound != tr.NumStreamsOutbound+protoStreams:
+			t.Fatalf("inconsistent streams: %d in the system, %d transient and %d in the protocols", sys.NumStreamsOutbound, tr.NumStreamsOutbound, protoStreams)
+		case sys.Memory != peerMemory:
+			t.Fatalf("inconsistent memory: %d in the system and %d in the peers", sys.Memory, peerMemory)
+		case sys.NumFD != sys.NumConnsInbound:
+			t.Fatalf("inconsistent file descriptors: %d for %d connections", sys.NumFD, sys.NumConnsInbound)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestAllowlistedStreams(t *testing.T) {
+	subnetPeer, err := peer.Decode("QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	anywherePeer, err := peer.Decode("QmdW3RrgBWBbMBmSjqDV4M1XT3kfWKBRGqNMiUaLtNWcJp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := rcmgr.NewResourceManager(rcmgr.InfiniteLimits, rcmgr.WithAllowlistedMultiaddrs([]ma.Multiaddr{
+		ma.StringCast("/ip4/10.0.0.0/ipcidr/8/p2p/" + subnetPeer.String()),
+		ma.StringCast("/p2p/" + anywherePeer.String()),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Close()
+	snapshotter, _ := netx.GetResourceSnapshotter(rm)
+
+	// requireStreams checks that the stream of p is accounted in the
+	// allowlisted scopes if allowlisted is set, in the others if not
+	requireStreams := func(p peer.ID, allowlisted bool) {
+		t.Helper()
+		s, err := rm.OpenStream(p, network.DirOutbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Done()
+		snap := snapshotter.SnapshotResources()
+		sys, allowlistedSys := snap.System.NumStreamsOutbound, snap.AllowlistedSystem.NumStreamsOutbound
+		if allowlisted && (sys != 0 || allowlistedSys != 1) {
+			t.Fatalf("expected the stream to be allowlisted, got %d in the system and %d allowlisted", sys, allowlistedSys)
+		}
+		if !allowlisted && (sys != 1 || allowlistedSys != 0) {
+			t.Fatalf("expected the stream not to be allowlisted, got %d in the system and %d allowlisted", sys, allowlistedSys)
+		}
+	}
+	connect := func(p peer.ID, addr string) network.ConnManagementScope {
+		t.Helper()
+		c, err := rm.OpenConnection(network.DirInbound, true, ma.StringCast(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetPeer(p); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	requireStreams(anywherePeer, true)
+	requireStreams(subnetPeer, false)
+
+	// a connection from outside the subnet does not allowlist the peer
+	outside := connect(subnetPeer, "/ip4/8.8.8.8/tcp/1234")
+	defer outside.Done()
+	requireStreams(subnetPeer, false)
+
+	// nor does the peer allowlist the connections of others in the subnet
+	other := connect("peer", "/ip4/10.1.2.3/tcp/1234")
+	defer other.Done()
+	requireStreams("peer", false)
+
+	// the streams of the peer are allowlisted while it is connected from
+	// the subnet
+	inside := connect(subnetPeer, "/ip4/10.1.2.3/tcp/1234")
+	requireStreams(subnetPeer, true)
+	inside.Done()
+	requireStreams(subnetPeer, false)
+}
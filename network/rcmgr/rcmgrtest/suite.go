@@ -0,0 +1,435 @@
+// Package rcmgrtest is a conformance suite for network.ResourceManager
+// implementations, to be run from their test files:
+//
+//	func TestConformance(t *testing.T) {
+//		rcmgrtest.TestResourceManager(t, func(l rcmgr.Limits) (network.ResourceManager, error) {
+//			return NewResourceManager(convertLimits(l))
+//		})
+//	}
+package rcmgrtest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network/rcmgr"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Factory creates the resource manager under test, enforcing limits.
+type Factory func(limits rcmgr.Limits) (network.ResourceManager, error)
+
+var tests = []struct {
+	name string
+	f    func(t *testing.T, f Factory)
+}{
+	{"SystemMemory", testSystemMemory},
+	{"ReservationPriority", testReservationPriority},
+	{"StreamMemory", testStreamMemory},
+	{"PeerStreams", testPeerStreams},
+	{"SystemConns", testSystemConns},
+	{"PeerConns", testPeerConns},
+	{"TransientStreams", testTransientStreams},
+	{"ProtocolStreams", testProtocolStreams},
+	{"ServiceStreams", testServiceStreams},
+	{"Spans", testSpans},
+	{"ClosedScope", testClosedScope},
+	{"ReleaseOnDone", testReleaseOnDone},
+	{"Concurrent", testConcurrent},
+}
+
+// TestResourceManager runs the conformance suite against the resource
+// managers created by f.
+func TestResourceManager(t *testing.T, f Factory) {
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) { tc.f(t, f) })
+	}
+}
+
+var (
+	peerA   = peer.ID("peer-a")
+	peerB   = peer.ID("peer-b")
+	protoA  = protocol.ID("/test/a")
+	protoB  = protocol.ID("/test/b")
+	testSvc = "test-service"
+	laddr   = ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+)
+
+func newManager(t *testing.T, f Factory, adjust func(l *rcmgr.Limits)) network.ResourceManager {
+	t.Helper()
+	l := rcmgr.InfiniteLimits
+	if adjust != nil {
+		adjust(&l)
+	}
+	rm, err := f(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rm.Close() })
+	return rm
+}
+
+func requireLimited(t *testing.T, err error, what string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("%s: expected the limit to be exceeded", what)
+	}
+	if !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("%s: expected network.ErrResourceLimitExceeded, got: %s", what, err)
+	}
+}
+
+func requireOK(t *testing.T, err error, what string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %s", what, err)
+	}
+}
+
+func systemStat(t *testing.T, rm network.ResourceManager) (st network.ScopeStat) {
+	t.Helper()
+	requireOK(t, rm.ViewSystem(func(s network.ResourceScope) error {
+		st = s.Stat()
+		return nil
+	}), "view system")
+	return st
+}
+
+func transientStat(t *testing.T, rm network.ResourceManager) (st network.ScopeStat) {
+	t.Helper()
+	requireOK(t, rm.ViewTransient(func(s network.ResourceScope) error {
+		st = s.Stat()
+		return nil
+	}), "view transient")
+	return st
+}
+
+func peerStat(t *testing.T, rm network.ResourceManager, p peer.ID) (st network.ScopeStat) {
+	t.Helper()
+	requireOK(t, rm.ViewPeer(p, func(s network.PeerScope) error {
+		if s.Peer() != p {
+			t.Errorf("peer scope of %s reports peer %s", p, s.Peer())
+		}
+		st = s.Stat()
+		return nil
+	}), "view peer")
+	return st
+}
+
+func protocolStat(t *testing.T, rm network.ResourceManager, proto protocol.ID) (st network.ScopeStat) {
+	t.Helper()
+	requireOK(t, rm.ViewProtocol(proto, func(s network.ProtocolScope) error {
+		if s.Protocol() != proto {
+			t.Errorf("protocol scope of %s reports protocol %s", proto, s.Protocol())
+		}
+		st = s.Stat()
+		return nil
+	}), "view protocol")
+	return st
+}
+
+func requireStat(t *testing.T, what string, got, expected network.ScopeStat) {
+	t.Helper()
+	if got != expected {
+		t.Fatalf("%s: expected %+v, got %+v", what, expected, got)
+	}
+}
+
+func testSystemMemory(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) { l.System.Memory = 1024 })
+	requireOK(t, rm.ViewSystem(func(s network.ResourceScope) error {
+		requireOK(t, s.ReserveMemory(1000, network.ReservationPriorityAlways), "reserve 1000")
+		requireOK(t, s.ReserveMemory(24, network.ReservationPriorityAlways), "reserve 24")
+		requireLimited(t, s.ReserveMemory(1, network.ReservationPriorityAlways), "reserve past the limit")
+		requireStat(t, "system", s.Stat(), network.ScopeStat{Memory: 1024})
+		s.ReleaseMemory(1024)
+		requireStat(t, "system", s.Stat(), network.ScopeStat{})
+		return nil
+	}), "view system")
+}
+
+func testReservationPriority(t *testing.T, f Factory) {
+	// with a limit of 1024, a reservation of priority p may bring the usage
+	// up to 4*(1+p)
+	rm := newManager(t, f, func(l *rcmgr.Limits) { l.PeerDefault.Memory = 1024 })
+	s, err := rm.OpenStream(peerA, network.DirOutbound)
+	requireOK(t, err, "open stream")
+	defer s.Done()
+
+	low := int(4 * (1 + int(network.ReservationPriorityLow)))
+	medium := int(4 * (1 + int(network.ReservationPriorityMedium)))
+	requireOK(t, s.ReserveMemory(low, network.ReservationPriorityLow), "reserve up to the low threshold")
+	requireLimited(t, s.ReserveMemory(1, network.ReservationPriorityLow), "reserve past the low threshold")
+	requireOK(t, s.ReserveMemory(medium-low, network.ReservationPriorityMedium), "reserve up to the medium threshold")
+	requireLimited(t, s.ReserveMemory(1, network.ReservationPriorityMedium), "reserve past the medium threshold")
+	requireOK(t, s.ReserveMemory(1024-medium, network.ReservationPriorityAlways), "reserve up to the limit")
+	requireLimited(t, s.ReserveMemory(1, network.ReservationPriorityAlways), "reserve past the limit")
+	requireStat(t, "peer", peerStat(t, rm, peerA), network.ScopeStat{NumStreamsOutbound: 1, Memory: 1024})
+}
+
+func testStreamMemory(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) { l.Stream.Memory = 100 })
+	s, err := rm.OpenStream(peerA, network.DirInbound)
+	requireOK(t, err, "open stream")
+	defer s.Done()
+	requireLimited(t, s.ReserveMemory(101, network.ReservationPriorityAlways), "reserve past the stream limit")
+	requireOK(t, s.ReserveMemory(100, network.ReservationPriorityAlways), "reserve up to the stream limit")
+	requireStat(t, "system", systemStat(t, rm), network.ScopeStat{NumStreamsInbound: 1, Memory: 100})
+}
+
+func testPeerStreams(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) {
+		l.PeerDefault.Streams = 3
+		l.PeerDefault.StreamsInbound = 2
+	})
+	var streams []network.StreamManagementScope
+	defer func() {
+		for _, s := range streams {
+			s.Done()
+		}
+	}()
+	open := func(p peer.ID, dir network.Direction) error {
+		s, err := rm.OpenStream(p, dir)
+		if err == nil {
+			streams = append(streams, s)
+		}
+		return err
+	}
+
+	requireOK(t, open(peerA, network.DirInbound), "open inbound stream 1")
+	requireOK(t, open(peerA, network.DirInbound), "open inbound stream 2")
+	requireLimited(t, open(peerA, network.DirInbound), "open inbound stream 3")
+	requireOK(t, open(peerA, network.DirOutbound), "open outbound stream 1")
+	requireLimited(t, open(peerA, network.DirOutbound), "open outbound stream 2")
+	// other peers have limits of their own
+	requireOK(t, open(peerB, network.DirInbound), "open inbound stream to another peer")
+	requireStat(t, "peer", peerStat(t, rm, peerA), network.ScopeStat{NumStreamsInbound: 2, NumStreamsOutbound: 1})
+
+	streams[0].Done()
+	requireOK(t, open(peerA, network.DirInbound), "open inbound stream after closing one")
+}
+
+func testSystemConns(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) {
+		l.System.ConnsInbound = 1
+		l.System.FD = 1
+	})
+	c1, err := rm.OpenConnection(network.DirInbound, true, laddr)
+	requireOK(t, err, "open inbound connection")
+	defer c1.Done()
+	_, err = rm.OpenConnection(network.DirInbound, false, laddr)
+	requireLimited(t, err, "open a second inbound connection")
+	_, err = rm.OpenConnection(network.DirOutbound, true, laddr)
+	requireLimited(t, err, "open a connection using a second file descriptor")
+	c2, err := rm.OpenConnection(network.DirOutbound, false, laddr)
+	requireOK(t, err, "open outbound connection without file descriptor")
+	defer c2.Done()
+	requireStat(t, "system", systemStat(t, rm), network.ScopeStat{NumConnsInbound: 1, NumConnsOutbound: 1, NumFD: 1})
+}
+
+func testPeerConns(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) { l.PeerDefault.Conns = 1 })
+	c1, err := rm.OpenConnection(network.DirOutbound, true, laddr)
+	requireOK(t, err, "open connection 1")
+	defer c1.Done()
+	c2, err := rm.OpenConnection(network.DirOutbound, true, laddr)
+	requireOK(t, err, "open connection 2")
+	defer c2.Done()
+	requireStat(t, "transient", transientStat(t, rm), network.ScopeStat{NumConnsOutbound: 2, NumFD: 2})
+
+	requireOK(t, c1.SetPeer(peerA), "set the peer of connection 1")
+	if ps := c1.PeerScope(); ps == nil || ps.Peer() != peerA {
+		t.Fatalf("connection 1 is not attached to %s", peerA)
+	}
+	requireLimited(t, c2.SetPeer(peerA), "set the peer of connection 2")
+	requireStat(t, "peer", peerStat(t, rm, peerA), network.ScopeStat{NumConnsOutbound: 1, NumFD: 1})
+	requireStat(t, "transient", transientStat(t, rm), network.ScopeStat{NumConnsOutbound: 1, NumFD: 1})
+	requireStat(t, "system", systemStat(t, rm), network.ScopeStat{NumConnsOutbound: 2, NumFD: 2})
+}
+
+func testTransientStreams(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) { l.Transient.Streams = 1 })
+	s1, err := rm.OpenStream(peerA, network.DirInbound)
+	requireOK(t, err, "open stream 1")
+	defer s1.Done()
+	requireStat(t, "transient", transientStat(t, rm), network.ScopeStat{NumStreamsInbound: 1})
+	_, err = rm.OpenStream(peerA, network.DirInbound)
+	requireLimited(t, err, "open stream 2 while stream 1 is transient")
+
+	requireOK(t, s1.SetProtocol(protoA), "set the protocol of stream 1")
+	if ps := s1.ProtocolScope(); ps == nil || ps.Protocol() != protoA {
+		t.Fatalf("stream 1 is not attached to %s", protoA)
+	}
+	requireStat(t, "transient", transientStat(t, rm), network.ScopeStat{})
+	requireStat(t, "protocol", protocolStat(t, rm, protoA), network.ScopeStat{NumStreamsInbound: 1})
+	s2, err := rm.OpenStream(peerA, network.DirInbound)
+	requireOK(t, err, "open stream 2 once stream 1 has a protocol")
+	s2.Done()
+}
+
+func testProtocolStreams(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) {
+		lim := rcmgr.Unlimited
+		lim.StreamsInbound = 1
+		l.Protocol = map[protocol.ID]rcmgr.Limit{protoA: lim}
+	})
+	s1, err := rm.OpenStream(peerA, network.DirInbound)
+	requireOK(t, err, "open stream 1")
+	defer s1.Done()
+	s2, err := rm.OpenStream(peerB, network.DirInbound)
+	requireOK(t, err, "open stream 2")
+	defer s2.Done()
+
+	requireOK(t, s1.SetProtocol(protoA), "set the protocol of stream 1")
+	requireLimited(t, s2.SetProtocol(protoA), "set the protocol of stream 2")
+	if s2.ProtocolScope() != nil {
+		t.Fatal("stream 2 is attached to a protocol after failing to set it")
+	}
+	requireOK(t, s2.SetProtocol(protoB), "set another protocol on stream 2")
+	requireStat(t, "protocol", protocolStat(t, rm, protoA), network.ScopeStat{NumStreamsInbound: 1})
+	requireStat(t, "protocol", protocolStat(t, rm, protoB), network.ScopeStat{NumStreamsInbound: 1})
+}
+
+func testServiceStreams(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) {
+		lim := rcmgr.Unlimited
+		lim.Streams = 1
+		l.Service = map[string]rcmgr.Limit{testSvc: lim}
+	})
+	s1, err := rm.OpenStream(peerA, network.DirOutbound)
+	requireOK(t, err, "open stream 1")
+	defer s1.Done()
+	s2, err := rm.OpenStream(peerA, network.DirOutbound)
+	requireOK(t, err, "open stream 2")
+	defer s2.Done()
+	requireOK(t, s1.SetProtocol(protoA), "set the protocol of stream 1")
+	requireOK(t, s2.SetProtocol(protoA), "set the protocol of stream 2")
+
+	requireOK(t, s1.SetService(testSvc), "set the service of stream 1")
+	if ss := s1.ServiceScope(); ss == nil || ss.Name() != testSvc {
+		t.Fatalf("stream 1 is not attached to %s", testSvc)
+	}
+	requireLimited(t, s2.SetService(testSvc), "set the service of stream 2")
+	requireOK(t, rm.ViewService(testSvc, func(s network.ServiceScope) error {
+		requireStat(t, "service", s.Stat(), network.ScopeStat{NumStreamsOutbound: 1})
+		return nil
+	}), "view service")
+}
+
+func testSpans(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) { l.PeerDefault.Memory = 1000 })
+	s, err := rm.OpenStream(peerA, network.DirOutbound)
+	requireOK(t, err, "open stream")
+	defer s.Done()
+
+	span, err := s.BeginSpan()
+	requireOK(t, err, "begin span")
+	requireOK(t, span.ReserveMemory(600, network.ReservationPriorityAlways), "reserve in span")
+	nested, err := span.BeginSpan()
+	requireOK(t, err, "begin nested span")
+	requireLimited(t, nested.ReserveMemory(401, network.ReservationPriorityAlways), "reserve past the peer limit in nested span")
+	requireOK(t, nested.ReserveMemory(400, network.ReservationPriorityAlways), "reserve in nested span")
+	requireStat(t, "span", span.Stat(), network.ScopeStat{Memory: 1000})
+	requireStat(t, "stream", s.Stat(), network.ScopeStat{NumStreamsOutbound: 1, Memory: 1000})
+	requireStat(t, "peer", peerStat(t, rm, peerA), network.ScopeStat{NumStreamsOutbound: 1, Memory: 1000})
+
+	nested.Done()
+	requireStat(t, "peer", peerStat(t, rm, peerA), network.ScopeStat{NumStreamsOutbound: 1, Memory: 600})
+	span.Done()
+	requireStat(t, "stream", s.Stat(), network.ScopeStat{NumStreamsOutbound: 1})
+	requireStat(t, "system", systemStat(t, rm), network.ScopeStat{NumStreamsOutbound: 1})
+}
+
+func testClosedScope(t *testing.T, f Factory) {
+	rm := newManager(t, f, nil)
+	s, err := rm.OpenStream(peerA, network.DirOutbound)
+	requireOK(t, err, "open stream")
+	s.Done()
+	// Done is idempotent
+	s.Done()
+
+	if err := s.ReserveMemory(1, network.ReservationPriorityAlways); err == nil {
+		t.Fatal("reserved memory in a closed scope")
+	}
+	if _, err := s.BeginSpan(); err == nil {
+		t.Fatal("began a span in a closed scope")
+	}
+	if err := s.SetProtocol(protoA); err == nil {
+		t.Fatal("set the protocol of a closed scope")
+	}
+	requireStat(t, "system", systemStat(t, rm), network.ScopeStat{})
+}
+
+func testReleaseOnDone(t *testing.T, f Factory) {
+	rm := newManager(t, f, nil)
+	var scopes []network.ResourceScopeSpan
+	for i := 0; i < 4; i++ {
+		c, err := rm.OpenConnection(network.DirInbound, true, laddr)
+		requireOK(t, err, "open connection")
+		requireOK(t, c.SetPeer(peerA), "set peer")
+		requireOK(t, c.ReserveMemory(100, network.ReservationPriorityAlways), "reserve connection memory")
+		scopes = append(scopes, c)
+
+		s, err := rm.OpenStream(peerA, network.DirOutbound)
+		requireOK(t, err, "open stream")
+		requireOK(t, s.SetProtocol(protoA), "set protocol")
+		requireOK(t, s.SetService(testSvc), "set service")
+		requireOK(t, s.ReserveMemory(10, network.ReservationPriorityAlways), "reserve stream memory")
+		span, err := s.BeginSpan()
+		requireOK(t, err, "begin span")
+		requireOK(t, span.ReserveMemory(1, network.ReservationPriorityAlways), "reserve span memory")
+		// the span is not done explicitly: closing the stream releases it
+		scopes = append(scopes, s)
+	}
+	requireStat(t, "system", systemStat(t, rm), network.ScopeStat{
+		NumConnsInbound:    4,
+		NumFD:              4,
+		NumStreamsOutbound: 4,
+		Memory:             4 * 111,
+	})
+	for _, s := range scopes {
+		s.Done()
+	}
+	requireStat(t, "system", systemStat(t, rm), network.ScopeStat{})
+	requireStat(t, "transient", transientStat(t, rm), network.ScopeStat{})
+	requireStat(t, "peer", peerStat(t, rm, peerA), network.ScopeStat{})
+	requireStat(t, "protocol", protocolStat(t, rm, protoA), network.ScopeStat{})
+}
+
+func testConcurrent(t *testing.T, f Factory) {
+	rm := newManager(t, f, func(l *rcmgr.Limits) { l.PeerDefault.Streams = 8 })
+	const workers, rounds = 16, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			p := peer.ID(fmt.Sprintf("peer-%d", w%4))
+			for i := 0; i < rounds; i++ {
+				s, err := rm.OpenStream(p, network.DirInbound)
+				if err != nil {
+					if !errors.Is(err, network.ErrResourceLimitExceeded) {
+						t.Error(err)
+						return
+					}
+					continue
+				}
+				if err := s.SetProtocol(protoA); err == nil {
+					s.ReserveMemory(1024, network.ReservationPriorityLow)
+				}
+				s.Done()
+			}
+		}(w)
+	}
+	wg.Wait()
+	requireStat(t, "system", systemStat(t, rm), network.ScopeStat{})
+	requireStat(t, "transient", transientStat(t, rm), network.ScopeStat{})
+}
@@ -0,0 +1,618 @@
+package rcmgr
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func addStat(a, b network.ScopeStat) network.ScopeStat {
+	return network.ScopeStat{
+		NumStreamsInbound:  a.NumStreamsInbound + b.NumStreamsInbound,
+		NumStreamsOutbound: a.NumStreamsOutbound + b.NumStreamsOutbound,
+		NumConnsInbound:    a.NumConnsInbound + b.NumConnsInbound,
+		NumConnsOutbound:   a.NumConnsOutbound + b.NumConnsOutbound,
+		NumFD:              a.NumFD + b.NumFD,
+		Memory:             a.Memory + b.Memory,
+	}
+}
+
+func subStat(a, b network.ScopeStat) network.ScopeStat {
+	return network.ScopeStat{
+		NumStreamsInbound:  a.NumStreamsInbound - b.NumStreamsInbound,
+		NumStreamsOutbound: a.NumStreamsOutbound - b.NumStreamsOutbound,
+		NumConnsInbound:    a.NumConnsInbound - b.NumConnsInbound,
+		NumConnsOutbound:   a.NumConnsOutbound - b.NumConnsOutbound,
+		NumFD:              a.NumFD - b.NumFD,
+		Memory:             a.Memory - b.Memory,
+	}
+}
+
+func streamStat(dir network.Direction) network.ScopeStat {
+	if dir == network.DirInbound {
+		return network.ScopeStat{NumStreamsInbound: 1}
+	}
+	return network.ScopeStat{NumStreamsOutbound: 1}
+}
+
+func connStat(dir network.Direction, usefd bool) network.ScopeStat {
+	var st network.ScopeStat
+	if dir == network.DirInbound {
+		st.NumConnsInbound = 1
+	} else {
+		st.NumConnsOutbound = 1
+	}
+	if usefd {
+		st.NumFD = 1
+	}
+	return st
+}
+
+// LimitError is returned when a reservation exceeds the limit of a scope. It
+// wraps network.ErrResourceLimitExceeded.
+type LimitError struct {
+	// Scope is the name of the scope whose limit is exceeded.
+	Scope string
+	// Resource is the resource that is exhausted.
+	Resource string
+	// Stat is the usage the reservation would have resulted in.
+	Stat network.ScopeStat
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: cannot reserve %s: %s", e.Scope, e.Resource, network.ErrResourceLimitExceeded)
+}
+
+func (e *LimitError) Unwrap() error {
+	return network.ErrResourceLimitExceeded
+}
+
+// resourceScope accounts the resources of a scope of the DAG. Reservations
+// are checked against the limit of the scope and of all its edges, which are
+// all the ancestors of the scope. Spans have no edges of their own: they
+// reserve through their owner.
+type resourceScope struct {
+	rm    *resourceManager
+	name  string
+	order int
+
+	mu     sync.Mutex
+	done   bool
+	refCnt int
+	limit  Limit
+	stat   network.ScopeStat
+	owner  *resourceScope
+	edges  []*resourceScope
+	nspans int
+
+	// forget removes a named scope from its manager once it is unused. It
+	// is called with the manager lock held.
+	forget func()
+}
+
+var (
+	_ network.ResourceScope     = (*resourceScope)(nil)
+	_ network.ResourceScopeSpan = (*resourceScope)(nil)
+)
+
+func newScope(rm *resourceManager, name string, order int, limit Limit, edges ...*resourceScope) *resourceScope {
+	return &resourceScope{rm: rm, name: name, order: order, limit: limit, edges: edges}
+}
+
+// reservation is a single reservation, checked against the limits of a
+// scope and of its ancestors.
+type reservation struct {
+	// origin is the scope the reservation is made from.
+	origin *resourceScope
+	st     network.ScopeStat
+	prio   uint8
+
+	// exceeded lists the limits exceeded so far, and chain the scopes of
+	// origin, once a limit is exceeded.
+	exceeded []LimitError
+	chain    []string
+}
+
+// check returns an error if r would exceed the limit of the scope. Exceeded
+// limits are recorded in r, and allowed in dry-run mode. Callers hold s.mu,
+// and the locks of the scopes between the origin of r and s.
+func (s *resourceScope) check(r *reservation) error {
+	if s.done {
+		return fmt.Errorf("%s: %w", s.name, network.ErrResourceScopeClosed)
+	}
+	next := addStat(s.stat, r.st)
+	if next.Memory < s.stat.Memory && r.st.Memory > 0 {
+		return &LimitError{Scope: s.name, Resource: "memory", Stat: s.stat}
+	}
+	if res := s.limit.allows(r.st, next, r.prio); res != "" {
+		err := &LimitError{Scope: s.name, Resource: res, Stat: next}
+		if len(r.exceeded) == 0 {
+			r.chain = r.origin.chain()
+		}
+		r.exceeded = append(r.exceeded, *err)
+		if s.rm.dryRun {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// reserve reserves st in the scope and all its ancestors.
+func (s *resourceScope) reserve(st network.ScopeStat, prio uint8) error {
+	r := &reservation{origin: s, st: st, prio: prio}
+	err := s.reserveFor(r)
+	s.rm.trace(r)
+	return err
+}
+
+// reserveFor reserves r in the scope and all its ancestors, on behalf of its
+// origin: the scope itself, or one of its spans.
+func (s *resourceScope) reserveFor(r *reservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.check(r); err != nil {
+		return err
+	}
+	if err := s.reserveAncestors(r); err != nil {
+		return err
+	}
+	s.stat = addStat(s.stat, r.st)
+	return nil
+}
+
+// reserveAncestors reserves r in the ancestors of the scope. The edges are
+// locked together, so that the reservation is seen in all of them or in
+// none. Callers hold s.mu.
+func (s *resourceScope) reserveAncestors(r *reservation) error {
+	if s.owner != nil {
+		return s.owner.reserveFor(r)
+	}
+	locked := lockScopes(s.edges...)
+	defer unlockScopes(locked)
+	for _, e := range locked {
+		if err := e.check(r); err != nil {
+			return err
+		}
+	}
+	for _, e := range locked {
+		e.stat = addStat(e.stat, r.st)
+	}
+	return nil
+}
+
+func (s *resourceScope) release(st network.ScopeStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.stat = subStat(s.stat, st)
+	s.releaseAncestors(st)
+}
+
+// releaseAncestors releases st from the ancestors of the scope. Callers hold
+// s.mu.
+func (s *resourceScope) releaseAncestors(st network.ScopeStat) {
+	if s.owner != nil {
+		s.owner.release(st)
+		return
+	}
+	locked := lockScopes(s.edges...)
+	defer unlockScopes(locked)
+	for _, e := range locked {
+		e.stat = subStat(e.stat, st)
+	}
+}
+
+// moveEdge replaces the edge from by to, moving the usage of the scope along.
+// Callers hold s.mu.
+func (s *resourceScope) moveEdge(from, to *resourceScope) error {
+	return s.moveEdges([]*resourceScope{from}, []*resourceScope{to})
+}
+
+// moveEdges replaces the edges from[i] by to[i], moving the usage of the
+// scope along. The scopes are locked together, so that the usage is seen
+// moved in all of them or in none, and no edge is moved if a limit of the
+// new ones is exceeded. Callers hold s.mu.
+func (s *resourceScope) moveEdges(from, to []*resourceScope) error {
+	locked := lockScopes(append(append([]*resourceScope(nil), from...), to...)...)
+	defer unlockScopes(locked)
+	r := &reservation{origin: s, st: s.stat, prio: network.ReservationPriorityAlways}
+	defer s.rm.trace(r)
+	for i := range from {
+		if from[i] == to[i] {
+			continue
+		}
+		if err := to[i].check(r); err != nil {
+			return err
+		}
+	}
+	for i := range from {
+		if from[i] == to[i] {
+			continue
+		}
+		to[i].stat = addStat(to[i].stat, s.stat)
+		moved := false
+		for j, e := range s.edges {
+			if e == from[i] {
+				s.edges[j] = to[i]
+				from[i].stat = subStat(from[i].stat, s.stat)
+				moved = true
+				break
+			}
+		}
+		if !moved {
+			s.edges = append(s.edges, to[i])
+		}
+	}
+	return nil
+}
+
+// addEdge adds the ancestor to, reserving the usage of the scope in it.
+// Callers hold s.mu.
+func (s *resourceScope) addEdge(to *resourceScope) error {
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	r := &reservation{origin: s, st: s.stat, prio: network.ReservationPriorityAlways}
+	defer s.rm.trace(r)
+	if err := to.check(r); err != nil {
+		return err
+	}
+	to.stat = addStat(to.stat, s.stat)
+	s.edges = append(s.edges, to)
+	return nil
+}
+
+// Lock order of the scopes: when several scopes are locked, the scopes of
+// connections, streams and spans are locked first, then the ancestor scopes
+// in the order below. SnapshotResources locks the ancestor scopes in that
+// order too.
+const (
+	orderLeaf = iota
+	orderService
+	orderProtocol
+	orderPeer
+	orderTransient
+	orderAllowlistedTransient
+	orderSystem
+	orderAllowlistedSystem
+)
+
+// lockScopes locks the given scopes in lock order, once each, and returns
+// them in that order.
+func lockScopes(scopes ...*resourceScope) []*resourceScope {
+	sorted := make([]*resourceScope, 0, len(scopes))
+next:
+	for _, s := range scopes {
+		for _, other := range sorted {
+			if other == s {
+				continue next
+			}
+		}
+		sorted = append(sorted, s)
+		for i := len(sorted) - 1; i > 0 && sorted[i].order < sorted[i-1].order; i-- {
+			sorted[i], sorted[i-1] = sorted[i-1], sorted[i]
+		}
+	}
+	for _, s := range sorted {
+		s.mu.Lock()
+	}
+	return sorted
+}
+
+func unlockScopes(scopes []*resourceScope) {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		scopes[i].mu.Unlock()
+	}
+}
+
+func (s *resourceScope) ReserveMemory(size int, prio uint8) error {
+	if size < 0 {
+		return fmt.Errorf("%s: cannot reserve a negative amount of memory", s.name)
+	}
+	return s.reserve(network.ScopeStat{Memory: int64(size)}, prio)
+}
+
+func (s *resourceScope) ReleaseMemory(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	st := network.ScopeStat{Memory: int64(size)}
+	if st.Memory > s.stat.Memory {
+		log.Warnf("%s: releasing more memory than reserved: %d > %d", s.name, st.Memory, s.stat.Memory)
+		st.Memory = s.stat.Memory
+	}
+	s.stat = subStat(s.stat, st)
+	s.releaseAncestors(st)
+}
+
+func (s *resourceScope) Stat() network.ScopeStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stat
+}
+
+func (s *resourceScope) BeginSpan() (network.ResourceScopeSpan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return nil, fmt.Errorf("%s: %w", s.name, network.ErrResourceScopeClosed)
+	}
+	s.nspans++
+	s.refCnt++
+	span := newScope(s.rm, fmt.Sprintf("%s.span-%d", s.name, s.nspans), orderLeaf, s.limit)
+	span.owner = s
+	return span, nil
+}
+
+// Done releases all the resources of the scope, and closes it.
+func (s *resourceScope) Done() {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.releaseAncestors(s.stat)
+	s.stat = network.ScopeStat{}
+	s.done = true
+	owner, edges := s.owner, s.edges
+	s.mu.Unlock()
+
+	if owner != nil {
+		owner.decRef()
+	}
+	for _, e := range edges {
+		if e.forget != nil {
+			e.decRef()
+		}
+	}
+}
+
+func (s *resourceScope) incRef() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refCnt++
+}
+
+// decRef drops a reference to the scope. Named scopes are forgotten by their
+// manager once they are unreferenced and unused.
+func (s *resourceScope) decRef() {
+	if s.forget == nil {
+		s.mu.Lock()
+		s.refCnt--
+		s.mu.Unlock()
+		return
+	}
+
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	s.mu.Lock()
+	s.refCnt--
+	unused := s.refCnt == 0 && s.stat == (network.ScopeStat{})
+	if unused {
+		s.done = true
+	}
+	s.mu.Unlock()
+	if unused {
+		s.forget()
+	}
+}
+
+type serviceScope struct {
+	*resourceScope
+	service string
+}
+
+var _ network.ServiceScope = (*serviceScope)(nil)
+
+func (s *serviceScope) Name() string {
+	return s.service
+}
+
+type protocolScope struct {
+	*resourceScope
+	proto protocol.ID
+}
+
+var _ network.ProtocolScope = (*protocolScope)(nil)
+
+func (s *protocolScope) Protocol() protocol.ID {
+	return s.proto
+}
+
+type peerScope struct {
+	*resourceScope
+	peer peer.ID
+
+	// allowlistedConns counts the allowlisted connections of the peer. It
+	// is accessed atomically.
+	allowlistedConns int32
+}
+
+var _ network.PeerScope = (*peerScope)(nil)
+
+func (s *peerScope) Peer() peer.ID {
+	return s.peer
+}
+
+// hasAllowlistedConns returns whether the peer is connected from an
+// allowlisted address.
+func (s *peerScope) hasAllowlistedConns() bool {
+	return atomic.LoadInt32(&s.allowlistedConns) > 0
+}
+
+// connScope is the scope of a connection. It starts in the transient scope,
+// and moves to the scope of its peer once the peer is known. Allowlisted
+// connections are accounted in the allowlisted scopes instead of the system
+// and transient scopes.
+type connScope struct {
+	*resourceScope
+	dir      network.Direction
+	usefd    bool
+	endpoint ma.Multiaddr
+
+	allowlisted bool
+	peer        *peerScope
+}
+
+var (
+	_ network.ConnScope           = (*connScope)(nil)
+	_ network.ConnManagementScope = (*connScope)(nil)
+)
+
+func (s *connScope) PeerScope() network.PeerScope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peer == nil {
+		return nil
+	}
+	return s.peer
+}
+
+func (s *connScope) SetPeer(p peer.ID) error {
+	ps := s.rm.getPeerScope(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.done:
+		ps.decRef()
+		return fmt.Errorf("%s: %w", s.name, network.ErrResourceScopeClosed)
+	case s.peer != nil:
+		ps.decRef()
+		return fmt.Errorf("%s: peer already set to %s", s.name, s.peer.peer)
+	}
+
+	// the connection may have been allowlisted for another peer of its
+	// subnet, or its peer may be allowlisted from any address
+	transient, system := s.rm.transient, s.rm.system
+	if s.allowlisted {
+		transient, system = s.rm.allowlistedTransient, s.rm.allowlistedSystem
+	}
+	allowlisted := s.rm.allowlist.AllowedPeerAndMultiaddr(p, s.endpoint)
+	newSystem := s.rm.system
+	if allowlisted {
+		newSystem = s.rm.allowlistedSystem
+	}
+	if err := s.moveEdges([]*resourceScope{system, transient}, []*resourceScope{newSystem, ps.resourceScope}); err != nil {
+		ps.decRef()
+		return err
+	}
+	s.allowlisted = allowlisted
+	s.peer = ps
+	if allowlisted {
+		atomic.AddInt32(&ps.allowlistedConns, 1)
+	}
+	return nil
+}
+
+func (s *connScope) Done() {
+	s.mu.Lock()
+	var ps *peerScope
+	if !s.done && s.allowlisted {
+		ps = s.peer
+		s.allowlisted = false
+	}
+	s.mu.Unlock()
+
+	s.resourceScope.Done()
+	if ps != nil {
+		atomic.AddInt32(&ps.allowlistedConns, -1)
+	}
+}
+
+// streamScope is the scope of a stream. It starts in the transient scope,
+// and moves to the scope of its protocol once the protocol is negotiated.
+// The streams of the peers allowlisted from any address, or connected from an
+// allowlisted address, are accounted in the allowlisted scopes instead of the
+// system and transient scopes.
+type streamScope struct {
+	*resourceScope
+	dir       network.Direction
+	transient *resourceScope
+
+	peer  *peerScope
+	proto *protocolScope
+	svc   *serviceScope
+}
+
+var (
+	_ network.StreamScope           = (*streamScope)(nil)
+	_ network.StreamManagementScope = (*streamScope)(nil)
+)
+
+func (s *streamScope) PeerScope() network.PeerScope {
+	return s.peer
+}
+
+func (s *streamScope) ProtocolScope() network.ProtocolScope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proto == nil {
+		return nil
+	}
+	return s.proto
+}
+
+func (s *streamScope) ServiceScope() network.ServiceScope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.svc == nil {
+		return nil
+	}
+	return s.svc
+}
+
+func (s *streamScope) SetProtocol(proto protocol.ID) error {
+	ps := s.rm.getProtocolScope(proto)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.done:
+		ps.decRef()
+		return fmt.Errorf("%s: %w", s.name, network.ErrResourceScopeClosed)
+	case s.proto != nil:
+		ps.decRef()
+		return fmt.Errorf("%s: protocol already set to %s", s.name, s.proto.proto)
+	}
+	if err := s.moveEdge(s.transient, ps.resourceScope); err != nil {
+		ps.decRef()
+		return err
+	}
+	s.proto = ps
+	return nil
+}
+
+func (s *streamScope) SetService(svc string) error {
+	ss := s.rm.getServiceScope(svc)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.done:
+		ss.decRef()
+		return fmt.Errorf("%s: %w", s.name, network.ErrResourceScopeClosed)
+	case s.proto == nil:
+		ss.decRef()
+		return fmt.Errorf("%s: cannot set the service of a stream without protocol", s.name)
+	case s.svc != nil:
+		ss.decRef()
+		return fmt.Errorf("%s: service already set to %s", s.name, s.svc.service)
+	}
+	if err := s.addEdge(ss.resourceScope); err != nil {
+		ss.decRef()
+		return err
+	}
+	s.svc = ss
+	return nil
+}
@@ -0,0 +1,63 @@
+package rcmgr
+
+import (
+	netx "github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+var _ netx.ResourceSnapshotter = (*resourceManager)(nil)
+
+// SnapshotResources returns the usage of all the live scopes. All the scopes
+// are locked while the snapshot is taken, so that it is consistent.
+func (rm *resourceManager) SnapshotResources() netx.ResourceSnapshot {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	// the scopes are locked in lock order: reservations lock all the
+	// ancestors they update together, so they are seen in all of them or
+	// in none
+	locked := make([]*resourceScope, 0, len(rm.services)+len(rm.protos)+len(rm.peers)+4)
+	for _, s := range rm.services {
+		locked = append(locked, s.resourceScope)
+	}
+	for _, s := range rm.protos {
+		locked = append(locked, s.resourceScope)
+	}
+	for _, s := range rm.peers {
+		locked = append(locked, s.resourceScope)
+	}
+	locked = append(locked, rm.transient, rm.allowlistedTransient, rm.system, rm.allowlistedSystem)
+	for _, s := range locked {
+		s.mu.Lock()
+	}
+	defer func() {
+		for _, s := range locked {
+			s.mu.Unlock()
+		}
+	}()
+
+	snap := netx.ResourceSnapshot{
+		Time:      rm.clock.Now(),
+		System:    rm.system.stat,
+		Transient: rm.transient.stat,
+
+		AllowlistedSystem:    rm.allowlistedSystem.stat,
+		AllowlistedTransient: rm.allowlistedTransient.stat,
+
+		Services:  make(map[string]network.ScopeStat, len(rm.services)),
+		Protocols: make(map[protocol.ID]network.ScopeStat, len(rm.protos)),
+		Peers:     make(map[peer.ID]network.ScopeStat, len(rm.peers)),
+	}
+	for svc, s := range rm.services {
+		snap.Services[svc] = s.stat
+	}
+	for proto, s := range rm.protos {
+		snap.Protocols[proto] = s.stat
+	}
+	for p, s := range rm.peers {
+		snap.Peers[p] = s.stat
+	}
+	return snap
+}
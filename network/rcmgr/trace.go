@@ -0,0 +1,316 @@
+package rcmgr
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// maxStackDepth is the number of frames recorded in the stack of a
+// BlockedReservation.
+const maxStackDepth = 32
+
+// BlockedReservation records a reservation that exceeded one or more limits.
+// A reservation is checked against the limits of its scope and of all the
+// ancestors of the scope, and is reported once, however many limits it
+// exceeded.
+type BlockedReservation struct {
+	Time time.Time
+	// Allowed is true if the reservation succeeded nonetheless, in dry-run
+	// mode.
+	Allowed bool
+
+	// Scope is the name of the first scope whose limit was exceeded.
+	Scope string
+	// Chain lists the names of the scopes the reservation was made in, from
+	// the scope it was made from to its ancestors.
+	Chain []string
+	// Peer, Protocol and Service are those of the scopes in Chain, if any.
+	Peer     peer.ID
+	Protocol protocol.ID
+	Service  string
+
+	// Resource is the resource whose limit was exceeded in Scope.
+	Resource string
+	// Amount is the reserved amount, Priority its priority, and Usage the
+	// usage of Scope the reservation would have resulted in.
+	Amount   network.ScopeStat
+	Priority uint8
+	Usage    network.ScopeStat
+	// Exceeded lists every limit the reservation exceeded, starting with the
+	// one of Scope. Outside dry-run mode, the reservation fails at the first
+	// one, and the limits of the remaining ancestors are not checked.
+	Exceeded []LimitError
+
+	// Stack is the stack trace of the caller of the resource manager.
+	Stack string
+}
+
+// TraceSink receives the reservations that exceed a limit. It is called
+// synchronously, possibly with the locks of the scopes involved held: it must
+// not block, nor call into the resource manager.
+type TraceSink interface {
+	BlockedReservation(BlockedReservation)
+}
+
+// WithDryRun makes the resource manager only record the reservations that
+// exceed a limit, instead of failing them. This is meant to find out what
+// limits would block before enforcing them; see WithTrace.
+func WithDryRun() Option {
+	return func(rm *resourceManager) error {
+		rm.dryRun = true
+		return nil
+	}
+}
+
+// WithTrace reports the reservations that exceed a limit to sink.
+func WithTrace(sink TraceSink) Option {
+	return func(rm *resourceManager) error {
+		rm.sinks = append(rm.sinks, sink)
+		return nil
+	}
+}
+
+// trace reports r to the sinks if it exceeded a limit.
+func (rm *resourceManager) trace(r *reservation) {
+	if len(r.exceeded) == 0 {
+		return
+	}
+	first := r.exceeded[0]
+	if len(rm.sinks) == 0 {
+		if rm.dryRun {
+			log.Warnf("dry run: %s (reserving %+v with priority %d)", &first, r.st, r.prio)
+		}
+		return
+	}
+
+	ev := BlockedReservation{
+		Time:     rm.clock.Now(),
+		Allowed:  rm.dryRun,
+		Scope:    first.Scope,
+		Chain:    r.chain,
+		Resource: first.Resource,
+		Amount:   r.st,
+		Priority: r.prio,
+		Usage:    first.Stat,
+		Exceeded: r.exceeded,
+		Stack:    callerStack(),
+	}
+	for _, name := range ev.Chain {
+		switch {
+		case strings.HasPrefix(name, peerScopePrefix):
+			ev.Peer, _ = peer.Decode(strings.TrimPrefix(name, peerScopePrefix))
+		case strings.HasPrefix(name, protocolScopePrefix):
+			ev.Protocol = protocol.ID(strings.TrimPrefix(name, protocolScopePrefix))
+		case strings.HasPrefix(name, serviceScopePrefix):
+			ev.Service = strings.TrimPrefix(name, serviceScopePrefix)
+		}
+	}
+	for _, sink := range rm.sinks {
+		sink.BlockedReservation(ev)
+	}
+}
+
+// chain returns the names of the scope, of its owners and of its edges.
+// Callers hold the locks of the scope and of its owners.
+func (s *resourceScope) chain() []string {
+	names := []string{s.name}
+	for s.owner != nil {
+		s = s.owner
+		names = append(names, s.name)
+	}
+	for _, e := range s.edges {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+// pkgPrefix prefixes the names of the functions of this package.
+var pkgPrefix = func() string {
+	name := runtime.FuncForPC(reflect.ValueOf(newScope).Pointer()).Name()
+	return name[:strings.LastIndex(name, ".")+1]
+}()
+
+// callerStack returns the stack trace of the caller of the resource manager.
+func callerStack() string {
+	pcs := make([]uintptr, maxStackDepth+16)
+	pcs = pcs[:runtime.Callers(2, pcs)]
+	frames := runtime.CallersFrames(pcs)
+
+	var b strings.Builder
+	inPkg, depth := true, 0
+	for depth < maxStackDepth {
+		f, more := frames.Next()
+		if inPkg && strings.HasPrefix(f.Function, pkgPrefix) {
+			if !more {
+				break
+			}
+			continue
+		}
+		inPkg = false
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		depth++
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// TraceAggregator is a TraceSink counting blocked reservations by peer,
+// protocol, service, scope, resource and stack. A reservation exceeding the
+// limits of several scopes counts once in the total and for its peer,
+// protocol, service, resources and stack, and once for each of these scopes.
+type TraceAggregator struct {
+	mu        sync.Mutex
+	total     int
+	peers     map[string]int
+	protocols map[string]int
+	services  map[string]int
+	scopes    map[string]int
+	resources map[string]int
+	stacks    map[string]int
+}
+
+var _ TraceSink = (*TraceAggregator)(nil)
+
+// NewTraceAggregator creates an empty TraceAggregator.
+func NewTraceAggregator() *TraceAggregator {
+	return &TraceAggregator{
+		peers:     make(map[string]int),
+		protocols: make(map[string]int),
+		services:  make(map[string]int),
+		scopes:    make(map[string]int),
+		resources: make(map[string]int),
+		stacks:    make(map[string]int),
+	}
+}
+
+func (a *TraceAggregator) BlockedReservation(ev BlockedReservation) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total++
+	if ev.Peer != "" {
+		a.peers[ev.Peer.String()]++
+	}
+	if ev.Protocol != "" {
+		a.protocols[string(ev.Protocol)]++
+	}
+	if ev.Service != "" {
+		a.services[ev.Service]++
+	}
+	resources := make(map[string]bool, 1)
+	for _, e := range ev.Exceeded {
+		a.scopes[e.Scope]++
+		resources[e.Resource] = true
+	}
+	for res := range resources {
+		a.resources[res]++
+	}
+	a.stacks[ev.Stack]++
+}
+
+// Reset drops all the counts.
+func (a *TraceAggregator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total = 0
+	for _, m := range []map[string]int{a.peers, a.protocols, a.services, a.scopes, a.resources, a.stacks} {
+		for k := range m {
+			delete(m, k)
+		}
+	}
+}
+
+// TraceCount is the number of blocked reservations of a peer, protocol,
+// service, scope, resource or stack.
+type TraceCount struct {
+	Name  string
+	Count int
+}
+
+// TraceReport summarizes the blocked reservations, listing the top offenders
+// first.
+type TraceReport struct {
+	Total     int
+	Peers     []TraceCount
+	Protocols []TraceCount
+	Services  []TraceCount
+	Scopes    []TraceCount
+	Resources []TraceCount
+	Stacks    []TraceCount
+}
+
+// Report returns the top n offenders of every kind, or all of them if n is
+// not positive.
+func (a *TraceAggregator) Report(n int) TraceReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return TraceReport{
+		Total:     a.total,
+		Peers:     topCounts(a.peers, n),
+		Protocols: topCounts(a.protocols, n),
+		Services:  topCounts(a.services, n),
+		Scopes:    topCounts(a.scopes, n),
+		Resources: topCounts(a.resources, n),
+		Stacks:    topCounts(a.stacks, n),
+	}
+}
+
+func topCounts(m map[string]int, n int) []TraceCount {
+	counts := make([]TraceCount, 0, len(m))
+	for name, c := range m {
+		counts = append(counts, TraceCount{Name: name, Count: c})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// WriteTo writes the report in a human readable form.
+func (r TraceReport) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d blocked reservations\n", r.Total)
+	for _, sec := range []struct {
+		title  string
+		counts []TraceCount
+	}{
+		{"peers", r.Peers},
+		{"protocols", r.Protocols},
+		{"services", r.Services},
+		{"scopes", r.Scopes},
+		{"resources", r.Resources},
+	} {
+		if len(sec.counts) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\ntop %s:\n", sec.title)
+		for _, c := range sec.counts {
+			fmt.Fprintf(&b, "%8d  %s\n", c.Count, c.Name)
+		}
+	}
+	if len(r.Stacks) > 0 {
+		b.WriteString("\ntop stacks:\n")
+		for _, c := range r.Stacks {
+			fmt.Fprintf(&b, "%8d\n\t%s\n", c.Count, strings.ReplaceAll(strings.TrimSpace(c.Name), "\n", "\n\t"))
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,205 @@
+package rcmgr_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network/rcmgr"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// recordingSink records the blocked reservations.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []rcmgr.BlockedReservation
+}
+
+func (s *recordingSink) BlockedReservation(ev rcmgr.BlockedReservation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+}
+
+func (s *recordingSink) recorded() []rcmgr.BlockedReservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]rcmgr.BlockedReservation(nil), s.events...)
+}
+
+// oneStreamLimits allow a single outbound stream per peer and in the system.
+func oneStreamLimits() rcmgr.Limits {
+	limits := rcmgr.InfiniteLimits
+	limits.System.Streams, limits.System.StreamsOutbound = 1, 1
+	limits.PeerDefault.Streams, limits.PeerDefault.StreamsOutbound = 1, 1
+	return limits
+}
+
+func newTracedManager(t *testing.T, limits rcmgr.Limits, opts ...rcmgr.Option) (network.ResourceManager, *recordingSink, *rcmgr.TraceAggregator) {
+	t.Helper()
+	sink, agg := &recordingSink{}, rcmgr.NewTraceAggregator()
+	rm, err := rcmgr.NewResourceManager(limits, append([]rcmgr.Option{rcmgr.WithTrace(sink), rcmgr.WithTrace(agg)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rm.Close() })
+	return rm, sink, agg
+}
+
+func TestDryRun(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(1000, 0))
+	rm, sink, agg := newTracedManager(t, oneStreamLimits(), rcmgr.WithDryRun(), rcmgr.WithClock(clk))
+	p := randPeerID(t)
+
+	for i := 0; i < 3; i++ {
+		s, err := rm.OpenStream(p, network.DirOutbound)
+		if err != nil {
+			t.Fatalf("expected the reservation to succeed in dry-run mode: %v", err)
+		}
+		defer s.Done()
+	}
+	rm.ViewPeer(p, func(s network.PeerScope) error {
+		if n := s.Stat().NumStreamsOutbound; n != 3 {
+			t.Fatalf("expected the streams to be accounted, got %d", n)
+		}
+		return nil
+	})
+
+	events := sink.recorded()
+	if len(events) != 2 {
+		t.Fatalf("expected a single event per blocked reservation, got %d", len(events))
+	}
+	ev := events[0]
+	if !ev.Allowed || !ev.Time.Equal(clk.Now()) || ev.Priority != network.ReservationPriorityAlways {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	peerScope := "peer:" + p.Pretty()
+	if ev.Scope != peerScope || ev.Resource != "streams" || ev.Peer != p {
+		t.Fatalf("expected the peer limit to be reported first, got %+v", ev)
+	}
+	if ev.Amount != (network.ScopeStat{NumStreamsOutbound: 1}) || ev.Usage.NumStreamsOutbound != 2 {
+		t.Fatalf("unexpected amounts: %+v, %+v", ev.Amount, ev.Usage)
+	}
+	if len(ev.Exceeded) != 2 || ev.Exceeded[0].Scope != peerScope || ev.Exceeded[1].Scope != "system" {
+		t.Fatalf("expected the peer and system limits to be exceeded, got %+v", ev.Exceeded)
+	}
+	if len(ev.Chain) != 4 || ev.Chain[1] != peerScope || ev.Chain[2] != "transient" || ev.Chain[3] != "system" {
+		t.Fatalf("unexpected scope chain: %v", ev.Chain)
+	}
+
+	r := agg.Report(0)
+	if r.Total != 2 {
+		t.Fatalf("expected 2 blocked reservations, got %d", r.Total)
+	}
+	expectCounts(t, "peers", r.Peers, rcmgr.TraceCount{Name: p.String(), Count: 2})
+	expectCounts(t, "scopes", r.Scopes, rcmgr.TraceCount{Name: peerScope, Count: 2}, rcmgr.TraceCount{Name: "system", Count: 2})
+	expectCounts(t, "resources", r.Resources, rcmgr.TraceCount{Name: "streams", Count: 2})
+}
+
+func TestTraceEnforced(t *testing.T) {
+	rm, sink, agg := newTracedManager(t, oneStreamLimits())
+	p := randPeerID(t)
+	s, err := rm.OpenStream(p, network.DirOutbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Done()
+	if _, err := rm.OpenStream(p, network.DirOutbound); !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("expected the reservation to fail, got %v", err)
+	}
+
+	events := sink.recorded()
+	if len(events) != 1 || events[0].Allowed {
+		t.Fatalf("expected a single failed reservation, got %+v", events)
+	}
+	// the reservation fails at the first limit exceeded
+	if len(events[0].Exceeded) != 1 {
+		t.Fatalf("expected the limits of the other ancestors not to be checked, got %+v", events[0].Exceeded)
+	}
+	if r := agg.Report(0); r.Total != 1 || len(r.Scopes) != 1 {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+}
+
+func TestTraceProtocolAndService(t *testing.T) {
+	limits := rcmgr.InfiniteLimits
+	limits.ProtocolDefault.Memory = 1 << 10
+	limits.ServiceDefault.Memory = 1 << 10
+	rm, sink, agg := newTracedManager(t, limits, rcmgr.WithDryRun())
+	p := randPeerID(t)
+
+	s, err := rm.OpenStream(p, network.DirInbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Done()
+	if err := s.SetProtocol("/proto"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetService("svc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReserveMemory(2<<10, network.ReservationPriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+
+	events := sink.recorded()
+	if len(events) != 1 {
+		t.Fatalf("expected a single event, got %d", len(events))
+	}
+	ev := events[0]
+	if ev.Protocol != "/proto" || ev.Service != "svc" || ev.Peer != p {
+		t.Fatalf("expected the peer, protocol and service to be filled, got %+v", ev)
+	}
+	if ev.Priority != network.ReservationPriorityHigh || ev.Amount.Memory != 2<<10 {
+		t.Fatalf("unexpected reservation: %+v", ev)
+	}
+
+	// the stack starts at the caller of the resource manager
+	if !strings.HasPrefix(ev.Stack, "github.com/libp2p/go-libp2p-core/network/rcmgr_test.TestTraceProtocolAndService\n") {
+		t.Fatalf("expected the stack to start with the test, got:\n%s", ev.Stack)
+	}
+	if strings.Contains(ev.Stack, "rcmgr.(*resourceScope)") {
+		t.Fatalf("expected the frames of the resource manager to be skipped, got:\n%s", ev.Stack)
+	}
+
+	r := agg.Report(1)
+	expectCounts(t, "protocols", r.Protocols, rcmgr.TraceCount{Name: "/proto", Count: 1})
+	expectCounts(t, "services", r.Services, rcmgr.TraceCount{Name: "svc", Count: 1})
+	// top 1 of the 2 scopes exceeded, ties broken by name
+	expectCounts(t, "scopes", r.Scopes, rcmgr.TraceCount{Name: "protocol:/proto", Count: 1})
+	expectCounts(t, "resources", r.Resources, rcmgr.TraceCount{Name: "memory", Count: 1})
+	if len(r.Stacks) != 1 || r.Stacks[0].Name != ev.Stack {
+		t.Fatalf("expected the stack to be counted, got %+v", r.Stacks)
+	}
+
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "1 blocked reservations\n\ntop peers:\n       1  "+p.String()+"\n") {
+		t.Fatalf("unexpected report:\n%s", b.String())
+	}
+
+	agg.Reset()
+	if r := agg.Report(0); r.Total != 0 || len(r.Scopes) != 0 || len(r.Stacks) != 0 {
+		t.Fatalf("expected the counts to be dropped, got %+v", r)
+	}
+}
+
+func expectCounts(t *testing.T, kind string, got []rcmgr.TraceCount, expected ...rcmgr.TraceCount) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %s %+v, got %+v", kind, expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %s %+v, got %+v", kind, expected, got)
+		}
+	}
+}
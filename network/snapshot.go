@@ -0,0 +1,38 @@
+package network
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ResourceSnapshot is the usage of all the live scopes of a resource
+// manager, at a single point in time.
+type ResourceSnapshot struct {
+	Time time.Time
+
+	System    ScopeStat
+	Transient ScopeStat
+
+	AllowlistedSystem    ScopeStat
+	AllowlistedTransient ScopeStat
+
+	Services  map[string]ScopeStat
+	Protocols map[protocol.ID]ScopeStat
+	Peers     map[peer.ID]ScopeStat
+}
+
+// ResourceSnapshotter is implemented by resource managers able to snapshot
+// the usage of all their scopes consistently: no reservation is made or
+// released while the snapshot is taken.
+type ResourceSnapshotter interface {
+	SnapshotResources() ResourceSnapshot
+}
+
+// GetResourceSnapshotter returns the ResourceSnapshotter of rm, if it has
+// one.
+func GetResourceSnapshotter(rm ResourceManager) (ResourceSnapshotter, bool) {
+	s, ok := rm.(ResourceSnapshotter)
+	return s, ok
+}
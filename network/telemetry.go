@@ -0,0 +1,178 @@
+package network
+
+import (
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// HandshakePhase is a phase of the establishment of a connection.
+type HandshakePhase string
+
+const (
+	// HandshakeTransport is the establishment of the raw connection, e.g. the
+	// TCP three-way handshake.
+	HandshakeTransport HandshakePhase = "transport"
+	// HandshakeSecurity is the negotiation and handshake of the security
+	// protocol.
+	HandshakeSecurity HandshakePhase = "security"
+	// HandshakeMuxer is the negotiation of the stream multiplexer.
+	HandshakeMuxer HandshakePhase = "muxer"
+)
+
+// PhaseDuration is the time spent in a phase of a handshake.
+type PhaseDuration struct {
+	Phase    HandshakePhase
+	Duration time.Duration
+}
+
+// ConnTelemetry holds detailed statistics of a connection. Fields a transport
+// does not track are left zero.
+type ConnTelemetry struct {
+	// Handshake lists the phases of the connection handshake, in order.
+	// Transports with a combined handshake, such as QUIC, report a single
+	// phase.
+	Handshake []PhaseDuration
+	// SmoothedRTT and RTTVariance are the round trip time estimates of the
+	// connection, as maintained by its congestion control.
+	SmoothedRTT time.Duration
+	RTTVariance time.Duration
+	// Retransmits is the number of packets retransmitted.
+	Retransmits uint64
+	// BytesIn and BytesOut are the amounts of data received and sent on the
+	// connection, including the overhead of the muxer.
+	BytesIn, BytesOut int64
+	// StreamsByProtocol counts the open streams of the connection by
+	// protocol. Streams whose protocol is not negotiated yet are counted
+	// under "".
+	StreamsByProtocol map[protocol.ID]int
+}
+
+// HandshakeDuration returns the total duration of the handshake.
+func (t ConnTelemetry) HandshakeDuration() time.Duration {
+	var d time.Duration
+	for _, p := range t.Handshake {
+		d += p.Duration
+	}
+	return d
+}
+
+// TelemetryConn is an optional interface for connections reporting
+// ConnTelemetry. Transports implement it on their transport.CapableConn, and
+// Networks on their Conn, typically by forwarding to the transport
+// connection.
+type TelemetryConn interface {
+	Telemetry() ConnTelemetry
+}
+
+// GetConnTelemetry returns the telemetry of c, if c reports any. Stream
+// counts are filled from the streams of c if the connection does not track
+// them.
+func GetConnTelemetry(c Conn) (ConnTelemetry, bool) {
+	tc, ok := c.(TelemetryConn)
+	if !ok {
+		return ConnTelemetry{}, false
+	}
+	t := tc.Telemetry()
+	if t.StreamsByProtocol == nil {
+		t.StreamsByProtocol = countStreams(c, nil)
+	}
+	return t, true
+}
+
+func countStreams(c Conn, counts map[protocol.ID]int) map[protocol.ID]int {
+	if counts == nil {
+		counts = make(map[protocol.ID]int)
+	}
+	for _, s := range c.GetStreams() {
+		counts[s.Protocol()]++
+	}
+	return counts
+}
+
+// ConnTelemetrySnapshot is the telemetry of a single connection of a
+// NetworkTelemetry.
+type ConnTelemetrySnapshot struct {
+	ID        string
+	Peer      peer.ID
+	Stat      ConnStats
+	Telemetry ConnTelemetry
+}
+
+// NetworkTelemetry aggregates the telemetry of the connections of a Network.
+type NetworkTelemetry struct {
+	// Conns holds the connections reporting telemetry, from the oldest to
+	// the most recently opened. Connections opened at the same time are
+	// ordered by ID.
+	Conns []ConnTelemetrySnapshot
+	// Unreported is the number of connections not reporting telemetry.
+	Unreported int
+
+	// BytesIn, BytesOut and Retransmits are the sums over Conns.
+	BytesIn, BytesOut int64
+	Retransmits       uint64
+	// MeanSmoothedRTT is the mean of the connections reporting an RTT.
+	MeanSmoothedRTT time.Duration
+	// MeanHandshake is the mean duration of every handshake phase, over the
+	// connections reporting it.
+	MeanHandshake map[HandshakePhase]time.Duration
+	// StreamsByProtocol counts the open streams of all connections,
+	// including those not reporting telemetry.
+	StreamsByProtocol map[protocol.ID]int
+}
+
+// SnapshotTelemetry collects the telemetry of the connections of n.
+func SnapshotTelemetry(n Network) NetworkTelemetry {
+	nt := NetworkTelemetry{
+		MeanHandshake:     make(map[HandshakePhase]time.Duration),
+		StreamsByProtocol: make(map[protocol.ID]int),
+	}
+	var (
+		rttSum, rttCount time.Duration
+		phaseCount       = make(map[HandshakePhase]time.Duration)
+	)
+	for _, c := range n.Conns() {
+		t, ok := GetConnTelemetry(c)
+		if !ok {
+			nt.Unreported++
+			countStreams(c, nt.StreamsByProtocol)
+			continue
+		}
+		nt.Conns = append(nt.Conns, ConnTelemetrySnapshot{
+			ID:        c.ID(),
+			Peer:      c.RemotePeer(),
+			Stat:      c.Stat(),
+			Telemetry: t,
+		})
+		nt.BytesIn += t.BytesIn
+		nt.BytesOut += t.BytesOut
+		nt.Retransmits += t.Retransmits
+		if t.SmoothedRTT > 0 {
+			rttSum += t.SmoothedRTT
+			rttCount++
+		}
+		for _, p := range t.Handshake {
+			nt.MeanHandshake[p.Phase] += p.Duration
+			phaseCount[p.Phase]++
+		}
+		for proto, count := range t.StreamsByProtocol {
+			nt.StreamsByProtocol[proto] += count
+		}
+	}
+	if rttCount > 0 {
+		nt.MeanSmoothedRTT = rttSum / rttCount
+	}
+	for phase, count := range phaseCount {
+		nt.MeanHandshake[phase] /= count
+	}
+	sort.Slice(nt.Conns, func(i, j int) bool {
+		a, b := nt.Conns[i], nt.Conns[j]
+		if !a.Stat.Opened.Equal(b.Stat.Opened) {
+			return a.Stat.Opened.Before(b.Stat.Opened)
+		}
+		return a.ID < b.ID
+	})
+	return nt
+}
@@ -0,0 +1,64 @@
+package network_test
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/network/memnet"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+)
+
+func TestSnapshotTelemetryOrder(t *testing.T) {
+	hub, err := memnet.NewHub(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newNet := func() *memnet.Network {
+		sk, _, err := ic.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps, err := pstoremem.NewPeerstore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := hub.AddPeer(sk, ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			n.Close()
+			ps.Close()
+		})
+		return n
+	}
+
+	// more than ten connections, so that lexical order differs
+	center := newNet()
+	var dialers []peer.ID
+	for i := 0; i < 12; i++ {
+		n := newNet()
+		if _, err := n.DialPeer(context.Background(), center.LocalPeer()); err != nil {
+			t.Fatal(err)
+		}
+		dialers = append(dialers, n.LocalPeer())
+	}
+
+	nt := network.SnapshotTelemetry(center)
+	if len(nt.Conns) != len(dialers) {
+		t.Fatalf("expected %d connections, got %d", len(dialers), len(nt.Conns))
+	}
+	for i, c := range nt.Conns {
+		if c.Peer != dialers[i] {
+			t.Fatalf("expected connection %d to be with the dialer %d, got %s", i, i, c.ID)
+		}
+		if i > 0 && c.Stat.Opened.Before(nt.Conns[i-1].Stat.Opened) {
+			t.Fatalf("expected the connections to be ordered by open time, got %s before %s", nt.Conns[i-1].ID, c.ID)
+		}
+	}
+}
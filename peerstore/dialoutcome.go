@@ -0,0 +1,410 @@
+package peerstore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/sec"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DialFailureClass classifies why a dial failed.
+type DialFailureClass int
+
+const (
+	// DialFailureNone is used for successful dials.
+	DialFailureNone DialFailureClass = iota
+	DialFailureTimeout
+	DialFailureRefused
+	DialFailureUnreachable
+	// DialFailureHandshake is used when the connection was established but
+	// the security or multiplexer negotiation failed.
+	DialFailureHandshake
+	// DialFailurePeerIDMismatch is used when the remote peer turned out to be
+	// a different peer than the one dialed.
+	DialFailurePeerIDMismatch
+	DialFailureOther
+)
+
+func (c DialFailureClass) String() string {
+	str := [...]string{"none", "timeout", "refused", "unreachable", "handshake", "peer-id-mismatch", "other"}
+	if c < 0 || int(c) >= len(str) {
+		return "(unrecognized)"
+	}
+	return str[c]
+}
+
+// The go-libp2p upgrader and security transports format the errors they wrap
+// with %s, so their handshake failures can only be recognized by message.
+var (
+	peerIDMismatchMessages = []string{
+		"peer id mismatch",                    // noise
+		"peer IDs don't match",                // tls
+		"remote peer sent unexpected peer ID", // insecure
+	}
+	handshakeMessages = []string{
+		"failed to negotiate security protocol",
+		"failed to negotiate stream multiplexer",
+	}
+)
+
+// ClassifyDialError maps a dial error onto a DialFailureClass. Peer ID
+// mismatches are recognized from sec.ErrPeerIDMismatch, and handshake
+// failures from the messages of the go-libp2p upgrader. Other errors that
+// can't be classified from their type are reported as DialFailureOther.
+func ClassifyDialError(err error) DialFailureClass {
+	if err == nil {
+		return DialFailureNone
+	}
+	var nerr net.Error
+	var mismatch sec.ErrPeerIDMismatch
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return DialFailureTimeout
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return DialFailureTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialFailureRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return DialFailureUnreachable
+	case errors.As(err, &mismatch), containsAny(err.Error(), peerIDMismatchMessages):
+		return DialFailurePeerIDMismatch
+	case containsAny(err.Error(), handshakeMessages):
+		return DialFailureHandshake
+	default:
+		return DialFailureOther
+	}
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialOutcome describes the result of a single dial attempt.
+type DialOutcome struct {
+	// Failure is DialFailureNone if the dial succeeded.
+	Failure DialFailureClass
+	// Latency is the time it took for the dial to succeed or fail.
+	Latency time.Duration
+	// Time is when the attempt was made. Defaults to now.
+	Time time.Time
+}
+
+// Success returns true if the outcome records a successful dial.
+func (o DialOutcome) Success() bool {
+	return o.Failure == DialFailureNone
+}
+
+// AddrDialStats is the dial history of a single address.
+type AddrDialStats struct {
+	Addr ma.Multiaddr
+
+	Successes           int
+	Failures            int
+	ConsecutiveFailures int
+
+	LastFailure DialFailureClass
+	LastLatency time.Duration
+	LastAttempt time.Time
+	LastSuccess time.Time
+
+	// Score is the decayed probability that a dial to this address succeeds,
+	// between 0 and 1. Addresses without history score 0.5.
+	Score float64
+}
+
+// DialOutcomeBook records the outcome of dials per address, and ranks the
+// addresses of a peer by their expected dial success.
+type DialOutcomeBook interface {
+	// RecordDialOutcome records the outcome of a dial to the given address.
+	RecordDialOutcome(p peer.ID, addr ma.Multiaddr, o DialOutcome)
+
+	// AddrDialStats returns the dial history of the given address.
+	AddrDialStats(p peer.ID, addr ma.Multiaddr) (AddrDialStats, bool)
+
+	// RankedAddrs returns the known addresses of a peer, ordered by expected
+	// dial success.
+	RankedAddrs(p peer.ID) []ma.Multiaddr
+}
+
+// GetDialOutcomeBook is a helper to "upcast" an AddrBook to a DialOutcomeBook
+// by using type assertion. Returns (nil, false) if the AddrBook does not
+// track dial outcomes.
+func GetDialOutcomeBook(ab AddrBook) (dob DialOutcomeBook, ok bool) {
+	dob, ok = ab.(DialOutcomeBook)
+	return dob, ok
+}
+
+const (
+	// DefaultDialScoreHalfLife is the default time after which the weight of
+	// a recorded dial outcome is halved.
+	DefaultDialScoreHalfLife = time.Hour
+	// DefaultMaxConsecutiveDialFailures is the default number of consecutive
+	// failures after which an address is dropped, if its score is also below
+	// the drop threshold.
+	DefaultMaxConsecutiveDialFailures = 5
+	// DefaultDialScoreDropThreshold is the default score below which a
+	// repeatedly failing address is dropped.
+	DefaultDialScoreDropThreshold = 0.2
+)
+
+// RankedAddrBookOption is a single RankedAddrBook option.
+type RankedAddrBookOption func(ab *RankedAddrBook) error
+
+// WithDialScoreHalfLife sets the half life of recorded dial outcomes.
+func WithDialScoreHalfLife(d time.Duration) RankedAddrBookOption {
+	return func(ab *RankedAddrBook) error {
+		if d <= 0 {
+			return errors.New("dial score half life must be positive")
+		}
+		ab.halfLife = d
+		return nil
+	}
+}
+
+// WithDialFailureDrop sets the number of consecutive failures and the score
+// threshold after which an address is removed from the AddrBook. A count of
+// zero disables dropping.
+func WithDialFailureDrop(consecutive int, threshold float64) RankedAddrBookOption {
+	return func(ab *RankedAddrBook) error {
+		if consecutive < 0 {
+			return errors.New("consecutive dial failures must not be negative")
+		}
+		ab.maxFailures = consecutive
+		ab.dropThreshold = threshold
+		return nil
+	}
+}
+
+// WithDialOutcomeClock sets the clock used to timestamp dial outcomes and to
+// decay their weight. Defaults to clock.Real.
+func WithDialOutcomeClock(c clock.Clock) RankedAddrBookOption {
+	return func(ab *RankedAddrBook) error {
+		ab.clock = c
+		return nil
+	}
+}
+
+// RankedAddrBook wraps an AddrBook and implements DialOutcomeBook on top of
+// it. Addresses that keep failing are removed from the wrapped AddrBook.
+type RankedAddrBook struct {
+	AddrBook
+
+	clock         clock.Clock
+	halfLife      time.Duration
+	maxFailures   int
+	dropThreshold float64
+
+	mu    sync.Mutex
+	stats map[peer.ID]map[string]*addrDialRecord
+}
+
+var _ AddrBook = (*RankedAddrBook)(nil)
+var _ DialOutcomeBook = (*RankedAddrBook)(nil)
+
+type addrDialRecord struct {
+	AddrDialStats
+
+	// decayed success and failure weights, as of AddrDialStats.LastAttempt
+	wSuccess, wFailure float64
+}
+
+// NewRankedAddrBook wraps the given AddrBook with dial outcome tracking.
+func NewRankedAddrBook(ab AddrBook, opts ...RankedAddrBookOption) (*RankedAddrBook, error) {
+	rab := &RankedAddrBook{
+		AddrBook:      ab,
+		clock:         clock.Real,
+		halfLife:      DefaultDialScoreHalfLife,
+		maxFailures:   DefaultMaxConsecutiveDialFailures,
+		dropThreshold: DefaultDialScoreDropThreshold,
+		stats:         make(map[peer.ID]map[string]*addrDialRecord),
+	}
+	for _, o := range opts {
+		if err := o(rab); err != nil {
+			return nil, err
+		}
+	}
+	return rab, nil
+}
+
+func (ab *RankedAddrBook) RecordDialOutcome(p peer.ID, addr ma.Multiaddr, o DialOutcome) {
+	if o.Time.IsZero() {
+		o.Time = ab.clock.Now()
+	}
+	live := ab.AddrBook.Addrs(p)
+
+	ab.mu.Lock()
+	addrs, ok := ab.stats[p]
+	if !ok {
+		addrs = make(map[string]*addrDialRecord)
+		ab.stats[p] = addrs
+	}
+	key := string(addr.Bytes())
+	r, ok := addrs[key]
+	if !ok {
+		r = &addrDialRecord{AddrDialStats: AddrDialStats{Addr: addr}}
+		addrs[key] = r
+	}
+
+	r.decay(o.Time, ab.halfLife)
+	r.LastAttempt = o.Time
+	r.LastLatency = o.Latency
+	if o.Success() {
+		r.Successes++
+		r.ConsecutiveFailures = 0
+		r.LastSuccess = o.Time
+		r.wSuccess++
+	} else {
+		r.Failures++
+		r.ConsecutiveFailures++
+		r.LastFailure = o.Failure
+		r.wFailure++
+	}
+	r.Score = r.score()
+	ab.prune(p, live, key)
+
+	drop := ab.maxFailures > 0 && r.ConsecutiveFailures >= ab.maxFailures && r.Score < ab.dropThreshold
+	if drop {
+		delete(addrs, key)
+		if len(addrs) == 0 {
+			delete(ab.stats, p)
+		}
+	}
+	ab.mu.Unlock()
+
+	if drop {
+		ab.AddrBook.SetAddr(p, addr, 0)
+	}
+}
+
+func (ab *RankedAddrBook) AddrDialStats(p peer.ID, addr ma.Multiaddr) (AddrDialStats, bool) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	r, ok := ab.stats[p][string(addr.Bytes())]
+	if !ok {
+		return AddrDialStats{}, false
+	}
+	return r.AddrDialStats, true
+}
+
+func (ab *RankedAddrBook) RankedAddrs(p peer.ID) []ma.Multiaddr {
+	addrs := ab.AddrBook.Addrs(p)
+	now := ab.clock.Now()
+
+	type ranked struct {
+		addr    ma.Multiaddr
+		score   float64
+		latency time.Duration
+	}
+	rs := make([]ranked, len(addrs))
+
+	ab.mu.Lock()
+	known := ab.stats[p]
+	for i, a := range addrs {
+		key := string(a.Bytes())
+		rs[i] = ranked{addr: a, score: 0.5}
+		if r, ok := known[key]; ok {
+			rs[i].score = r.scoreAt(now, ab.halfLife)
+			rs[i].latency = r.LastLatency
+		}
+	}
+	ab.prune(p, addrs, "")
+	ab.mu.Unlock()
+
+	sort.SliceStable(rs, func(i, j int) bool {
+		if rs[i].score != rs[j].score {
+			return rs[i].score > rs[j].score
+		}
+		return rs[i].latency < rs[j].latency
+	})
+	out := make([]ma.Multiaddr, len(rs))
+	for i, r := range rs {
+		out[i] = r.addr
+	}
+	return out
+}
+
+// prune forgets the history of the addresses of p that have expired from the
+// book, that is, that are not in live, except for the address keep. Callers
+// hold ab.mu.
+func (ab *RankedAddrBook) prune(p peer.ID, live []ma.Multiaddr, keep string) {
+	known, ok := ab.stats[p]
+	if !ok {
+		return
+	}
+	set := make(map[string]struct{}, len(live))
+	for _, a := range live {
+		set[string(a.Bytes())] = struct{}{}
+	}
+	for key := range known {
+		if _, ok := set[key]; !ok && key != keep {
+			delete(known, key)
+		}
+	}
+	if len(known) == 0 {
+		delete(ab.stats, p)
+	}
+}
+
+func (ab *RankedAddrBook) ClearAddrs(p peer.ID) {
+	ab.AddrBook.ClearAddrs(p)
+
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	delete(ab.stats, p)
+}
+
+// RemovePeer forgets the dial history of p, and removes p from the wrapped
+// AddrBook if it supports removing peers, like a Peerstore does.
+func (ab *RankedAddrBook) RemovePeer(p peer.ID) {
+	if rp, ok := ab.AddrBook.(interface{ RemovePeer(peer.ID) }); ok {
+		rp.RemovePeer(p)
+	}
+
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	delete(ab.stats, p)
+}
+
+func (r *addrDialRecord) decay(now time.Time, halfLife time.Duration) {
+	if r.LastAttempt.IsZero() || !now.After(r.LastAttempt) {
+		return
+	}
+	f := decayFactor(now.Sub(r.LastAttempt), halfLife)
+	r.wSuccess *= f
+	r.wFailure *= f
+}
+
+// score is the Laplace-smoothed success ratio of the decayed weights.
+func (r *addrDialRecord) score() float64 {
+	return (r.wSuccess + 1) / (r.wSuccess + r.wFailure + 2)
+}
+
+func (r *addrDialRecord) scoreAt(now time.Time, halfLife time.Duration) float64 {
+	f := 1.0
+	if now.After(r.LastAttempt) {
+		f = decayFactor(now.Sub(r.LastAttempt), halfLife)
+	}
+	s, fl := r.wSuccess*f, r.wFailure*f
+	return (s + 1) / (s + fl + 2)
+}
+
+func decayFactor(elapsed, halfLife time.Duration) float64 {
+	return math.Exp2(-float64(elapsed) / float64(halfLife))
+}
@@ -0,0 +1,204 @@
+package peerstore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/sec"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func newRankedAddrBook(t *testing.T) (*peerstore.RankedAddrBook, peerstore.Peerstore) {
+	t.Helper()
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ps.Close() })
+	ab, err := peerstore.NewRankedAddrBook(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ab, ps
+}
+
+func TestRecordDialOutcomePrunesExpiredAddrs(t *testing.T) {
+	ab, _ := newRankedAddrBook(t)
+	p := peer.ID("peer")
+	a1 := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	a2 := ma.StringCast("/ip4/1.2.3.4/tcp/2")
+	ab.AddAddrs(p, []ma.Multiaddr{a1, a2}, time.Hour)
+
+	ab.RecordDialOutcome(p, a1, peerstore.DialOutcome{})
+	ab.RecordDialOutcome(p, a2, peerstore.DialOutcome{})
+	if _, ok := ab.AddrDialStats(p, a1); !ok {
+		t.Fatal("expected dial stats for the first address")
+	}
+
+	ab.SetAddr(p, a1, 0)
+	ab.RecordDialOutcome(p, a2, peerstore.DialOutcome{Failure: peerstore.DialFailureTimeout})
+	if _, ok := ab.AddrDialStats(p, a1); ok {
+		t.Fatal("expected the dial stats of the expired address to be pruned")
+	}
+	if s, ok := ab.AddrDialStats(p, a2); !ok || s.Successes != 1 || s.Failures != 1 {
+		t.Fatalf("unexpected dial stats for the live address: %+v", s)
+	}
+}
+
+func TestRankedAddrBookRemovePeer(t *testing.T) {
+	ab, ps := newRankedAddrBook(t)
+	p := peer.ID("peer")
+	a := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	ab.AddAddr(p, a, time.Hour)
+	ps.Put(p, "key", "value")
+	ab.RecordDialOutcome(p, a, peerstore.DialOutcome{})
+
+	ab.RemovePeer(p)
+	if _, ok := ab.AddrDialStats(p, a); ok {
+		t.Fatal("expected the dial stats to be forgotten")
+	}
+	if _, err := ps.Get(p, "key"); err == nil {
+		t.Fatal("expected the peer to be removed from the wrapped peerstore")
+	}
+}
+
+func TestRankedAddrsOrdering(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	ab, err := peerstore.NewRankedAddrBook(ps, peerstore.WithDialOutcomeClock(clk), peerstore.WithDialFailureDrop(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer")
+	fresh := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	good := ma.StringCast("/ip4/1.2.3.4/tcp/2")
+	bad := ma.StringCast("/ip4/1.2.3.4/tcp/3")
+	fast := ma.StringCast("/ip4/1.2.3.4/tcp/4")
+	slow := ma.StringCast("/ip4/1.2.3.4/tcp/5")
+	ab.AddAddrs(p, []ma.Multiaddr{fresh, good, bad, fast, slow}, time.Hour*24)
+
+	// good scores (3+1)/(3+2) = 0.8, bad 1/3, fast and slow 2/3
+	for i := 0; i < 3; i++ {
+		ab.RecordDialOutcome(p, good, peerstore.DialOutcome{Latency: 50 * time.Millisecond})
+	}
+	ab.RecordDialOutcome(p, bad, peerstore.DialOutcome{Failure: peerstore.DialFailureRefused})
+	ab.RecordDialOutcome(p, slow, peerstore.DialOutcome{Latency: 80 * time.Millisecond})
+	ab.RecordDialOutcome(p, fast, peerstore.DialOutcome{Latency: 10 * time.Millisecond})
+
+	if s, _ := ab.AddrDialStats(p, good); s.Score != 0.8 || s.Successes != 3 {
+		t.Fatalf("unexpected stats for the good address: %+v", s)
+	}
+	checkAddrs(t, ab.RankedAddrs(p), good, fast, slow, fresh, bad)
+
+	// Two half lives later, every past outcome weighs a quarter: good scores
+	// (0.75+1)/(0.75+2) ≈ 0.64, fast 1.25/2.25 ≈ 0.56 and bad 1/2.25 ≈ 0.44,
+	// while slow, with a fresh success, scores 2.25/3.25 ≈ 0.69.
+	clk.Advance(2 * time.Hour)
+	ab.RecordDialOutcome(p, slow, peerstore.DialOutcome{Latency: 80 * time.Millisecond})
+	if s, _ := ab.AddrDialStats(p, slow); s.Successes != 2 || s.LastAttempt != clk.Now() {
+		t.Fatalf("unexpected stats for the slow address: %+v", s)
+	}
+	checkAddrs(t, ab.RankedAddrs(p), slow, good, fast, fresh, bad)
+}
+
+func TestRankedAddrBookDropsFailingAddrs(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	ab, err := peerstore.NewRankedAddrBook(ps, peerstore.WithDialOutcomeClock(clk), peerstore.WithDialFailureDrop(3, 0.3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := peer.ID("peer")
+	flaky := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	reliable := ma.StringCast("/ip4/1.2.3.4/tcp/2")
+	ab.AddAddrs(p, []ma.Multiaddr{flaky, reliable}, time.Hour)
+
+	timeout := peerstore.DialOutcome{Failure: peerstore.DialFailureTimeout}
+	ab.RecordDialOutcome(p, flaky, timeout)
+	ab.RecordDialOutcome(p, flaky, peerstore.DialOutcome{})
+	ab.RecordDialOutcome(p, flaky, timeout)
+	ab.RecordDialOutcome(p, flaky, timeout)
+	// two consecutive failures only: (1+1)/(1+3+2) ≈ 0.33
+	if s, ok := ab.AddrDialStats(p, flaky); !ok || s.ConsecutiveFailures != 2 || s.LastFailure != peerstore.DialFailureTimeout {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	ab.RecordDialOutcome(p, flaky, timeout)
+	// three consecutive failures, scoring (1+1)/(1+4+2) ≈ 0.29
+	if _, ok := ab.AddrDialStats(p, flaky); ok {
+		t.Fatal("expected the dial stats of the dropped address to be forgotten")
+	}
+	checkAddrs(t, ab.Addrs(p), reliable)
+
+	// consecutive failures above the score threshold keep the address
+	for i := 0; i < 5; i++ {
+		ab.RecordDialOutcome(p, reliable, peerstore.DialOutcome{})
+	}
+	for i := 0; i < 3; i++ {
+		ab.RecordDialOutcome(p, reliable, timeout)
+	}
+	if s, ok := ab.AddrDialStats(p, reliable); !ok || s.ConsecutiveFailures != 3 || s.Score != 0.6 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	checkAddrs(t, ab.Addrs(p), reliable)
+}
+
+func TestClassifyDialError(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected peerstore.DialFailureClass
+	}{
+		{nil, peerstore.DialFailureNone},
+		{context.DeadlineExceeded, peerstore.DialFailureTimeout},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), peerstore.DialFailureTimeout},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, peerstore.DialFailureTimeout},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, peerstore.DialFailureRefused},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, peerstore.DialFailureUnreachable},
+		{os.NewSyscallError("connect", syscall.EHOSTUNREACH), peerstore.DialFailureUnreachable},
+		{context.Canceled, peerstore.DialFailureOther},
+		{errors.New("connection reset"), peerstore.DialFailureOther},
+		{errors.New("failed to negotiate security protocol: EOF"), peerstore.DialFailureHandshake},
+		{errors.New("failed to negotiate stream multiplexer: protocols not supported"), peerstore.DialFailureHandshake},
+		{sec.ErrPeerIDMismatch{Expected: "a", Actual: "b"}, peerstore.DialFailurePeerIDMismatch},
+		{fmt.Errorf("upgrade: %w", sec.ErrPeerIDMismatch{Expected: "a", Actual: "b"}), peerstore.DialFailurePeerIDMismatch},
+		{errors.New("failed to negotiate security protocol: peer id mismatch: expected a, but remote key matches b"), peerstore.DialFailurePeerIDMismatch},
+		{errors.New("failed to negotiate security protocol: peer IDs don't match: expected a, got b"), peerstore.DialFailurePeerIDMismatch},
+	} {
+		if c := peerstore.ClassifyDialError(tc.err); c != tc.expected {
+			t.Errorf("expected %v to be classified as %s, got %s", tc.err, tc.expected, c)
+		}
+	}
+}
+
+func checkAddrs(t *testing.T, got []ma.Multiaddr, expected ...ma.Multiaddr) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected addrs %v, got %v", expected, got)
+	}
+	for i := range got {
+		if !got[i].Equal(expected[i]) {
+			t.Fatalf("expected addrs %v, got %v", expected, got)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package peerstore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// DefaultLatencyWindow is the default number of samples kept per peer,
+	// address and transport.
+	DefaultLatencyWindow = 64
+	// DefaultMaxLatencyAddrs is the default number of addresses per peer for
+	// which latency is tracked individually.
+	DefaultMaxLatencyAddrs = 8
+
+	// maxLatencyTransports bounds the number of transports tracked per peer.
+	maxLatencyTransports = 8
+)
+
+// LatencyStat selects a statistic from a LatencyStats summary.
+type LatencyStat int
+
+const (
+	LatencyMin LatencyStat = iota
+	LatencyMean
+	LatencyP50
+	LatencyP90
+	LatencyP99
+	LatencyMax
+	LatencyJitter
+)
+
+func (s LatencyStat) String() string {
+	str := [...]string{"min", "mean", "p50", "p90", "p99", "max", "jitter"}
+	if s < 0 || int(s) >= len(str) {
+		return "(unrecognized)"
+	}
+	return str[s]
+}
+
+// LatencyStats summarizes the latency samples in a sliding window.
+type LatencyStats struct {
+	// Samples is the number of samples in the window.
+	Samples int
+
+	Min, Max, Mean time.Duration
+	P50, P90, P99  time.Duration
+
+	// Jitter is the mean absolute difference between consecutive samples.
+	Jitter time.Duration
+}
+
+// Get returns the requested statistic.
+func (s LatencyStats) Get(stat LatencyStat) time.Duration {
+	switch stat {
+	case LatencyMin:
+		return s.Min
+	case LatencyMean:
+		return s.Mean
+	case LatencyP50:
+		return s.P50
+	case LatencyP90:
+		return s.P90
+	case LatencyP99:
+		return s.P99
+	case LatencyMax:
+		return s.Max
+	case LatencyJitter:
+		return s.Jitter
+	default:
+		return 0
+	}
+}
+
+// LatencyMetrics extends Metrics with windowed latency statistics, broken down
+// per address and per transport.
+type LatencyMetrics interface {
+	Metrics
+
+	// RecordLatencyAddr records a new latency measurement taken over the given
+	// address. It is also accounted as a measurement for the peer.
+	RecordLatencyAddr(p peer.ID, addr ma.Multiaddr, d time.Duration)
+
+	// LatencyStats summarizes the latency samples recorded for a peer.
+	LatencyStats(p peer.ID) (LatencyStats, bool)
+
+	// LatencyStatsForAddr summarizes the latency samples recorded for a peer
+	// over a specific address.
+	LatencyStatsForAddr(p peer.ID, addr ma.Multiaddr) (LatencyStats, bool)
+
+	// LatencyStatsForTransport summarizes the latency samples recorded for a
+	// peer over a transport, as named by TransportName.
+	LatencyStatsForTransport(p peer.ID, transport string) (LatencyStats, bool)
+
+	// RankPeers orders the given peers by ascending value of the chosen
+	// statistic. Peers without any samples are placed last.
+	RankPeers(stat LatencyStat, peers ...peer.ID) peer.IDSlice
+}
+
+// GetLatencyMetrics is a helper to "upcast" a Metrics to a LatencyMetrics by
+// using type assertion. Returns (nil, false) if the Metrics does not keep
+// windowed latency statistics.
+func GetLatencyMetrics(m Metrics) (lm LatencyMetrics, ok bool) {
+	lm, ok = m.(LatencyMetrics)
+	return lm, ok
+}
+
+// TransportName returns the name under which latency samples taken over addr
+// are grouped, e.g. "tcp", "udp/quic" or "tcp/ws". Addressing components (IP
+// addresses, DNS names, peer IDs, certificate hashes) are ignored.
+func TransportName(addr ma.Multiaddr) string {
+	var parts []string
+	ma.ForEach(addr, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_IP4, ma.P_IP6, ma.P_IP6ZONE, ma.P_IPCIDR,
+			ma.P_DNS, ma.P_DNS4, ma.P_DNS6, ma.P_DNSADDR,
+			ma.P_P2P, ma.P_CERTHASH:
+		default:
+			parts = append(parts, c.Protocol().Name)
+		}
+		return true
+	})
+	return strings.Join(parts, "/")
+}
+
+// LatencyOption is a single LatencyMetrics option.
+type LatencyOption func(cfg *latencyConfig) error
+
+type latencyConfig struct {
+	window   int
+	maxAddrs int
+	maxAge   time.Duration
+	clock    clock.Clock
+}
+
+// WithLatencyWindow sets the number of samples kept per peer, address and
+// transport.
+func WithLatencyWindow(n int) LatencyOption {
+	return func(cfg *latencyConfig) error {
+		if n <= 0 {
+			return errors.New("latency window must be positive")
+		}
+		cfg.window = n
+		return nil
+	}
+}
+
+// WithMaxLatencyAddrs sets the number of addresses per peer for which latency
+// is tracked individually. When exceeded, the least recently sampled address
+// is forgotten.
+func WithMaxLatencyAddrs(n int) LatencyOption {
+	return func(cfg *latencyConfig) error {
+		if n < 0 {
+			return errors.New("max latency addrs must not be negative")
+		}
+		cfg.maxAddrs = n
+		return nil
+	}
+}
+
+// WithLatencyMaxAge sets the age after which a sample no longer counts
+// towards the statistics, even if it is still in the window. Zero, the
+// default, keeps samples until they are pushed out of the window.
+func WithLatencyMaxAge(d time.Duration) LatencyOption {
+	return func(cfg *latencyConfig) error {
+		if d < 0 {
+			return errors.New("latency max age must not be negative")
+		}
+		cfg.maxAge = d
+		return nil
+	}
+}
+
+// WithLatencyClock sets the clock used to timestamp samples and expire them.
+// Defaults to clock.Real.
+func WithLatencyClock(c clock.Clock) LatencyOption {
+	return func(cfg *latencyConfig) error {
+		cfg.clock = c
+		return nil
+	}
+}
+
+// NewLatencyMetrics wraps the given Metrics with windowed latency statistics.
+// RecordLatency, LatencyEWMA and RemovePeer are forwarded to m, so the EWMA
+// keeps working as before.
+//
+// Memory per peer is bounded by the window size times the number of tracked
+// addresses and transports.
+func NewLatencyMetrics(m Metrics, opts ...LatencyOption) (LatencyMetrics, error) {
+	cfg := latencyConfig{
+		window:   DefaultLatencyWindow,
+		maxAddrs: DefaultMaxLatencyAddrs,
+		clock:    clock.Real,
+	}
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &latencyMetrics{
+		Metrics: m,
+		cfg:     cfg,
+		peers:   make(map[peer.ID]*peerLatency),
+	}, nil
+}
+
+type latencyMetrics struct {
+	Metrics
+	cfg latencyConfig
+
+	mu    sync.RWMutex
+	seq   uint64
+	peers map[peer.ID]*peerLatency
+}
+
+type peerLatency struct {
+	all        *latencyWindow
+	addrs      map[string]*latencyWindow
+	transports map[string]*latencyWindow
+}
+
+func (m *latencyMetrics) RecordLatency(p peer.ID, d time.Duration) {
+	m.Metrics.RecordLatency(p, d)
+
+	now := m.cfg.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	m.peer(p).all.add(d, now, m.seq)
+}
+
+func (m *latencyMetrics) RecordLatencyAddr(p peer.ID, addr ma.Multiaddr, d time.Duration) {
+	m.Metrics.RecordLatency(p, d)
+
+	now := m.cfg.clock.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	pl := m.peer(p)
+	pl.all.add(d, now, m.seq)
+
+	if m.cfg.maxAddrs > 0 {
+		key := string(addr.Bytes())
+		w, ok := pl.addrs[key]
+		if !ok {
+			if len(pl.addrs) >= m.cfg.maxAddrs {
+				evictStalest(pl.addrs)
+			}
+			w = newLatencyWindow(m.cfg.window)
+			pl.addrs[key] = w
+		}
+		w.add(d, now, m.seq)
+	}
+
+	tpt := TransportName(addr)
+	w, ok := pl.transports[tpt]
+	if !ok {
+		if len(pl.transports) >= maxLatencyTransports {
+			evictStalest(pl.transports)
+		}
+		w = newLatencyWindow(m.cfg.window)
+		pl.transports[tpt] = w
+	}
+	w.add(d, now, m.seq)
+}
+
+func (m *latencyMetrics) peer(p peer.ID) *peerLatency {
+	pl, ok := m.peers[p]
+	if !ok {
+		pl = &peerLatency{
+			all:        newLatencyWindow(m.cfg.window),
+			addrs:      make(map[string]*latencyWindow),
+			transports: make(map[string]*latencyWindow),
+		}
+		m.peers[p] = pl
+	}
+	return pl
+}
+
+// evictStalest forgets the window whose last sample is the oldest.
+func evictStalest(windows map[string]*latencyWindow) {
+	var (
+		stalest string
+		oldest  uint64
+		first   = true
+	)
+	for k, w := range windows {
+		if first || w.lastSeq < oldest {
+			stalest, oldest, first = k, w.lastSeq, false
+		}
+	}
+	delete(windows, stalest)
+}
+
+// cutoff returns the time before which samples are considered expired, or
+// the zero time if samples never expire.
+func (m *latencyMetrics) cutoff() time.Time {
+	if m.cfg.maxAge == 0 {
+		return time.Time{}
+	}
+	return m.cfg.clock.Now().Add(-m.cfg.maxAge)
+}
+
+// liveStats summarizes w, reporting false if it holds no live samples.
+func liveStats(w *latencyWindow, cutoff time.Time) (LatencyStats, bool) {
+	s := w.stats(cutoff)
+	return s, s.Samples > 0
+}
+
+func (m *latencyMetrics) LatencyStats(p peer.ID) (LatencyStats, bool) {
+	cutoff := m.cutoff()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pl, ok := m.peers[p]
+	if !ok {
+		return LatencyStats{}, false
+	}
+	return liveStats(pl.all, cutoff)
+}
+
+func (m *latencyMetrics) LatencyStatsForAddr(p peer.ID, addr ma.Multiaddr) (LatencyStats, bool) {
+	cutoff := m.cutoff()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pl, ok := m.peers[p]
+	if !ok {
+		return LatencyStats{}, false
+	}
+	w, ok := pl.addrs[string(addr.Bytes())]
+	if !ok {
+		return LatencyStats{}, false
+	}
+	return liveStats(w, cutoff)
+}
+
+func (m *latencyMetrics) LatencyStatsForTransport(p peer.ID, transport string) (LatencyStats, bool) {
+	cutoff := m.cutoff()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	pl, ok := m.peers[p]
+	if !ok {
+		return LatencyStats{}, false
+	}
+	w, ok := pl.transports[transport]
+	if !ok {
+		return LatencyStats{}, false
+	}
+	return liveStats(w, cutoff)
+}
+
+func (m *latencyMetrics) RankPeers(stat LatencyStat, peers ...peer.ID) peer.IDSlice {
+	type ranked struct {
+		p     peer.ID
+		value time.Duration
+		ok    bool
+	}
+	rs := make([]ranked, len(peers))
+	cutoff := m.cutoff()
+	m.mu.RLock()
+	for i, p := range peers {
+		rs[i].p = p
+		if pl, ok := m.peers[p]; ok {
+			if s, ok := liveStats(pl.all, cutoff); ok {
+				rs[i].value = s.Get(stat)
+				rs[i].ok = true
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.SliceStable(rs, func(i, j int) bool {
+		if rs[i].ok != rs[j].ok {
+			return rs[i].ok
+		}
+		return rs[i].value < rs[j].value
+	})
+	out := make(peer.IDSlice, len(rs))
+	for i, r := range rs {
+		out[i] = r.p
+	}
+	return out
+}
+
+func (m *latencyMetrics) RemovePeer(p peer.ID) {
+	m.Metrics.RemovePeer(p)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.peers, p)
+}
+
+// latencyWindow is a fixed size ring buffer of latency samples.
+type latencyWindow struct {
+	samples []time.Duration
+	times   []time.Time
+	next    int
+	full    bool
+
+	// lastSeq orders windows by recency of their last sample.
+	lastSeq uint64
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, size), times: make([]time.Time, size)}
+}
+
+func (w *latencyWindow) add(d time.Duration, at time.Time, seq uint64) {
+	w.samples[w.next] = d
+	w.times[w.next] = at
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+	w.lastSeq = seq
+}
+
+// ordered returns the samples taken at or after cutoff, from oldest to newest.
+func (w *latencyWindow) ordered(cutoff time.Time) []time.Duration {
+	var out []time.Duration
+	appendLive := func(from, to int) {
+		for i := from; i < to; i++ {
+			if !w.times[i].Before(cutoff) {
+				out = append(out, w.samples[i])
+			}
+		}
+	}
+	if w.full {
+		appendLive(w.next, len(w.samples))
+	}
+	appendLive(0, w.next)
+	return out
+}
+
+func (w *latencyWindow) stats(cutoff time.Time) LatencyStats {
+	samples := w.ordered(cutoff)
+	n := len(samples)
+	if n == 0 {
+		return LatencyStats{}
+	}
+
+	var sum, jitter time.Duration
+	for i, d := range samples {
+		sum += d
+		if i > 0 {
+			diff := d - samples[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
+		}
+	}
+
+	s := LatencyStats{Samples: n, Mean: sum / time.Duration(n)}
+	if n > 1 {
+		s.Jitter = jitter / time.Duration(n-1)
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	s.Min = samples[0]
+	s.Max = samples[n-1]
+	s.P50 = percentile(samples, 50)
+	s.P90 = percentile(samples, 90)
+	s.P99 = percentile(samples, 99)
+	return s
+}
+
+// percentile uses the nearest-rank method on sorted samples.
+func percentile(sorted []time.Duration, pct int) time.Duration {
+	rank := (pct*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
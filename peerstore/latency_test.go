@@ -0,0 +1,189 @@
+package peerstore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	pstore "github.com/libp2p/go-libp2p/p2p/host/peerstore"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func newLatencyMetrics(t *testing.T, opts ...peerstore.LatencyOption) peerstore.LatencyMetrics {
+	t.Helper()
+	m, err := peerstore.NewLatencyMetrics(pstore.NewMetrics(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestLatencyStats(t *testing.T) {
+	m := newLatencyMetrics(t)
+	p := peer.ID("peer")
+	if _, ok := m.LatencyStats(p); ok {
+		t.Fatal("expected no stats before any sample")
+	}
+
+	// 1ms..10ms, recorded out of order
+	for _, ms := range []int{5, 1, 9, 3, 7, 2, 10, 4, 8, 6} {
+		m.RecordLatency(p, time.Duration(ms)*time.Millisecond)
+	}
+	s, ok := m.LatencyStats(p)
+	if !ok {
+		t.Fatal("expected stats")
+	}
+	expected := peerstore.LatencyStats{
+		Samples: 10,
+		Min:     time.Millisecond,
+		Max:     10 * time.Millisecond,
+		Mean:    5500 * time.Microsecond,
+		// nearest rank: ceil(p/100 * n)
+		P50: 5 * time.Millisecond,
+		P90: 9 * time.Millisecond,
+		P99: 10 * time.Millisecond,
+		// |1-5|+|9-1|+|3-9|+|7-3|+|2-7|+|10-2|+|4-10|+|8-4|+|6-8| = 47ms over 9
+		Jitter: 47 * time.Millisecond / 9,
+	}
+	if s != expected {
+		t.Fatalf("expected %+v, got %+v", expected, s)
+	}
+	if m.LatencyEWMA(p) == 0 {
+		t.Fatal("expected samples to be forwarded to the wrapped metrics")
+	}
+}
+
+func TestLatencyStatsSingleSample(t *testing.T) {
+	m := newLatencyMetrics(t)
+	p := peer.ID("peer")
+	m.RecordLatency(p, 3*time.Millisecond)
+	s, _ := m.LatencyStats(p)
+	for _, stat := range []peerstore.LatencyStat{peerstore.LatencyMin, peerstore.LatencyP50, peerstore.LatencyP99, peerstore.LatencyMax} {
+		if v := s.Get(stat); v != 3*time.Millisecond {
+			t.Fatalf("expected %s of 3ms, got %s", stat, v)
+		}
+	}
+	if s.Jitter != 0 {
+		t.Fatalf("expected no jitter for a single sample, got %s", s.Jitter)
+	}
+}
+
+func TestLatencyWindowBound(t *testing.T) {
+	m := newLatencyMetrics(t, peerstore.WithLatencyWindow(3))
+	p := peer.ID("peer")
+	for _, ms := range []int{100, 1, 2, 3} {
+		m.RecordLatency(p, time.Duration(ms)*time.Millisecond)
+	}
+	s, _ := m.LatencyStats(p)
+	if s.Samples != 3 || s.Max != 3*time.Millisecond || s.Min != time.Millisecond {
+		t.Fatalf("expected the oldest sample to be pushed out of the window: %+v", s)
+	}
+	if s.Jitter != time.Millisecond {
+		t.Fatalf("expected a jitter over the window only, got %s", s.Jitter)
+	}
+
+	if _, err := peerstore.NewLatencyMetrics(pstore.NewMetrics(), peerstore.WithLatencyWindow(0)); err == nil {
+		t.Fatal("expected an empty window to be rejected")
+	}
+}
+
+func TestLatencyMaxAge(t *testing.T) {
+	clk := clock.NewVirtual(time.Unix(0, 0))
+	m := newLatencyMetrics(t, peerstore.WithLatencyClock(clk), peerstore.WithLatencyMaxAge(time.Minute))
+	p := peer.ID("peer")
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+
+	m.RecordLatencyAddr(p, addr, 50*time.Millisecond)
+	clk.Advance(30 * time.Second)
+	m.RecordLatencyAddr(p, addr, 10*time.Millisecond)
+
+	s, _ := m.LatencyStats(p)
+	if s.Samples != 2 {
+		t.Fatalf("expected both samples to be live, got %+v", s)
+	}
+
+	clk.Advance(45 * time.Second)
+	s, _ = m.LatencyStats(p)
+	if s.Samples != 1 || s.Max != 10*time.Millisecond {
+		t.Fatalf("expected the first sample to have expired, got %+v", s)
+	}
+	if s, _ := m.LatencyStatsForAddr(p, addr); s.Samples != 1 {
+		t.Fatalf("expected the address sample to have expired, got %+v", s)
+	}
+	if s, _ := m.LatencyStatsForTransport(p, "tcp"); s.Samples != 1 {
+		t.Fatalf("expected the transport sample to have expired, got %+v", s)
+	}
+
+	clk.Advance(time.Minute)
+	if _, ok := m.LatencyStats(p); ok {
+		t.Fatal("expected no stats once every sample expired")
+	}
+	if ranked := m.RankPeers(peerstore.LatencyP50, "other", p); ranked[0] != "other" || ranked[1] != p {
+		t.Fatalf("expected peers with expired samples to keep their order at the end, got %v", ranked)
+	}
+}
+
+func TestLatencyPerAddrAndTransport(t *testing.T) {
+	m := newLatencyMetrics(t, peerstore.WithMaxLatencyAddrs(2))
+	p := peer.ID("peer")
+	tcp1 := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	tcp2 := ma.StringCast("/ip6/::1/tcp/2")
+	quic := ma.StringCast("/ip4/1.2.3.4/udp/1/quic")
+
+	m.RecordLatencyAddr(p, tcp1, time.Millisecond)
+	m.RecordLatencyAddr(p, tcp2, 3*time.Millisecond)
+	m.RecordLatencyAddr(p, tcp1, time.Millisecond)
+	m.RecordLatencyAddr(p, quic, 9*time.Millisecond)
+
+	if s, _ := m.LatencyStatsForTransport(p, "tcp"); s.Samples != 3 || s.Max != 3*time.Millisecond {
+		t.Fatalf("unexpected tcp stats: %+v", s)
+	}
+	if s, _ := m.LatencyStatsForTransport(p, "udp/quic"); s.Samples != 1 {
+		t.Fatalf("unexpected quic stats: %+v", s)
+	}
+	if s, _ := m.LatencyStats(p); s.Samples != 4 {
+		t.Fatalf("unexpected peer stats: %+v", s)
+	}
+	// tcp2 was sampled least recently and is forgotten to make room for quic
+	if _, ok := m.LatencyStatsForAddr(p, tcp2); ok {
+		t.Fatal("expected the stalest address to be evicted")
+	}
+	if s, ok := m.LatencyStatsForAddr(p, tcp1); !ok || s.Samples != 2 {
+		t.Fatalf("unexpected stats for the first address: %+v", s)
+	}
+	if _, ok := m.LatencyStatsForAddr(p, quic); !ok {
+		t.Fatal("expected stats for the newest address")
+	}
+
+	m.RemovePeer(p)
+	if _, ok := m.LatencyStats(p); ok {
+		t.Fatal("expected the stats to be forgotten with the peer")
+	}
+}
+
+func TestLatencyRankPeers(t *testing.T) {
+	m := newLatencyMetrics(t)
+	a, b, c, unknown := peer.ID("a"), peer.ID("b"), peer.ID("c"), peer.ID("unknown")
+
+	// a: low mean, high jitter; b: steady; c: slow
+	for _, ms := range []int{1, 19, 1, 19} {
+		m.RecordLatency(a, time.Duration(ms)*time.Millisecond)
+	}
+	for _, ms := range []int{12, 12, 12, 12} {
+		m.RecordLatency(b, time.Duration(ms)*time.Millisecond)
+	}
+	for _, ms := range []int{30, 31, 30, 31} {
+		m.RecordLatency(c, time.Duration(ms)*time.Millisecond)
+	}
+
+	checkPeers(t, m.RankPeers(peerstore.LatencyMean, unknown, c, b, a), a, b, c, unknown)
+	checkPeers(t, m.RankPeers(peerstore.LatencyMin, c, unknown, b, a), a, b, c, unknown)
+	checkPeers(t, m.RankPeers(peerstore.LatencyMax, a, unknown, c, b), b, a, c, unknown)
+	checkPeers(t, m.RankPeers(peerstore.LatencyJitter, a, b, c), b, c, a)
+	// ties keep the given order
+	checkPeers(t, m.RankPeers(peerstore.LatencyP50, unknown, "other"), unknown, "other")
+}
@@ -0,0 +1,368 @@
+package peerstore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// ProtoIndex answers "which peers speak protocol X" queries from a reverse
+// index, without scanning every peer known to the peerstore.
+type ProtoIndex interface {
+	// PeersSupportingAll returns the peers known to support every one of the
+	// given protocols.
+	PeersSupportingAll(protos []string, opts ...ProtoQueryOption) (peer.IDSlice, error)
+
+	// PeersSupportingAny returns the peers known to support at least one of
+	// the given protocols.
+	PeersSupportingAny(protos []string, opts ...ProtoQueryOption) (peer.IDSlice, error)
+
+	// ForEachPeerSupportingAll calls f for every peer known to support all of
+	// the given protocols, stopping early if f returns false.
+	// An error is returned only if one of the options cannot be applied.
+	ForEachPeerSupportingAll(protos []string, f func(peer.ID) bool, opts ...ProtoQueryOption) error
+
+	// ForEachPeerSupportingAny calls f for every peer known to support any of
+	// the given protocols, stopping early if f returns false.
+	// An error is returned only if one of the options cannot be applied.
+	ForEachPeerSupportingAny(protos []string, f func(peer.ID) bool, opts ...ProtoQueryOption) error
+}
+
+// GetProtoIndex is a helper to "upcast" a ProtoBook to a ProtoIndex by using
+// type assertion. Returns (nil, false) if the ProtoBook does not maintain a
+// reverse protocol index.
+func GetProtoIndex(pb ProtoBook) (idx ProtoIndex, ok bool) {
+	idx, ok = pb.(ProtoIndex)
+	return idx, ok
+}
+
+// ProtoQueryOption is a single protocol index query option.
+type ProtoQueryOption func(opts *ProtoQueryOptions) error
+
+// ProtoQueryOptions is a set of protocol index query options.
+type ProtoQueryOptions struct {
+	// Connectedness, when set, is consulted for every candidate peer; only
+	// peers whose connectedness is one of States are returned.
+	Connectedness func(peer.ID) network.Connectedness
+	States        []network.Connectedness
+
+	// Limit is an upper bound on the number of peers returned. Zero means
+	// no limit.
+	Limit int
+}
+
+// Apply applies the given options to this ProtoQueryOptions
+func (opts *ProtoQueryOptions) Apply(options ...ProtoQueryOption) error {
+	for _, o := range options {
+		if err := o(opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithConnectedness is an option that restricts the query to peers whose
+// connectedness, as reported by f (typically network.Network.Connectedness),
+// is one of the given states.
+func WithConnectedness(f func(peer.ID) network.Connectedness, states ...network.Connectedness) ProtoQueryOption {
+	return func(opts *ProtoQueryOptions) error {
+		opts.Connectedness = f
+		opts.States = states
+		return nil
+	}
+}
+
+// WithQueryLimit is an option that provides an upper bound on the number of
+// peers returned by a query. The limit must not be negative.
+func WithQueryLimit(limit int) ProtoQueryOption {
+	return func(opts *ProtoQueryOptions) error {
+		if limit < 0 {
+			return fmt.Errorf("invalid query limit: %d", limit)
+		}
+		opts.Limit = limit
+		return nil
+	}
+}
+
+func (opts *ProtoQueryOptions) accept(p peer.ID) bool {
+	if opts.Connectedness == nil {
+		return true
+	}
+	c := opts.Connectedness(p)
+	for _, s := range opts.States {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexedProtoBook wraps a ProtoBook and maintains a reverse index from
+// protocol to the peers supporting it. All mutations must go through the
+// IndexedProtoBook for the index to stay consistent with the wrapped book.
+type IndexedProtoBook struct {
+	ProtoBook
+
+	mu      sync.RWMutex
+	byProto map[string]map[peer.ID]struct{}
+	byPeer  map[peer.ID]map[string]struct{}
+}
+
+var _ ProtoBook = (*IndexedProtoBook)(nil)
+var _ ProtoIndex = (*IndexedProtoBook)(nil)
+
+// NewIndexedProtoBook wraps the given ProtoBook with a reverse protocol index.
+// The index starts empty; call Reindex with the peers already known to the
+// underlying book to populate it.
+func NewIndexedProtoBook(pb ProtoBook) *IndexedProtoBook {
+	return &IndexedProtoBook{
+		ProtoBook: pb,
+		byProto:   make(map[string]map[peer.ID]struct{}),
+		byPeer:    make(map[peer.ID]map[string]struct{}),
+	}
+}
+
+// Reindex refreshes the index entries of the given peers from the underlying
+// ProtoBook.
+func (b *IndexedProtoBook) Reindex(peers ...peer.ID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range peers {
+		if err := b.refresh(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *IndexedProtoBook) AddProtocols(p peer.ID, protos ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.ProtoBook.AddProtocols(p, protos...); err != nil {
+		return err
+	}
+	return b.refresh(p)
+}
+
+func (b *IndexedProtoBook) SetProtocols(p peer.ID, protos ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.ProtoBook.SetProtocols(p, protos...); err != nil {
+		return err
+	}
+	return b.refresh(p)
+}
+
+func (b *IndexedProtoBook) RemoveProtocols(p peer.ID, protos ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.ProtoBook.RemoveProtocols(p, protos...); err != nil {
+		return err
+	}
+	return b.refresh(p)
+}
+
+func (b *IndexedProtoBook) RemovePeer(p peer.ID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ProtoBook.RemovePeer(p)
+	b.set(p, nil)
+}
+
+// refresh re-reads the protocols of p from the underlying book, which remains
+// the source of truth (it may normalize or cap the protocols it stores).
+func (b *IndexedProtoBook) refresh(p peer.ID) error {
+	protos, err := b.ProtoBook.GetProtocols(p)
+	if err != nil && err != peerstore.ErrNotFound {
+		return err
+	}
+	b.set(p, protos)
+	return nil
+}
+
+func (b *IndexedProtoBook) set(p peer.ID, protos []string) {
+	for proto := range b.byPeer[p] {
+		peers := b.byProto[proto]
+		delete(peers, p)
+		if len(peers) == 0 {
+			delete(b.byProto, proto)
+		}
+	}
+	delete(b.byPeer, p)
+	if len(protos) == 0 {
+		return
+	}
+
+	set := make(map[string]struct{}, len(protos))
+	for _, proto := range protos {
+		set[proto] = struct{}{}
+		peers, ok := b.byProto[proto]
+		if !ok {
+			peers = make(map[peer.ID]struct{})
+			b.byProto[proto] = peers
+		}
+		peers[p] = struct{}{}
+	}
+	b.byPeer[p] = set
+}
+
+func (b *IndexedProtoBook) PeersSupportingAll(protos []string, opts ...ProtoQueryOption) (peer.IDSlice, error) {
+	var out peer.IDSlice
+	err := b.ForEachPeerSupportingAll(protos, func(p peer.ID) bool {
+		out = append(out, p)
+		return true
+	}, opts...)
+	return out, err
+}
+
+func (b *IndexedProtoBook) PeersSupportingAny(protos []string, opts ...ProtoQueryOption) (peer.IDSlice, error) {
+	var out peer.IDSlice
+	err := b.ForEachPeerSupportingAny(protos, func(p peer.ID) bool {
+		out = append(out, p)
+		return true
+	}, opts...)
+	return out, err
+}
+
+func (b *IndexedProtoBook) ForEachPeerSupportingAll(protos []string, f func(peer.ID) bool, opts ...ProtoQueryOption) error {
+	var o ProtoQueryOptions
+	if err := o.Apply(opts...); err != nil {
+		return err
+	}
+	b.forEach(b.matchAll(protos), f, &o)
+	return nil
+}
+
+func (b *IndexedProtoBook) ForEachPeerSupportingAny(protos []string, f func(peer.ID) bool, opts ...ProtoQueryOption) error {
+	var o ProtoQueryOptions
+	if err := o.Apply(opts...); err != nil {
+		return err
+	}
+	b.forEach(b.matchAny(protos), f, &o)
+	return nil
+}
+
+// forEach runs the callback outside of the index lock, so that f may safely
+// call back into the book.
+func (b *IndexedProtoBook) forEach(candidates peer.IDSlice, f func(peer.ID) bool, o *ProtoQueryOptions) {
+	n := 0
+	for _, p := range candidates {
+		if !o.accept(p) {
+			continue
+		}
+		if !f(p) {
+			return
+		}
+		n++
+		if o.Limit > 0 && n >= o.Limit {
+			return
+		}
+	}
+}
+
+func (b *IndexedProtoBook) matchAll(protos []string) peer.IDSlice {
+	if len(protos) == 0 {
+		return nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// intersect starting from the rarest protocol
+	smallest := b.byProto[protos[0]]
+	for _, proto := range protos[1:] {
+		if peers := b.byProto[proto]; len(peers) < len(smallest) {
+			smallest = peers
+		}
+	}
+
+	out := make(peer.IDSlice, 0, len(smallest))
+outer:
+	for p := range smallest {
+		supported := b.byPeer[p]
+		for _, proto := range protos {
+			if _, ok := supported[proto]; !ok {
+				continue outer
+			}
+		}
+		out = append(out, p)
+	}
+	sort.Sort(out)
+	return out
+}
+
+func (b *IndexedProtoBook) matchAny(protos []string) peer.IDSlice {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	seen := make(map[peer.ID]struct{})
+	var out peer.IDSlice
+	for _, proto := range protos {
+		for p := range b.byProto[proto] {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			out = append(out, p)
+		}
+	}
+	sort.Sort(out)
+	return out
+}
+
+// IndexPeerstore wraps a Peerstore so that its ProtoBook maintains a reverse
+// protocol index. The peers already known to ps are indexed immediately.
+// The returned Peerstore also implements ProtoIndex; use GetProtoIndex to
+// access it.
+func IndexPeerstore(ps Peerstore) (Peerstore, error) {
+	ips := &indexedPeerstore{Peerstore: ps, idx: NewIndexedProtoBook(ps)}
+	if err := ips.idx.Reindex(ps.Peers()...); err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+type indexedPeerstore struct {
+	Peerstore
+	idx *IndexedProtoBook
+}
+
+var _ Peerstore = (*indexedPeerstore)(nil)
+var _ ProtoIndex = (*indexedPeerstore)(nil)
+
+func (ps *indexedPeerstore) AddProtocols(p peer.ID, protos ...string) error {
+	return ps.idx.AddProtocols(p, protos...)
+}
+
+func (ps *indexedPeerstore) SetProtocols(p peer.ID, protos ...string) error {
+	return ps.idx.SetProtocols(p, protos...)
+}
+
+func (ps *indexedPeerstore) RemoveProtocols(p peer.ID, protos ...string) error {
+	return ps.idx.RemoveProtocols(p, protos...)
+}
+
+// RemovePeer removes the peer from the underlying peerstore and the index.
+func (ps *indexedPeerstore) RemovePeer(p peer.ID) {
+	ps.idx.RemovePeer(p)
+}
+
+func (ps *indexedPeerstore) PeersSupportingAll(protos []string, opts ...ProtoQueryOption) (peer.IDSlice, error) {
+	return ps.idx.PeersSupportingAll(protos, opts...)
+}
+
+func (ps *indexedPeerstore) PeersSupportingAny(protos []string, opts ...ProtoQueryOption) (peer.IDSlice, error) {
+	return ps.idx.PeersSupportingAny(protos, opts...)
+}
+
+func (ps *indexedPeerstore) ForEachPeerSupportingAll(protos []string, f func(peer.ID) bool, opts ...ProtoQueryOption) error {
+	return ps.idx.ForEachPeerSupportingAll(protos, f, opts...)
+}
+
+func (ps *indexedPeerstore) ForEachPeerSupportingAny(protos []string, f func(peer.ID) bool, opts ...ProtoQueryOption) error {
+	return ps.idx.ForEachPeerSupportingAny(protos, f, opts...)
+}
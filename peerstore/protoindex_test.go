@@ -0,0 +1,212 @@
+package peerstore_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peerstore"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+)
+
+func newIndexedPeerstore(t *testing.T) (peerstore.Peerstore, peerstore.ProtoIndex) {
+	t.Helper()
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ps.Close() })
+	ips, err := peerstore.IndexPeerstore(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, ok := peerstore.GetProtoIndex(ips)
+	if !ok {
+		t.Fatal("expected the indexed peerstore to implement ProtoIndex")
+	}
+	return ips, idx
+}
+
+func mustQuery(t *testing.T) func(peer.IDSlice, error) peer.IDSlice {
+	return func(peers peer.IDSlice, err error) peer.IDSlice {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return peers
+	}
+}
+
+func checkPeers(t *testing.T, got peer.IDSlice, expected ...peer.ID) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected peers %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected peers %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestProtoIndexMatchAnyAll(t *testing.T) {
+	ps, idx := newIndexedPeerstore(t)
+	q := mustQuery(t)
+	a, b, c := peer.ID("a"), peer.ID("b"), peer.ID("c")
+	ps.AddProtocols(a, "/x", "/y")
+	ps.AddProtocols(b, "/y", "/z")
+	ps.AddProtocols(c, "/x", "/y", "/z")
+
+	checkPeers(t, q(idx.PeersSupportingAll([]string{"/x", "/y"})), a, c)
+	checkPeers(t, q(idx.PeersSupportingAll([]string{"/y", "/z"})), b, c)
+	checkPeers(t, q(idx.PeersSupportingAll([]string{"/x", "/unknown"})))
+	checkPeers(t, q(idx.PeersSupportingAll(nil)))
+	checkPeers(t, q(idx.PeersSupportingAny([]string{"/x", "/z"})), a, b, c)
+	checkPeers(t, q(idx.PeersSupportingAny([]string{"/z"})), b, c)
+	checkPeers(t, q(idx.PeersSupportingAny([]string{"/unknown"})))
+
+	ps.SetProtocols(c, "/z")
+	checkPeers(t, q(idx.PeersSupportingAll([]string{"/x", "/y"})), a)
+	ps.RemoveProtocols(b, "/z")
+	checkPeers(t, q(idx.PeersSupportingAny([]string{"/z"})), c)
+	ps.RemovePeer(a)
+	checkPeers(t, q(idx.PeersSupportingAny([]string{"/x", "/y"})), b)
+}
+
+func TestProtoIndexOptions(t *testing.T) {
+	ps, idx := newIndexedPeerstore(t)
+	q := mustQuery(t)
+	peers := []peer.ID{"a", "b", "c", "d"}
+	for _, p := range peers {
+		ps.AddProtocols(p, "/x")
+	}
+
+	checkPeers(t, q(idx.PeersSupportingAny([]string{"/x"}, peerstore.WithQueryLimit(2))), "a", "b")
+	checkPeers(t, q(idx.PeersSupportingAll([]string{"/x"}, peerstore.WithQueryLimit(0))), peers...)
+
+	connected := func(p peer.ID) network.Connectedness {
+		if p == "b" || p == "d" {
+			return network.Connected
+		}
+		return network.NotConnected
+	}
+	checkPeers(t, q(idx.PeersSupportingAll([]string{"/x"}, peerstore.WithConnectedness(connected, network.Connected))), "b", "d")
+	// the limit only counts accepted peers
+	checkPeers(t, q(idx.PeersSupportingAny([]string{"/x"},
+		peerstore.WithConnectedness(connected, network.Connected),
+		peerstore.WithQueryLimit(1),
+	)), "b")
+
+	if _, err := idx.PeersSupportingAny([]string{"/x"}, peerstore.WithQueryLimit(-1)); err == nil {
+		t.Fatal("expected an invalid limit to fail the query")
+	}
+	failing := func(*peerstore.ProtoQueryOptions) error { return fmt.Errorf("bad option") }
+	called := false
+	err := idx.ForEachPeerSupportingAll([]string{"/x"}, func(peer.ID) bool {
+		called = true
+		return true
+	}, failing)
+	if err == nil || err.Error() != "bad option" {
+		t.Fatalf("expected the option error to be returned, got %v", err)
+	}
+	if called {
+		t.Fatal("expected the callback not to be called when an option fails")
+	}
+}
+
+func TestProtoIndexForEachStopAndReentry(t *testing.T) {
+	ps, idx := newIndexedPeerstore(t)
+	for _, p := range []peer.ID{"a", "b", "c"} {
+		ps.AddProtocols(p, "/x")
+	}
+
+	var seen []peer.ID
+	err := idx.ForEachPeerSupportingAny([]string{"/x"}, func(p peer.ID) bool {
+		seen = append(seen, p)
+		return len(seen) < 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPeers(t, seen, "a", "b")
+
+	// the callback may mutate the book and query the index without deadlocking
+	seen = nil
+	err = idx.ForEachPeerSupportingAll([]string{"/x"}, func(p peer.ID) bool {
+		seen = append(seen, p)
+		if err := ps.RemoveProtocols(p, "/x"); err != nil {
+			t.Error(err)
+		}
+		if err := ps.AddProtocols(p, "/y"); err != nil {
+			t.Error(err)
+		}
+		if _, err := idx.PeersSupportingAny([]string{"/y"}); err != nil {
+			t.Error(err)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPeers(t, seen, "a", "b", "c")
+	checkPeers(t, mustQuery(t)(idx.PeersSupportingAny([]string{"/x"})))
+	checkPeers(t, mustQuery(t)(idx.PeersSupportingAll([]string{"/y"})), "a", "b", "c")
+}
+
+func TestProtoIndexConcurrentConsistency(t *testing.T) {
+	ps, idx := newIndexedPeerstore(t)
+	protos := []string{"/a", "/b", "/c", "/d", "/e"}
+	peers := make([]peer.ID, 16)
+	for i := range peers {
+		peers[i] = peer.ID(fmt.Sprintf("peer-%02d", i))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < 500; i++ {
+				p := peers[rng.Intn(len(peers))]
+				proto := protos[rng.Intn(len(protos))]
+				switch rng.Intn(5) {
+				case 0:
+					ps.AddProtocols(p, proto)
+				case 1:
+					ps.SetProtocols(p, proto, protos[rng.Intn(len(protos))])
+				case 2:
+					ps.RemoveProtocols(p, proto)
+				case 3:
+					ps.RemovePeer(p)
+				default:
+					if _, err := idx.PeersSupportingAny([]string{proto}); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	// the index must agree with the wrapped book, which is the source of truth
+	for _, proto := range protos {
+		var expected peer.IDSlice
+		for _, p := range peers {
+			supported, err := ps.SupportsProtocols(p, proto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(supported) > 0 {
+				expected = append(expected, p)
+			}
+		}
+		sort.Sort(expected)
+		checkPeers(t, mustQuery(t)(idx.PeersSupportingAny([]string{proto})), expected...)
+	}
+}
@@ -0,0 +1,308 @@
+package peerstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/canonicallog"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// DefaultRecordHistoryPerPeer is the default number of consumed
+	// envelopes remembered per peer.
+	DefaultRecordHistoryPerPeer = 16
+	// DefaultRecordHistoryPeers is the default number of peers for which a
+	// history is kept.
+	DefaultRecordHistoryPeers = 4096
+)
+
+// errSeqRegression is logged when a peer record with a lower seq than the
+// last accepted one is consumed.
+var errSeqRegression = errors.New("peer record seq regression")
+
+// logMisbehavingPeer is replaced in tests.
+var logMisbehavingPeer = canonicallog.LogMisbehavingPeer
+
+// PeerRecordSource identifies where a peer record was received from.
+type PeerRecordSource struct {
+	// Peer is the peer that sent us the record. It is empty if the record was
+	// obtained some other way (e.g. from a DHT lookup).
+	Peer peer.ID
+	// Addr is the remote address the record was received on, if known.
+	Addr ma.Multiaddr
+}
+
+// PeerRecordEntry is a single consumed envelope in a peer's record history.
+type PeerRecordEntry struct {
+	Envelope *record.Envelope
+	// Subject is the peer the record claims to be about. It may differ from
+	// the signer of the envelope, in whose history the entry is kept.
+	Subject peer.ID
+	// Seq is the sequence number of the record, or zero if the envelope didn't
+	// contain a valid peer record.
+	Seq uint64
+	// Received is when the envelope was consumed.
+	Received time.Time
+	Source   PeerRecordSource
+
+	Accepted bool
+	// RejectReason is set when the envelope was rejected.
+	RejectReason string
+}
+
+// PeerRecordHistory provides access to the history of consumed peer records.
+type PeerRecordHistory interface {
+	// RecordHistory returns the remembered entries of a peer, oldest first.
+	RecordHistory(p peer.ID) []PeerRecordEntry
+
+	// RecordHistorySince returns the remembered entries of a peer received at
+	// or after the given time, oldest first.
+	RecordHistorySince(p peer.ID, since time.Time) []PeerRecordEntry
+
+	// RejectedRecords returns the remembered rejected entries of a peer,
+	// oldest first.
+	RejectedRecords(p peer.ID) []PeerRecordEntry
+
+	// PeersWithRecordHistory returns the peers with a history.
+	PeersWithRecordHistory() peer.IDSlice
+}
+
+// GetPeerRecordHistory is a helper to "upcast" a CertifiedAddrBook to a
+// PeerRecordHistory by using type assertion. Returns (nil, false) if the
+// CertifiedAddrBook does not keep a record history.
+func GetPeerRecordHistory(cab CertifiedAddrBook) (h PeerRecordHistory, ok bool) {
+	h, ok = cab.(PeerRecordHistory)
+	return h, ok
+}
+
+// RecordHistoryOption is a single AuditedCertifiedAddrBook option.
+type RecordHistoryOption func(ab *AuditedCertifiedAddrBook) error
+
+// WithRecordHistoryClock sets the clock used to timestamp consumed records.
+// Defaults to clock.Real.
+func WithRecordHistoryClock(c clock.Clock) RecordHistoryOption {
+	return func(ab *AuditedCertifiedAddrBook) error {
+		ab.clock = c
+		return nil
+	}
+}
+
+// AuditedCertifiedAddrBook wraps a CertifiedAddrBook and keeps a bounded
+// history of the envelopes consumed for every peer, accepted or not.
+// Sequence number regressions are logged as misbehaviour through canonicallog.
+//
+// Envelopes are kept in the history of the peer that signed them. A record
+// naming a different peer than its signer is kept in the signer's history,
+// so that forged records can't fill or evict the history of the peer they
+// name, nor get it logged as misbehaving.
+type AuditedCertifiedAddrBook struct {
+	CertifiedAddrBook
+
+	clock    clock.Clock
+	perPeer  int
+	maxPeers int
+
+	mu      sync.Mutex
+	seq     uint64
+	history map[peer.ID]*recordHistory
+}
+
+var _ CertifiedAddrBook = (*AuditedCertifiedAddrBook)(nil)
+var _ PeerRecordHistory = (*AuditedCertifiedAddrBook)(nil)
+
+type recordHistory struct {
+	entries []PeerRecordEntry
+	// lastSeq is the seq of the last accepted record.
+	lastSeq     uint64
+	hasAccepted bool
+	// touched orders histories by recency, for eviction.
+	touched uint64
+}
+
+// NewAuditedCertifiedAddrBook wraps cab, remembering up to perPeer envelopes
+// for each of up to maxPeers peers. Non-positive values select the defaults.
+// When maxPeers is exceeded, the least recently updated history is dropped.
+func NewAuditedCertifiedAddrBook(cab CertifiedAddrBook, perPeer, maxPeers int, opts ...RecordHistoryOption) (*AuditedCertifiedAddrBook, error) {
+	if perPeer <= 0 {
+		perPeer = DefaultRecordHistoryPerPeer
+	}
+	if maxPeers <= 0 {
+		maxPeers = DefaultRecordHistoryPeers
+	}
+	ab := &AuditedCertifiedAddrBook{
+		CertifiedAddrBook: cab,
+		clock:             clock.Real,
+		perPeer:           perPeer,
+		maxPeers:          maxPeers,
+		history:           make(map[peer.ID]*recordHistory),
+	}
+	for _, o := range opts {
+		if err := o(ab); err != nil {
+			return nil, err
+		}
+	}
+	return ab, nil
+}
+
+// ConsumePeerRecord consumes an envelope from an unknown source.
+func (ab *AuditedCertifiedAddrBook) ConsumePeerRecord(s *record.Envelope, ttl time.Duration) (accepted bool, err error) {
+	return ab.ConsumePeerRecordFrom(PeerRecordSource{}, s, ttl)
+}
+
+// ConsumePeerRecordFrom consumes an envelope received from the given source,
+// and records the outcome in the history of the envelope's signer.
+func (ab *AuditedCertifiedAddrBook) ConsumePeerRecordFrom(src PeerRecordSource, s *record.Envelope, ttl time.Duration) (accepted bool, err error) {
+	entry := PeerRecordEntry{
+		Envelope: s,
+		Received: ab.clock.Now(),
+		Source:   src,
+	}
+	var addrs []ma.Multiaddr
+	if r, rerr := s.Record(); rerr == nil {
+		if rec, ok := r.(*peer.PeerRecord); ok {
+			entry.Subject = rec.PeerID
+			entry.Seq = rec.Seq
+			addrs = rec.Addrs
+		}
+	}
+	var signer peer.ID
+	if id, ierr := peer.IDFromPublicKey(s.PublicKey); ierr == nil {
+		signer = id
+	}
+	if entry.Subject == "" {
+		entry.Subject = signer
+	}
+
+	accepted, err = ab.CertifiedAddrBook.ConsumePeerRecord(s, ttl)
+	if signer == "" {
+		// nothing to attribute the envelope to
+		return accepted, err
+	}
+	entry.Accepted = accepted
+	// Only a record signed by its subject can regress the subject's seq.
+	authentic := err == nil && signer == entry.Subject
+
+	ab.mu.Lock()
+	h := ab.peerHistory(signer)
+	regression := authentic && h.hasAccepted && entry.Seq < h.lastSeq
+	switch {
+	case err != nil:
+		entry.RejectReason = err.Error()
+	case !accepted && regression:
+		entry.RejectReason = fmt.Sprintf("stale seq %d, last accepted %d", entry.Seq, h.lastSeq)
+	case !accepted:
+		entry.RejectReason = "rejected by address book"
+	case !authentic:
+		// the wrapped book accepted a record that its subject didn't sign;
+		// don't let it move the seq of either peer
+	default:
+		h.lastSeq = entry.Seq
+		h.hasAccepted = true
+	}
+	if len(h.entries) >= ab.perPeer {
+		copy(h.entries, h.entries[1:])
+		h.entries = h.entries[:len(h.entries)-1]
+	}
+	h.entries = append(h.entries, entry)
+	lastSeq := h.lastSeq
+	ab.mu.Unlock()
+
+	if regression {
+		offender, addr := entry.Subject, src.Addr
+		if src.Peer != "" {
+			offender = src.Peer
+		}
+		if addr == nil && len(addrs) > 0 {
+			addr = addrs[0]
+		}
+		if addr == nil {
+			if c, cerr := ma.NewComponent("p2p", offender.String()); cerr == nil {
+				addr = c
+			}
+		}
+		if addr != nil {
+			logMisbehavingPeer(offender, addr, "peerstore", errSeqRegression,
+				fmt.Sprintf("peer record for %s has seq %d, last accepted %d", entry.Subject, entry.Seq, lastSeq))
+		}
+	}
+	return accepted, err
+}
+
+// peerHistory returns the history of p, creating it (and evicting the least
+// recently updated history if needed) if it doesn't exist.
+func (ab *AuditedCertifiedAddrBook) peerHistory(p peer.ID) *recordHistory {
+	ab.seq++
+	h, ok := ab.history[p]
+	if !ok {
+		if len(ab.history) >= ab.maxPeers {
+			var (
+				stalest peer.ID
+				oldest  uint64
+				first   = true
+			)
+			for id, other := range ab.history {
+				if first || other.touched < oldest {
+					stalest, oldest, first = id, other.touched, false
+				}
+			}
+			delete(ab.history, stalest)
+		}
+		h = &recordHistory{}
+		ab.history[p] = h
+	}
+	h.touched = ab.seq
+	return h
+}
+
+func (ab *AuditedCertifiedAddrBook) RecordHistory(p peer.ID) []PeerRecordEntry {
+	return ab.filter(p, func(PeerRecordEntry) bool { return true })
+}
+
+func (ab *AuditedCertifiedAddrBook) RecordHistorySince(p peer.ID, since time.Time) []PeerRecordEntry {
+	return ab.filter(p, func(e PeerRecordEntry) bool { return !e.Received.Before(since) })
+}
+
+func (ab *AuditedCertifiedAddrBook) RejectedRecords(p peer.ID) []PeerRecordEntry {
+	return ab.filter(p, func(e PeerRecordEntry) bool { return !e.Accepted })
+}
+
+func (ab *AuditedCertifiedAddrBook) filter(p peer.ID, keep func(PeerRecordEntry) bool) []PeerRecordEntry {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	h, ok := ab.history[p]
+	if !ok {
+		return nil
+	}
+	var out []PeerRecordEntry
+	for _, e := range h.entries {
+		if keep(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (ab *AuditedCertifiedAddrBook) PeersWithRecordHistory() peer.IDSlice {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	out := make(peer.IDSlice, 0, len(ab.history))
+	for p := range ab.history {
+		out = append(out, p)
+	}
+	return out
+}
+
+// ForgetRecordHistory drops the history of a peer.
+func (ab *AuditedCertifiedAddrBook) ForgetRecordHistory(p peer.ID) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	delete(ab.history, p)
+}
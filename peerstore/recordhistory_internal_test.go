@@ -0,0 +1,189 @@
+package peerstore
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+type misbehaviour struct {
+	p    peer.ID
+	addr ma.Multiaddr
+}
+
+func captureMisbehaviour(t *testing.T) *[]misbehaviour {
+	var logged []misbehaviour
+	orig := logMisbehavingPeer
+	logMisbehavingPeer = func(p peer.ID, addr ma.Multiaddr, _ string, _ error, _ string) {
+		logged = append(logged, misbehaviour{p, addr})
+	}
+	t.Cleanup(func() { logMisbehavingPeer = orig })
+	return &logged
+}
+
+func newAuditedBook(t *testing.T, perPeer, maxPeers int) *AuditedCertifiedAddrBook {
+	t.Helper()
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ps.Close() })
+	cab, ok := GetCertifiedAddrBook(ps)
+	if !ok {
+		t.Fatal("expected the peerstore to be a CertifiedAddrBook")
+	}
+	ab, err := NewAuditedCertifiedAddrBook(cab, perPeer, maxPeers, WithRecordHistoryClock(clock.NewVirtual(time.Unix(0, 0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ab
+}
+
+func newIdentity(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, id
+}
+
+// sealRecord signs a peer record about subject with the given key.
+func sealRecord(t *testing.T, key crypto.PrivKey, subject peer.ID, seq uint64) *record.Envelope {
+	t.Helper()
+	rec := peer.NewPeerRecord()
+	rec.PeerID = subject
+	rec.Seq = seq
+	rec.Addrs = []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/1")}
+	env, err := record.Seal(rec, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestRecordHistoryForgedSubject(t *testing.T) {
+	logged := captureMisbehaviour(t)
+	ab := newAuditedBook(t, 0, 0)
+	victimKey, victim := newIdentity(t)
+	attackerKey, attacker := newIdentity(t)
+
+	if ok, err := ab.ConsumePeerRecord(sealRecord(t, victimKey, victim, 10), time.Hour); !ok || err != nil {
+		t.Fatalf("expected the authentic record to be accepted: %v", err)
+	}
+	// a low seq record naming the victim, signed by the attacker
+	if ok, err := ab.ConsumePeerRecordFrom(PeerRecordSource{}, sealRecord(t, attackerKey, victim, 1), time.Hour); ok || err == nil {
+		t.Fatal("expected the forged record to be rejected")
+	}
+
+	if len(*logged) != 0 {
+		t.Fatalf("expected no misbehaviour to be logged, got %v", *logged)
+	}
+	if h := ab.RecordHistory(victim); len(h) != 1 || !h[0].Accepted || h[0].Seq != 10 {
+		t.Fatalf("expected the history of the victim to be untouched, got %+v", h)
+	}
+	h := ab.RejectedRecords(attacker)
+	if len(h) != 1 || h[0].Subject != victim || h[0].RejectReason == "" {
+		t.Fatalf("expected the forged record in the history of its signer, got %+v", h)
+	}
+}
+
+func TestRecordHistorySeqRegression(t *testing.T) {
+	logged := captureMisbehaviour(t)
+	ab := newAuditedBook(t, 0, 0)
+	key, id := newIdentity(t)
+	_, relay := newIdentity(t)
+
+	ab.ConsumePeerRecord(sealRecord(t, key, id, 10), time.Hour)
+	if ok, err := ab.ConsumePeerRecord(sealRecord(t, key, id, 5), time.Hour); ok || err != nil {
+		t.Fatalf("expected the stale record to be rejected without error, got %t, %v", ok, err)
+	}
+	if len(*logged) != 1 || (*logged)[0].p != id {
+		t.Fatalf("expected the subject to be logged as misbehaving, got %v", *logged)
+	}
+	if !(*logged)[0].addr.Equal(ma.StringCast("/ip4/1.2.3.4/tcp/1")) {
+		t.Fatalf("expected the record address to be logged, got %s", (*logged)[0].addr)
+	}
+
+	// a stale record relayed by another peer blames the relay
+	relayAddr := ma.StringCast("/ip4/5.6.7.8/tcp/1")
+	ab.ConsumePeerRecordFrom(PeerRecordSource{Peer: relay, Addr: relayAddr}, sealRecord(t, key, id, 7), time.Hour)
+	if len(*logged) != 2 || (*logged)[1].p != relay || !(*logged)[1].addr.Equal(relayAddr) {
+		t.Fatalf("expected the relay to be logged as misbehaving, got %v", *logged)
+	}
+
+	rejected := ab.RejectedRecords(id)
+	if len(rejected) != 2 || rejected[0].RejectReason != "stale seq 5, last accepted 10" {
+		t.Fatalf("unexpected rejected records: %+v", rejected)
+	}
+	if rejected[1].Source.Peer != relay {
+		t.Fatalf("expected the source to be recorded, got %+v", rejected[1].Source)
+	}
+
+	// a newer record is not a regression
+	ab.ConsumePeerRecord(sealRecord(t, key, id, 11), time.Hour)
+	if len(*logged) != 2 {
+		t.Fatalf("expected no more misbehaviour, got %v", *logged)
+	}
+}
+
+func TestRecordHistoryPerPeerBound(t *testing.T) {
+	captureMisbehaviour(t)
+	ab := newAuditedBook(t, 3, 0)
+	key, id := newIdentity(t)
+	for seq := uint64(1); seq <= 5; seq++ {
+		ab.ConsumePeerRecord(sealRecord(t, key, id, seq), time.Hour)
+	}
+	h := ab.RecordHistory(id)
+	if len(h) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(h))
+	}
+	for i, e := range h {
+		if e.Seq != uint64(i+3) {
+			t.Fatalf("expected the oldest entries to be dropped, got seq %d at %d", e.Seq, i)
+		}
+	}
+}
+
+func TestRecordHistoryEviction(t *testing.T) {
+	captureMisbehaviour(t)
+	ab := newAuditedBook(t, 0, 2)
+	ka, a := newIdentity(t)
+	kb, b := newIdentity(t)
+	kc, c := newIdentity(t)
+
+	ab.ConsumePeerRecord(sealRecord(t, ka, a, 1), time.Hour)
+	ab.ConsumePeerRecord(sealRecord(t, kb, b, 1), time.Hour)
+	// a is now the most recently updated history
+	ab.ConsumePeerRecord(sealRecord(t, ka, a, 2), time.Hour)
+	ab.ConsumePeerRecord(sealRecord(t, kc, c, 1), time.Hour)
+
+	peers := ab.PeersWithRecordHistory()
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 histories, got %d", len(peers))
+	}
+	if ab.RecordHistory(b) != nil {
+		t.Fatal("expected the least recently updated history to be evicted")
+	}
+	if len(ab.RecordHistory(a)) != 2 || len(ab.RecordHistory(c)) != 1 {
+		t.Fatal("expected the other histories to be kept")
+	}
+
+	ab.ForgetRecordHistory(a)
+	if ab.RecordHistory(a) != nil {
+		t.Fatal("expected the history to be forgotten")
+	}
+}
@@ -0,0 +1,508 @@
+package peerstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+var (
+	// ErrUnknownMetadataKey is returned when using a key that hasn't been
+	// registered with the schema.
+	ErrUnknownMetadataKey = errors.New("unknown metadata key")
+	// ErrMetadataTooLarge is returned when an encoded value exceeds the
+	// maximum size of its key.
+	ErrMetadataTooLarge = errors.New("metadata value too large")
+	// ErrMetadataBudgetExceeded is returned when storing a value would exceed
+	// the per-peer metadata budget.
+	ErrMetadataBudgetExceeded = errors.New("peer metadata budget exceeded")
+)
+
+// typedMetadataPrefix namespaces typed entries in the underlying PeerMetadata.
+const typedMetadataPrefix = "/typed/"
+
+// MetadataCodec encodes and decodes the values of a typed metadata key.
+type MetadataCodec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(b []byte) (interface{}, error)
+}
+
+// MetadataKey describes a typed metadata entry.
+type MetadataKey struct {
+	// Name identifies the entry. It must be unique within a schema.
+	Name string
+	// Codec encodes values for storage.
+	Codec MetadataCodec
+	// MaxSize is the maximum encoded size of a value, in bytes.
+	MaxSize int
+}
+
+// MetadataSchema is a registry of typed metadata keys.
+type MetadataSchema struct {
+	mu   sync.RWMutex
+	keys map[string]MetadataKey
+}
+
+// NewMetadataSchema creates an empty MetadataSchema.
+func NewMetadataSchema() *MetadataSchema {
+	return &MetadataSchema{keys: make(map[string]MetadataKey)}
+}
+
+// DefaultMetadataSchema is the schema used by RegisterMetadataKey.
+var DefaultMetadataSchema = NewMetadataSchema()
+
+// RegisterMetadataKey registers a key with the DefaultMetadataSchema.
+func RegisterMetadataKey(k MetadataKey) error {
+	return DefaultMetadataSchema.Register(k)
+}
+
+// Register adds a key to the schema. Keys can't be registered twice.
+func (s *MetadataSchema) Register(k MetadataKey) error {
+	if k.Name == "" {
+		return errors.New("metadata key must have a name")
+	}
+	if k.Codec == nil {
+		return fmt.Errorf("metadata key %s has no codec", k.Name)
+	}
+	if k.MaxSize <= 0 {
+		return fmt.Errorf("metadata key %s must have a positive max size", k.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[k.Name]; ok {
+		return fmt.Errorf("metadata key %s already registered", k.Name)
+	}
+	s.keys[k.Name] = k
+	return nil
+}
+
+// Key looks up a registered key by name.
+func (s *MetadataSchema) Key(name string) (MetadataKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[name]
+	return k, ok
+}
+
+// Keys returns the names of all registered keys, sorted.
+func (s *MetadataSchema) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.keys))
+	for name := range s.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StringKey is a metadata key registered with StringCodec. It is used with
+// TypedMetadata.GetString and PutString, which are checked at compile time.
+type StringKey struct{ typedKey }
+
+// BytesKey is a metadata key registered with BytesCodec. It is used with
+// TypedMetadata.GetBytes and PutBytes, which are checked at compile time.
+type BytesKey struct{ typedKey }
+
+// JSONKey is a metadata key registered with a JSON codec. It is used with
+// TypedMetadata.GetJSON and PutJSON.
+type JSONKey struct{ typedKey }
+
+// typedKey binds a key name to the schema it was registered with.
+type typedKey struct {
+	schema *MetadataSchema
+	name   string
+}
+
+// Name returns the name the key was registered under.
+func (k typedKey) Name() string { return k.name }
+
+// RegisterString registers a key whose values are strings of up to maxSize
+// bytes.
+func (s *MetadataSchema) RegisterString(name string, maxSize int) (StringKey, error) {
+	if err := s.Register(MetadataKey{Name: name, Codec: StringCodec, MaxSize: maxSize}); err != nil {
+		return StringKey{}, err
+	}
+	return StringKey{typedKey{schema: s, name: name}}, nil
+}
+
+// RegisterBytes registers a key whose values are byte slices of up to
+// maxSize bytes.
+func (s *MetadataSchema) RegisterBytes(name string, maxSize int) (BytesKey, error) {
+	if err := s.Register(MetadataKey{Name: name, Codec: BytesCodec, MaxSize: maxSize}); err != nil {
+		return BytesKey{}, err
+	}
+	return BytesKey{typedKey{schema: s, name: name}}, nil
+}
+
+// RegisterJSON registers a key whose values are stored as JSON documents of
+// up to maxSize bytes. newValue is used by the untyped Get, as for
+// NewJSONCodec.
+func (s *MetadataSchema) RegisterJSON(name string, maxSize int, newValue func() interface{}) (JSONKey, error) {
+	if err := s.Register(MetadataKey{Name: name, Codec: NewJSONCodec(newValue), MaxSize: maxSize}); err != nil {
+		return JSONKey{}, err
+	}
+	return JSONKey{typedKey{schema: s, name: name}}, nil
+}
+
+// StringCodec stores string values as-is.
+var StringCodec MetadataCodec = stringCodec{}
+
+// BytesCodec stores []byte values as-is.
+var BytesCodec MetadataCodec = bytesCodec{}
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected string, got %T", v)
+	}
+	return []byte(s), nil
+}
+
+func (stringCodec) Decode(b []byte) (interface{}, error) {
+	return string(b), nil
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Encode(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("expected []byte, got %T", v)
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (bytesCodec) Decode(b []byte) (interface{}, error) {
+	return append([]byte(nil), b...), nil
+}
+
+// NewJSONCodec returns a codec storing values as JSON. newValue must return a
+// pointer to a fresh value to decode into; Decode returns that pointer.
+func NewJSONCodec(newValue func() interface{}) MetadataCodec {
+	return jsonCodec{newValue: newValue}
+}
+
+type jsonCodec struct {
+	newValue func() interface{}
+}
+
+func (c jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Decode(b []byte) (interface{}, error) {
+	v := c.newValue()
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// TypedMetadata stores typed, size-limited values on top of a PeerMetadata.
+// Values are stored encoded, as []byte, so that persistent peerstores can
+// serialize them without knowing their types.
+//
+// Put and Get take keys by name and values as interface{}; the type of a
+// value is only checked at run time, by the codec of its key. Keys
+// registered with RegisterString, RegisterBytes and RegisterJSON have typed
+// accessors instead.
+type TypedMetadata struct {
+	pm     PeerMetadata
+	schema *MetadataSchema
+	budget int
+
+	mu    sync.Mutex
+	usage map[peer.ID]map[string]int
+}
+
+// NewTypedMetadata creates a TypedMetadata storing entries in pm. Keys are
+// looked up in schema, and the encoded entries of a single peer may take up
+// to budget bytes; a budget of zero means no per-peer limit.
+func NewTypedMetadata(pm PeerMetadata, schema *MetadataSchema, budget int) *TypedMetadata {
+	return &TypedMetadata{
+		pm:     pm,
+		schema: schema,
+		budget: budget,
+		usage:  make(map[peer.ID]map[string]int),
+	}
+}
+
+// Put encodes and stores a value for the given key. The codec of the key
+// rejects values of the wrong type.
+func (m *TypedMetadata) Put(p peer.ID, key string, val interface{}) error {
+	k, ok := m.schema.Key(key)
+	if !ok {
+		return ErrUnknownMetadataKey
+	}
+	b, err := k.Codec.Encode(val)
+	if err != nil {
+		return err
+	}
+	return m.putEncoded(p, k, b)
+}
+
+func (m *TypedMetadata) putEncoded(p peer.ID, k MetadataKey, b []byte) error {
+	if len(b) > k.MaxSize {
+		return ErrMetadataTooLarge
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := m.peerUsage(p)
+	if usage == nil {
+		usage = make(map[string]int)
+	}
+	if !m.fitsBudget(usage, map[string]int{k.Name: len(b)}) {
+		return ErrMetadataBudgetExceeded
+	}
+	if err := m.pm.Put(p, typedMetadataPrefix+k.Name, b); err != nil {
+		return err
+	}
+	usage[k.Name] = len(b)
+	m.usage[p] = usage
+	return nil
+}
+
+// fitsBudget returns true if a peer with the given usage stays within the
+// budget once the entries of the given sizes are written.
+func (m *TypedMetadata) fitsBudget(usage map[string]int, sizes map[string]int) bool {
+	if m.budget <= 0 {
+		return true
+	}
+	total := 0
+	for name, n := range usage {
+		if _, ok := sizes[name]; !ok {
+			total += n
+		}
+	}
+	for _, n := range sizes {
+		total += n
+	}
+	return total <= m.budget
+}
+
+// Get decodes and returns the value stored for the given key. Returns
+// ErrNotFound if the peer has no value for the key.
+func (m *TypedMetadata) Get(p peer.ID, key string) (interface{}, error) {
+	k, ok := m.schema.Key(key)
+	if !ok {
+		return nil, ErrUnknownMetadataKey
+	}
+	b, err := m.getEncoded(p, k.Name)
+	if err != nil {
+		return nil, err
+	}
+	return k.Codec.Decode(b)
+}
+
+// typedKey looks up a key bound to a schema, which must be the schema of m.
+func (m *TypedMetadata) typedKey(k typedKey) (MetadataKey, error) {
+	if k.schema != m.schema {
+		return MetadataKey{}, ErrUnknownMetadataKey
+	}
+	mk, ok := m.schema.Key(k.name)
+	if !ok {
+		return MetadataKey{}, ErrUnknownMetadataKey
+	}
+	return mk, nil
+}
+
+// PutString stores a string value for the given key.
+func (m *TypedMetadata) PutString(p peer.ID, k StringKey, val string) error {
+	mk, err := m.typedKey(k.typedKey)
+	if err != nil {
+		return err
+	}
+	return m.putEncoded(p, mk, []byte(val))
+}
+
+// GetString returns the string value stored for the given key. Returns
+// ErrNotFound if the peer has no value for the key.
+func (m *TypedMetadata) GetString(p peer.ID, k StringKey) (string, error) {
+	if _, err := m.typedKey(k.typedKey); err != nil {
+		return "", err
+	}
+	b, err := m.getEncoded(p, k.name)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// PutBytes stores a byte slice value for the given key.
+func (m *TypedMetadata) PutBytes(p peer.ID, k BytesKey, val []byte) error {
+	mk, err := m.typedKey(k.typedKey)
+	if err != nil {
+		return err
+	}
+	return m.putEncoded(p, mk, append([]byte(nil), val...))
+}
+
+// GetBytes returns a copy of the byte slice value stored for the given key.
+// Returns ErrNotFound if the peer has no value for the key.
+func (m *TypedMetadata) GetBytes(p peer.ID, k BytesKey) ([]byte, error) {
+	if _, err := m.typedKey(k.typedKey); err != nil {
+		return nil, err
+	}
+	b, err := m.getEncoded(p, k.name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// PutJSON stores the JSON encoding of val for the given key.
+func (m *TypedMetadata) PutJSON(p peer.ID, k JSONKey, val interface{}) error {
+	mk, err := m.typedKey(k.typedKey)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return m.putEncoded(p, mk, b)
+}
+
+// GetJSON decodes the value stored for the given key into v, like
+// json.Unmarshal. Returns ErrNotFound if the peer has no value for the key.
+func (m *TypedMetadata) GetJSON(p peer.ID, k JSONKey, v interface{}) error {
+	if _, err := m.typedKey(k.typedKey); err != nil {
+		return err
+	}
+	b, err := m.getEncoded(p, k.name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (m *TypedMetadata) getEncoded(p peer.ID, name string) ([]byte, error) {
+	v, err := m.pm.Get(p, typedMetadataPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("metadata entry %s is not encoded", name)
+	}
+	return b, nil
+}
+
+// Usage returns the number of bytes taken up by the typed entries of a peer.
+func (m *TypedMetadata) Usage(p peer.ID) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total := 0
+	for _, n := range m.peerUsage(p) {
+		total += n
+	}
+	return total
+}
+
+// peerUsage returns the accounted entry sizes of a peer, loading them from
+// the underlying store if the peer isn't accounted yet (e.g. after a restart
+// of a persistent peerstore). Loaded sizes are only retained once an entry
+// is written, so that reads don't grow the accounting. Accounted entries
+// that are gone from the store, because the peer was removed from the
+// Peerstore directly rather than through RemovePeer, are released.
+func (m *TypedMetadata) peerUsage(p peer.ID) map[string]int {
+	usage, ok := m.usage[p]
+	if ok {
+		for name := range usage {
+			if _, err := m.getEncoded(p, name); err == peerstore.ErrNotFound {
+				delete(usage, name)
+			}
+		}
+		if len(usage) == 0 {
+			delete(m.usage, p)
+			return nil
+		}
+		return usage
+	}
+	for _, name := range m.schema.Keys() {
+		if b, err := m.getEncoded(p, name); err == nil {
+			if usage == nil {
+				usage = make(map[string]int)
+			}
+			usage[name] = len(b)
+		}
+	}
+	return usage
+}
+
+// RemovePeer removes all metadata of the peer from the underlying store,
+// including the untyped entries stored directly in the PeerMetadata, and
+// releases its budget. PeerMetadata can't delete single entries, so the
+// typed entries can't be removed on their own.
+func (m *TypedMetadata) RemovePeer(p peer.ID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pm.RemovePeer(p)
+	delete(m.usage, p)
+}
+
+// Export returns the encoded typed entries of a peer, keyed by name, for
+// persistence or transfer to another store.
+func (m *TypedMetadata) Export(p peer.ID) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	for _, name := range m.schema.Keys() {
+		b, err := m.getEncoded(p, name)
+		switch err {
+		case nil:
+			out[name] = b
+		case peerstore.ErrNotFound:
+		default:
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Import stores previously exported entries for a peer, enforcing the
+// schema's size limits and the per-peer budget. The entries are checked as a
+// whole before any is stored: an import rejected for an unknown key, an
+// oversized entry or the budget leaves the entries of the peer unchanged.
+func (m *TypedMetadata) Import(p peer.ID, entries map[string][]byte) error {
+	names := make([]string, 0, len(entries))
+	sizes := make(map[string]int, len(entries))
+	for name, b := range entries {
+		k, ok := m.schema.Key(name)
+		if !ok {
+			return ErrUnknownMetadataKey
+		}
+		if len(b) > k.MaxSize {
+			return ErrMetadataTooLarge
+		}
+		names = append(names, name)
+		sizes[name] = len(b)
+	}
+	sort.Strings(names)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := m.peerUsage(p)
+	if usage == nil {
+		usage = make(map[string]int)
+	}
+	if !m.fitsBudget(usage, sizes) {
+		return ErrMetadataBudgetExceeded
+	}
+	for _, name := range names {
+		if err := m.pm.Put(p, typedMetadataPrefix+name, entries[name]); err != nil {
+			return err
+		}
+		usage[name] = sizes[name]
+		m.usage[p] = usage
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package peerstore
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+)
+
+func TestTypedMetadataUsageAccounting(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	schema := NewMetadataSchema()
+	k, err := schema.RegisterString("k", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewTypedMetadata(ps, schema, 0)
+
+	// reading the usage of unknown peers doesn't account them
+	for _, p := range []peer.ID{"a", "b", "c"} {
+		if n := m.Usage(p); n != 0 {
+			t.Fatalf("expected no usage, got %d", n)
+		}
+	}
+	if len(m.usage) != 0 {
+		t.Fatalf("expected no accounted peers, got %d", len(m.usage))
+	}
+
+	// entries written behind the back of m are loaded, but not retained
+	ps.Put("a", typedMetadataPrefix+"k", []byte("abc"))
+	if n := m.Usage("a"); n != 3 {
+		t.Fatalf("expected a usage of 3, got %d", n)
+	}
+	if len(m.usage) != 0 {
+		t.Fatalf("expected no accounted peers, got %d", len(m.usage))
+	}
+
+	if err := m.PutString("b", k, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.PutString("c", k, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.usage) != 2 {
+		t.Fatalf("expected 2 accounted peers, got %d", len(m.usage))
+	}
+
+	m.RemovePeer("b")
+	if _, ok := m.usage["b"]; ok {
+		t.Fatal("expected RemovePeer to forget the accounting of the peer")
+	}
+
+	// peers removed from the peerstore directly are forgotten once looked at
+	ps.RemovePeer("c")
+	if n := m.Usage("c"); n != 0 {
+		t.Fatalf("expected no usage, got %d", n)
+	}
+	if len(m.usage) != 0 {
+		t.Fatalf("expected no accounted peers, got %d", len(m.usage))
+	}
+}
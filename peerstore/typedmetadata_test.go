@@ -0,0 +1,208 @@
+package peerstore_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peerstore"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	pstore "github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+)
+
+func TestTypedMetadataBudgetAfterPeerstoreRemovePeer(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	schema := peerstore.NewMetadataSchema()
+	for _, name := range []string{"a", "b"} {
+		if err := schema.Register(peerstore.MetadataKey{Name: name, Codec: peerstore.StringCodec, MaxSize: 8}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := peerstore.NewTypedMetadata(ps, schema, 10)
+
+	p := peer.ID("peer")
+	if err := m.Put(p, "a", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Put(p, "b", "1234"); err != peerstore.ErrMetadataBudgetExceeded {
+		t.Fatalf("expected the budget to be exceeded, got %v", err)
+	}
+
+	// removing the peer from the peerstore directly releases its budget too
+	ps.RemovePeer(p)
+	if n := m.Usage(p); n != 0 {
+		t.Fatalf("expected no usage after removing the peer, got %d", n)
+	}
+	if err := m.Put(p, "b", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Usage(p); n != 4 {
+		t.Fatalf("expected a usage of 4, got %d", n)
+	}
+}
+
+func TestTypedMetadataTypedKeys(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	type info struct {
+		Agent string
+		Port  int
+	}
+	schema := peerstore.NewMetadataSchema()
+	name, err := schema.RegisterString("name", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := schema.RegisterBytes("blob", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inf, err := schema.RegisterJSON("info", 64, func() interface{} { return new(info) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schema.RegisterString("name", 16); err == nil {
+		t.Fatal("expected registering a key twice to fail")
+	}
+	m := peerstore.NewTypedMetadata(ps, schema, 0)
+	p := peer.ID("peer")
+
+	if _, err := m.GetString(p, name); err != pstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := m.PutString(p, name, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.GetString(p, name); err != nil || v != "alice" {
+		t.Fatalf("unexpected value %q: %v", v, err)
+	}
+
+	b := []byte{1, 2, 3}
+	if err := m.PutBytes(p, blob, b); err != nil {
+		t.Fatal(err)
+	}
+	b[0] = 9
+	if v, err := m.GetBytes(p, blob); err != nil || !bytes.Equal(v, []byte{1, 2, 3}) {
+		t.Fatalf("unexpected value %v: %v", v, err)
+	}
+	if err := m.PutBytes(p, blob, make([]byte, 5)); err != peerstore.ErrMetadataTooLarge {
+		t.Fatalf("expected ErrMetadataTooLarge, got %v", err)
+	}
+
+	if err := m.PutJSON(p, inf, info{Agent: "test", Port: 4001}); err != nil {
+		t.Fatal(err)
+	}
+	var got info
+	if err := m.GetJSON(p, inf, &got); err != nil || got != (info{Agent: "test", Port: 4001}) {
+		t.Fatalf("unexpected value %+v: %v", got, err)
+	}
+	// the untyped accessor decodes with the registered codec
+	if v, err := m.Get(p, "info"); err != nil || *v.(*info) != got {
+		t.Fatalf("unexpected value %v: %v", v, err)
+	}
+
+	// keys are bound to the schema they were registered with
+	other := peerstore.NewMetadataSchema()
+	foreign, err := other.RegisterString("name", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.PutString(p, foreign, "mallory"); err != peerstore.ErrUnknownMetadataKey {
+		t.Fatalf("expected ErrUnknownMetadataKey, got %v", err)
+	}
+	if _, err := m.GetString(p, peerstore.StringKey{}); err != peerstore.ErrUnknownMetadataKey {
+		t.Fatalf("expected ErrUnknownMetadataKey, got %v", err)
+	}
+}
+
+func TestTypedMetadataImport(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	schema := peerstore.NewMetadataSchema()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := schema.Register(peerstore.MetadataKey{Name: name, Codec: peerstore.BytesCodec, MaxSize: 8}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := peerstore.NewTypedMetadata(ps, schema, 10)
+	p := peer.ID("peer")
+	if err := m.Put(p, "a", []byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+
+	// every entry fits on its own, but not all of them together
+	for i := 0; i < 10; i++ {
+		err := m.Import(p, map[string][]byte{"b": []byte("1234"), "c": []byte("1234")})
+		if err != peerstore.ErrMetadataBudgetExceeded {
+			t.Fatalf("expected the budget to be exceeded, got %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		entries  map[string][]byte
+		expected error
+	}{
+		{map[string][]byte{"b": []byte("1"), "unknown": []byte("1")}, peerstore.ErrUnknownMetadataKey},
+		{map[string][]byte{"b": []byte("1"), "c": []byte("123456789")}, peerstore.ErrMetadataTooLarge},
+	} {
+		if err := m.Import(p, tc.entries); err != tc.expected {
+			t.Fatalf("expected %v, got %v", tc.expected, err)
+		}
+	}
+	if exported, err := m.Export(p); err != nil || len(exported) != 1 {
+		t.Fatalf("expected the failed imports to store nothing, got %v, %v", exported, err)
+	}
+	if n := m.Usage(p); n != 4 {
+		t.Fatalf("expected a usage of 4, got %d", n)
+	}
+
+	// replaced entries are released from the budget
+	if err := m.Import(p, map[string][]byte{"a": []byte("1"), "b": []byte("1234"), "c": []byte("1234")}); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Usage(p); n != 9 {
+		t.Fatalf("expected a usage of 9, got %d", n)
+	}
+}
+
+func TestTypedMetadataRemovePeer(t *testing.T) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	schema := peerstore.NewMetadataSchema()
+	if err := schema.Register(peerstore.MetadataKey{Name: "a", Codec: peerstore.StringCodec, MaxSize: 8}); err != nil {
+		t.Fatal(err)
+	}
+	m := peerstore.NewTypedMetadata(ps, schema, 0)
+	p := peer.ID("peer")
+	if err := m.Put(p, "a", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Put(p, "untyped", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.RemovePeer(p)
+	if _, err := m.Get(p, "a"); err != pstore.ErrNotFound {
+		t.Fatalf("expected the typed entry to be removed, got %v", err)
+	}
+	if _, err := ps.Get(p, "untyped"); err != pstore.ErrNotFound {
+		t.Fatalf("expected the untyped entry to be removed too, got %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Client calls a single RPC protocol on remote peers. Calls to the same peer
+// share a stream, which is closed once it has been idle for the configured
+// idle timeout.
+type Client struct {
+	h   host.Host
+	pid protocol.ID
+	cfg config
+
+	mu       sync.Mutex
+	closed   bool
+	sessions map[peer.ID]*session
+	// opening is closed once the stream being opened to a peer is open, or
+	// failed to open.
+	opening map[peer.ID]chan struct{}
+}
+
+// NewClient creates a Client calling pid through h.
+func NewClient(h host.Host, pid protocol.ID, opts ...Option) (*Client, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		h:        h,
+		pid:      pid,
+		cfg:      cfg,
+		sessions: make(map[peer.ID]*session),
+		opening:  make(map[peer.ID]chan struct{}),
+	}, nil
+}
+
+// Call sends req to p, and decodes the response into resp. Errors returned
+// by the remote handler are returned as *Error. Calls interrupted by a stream
+// reset are retried as configured with WithRetries.
+func (c *Client) Call(ctx context.Context, p peer.ID, req, resp interface{}) error {
+	payload, err := c.cfg.codec.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if len(payload) > c.cfg.maxSize {
+		return network.ErrMessageTooLarge
+	}
+	if c.cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = clock.WithTimeout(ctx, c.cfg.clock, c.cfg.timeout)
+		defer cancel()
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = c.call(ctx, p, payload, resp)
+		if err == nil || !retryable(err) || attempt >= c.cfg.retries || ctx.Err() != nil {
+			return err
+		}
+		log.Debugf("retrying %s call to %s after: %s", c.pid, p, err)
+	}
+}
+
+func retryable(err error) bool {
+	return errors.Is(err, network.ErrReset) || errors.Is(err, ErrStreamClosed)
+}
+
+func (c *Client) call(ctx context.Context, p peer.ID, payload []byte, resp interface{}) error {
+	s, id, ch, err := c.register(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	f := &frame{kind: kindRequest, id: id, payload: payload}
+	if deadline, ok := ctx.Deadline(); ok {
+		// round up, so that a zero timeout is not mistaken for no timeout
+		f.timeout = c.cfg.clock.Until(deadline) + time.Millisecond - 1
+		if f.timeout <= 0 {
+			s.unregister(id)
+			return context.DeadlineExceeded
+		}
+	}
+	if err := s.write(ctx, f); err != nil {
+		s.unregister(id)
+		return err
+	}
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return r.err
+		}
+		return c.cfg.codec.Unmarshal(r.payload, resp)
+	case <-ctx.Done():
+		s.unregister(id)
+		return ctx.Err()
+	}
+}
+
+// register allocates a request ID on the session with p, opening one if
+// needed.
+func (c *Client) register(ctx context.Context, p peer.ID) (*session, uint64, chan result, error) {
+	for {
+		s, err := c.session(ctx, p)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if id, ch, ok := s.register(); ok {
+			return s, id, ch, nil
+		}
+		// the session was closed in the meantime
+		c.remove(s)
+	}
+}
+
+// session returns the session with p, opening its stream if needed. Calls
+// made while the stream is being opened wait for it.
+func (c *Client) session(ctx context.Context, p peer.ID) (*session, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrClientClosed
+		}
+		if s, ok := c.sessions[p]; ok {
+			c.mu.Unlock()
+			return s, nil
+		}
+		opening, ok := c.opening[p]
+		if !ok {
+			opening = make(chan struct{})
+			c.opening[p] = opening
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-opening:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	s, err := c.open(ctx, p)
+	c.mu.Lock()
+	close(c.opening[p])
+	delete(c.opening, p)
+	if err == nil && c.closed {
+		err = ErrClientClosed
+		s.fs.Stream().Reset()
+	}
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.sessions[p] = s
+	c.mu.Unlock()
+
+	go s.readLoop()
+	return s, nil
+}
+
+// open opens a stream to p.
+func (c *Client) open(ctx context.Context, p peer.ID) (*session, error) {
+	st, err := c.h.NewStream(ctx, p, c.pid)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := network.NewFramedStream(st, network.WithMaxMessageSize(c.cfg.maxSize+frameOverhead), network.WithMessageClock(c.cfg.clock))
+	if err != nil {
+		st.Reset()
+		return nil, err
+	}
+	return newSession(c, p, fs), nil
+}
+
+func (c *Client) remove(s *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions[s.p] == s {
+		delete(c.sessions, s.p)
+	}
+}
+
+// Close closes the streams of the client. Pending calls fail with
+// ErrClientClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	sessions := c.sessions
+	c.sessions = make(map[peer.ID]*session)
+	c.mu.Unlock()
+
+	for _, s := range sessions {
+		s.fail(ErrClientClosed)
+	}
+	return nil
+}
+
+type result struct {
+	payload []byte
+	err     error
+}
+
+// session multiplexes the calls to a single peer on a stream.
+type session struct {
+	c  *Client
+	p  peer.ID
+	fs *network.FramedStream
+
+	// wmu serializes the writes. It is a channel so that calls can give up
+	// waiting for it.
+	wmu chan struct{}
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan result
+	// done is set once no more calls may be registered; failed once the
+	// stream has been torn down.
+	done   bool
+	failed bool
+	idle   clock.Timer
+}
+
+func newSession(c *Client, p peer.ID, fs *network.FramedStream) *session {
+	return &session{c: c, p: p, fs: fs, wmu: make(chan struct{}, 1), pending: make(map[uint64]chan result)}
+}
+
+func (s *session) register() (uint64, chan result, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return 0, nil, false
+	}
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	s.nextID++
+	ch := make(chan result, 1)
+	s.pending[s.nextID] = ch
+	return s.nextID, ch, true
+}
+
+func (s *session) unregister(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, id)
+	s.armIdle()
+}
+
+// armIdle starts the idle timer if no calls are pending. Callers hold s.mu.
+func (s *session) armIdle() {
+	if s.done || len(s.pending) > 0 || s.idle != nil {
+		return
+	}
+	s.idle = s.c.cfg.clock.AfterFunc(s.c.cfg.idleTimeout, s.closeIdle)
+}
+
+func (s *session) closeIdle() {
+	s.mu.Lock()
+	if s.done || len(s.pending) > 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.mu.Unlock()
+
+	s.c.remove(s)
+	// the server closes its side once it has seen the end of the requests
+	s.fs.Stream().CloseWrite()
+}
+
+// write writes a frame of the call made with ctx, bounded by the deadline
+// and the cancellation of ctx. A frame can't be abandoned halfway without
+// corrupting the stream, so a write still blocked when ctx is done, e.g.
+// because the peer stopped reading, fails the session and resets its
+// stream. Pending calls then fail with network.ErrReset and are retried.
+func (s *session) write(ctx context.Context, f *frame) error {
+	select {
+	case s.wmu <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.wmu }()
+
+	deadline, _ := ctx.Deadline()
+	if err := s.fs.SetWriteDeadline(deadline); err != nil {
+		s.fail(err)
+		return err
+	}
+	defer s.fs.SetWriteDeadline(time.Time{})
+
+	var mu sync.Mutex
+	writing := true
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			if writing {
+				s.fail(network.ErrReset)
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	err := s.fs.WriteMsg(f.encode())
+	mu.Lock()
+	writing = false
+	mu.Unlock()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (s *session) readLoop() {
+	for {
+		msg, err := s.fs.ReadMsg()
+		if err != nil {
+			if err == io.EOF {
+				err = ErrStreamClosed
+			}
+			s.fail(err)
+			return
+		}
+		f, err := decodeFrame(msg)
+		if err != nil || f.kind == kindRequest {
+			s.fs.ReleaseMsg(msg)
+			s.fail(errMalformedFrame)
+			return
+		}
+
+		var r result
+		if f.kind == kindError {
+			r.err = &Error{Code: f.code, Message: string(f.payload)}
+		} else {
+			r.payload = append([]byte(nil), f.payload...)
+		}
+		s.fs.ReleaseMsg(msg)
+
+		s.mu.Lock()
+		ch, ok := s.pending[f.id]
+		delete(s.pending, f.id)
+		s.armIdle()
+		s.mu.Unlock()
+		if ok {
+			ch <- r
+		}
+	}
+}
+
+// fail aborts the session, failing all pending calls with err.
+func (s *session) fail(err error) {
+	s.mu.Lock()
+	if s.failed {
+		s.mu.Unlock()
+		return
+	}
+	s.failed = true
+	s.done = true
+	pending := s.pending
+	s.pending = make(map[uint64]chan result)
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	s.mu.Unlock()
+
+	s.c.remove(s)
+	for _, ch := range pending {
+		ch <- result{err: err}
+	}
+	if err == ErrStreamClosed || err == ErrClientClosed {
+		s.fs.Stream().Close()
+	} else {
+		s.fs.Stream().Reset()
+	}
+}
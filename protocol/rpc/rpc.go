@@ -0,0 +1,288 @@
+// Package rpc implements request/response exchanges over libp2p streams.
+//
+// Every RPC protocol is identified by a protocol.ID. A Server registers a
+// handler per protocol on a protocol.Switch, and a Client calls it through a
+// host.Host. Requests and responses are encoded with a pluggable
+// network.MessageCodec, and exchanged as length-prefixed frames, each tagged
+// with a request ID so that concurrent calls to the same peer share a single
+// stream.
+//
+// Handlers report failures as *Error values, which are transmitted to the
+// caller with their code and message.
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/multiformats/go-varint"
+)
+
+// DefaultIdleTimeout is the default time after which a client closes a
+// stream with no pending calls.
+const DefaultIdleTimeout = time.Minute
+
+// DefaultMaxConcurrentRequests is the default number of requests handled
+// concurrently on a single stream by a server.
+const DefaultMaxConcurrentRequests = 64
+
+var (
+	// ErrClientClosed is returned when calling through a closed Client.
+	ErrClientClosed = errors.New("rpc client closed")
+	// ErrStreamClosed is returned when the stream carrying a call is closed
+	// by the server before the response is received.
+	ErrStreamClosed = errors.New("rpc stream closed")
+
+	errMalformedFrame = errors.New("malformed rpc frame")
+)
+
+// ErrorCode classifies the errors returned by handlers.
+type ErrorCode uint32
+
+const (
+	// CodeInternal is used for handler errors that are not *Error values.
+	CodeInternal ErrorCode = iota + 1
+	// CodeInvalidRequest is used when the request cannot be decoded, or is
+	// rejected by the handler.
+	CodeInvalidRequest
+	// CodeNotFound is used when the requested entity does not exist.
+	CodeNotFound
+	// CodeUnavailable is used when the handler cannot serve the request at
+	// the moment. Such requests may be retried later.
+	CodeUnavailable
+	// CodeDeadlineExceeded is used when the handler did not complete before
+	// the deadline of the call.
+	CodeDeadlineExceeded
+	// CodeResourceExhausted is used when serving the request would exceed
+	// resource limits.
+	CodeResourceExhausted
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeInternal:
+		return "internal"
+	case CodeInvalidRequest:
+		return "invalid request"
+	case CodeNotFound:
+		return "not found"
+	case CodeUnavailable:
+		return "unavailable"
+	case CodeDeadlineExceeded:
+		return "deadline exceeded"
+	case CodeResourceExhausted:
+		return "resource exhausted"
+	default:
+		return fmt.Sprintf("code %d", uint32(c))
+	}
+}
+
+// Error is an error returned by a remote handler.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Errorf creates an Error with a formatted message.
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("rpc error: %s", e.Code)
+	}
+	return fmt.Sprintf("rpc error: %s: %s", e.Code, e.Message)
+}
+
+// Option is a single option for a Client or a Server handler.
+type Option func(cfg *config) error
+
+type config struct {
+	codec         network.MessageCodec
+	maxSize       int
+	timeout       time.Duration
+	retries       int
+	idleTimeout   time.Duration
+	maxConcurrent int
+	clock         clock.Clock
+}
+
+func newConfig(opts []Option) (config, error) {
+	cfg := config{
+		codec:         network.ProtobufCodec,
+		maxSize:       network.MessageSizeMax,
+		idleTimeout:   DefaultIdleTimeout,
+		maxConcurrent: DefaultMaxConcurrentRequests,
+		clock:         clock.Real,
+	}
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// WithCodec sets the codec of requests and responses. Both sides of a
+// protocol must use the same codec. Defaults to network.ProtobufCodec.
+func WithCodec(c network.MessageCodec) Option {
+	return func(cfg *config) error {
+		if c == nil {
+			return errors.New("nil codec")
+		}
+		cfg.codec = c
+		return nil
+	}
+}
+
+// WithMaxMessageSize sets the largest encoded request or response accepted.
+// Defaults to network.MessageSizeMax.
+func WithMaxMessageSize(n int) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max message size: %d", n)
+		}
+		cfg.maxSize = n
+		return nil
+	}
+}
+
+// WithTimeout sets the default deadline of a call, including retries, on a
+// Client; and the longest time a handler may run on a Server. The deadline
+// of the caller's context, if earlier, takes precedence, and is transmitted
+// to the server. Zero, the default, sets no timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return fmt.Errorf("invalid timeout: %s", d)
+		}
+		cfg.timeout = d
+		return nil
+	}
+}
+
+// WithRetries sets how many times a Client retries a call whose stream was
+// reset or closed before the response arrived. Handlers of protocols called
+// with retries must be idempotent. Defaults to zero.
+func WithRetries(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return fmt.Errorf("invalid number of retries: %d", n)
+		}
+		cfg.retries = n
+		return nil
+	}
+}
+
+// WithIdleTimeout sets the time after which a Client closes a stream with no
+// pending calls. Defaults to DefaultIdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid idle timeout: %s", d)
+		}
+		cfg.idleTimeout = d
+		return nil
+	}
+}
+
+// WithMaxConcurrentRequests sets how many requests a Server handles
+// concurrently on a single stream. Further requests are not read from the
+// stream until a handler returns. Defaults to DefaultMaxConcurrentRequests.
+func WithMaxConcurrentRequests(n int) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return fmt.Errorf("invalid max concurrent requests: %d", n)
+		}
+		cfg.maxConcurrent = n
+		return nil
+	}
+}
+
+// WithClock sets the clock timing the idle timeout of a Client, the call and
+// handler timeouts, and the frame deadlines of the streams. It should be the
+// clock of the network the host runs on. Defaults to clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clock = c
+		return nil
+	}
+}
+
+// frameKind is the first byte of every frame.
+type frameKind byte
+
+const (
+	kindRequest frameKind = iota
+	kindResponse
+	kindError
+)
+
+// frameOverhead is the largest size of a frame header.
+const frameOverhead = 1 + 3*varint.MaxLenUvarint63
+
+// frame is a decoded rpc frame. A request carries the remaining time of the
+// call in milliseconds (zero if unbounded); an error carries an error code
+// and message in place of a payload.
+type frame struct {
+	kind    frameKind
+	id      uint64
+	timeout time.Duration
+	code    ErrorCode
+	payload []byte
+}
+
+func (f *frame) encode() []byte {
+	buf := make([]byte, 0, frameOverhead+len(f.payload))
+	buf = append(buf, byte(f.kind))
+	buf = append(buf, varint.ToUvarint(f.id)...)
+	switch f.kind {
+	case kindRequest:
+		buf = append(buf, varint.ToUvarint(uint64(f.timeout/time.Millisecond))...)
+	case kindError:
+		buf = append(buf, varint.ToUvarint(uint64(f.code))...)
+	}
+	return append(buf, f.payload...)
+}
+
+func decodeFrame(b []byte) (*frame, error) {
+	if len(b) == 0 {
+		return nil, errMalformedFrame
+	}
+	f := &frame{kind: frameKind(b[0])}
+	b = b[1:]
+
+	id, n, err := varint.FromUvarint(b)
+	if err != nil {
+		return nil, errMalformedFrame
+	}
+	f.id = id
+	b = b[n:]
+
+	switch f.kind {
+	case kindRequest:
+		ms, n, err := varint.FromUvarint(b)
+		if err != nil {
+			return nil, errMalformedFrame
+		}
+		f.timeout = time.Duration(ms) * time.Millisecond
+		b = b[n:]
+	case kindResponse:
+	case kindError:
+		code, n, err := varint.FromUvarint(b)
+		if err != nil || code > 1<<32-1 {
+			return nil, errMalformedFrame
+		}
+		f.code = ErrorCode(code)
+		b = b[n:]
+	default:
+		return nil, errMalformedFrame
+	}
+	f.payload = b
+	return f, nil
+}
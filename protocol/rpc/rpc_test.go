@@ -0,0 +1,350 @@
+package rpc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/network/memnet"
+	"github.com/libp2p/go-libp2p-core/protocol/rpc"
+
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	corenet "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	blankhost "github.com/libp2p/go-libp2p/p2p/host/blank"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+)
+
+const testProto = protocol.ID("/test/rpc/1.0.0")
+
+type request struct {
+	N     int
+	Delay time.Duration
+}
+
+type response struct {
+	N int
+}
+
+func newRequest() interface{} { return new(request) }
+
+// streamCounter counts the streams opened through a hub.
+type streamCounter struct {
+	opened, closed int64
+}
+
+func (c *streamCounter) trace(ev memnet.Event) {
+	switch ev.Kind {
+	case memnet.StreamOpened:
+		atomic.AddInt64(&c.opened, 1)
+	case memnet.StreamClosed, memnet.StreamReset:
+		atomic.AddInt64(&c.closed, 1)
+	}
+}
+
+func (c *streamCounter) Opened() int64 { return atomic.LoadInt64(&c.opened) }
+func (c *streamCounter) Closed() int64 { return atomic.LoadInt64(&c.closed) }
+
+// setup creates a client and a server host on a memnet hub, and a server
+// serving testProto with fn.
+func setup(t *testing.T, fn rpc.HandlerFunc, opts ...rpc.Option) (client, server *blankhost.BlankHost, streams *streamCounter) {
+	t.Helper()
+	streams = &streamCounter{}
+	hub, err := memnet.NewHub(1, memnet.WithTracer(streams.trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHost := func() *blankhost.BlankHost {
+		sk, _, err := ic.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps, err := pstoremem.NewPeerstore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := hub.AddPeer(sk, ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := blankhost.NewBlankHost(n)
+		t.Cleanup(func() {
+			h.Close()
+			ps.Close()
+		})
+		return h
+	}
+	client, server = newHost(), newHost()
+
+	opts = append([]rpc.Option{rpc.WithCodec(network.JSONCodec)}, opts...)
+	if err := rpc.NewServer(server.Mux()).Handle(testProto, newRequest, fn, opts...); err != nil {
+		t.Fatal(err)
+	}
+	return client, server, streams
+}
+
+func newClient(t *testing.T, h *blankhost.BlankHost, opts ...rpc.Option) *rpc.Client {
+	t.Helper()
+	opts = append([]rpc.Option{rpc.WithCodec(network.JSONCodec)}, opts...)
+	c, err := rpc.NewClient(h, testProto, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func double(ctx context.Context, _ peer.ID, req interface{}) (interface{}, error) {
+	r := req.(*request)
+	if r.Delay > 0 {
+		select {
+		case <-time.After(r.Delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &response{N: 2 * r.N}, nil
+}
+
+func TestCall(t *testing.T) {
+	client, server, _ := setup(t, double)
+	c := newClient(t, client)
+
+	var resp response
+	if err := c.Call(context.Background(), server.ID(), &request{N: 21}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.N != 42 {
+		t.Fatalf("expected 42, got %d", resp.N)
+	}
+}
+
+func TestRequestMultiplexing(t *testing.T) {
+	client, server, streams := setup(t, double)
+	c := newClient(t, client)
+
+	// later calls complete first
+	const calls = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var resp response
+			req := &request{N: i, Delay: time.Duration(calls-i) * 10 * time.Millisecond}
+			if err := c.Call(context.Background(), server.ID(), req, &resp); err != nil {
+				errs <- err
+				return
+			}
+			if resp.N != 2*i {
+				errs <- fmt.Errorf("call %d: expected %d, got %d", i, 2*i, resp.N)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := streams.Opened(); n != 1 {
+		t.Fatalf("expected the calls to share a single stream, got %d", n)
+	}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	client, server, _ := setup(t, func(_ context.Context, _ peer.ID, req interface{}) (interface{}, error) {
+		if req.(*request).N == 0 {
+			return nil, rpc.Errorf(rpc.CodeNotFound, "no such thing: %d", 0)
+		}
+		return nil, errors.New("boom")
+	})
+	c := newClient(t, client)
+
+	var resp response
+	err := c.Call(context.Background(), server.ID(), &request{N: 0}, &resp)
+	var rerr *rpc.Error
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected an *rpc.Error, got %v", err)
+	}
+	if rerr.Code != rpc.CodeNotFound || rerr.Message != "no such thing: 0" {
+		t.Fatalf("unexpected error: %+v", rerr)
+	}
+
+	err = c.Call(context.Background(), server.ID(), &request{N: 1}, &resp)
+	if !errors.As(err, &rerr) || rerr.Code != rpc.CodeInternal {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+
+	// the stream survives handler errors
+	if err := c.Call(context.Background(), server.ID(), &request{N: 0}, &resp); !errors.As(err, &rerr) {
+		t.Fatalf("expected an *rpc.Error, got %v", err)
+	}
+}
+
+func TestIdleClose(t *testing.T) {
+	client, server, streams := setup(t, double)
+	clk := clock.NewVirtual(time.Now())
+	c := newClient(t, client, rpc.WithIdleTimeout(time.Minute), rpc.WithClock(clk))
+
+	var resp response
+	if err := c.Call(context.Background(), server.ID(), &request{N: 1}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Minute - time.Nanosecond)
+	if n := streams.Closed(); n != 0 {
+		t.Fatalf("expected the stream to stay open, got %d closed", n)
+	}
+
+	clk.Advance(time.Nanosecond)
+	// both sides of the stream close
+	waitFor(t, func() bool { return streams.Closed() == 2 })
+
+	if err := c.Call(context.Background(), server.ID(), &request{N: 1}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if n := streams.Opened(); n != 2 {
+		t.Fatalf("expected a new stream after the idle close, got %d streams", n)
+	}
+}
+
+func TestHandlerTimeoutOnClock(t *testing.T) {
+	clk := clock.NewVirtual(time.Now())
+	started := make(chan struct{})
+	client, server, _ := setup(t, func(ctx context.Context, _ peer.ID, _ interface{}) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, rpc.WithTimeout(time.Minute), rpc.WithClock(clk))
+	c := newClient(t, client, rpc.WithClock(clk))
+
+	errCh := make(chan error, 1)
+	go func() {
+		var resp response
+		errCh <- c.Call(context.Background(), server.ID(), &request{N: 1}, &resp)
+	}()
+	<-started
+	clk.Advance(time.Minute - time.Nanosecond)
+	select {
+	case err := <-errCh:
+		t.Fatalf("expected the call to run until the timeout, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(time.Nanosecond)
+	var rerr *rpc.Error
+	if err := <-errCh; !errors.As(err, &rerr) || rerr.Code != rpc.CodeDeadlineExceeded {
+		t.Fatalf("expected the handler to time out on the clock, got %v", err)
+	}
+}
+
+func TestRetryOnReset(t *testing.T) {
+	for _, retries := range []int{0, 1} {
+		retries := retries
+		t.Run(fmt.Sprintf("retries=%d", retries), func(t *testing.T) {
+			var calls int64
+			started := make(chan struct{}, 1)
+			client, server, _ := setup(t, func(ctx context.Context, _ peer.ID, req interface{}) (interface{}, error) {
+				if atomic.AddInt64(&calls, 1) == 1 {
+					started <- struct{}{}
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return &response{N: req.(*request).N}, nil
+			})
+			c := newClient(t, client, rpc.WithRetries(retries))
+
+			go func() {
+				<-started
+				for _, conn := range server.Network().ConnsToPeer(client.ID()) {
+					for _, s := range conn.GetStreams() {
+						s.Reset()
+					}
+				}
+			}()
+
+			var resp response
+			err := c.Call(context.Background(), server.ID(), &request{N: 7}, &resp)
+			if retries == 0 {
+				if !errors.Is(err, corenet.ErrReset) {
+					t.Fatalf("expected the call to fail with a reset, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.N != 7 || atomic.LoadInt64(&calls) != 2 {
+				t.Fatalf("expected the call to succeed on the second attempt, got %d after %d calls", resp.N, calls)
+			}
+		})
+	}
+}
+
+func TestCallBlockedWrite(t *testing.T) {
+	client, server, streams := setup(t, double)
+	// the server never reads the requests
+	release := make(chan struct{})
+	server.SetStreamHandler(testProto, func(s corenet.Stream) {
+		<-release
+		s.Reset()
+	})
+	defer close(release)
+	c := newClient(t, client, rpc.WithMaxMessageSize(1<<20))
+	// larger than the receive window of memnet streams
+	big := struct{ Data []byte }{make([]byte, 512<<10)}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	blocked := make(chan error, 1)
+	go func() {
+		var resp response
+		blocked <- c.Call(canceled, server.ID(), big, &resp)
+	}()
+	waitFor(t, func() bool { return streams.Opened() > 0 })
+
+	// a call queued behind the blocked write gives up at its deadline
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelTimeout()
+	var resp response
+	if err := c.Call(ctx, server.ID(), &request{N: 1}, &resp); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the queued call to time out, got %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the blocked call to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the canceled call to return")
+	}
+	// the stream is reset, as the frame was only partially written
+	waitFor(t, func() bool { return streams.Closed() > 0 })
+
+	// a write blocked past the deadline of its call fails too
+	ctx, cancelTimeout = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelTimeout()
+	if err := c.Call(ctx, server.ID(), big, &resp); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the blocked call to time out, got %v", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,210 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+var log = logging.Logger("rpc")
+
+// HandlerFunc serves a single request. req is the value returned by the
+// handler's request constructor, decoded from the request. The returned
+// response is encoded and sent to the caller, unless err is not nil. The
+// context is done when the deadline of the call passes, or when the stream
+// is reset.
+type HandlerFunc func(ctx context.Context, from peer.ID, req interface{}) (resp interface{}, err error)
+
+// Server serves RPC protocols through a protocol.Switch, such as the Mux of
+// a host.Host.
+type Server struct {
+	sw protocol.Switch
+
+	mu       sync.Mutex
+	handlers map[protocol.ID]*handler
+}
+
+type handler struct {
+	pid    protocol.ID
+	newReq func() interface{}
+	fn     HandlerFunc
+	cfg    config
+}
+
+// NewServer creates a Server registering its handlers on sw.
+func NewServer(sw protocol.Switch) *Server {
+	return &Server{sw: sw, handlers: make(map[protocol.ID]*handler)}
+}
+
+// Handle registers fn as the handler of pid. newReq must return a pointer to
+// a fresh request value for every call, into which requests are decoded.
+func (s *Server) Handle(pid protocol.ID, newReq func() interface{}, fn HandlerFunc, opts ...Option) error {
+	if newReq == nil || fn == nil {
+		return errors.New("rpc handler and request constructor must not be nil")
+	}
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	h := &handler{pid: pid, newReq: newReq, fn: fn, cfg: cfg}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.handlers[pid]; ok {
+		return fmt.Errorf("rpc handler for %s already registered", pid)
+	}
+	s.handlers[pid] = h
+	s.sw.AddHandler(string(pid), h.serve)
+	return nil
+}
+
+// Remove unregisters the handler of pid. Requests on streams already open
+// are still served.
+func (s *Server) Remove(pid protocol.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.handlers[pid]; !ok {
+		return
+	}
+	delete(s.handlers, pid)
+	s.sw.RemoveHandler(string(pid))
+}
+
+// Protocols returns the protocols served.
+func (s *Server) Protocols() []protocol.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]protocol.ID, 0, len(s.handlers))
+	for pid := range s.handlers {
+		out = append(out, pid)
+	}
+	return out
+}
+
+// serve reads requests from a stream until the client closes it, and handles
+// them concurrently.
+func (h *handler) serve(proto string, rwc io.ReadWriteCloser) error {
+	st, ok := rwc.(network.Stream)
+	if !ok {
+		rwc.Close()
+		return fmt.Errorf("rpc: protocol %s negotiated on a %T, not a stream", proto, rwc)
+	}
+	fs, err := network.NewFramedStream(st, network.WithMaxMessageSize(h.cfg.maxSize+frameOverhead), network.WithMessageClock(h.cfg.clock))
+	if err != nil {
+		st.Reset()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		wmu sync.Mutex
+		wg  sync.WaitGroup
+	)
+	sem := make(chan struct{}, h.cfg.maxConcurrent)
+	write := func(f *frame) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		return fs.WriteMsg(f.encode())
+	}
+
+	for {
+		msg, err := fs.ReadMsg()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			cancel()
+			st.Reset()
+			wg.Wait()
+			return err
+		}
+		f, err := decodeFrame(msg)
+		if err != nil || f.kind != kindRequest {
+			fs.ReleaseMsg(msg)
+			cancel()
+			st.Reset()
+			wg.Wait()
+			return errMalformedFrame
+		}
+		req := h.newReq()
+		err = h.cfg.codec.Unmarshal(f.payload, req)
+		fs.ReleaseMsg(msg)
+		if err != nil {
+			ef := h.errorFrame(f.id, Errorf(CodeInvalidRequest, "cannot decode request: %s", err))
+			if err := write(ef); err != nil {
+				log.Debugf("failed to write rpc error to %s: %s", st.Conn().RemotePeer(), err)
+			}
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id uint64, timeout time.Duration) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := write(h.handle(ctx, st.Conn().RemotePeer(), id, timeout, req)); err != nil {
+				log.Debugf("failed to write rpc response to %s: %s", st.Conn().RemotePeer(), err)
+			}
+		}(f.id, f.timeout)
+	}
+
+	wg.Wait()
+	return st.Close()
+}
+
+func (h *handler) handle(ctx context.Context, from peer.ID, id uint64, timeout time.Duration, req interface{}) *frame {
+	if h.cfg.timeout > 0 && (timeout == 0 || h.cfg.timeout < timeout) {
+		timeout = h.cfg.timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = clock.WithTimeout(ctx, h.cfg.clock, timeout)
+		defer cancel()
+	}
+
+	resp, err := h.fn(ctx, from, req)
+	if err != nil {
+		var rerr *Error
+		switch {
+		case errors.As(err, &rerr):
+		case errors.Is(err, context.DeadlineExceeded):
+			rerr = &Error{Code: CodeDeadlineExceeded, Message: err.Error()}
+		default:
+			rerr = &Error{Code: CodeInternal, Message: err.Error()}
+		}
+		return h.errorFrame(id, rerr)
+	}
+
+	payload, err := h.cfg.codec.Marshal(resp)
+	if err != nil {
+		return h.errorFrame(id, Errorf(CodeInternal, "cannot encode response: %s", err))
+	}
+	if len(payload) > h.cfg.maxSize {
+		return h.errorFrame(id, Errorf(CodeResourceExhausted, "response of %d bytes exceeds the limit of %d", len(payload), h.cfg.maxSize))
+	}
+	return &frame{kind: kindResponse, id: id, payload: payload}
+}
+
+// errorFrame encodes err, truncating its message to the maximum message
+// size.
+func (h *handler) errorFrame(id uint64, err *Error) *frame {
+	msg := err.Message
+	if len(msg) > h.cfg.maxSize {
+		msg = msg[:h.cfg.maxSize]
+	}
+	return &frame{kind: kindError, id: id, code: err.Code, payload: []byte(msg)}
+}
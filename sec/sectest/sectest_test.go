@@ -0,0 +1,22 @@
+package sectest_test
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/sec/sectest"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/sec"
+	"github.com/libp2p/go-libp2p/core/sec/insecure"
+)
+
+func TestInsecure(t *testing.T) {
+	sectest.TestSecureTransport(t, func(key crypto.PrivKey) (sec.SecureTransport, error) {
+		id, err := peer.IDFromPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return insecure.NewWithIdentity(id, key), nil
+	}, sectest.WithoutContextCancellation())
+}
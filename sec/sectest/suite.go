@@ -0,0 +1,604 @@
+// Package sectest is a conformance suite for sec.SecureTransport
+// implementations, to be run from their test files:
+//
+//	func TestConformance(t *testing.T) {
+//		sectest.TestSecureTransport(t, func(key crypto.PrivKey) (sec.SecureTransport, error) {
+//			return New(key)
+//		})
+//	}
+//
+// The handshakes run over TCP loopback connections. Transports ignoring the
+// context of their handshakes, such as insecure.Transport, are tested with
+// the WithoutContextCancellation option.
+package sectest
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/sec"
+)
+
+// testTimeout bounds the duration of every test of the suite: a transport
+// that deadlocks makes the test binary panic rather than hang.
+const testTimeout = 2 * time.Minute
+
+// opTimeout bounds the duration of the handshakes and reads expected to
+// succeed, and the time a failing handshake has to return.
+const opTimeout = 10 * time.Second
+
+// handshakeTimeout is the deadline of the handshakes of peers misbehaving in
+// the middle of it. Once past, the connection is closed, which must end the
+// handshakes.
+const handshakeTimeout = 2 * time.Second
+
+// largePayload is the amount of data sent in each direction by the
+// LargePayload test.
+const largePayload = 16 << 20
+
+// Factory creates the transport under test, for the peer of key.
+type Factory func(key crypto.PrivKey) (sec.SecureTransport, error)
+
+// Option is an option of the suite.
+type Option func(*config)
+
+type config struct {
+	ignoresContext bool
+}
+
+// WithoutContextCancellation accepts transports whose handshakes ignore their
+// context, and only end once complete or once the connection fails, like
+// insecure.Transport. The suite then closes the connections of the cancelled
+// handshakes, as the callers of such transports must.
+func WithoutContextCancellation() Option {
+	return func(c *config) {
+		c.ignoresContext = true
+	}
+}
+
+var tests = []struct {
+	name string
+	f    func(t *testing.T, f Factory, cfg *config)
+}{
+	{"Accessors", testAccessors},
+	{"AnyInboundPeer", testAnyInboundPeer},
+	{"MismatchedOutboundPeer", testMismatchedOutboundPeer},
+	{"MismatchedInboundPeer", testMismatchedInboundPeer},
+	{"ReadWrite", testReadWrite},
+	{"LargePayload", testLargePayload},
+	{"Concurrent", testConcurrent},
+	{"ContextCancel", testContextCancel},
+	{"TruncatedHandshake", testTruncatedHandshake},
+	{"CorruptedHandshake", testCorruptedHandshake},
+}
+
+// TestSecureTransport runs the conformance suite against the transports
+// created by f.
+func TestSecureTransport(t *testing.T, f Factory, opts ...Option) {
+	var cfg config
+	for _, o := range opts {
+		o(&cfg)
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			watchdog := time.AfterFunc(testTimeout, func() {
+				panic(fmt.Sprintf("%s timed out after %s", t.Name(), testTimeout))
+			})
+			defer watchdog.Stop()
+			tc.f(t, f, &cfg)
+		})
+	}
+}
+
+// node is a transport under test, with its identity.
+type node struct {
+	key crypto.PrivKey
+	id  peer.ID
+	tpt sec.SecureTransport
+}
+
+func newNode(t *testing.T, f Factory) *node {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt, err := f(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &node{key: key, id: id, tpt: tpt}
+}
+
+// tcpPair creates a pair of connected TCP loopback connections, closed at the
+// end of the test.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		client.Close()
+		t.Fatal("failed to accept connection")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+type result struct {
+	c   sec.SecureConn
+	err error
+}
+
+// handshake secures cc as an outbound connection of client to p, and sc as
+// an inbound connection of server from inbound, concurrently. The
+// connections are closed once ctx is done, to end the handshakes of
+// transports ignoring it.
+func handshake(ctx context.Context, client, server *node, cc, sc net.Conn, p, inbound peer.ID) (clientRes, serverRes result, err error) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c, err := client.tpt.SecureOutbound(ctx, cc, p)
+		clientRes = result{c, err}
+	}()
+	go func() {
+		defer wg.Done()
+		c, err := server.tpt.SecureInbound(ctx, sc, inbound)
+		serverRes = result{c, err}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return clientRes, serverRes, nil
+	case <-ctx.Done():
+	}
+	cc.Close()
+	sc.Close()
+	select {
+	case <-done:
+		return clientRes, serverRes, nil
+	case <-time.After(opTimeout):
+		return clientRes, serverRes, errors.New("handshake not returning after its connection was closed")
+	}
+}
+
+// connect secures a new connection from client to server, and returns both
+// ends of it.
+func connect(t *testing.T, client, server *node) (sec.SecureConn, sec.SecureConn) {
+	t.Helper()
+	cc, sc := tcpPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	cr, sr, err := handshake(ctx, client, server, cc, sc, server.id, client.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.err != nil {
+		t.Fatalf("outbound handshake failed: %s", cr.err)
+	}
+	if sr.err != nil {
+		t.Fatalf("inbound handshake failed: %s", sr.err)
+	}
+	return cr.c, sr.c
+}
+
+func checkAccessors(t *testing.T, side string, c sec.SecureConn, local, remote *node) {
+	t.Helper()
+	if c.LocalPeer() != local.id {
+		t.Errorf("%s connection: local peer is %s, expected %s", side, c.LocalPeer(), local.id)
+	}
+	if k := c.LocalPrivateKey(); k == nil || !k.Equals(local.key) {
+		t.Errorf("%s connection: wrong local private key", side)
+	}
+	if c.RemotePeer() != remote.id {
+		t.Errorf("%s connection: remote peer is %s, expected %s", side, c.RemotePeer(), remote.id)
+	}
+	if k := c.RemotePublicKey(); k == nil || !k.Equals(remote.key.GetPublic()) {
+		t.Errorf("%s connection: wrong remote public key", side)
+	}
+}
+
+func testAccessors(t *testing.T, f Factory, cfg *config) {
+	client, server := newNode(t, f), newNode(t, f)
+	cc, sc := connect(t, client, server)
+	checkAccessors(t, "outbound", cc, client, server)
+	checkAccessors(t, "inbound", sc, server, client)
+}
+
+// testAnyInboundPeer checks that inbound connections expecting no peer in
+// particular are secured, and authenticate the remote.
+func testAnyInboundPeer(t *testing.T, f Factory, cfg *config) {
+	client, server := newNode(t, f), newNode(t, f)
+	cc, sc := tcpPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	cr, sr, err := handshake(ctx, client, server, cc, sc, server.id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.err != nil || sr.err != nil {
+		t.Fatalf("handshake failed: outbound: %v, inbound: %v", cr.err, sr.err)
+	}
+	checkAccessors(t, "outbound", cr.c, client, server)
+	checkAccessors(t, "inbound", sr.c, server, client)
+}
+
+func testMismatchedOutboundPeer(t *testing.T, f Factory, cfg *config) {
+	client, server, other := newNode(t, f), newNode(t, f), newNode(t, f)
+	cc, sc := tcpPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	cr, _, err := handshake(ctx, client, server, cc, sc, other.id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.err == nil {
+		t.Fatalf("outbound connection to %s secured with %s", other.id, cr.c.RemotePeer())
+	}
+}
+
+func testMismatchedInboundPeer(t *testing.T, f Factory, cfg *config) {
+	client, server, other := newNode(t, f), newNode(t, f), newNode(t, f)
+	cc, sc := tcpPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	_, sr, err := handshake(ctx, client, server, cc, sc, server.id, other.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr.err == nil {
+		t.Fatalf("inbound connection from %s secured with %s", other.id, sr.c.RemotePeer())
+	}
+}
+
+// testReadWrite exchanges messages of various sizes in both directions, and
+// checks that closing a connection ends the reads of the remote.
+func testReadWrite(t *testing.T, f Factory, cfg *config) {
+	client, server := newNode(t, f), newNode(t, f)
+	cc, sc := connect(t, client, server)
+
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int{1, 100, 1 << 10, 64 << 10, 100<<10 + 1} {
+		for _, dir := range []struct {
+			name     string
+			src, dst sec.SecureConn
+		}{
+			{"outbound", cc, sc},
+			{"inbound", sc, cc},
+		} {
+			msg := make([]byte, size)
+			rng.Read(msg)
+			if err := transfer(dir.src, dir.dst, msg); err != nil {
+				t.Fatalf("%s message of %d bytes: %s", dir.name, size, err)
+			}
+		}
+	}
+
+	if err := cc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sc.SetReadDeadline(time.Now().Add(opTimeout))
+	if _, err := io.ReadAll(sc); err != nil {
+		t.Fatalf("read not ended by the closing of the remote: %s", err)
+	}
+}
+
+// transfer writes msg on src, and checks that it is read from dst.
+func transfer(src, dst sec.SecureConn, msg []byte) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := src.Write(msg)
+		errc <- err
+	}()
+	dst.SetReadDeadline(time.Now().Add(opTimeout))
+	defer dst.SetReadDeadline(time.Time{})
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(dst, buf); err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	if err := <-errc; err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		return errors.New("read data differs from the written data")
+	}
+	return nil
+}
+
+// testLargePayload sends a large payload in both directions at once, in
+// writes larger than any record or frame size.
+func testLargePayload(t *testing.T, f Factory, cfg *config) {
+	client, server := newNode(t, f), newNode(t, f)
+	cc, sc := connect(t, client, server)
+
+	out := make([]byte, largePayload)
+	in := make([]byte, largePayload)
+	rand.New(rand.NewSource(2)).Read(out)
+	rand.New(rand.NewSource(3)).Read(in)
+
+	errs := make(chan error, 2)
+	go func() { errs <- transfer(cc, sc, out) }()
+	go func() { errs <- transfer(sc, cc, in) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testConcurrent runs handshakes and transfers concurrently on the same
+// transports.
+func testConcurrent(t *testing.T, f Factory, cfg *config) {
+	const conns = 32
+	client, server := newNode(t, f), newNode(t, f)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		cc, sc := tcpPair(t)
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+			defer cancel()
+			cr, sr, err := handshake(ctx, client, server, cc, sc, server.id, client.id)
+			switch {
+			case err != nil:
+				errs <- err
+				return
+			case cr.err != nil:
+				errs <- fmt.Errorf("outbound handshake failed: %w", cr.err)
+				return
+			case sr.err != nil:
+				errs <- fmt.Errorf("inbound handshake failed: %w", sr.err)
+				return
+			case cr.c.RemotePeer() != server.id || sr.c.RemotePeer() != client.id:
+				errs <- errors.New("connection secured with the wrong peer")
+				return
+			}
+			msg := make([]byte, 64<<10)
+			rand.New(rand.NewSource(seed)).Read(msg)
+			if err := transfer(cr.c, sr.c, msg); err != nil {
+				errs <- err
+				return
+			}
+			if err := transfer(sr.c, cr.c, msg); err != nil {
+				errs <- err
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// testContextCancel cancels handshakes with a remote not answering, in both
+// roles. The handshakes must fail once cancelled, or, if the transport ignores
+// its context, once the connection is closed.
+func testContextCancel(t *testing.T, f Factory, cfg *config) {
+	for _, role := range []string{"outbound", "inbound"} {
+		t.Run(role, func(t *testing.T) {
+			n, remote := newNode(t, f), newNode(t, f)
+			c, silent := tcpPair(t)
+			go io.Copy(io.Discard, silent)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			res := make(chan result, 1)
+			go func() {
+				var sc sec.SecureConn
+				var err error
+				if role == "outbound" {
+					sc, err = n.tpt.SecureOutbound(ctx, c, remote.id)
+				} else {
+					sc, err = n.tpt.SecureInbound(ctx, c, remote.id)
+				}
+				res <- result{sc, err}
+			}()
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+			if cfg.ignoresContext {
+				c.Close()
+			}
+
+			select {
+			case r := <-res:
+				if r.err == nil {
+					t.Fatal("cancelled handshake with a silent remote succeeded")
+				}
+			case <-time.After(opTimeout):
+				c.Close()
+				t.Fatal("handshake not returning after its context was cancelled")
+			}
+		})
+	}
+}
+
+// relay forwards the bytes of src to dst, counting them in n. Past limit
+// bytes, it closes both connections instead. The byte at offset corrupt is
+// inverted. Negative limit and corrupt disable truncation and corruption.
+func relay(dst, src net.Conn, n *int64, mu *sync.Mutex, limit, corrupt int64) {
+	buf := make([]byte, 4096)
+	for {
+		k, err := src.Read(buf)
+		if k > 0 {
+			b := buf[:k]
+			mu.Lock()
+			off := *n
+			mu.Unlock()
+			if corrupt >= off && corrupt < off+int64(k) {
+				b[corrupt-off] ^= 0xff
+			}
+			truncated := limit >= 0 && off+int64(k) > limit
+			if truncated {
+				b = b[:limit-off]
+			}
+			// counted before written, so that the count is complete once
+			// the handshakes return
+			mu.Lock()
+			*n += int64(len(b))
+			mu.Unlock()
+			if _, err := dst.Write(b); err != nil {
+				break
+			}
+			if truncated {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	dst.Close()
+	src.Close()
+}
+
+// tamper is a misbehaviour of a relay, in one direction of a handshake.
+type tamper struct {
+	outbound       bool // tampering the bytes sent by the outbound side
+	limit, corrupt int64
+}
+
+// relayedHandshake runs a handshake relayed by the suite, tampered with by
+// tp, and returns its results and the numbers of bytes relayed in each
+// direction.
+func relayedHandshake(t *testing.T, client, server *node, tp tamper) (cr, sr result, sent, received int64) {
+	t.Helper()
+	cc, clientRelay := tcpPair(t)
+	serverRelay, sc := tcpPair(t)
+
+	var (
+		mu      sync.Mutex
+		out, in int64
+	)
+	outLimit, outCorrupt, inLimit, inCorrupt := int64(-1), int64(-1), int64(-1), int64(-1)
+	if tp.outbound {
+		outLimit, outCorrupt = tp.limit, tp.corrupt
+	} else {
+		inLimit, inCorrupt = tp.limit, tp.corrupt
+	}
+	go relay(serverRelay, clientRelay, &out, &mu, outLimit, outCorrupt)
+	go relay(clientRelay, serverRelay, &in, &mu, inLimit, inCorrupt)
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	cr, sr, err := handshake(ctx, client, server, cc, sc, server.id, client.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return cr, sr, out, in
+}
+
+// handshakeSize returns the numbers of bytes sent by the outbound side and the
+// inbound side of an untampered handshake.
+func handshakeSize(t *testing.T, client, server *node) (sent, received int64) {
+	t.Helper()
+	cr, sr, sent, received := relayedHandshake(t, client, server, tamper{limit: -1, corrupt: -1})
+	if cr.err != nil || sr.err != nil {
+		t.Fatalf("relayed handshake failed: outbound: %v, inbound: %v", cr.err, sr.err)
+	}
+	if sent == 0 && received == 0 {
+		t.Skip("transport exchanges no handshake")
+	}
+	return sent, received
+}
+
+// tamperCases returns the tampering of the handshakes of the Truncated and
+// Corrupted tests: at the start, the second byte and the middle of the bytes
+// sent by each side.
+func tamperCases(sent, received int64) []tamper {
+	var cases []tamper
+	for _, side := range []struct {
+		outbound bool
+		size     int64
+	}{
+		{true, sent},
+		{false, received},
+	} {
+		for _, off := range []int64{0, 1, side.size / 2} {
+			if off < side.size {
+				cases = append(cases, tamper{outbound: side.outbound, limit: off, corrupt: off})
+			}
+		}
+	}
+	return cases
+}
+
+// testTruncatedHandshake ends handshakes in the middle of the bytes sent by
+// either side. The other side must fail.
+func testTruncatedHandshake(t *testing.T, f Factory, cfg *config) {
+	client, server := newNode(t, f), newNode(t, f)
+	sent, received := handshakeSize(t, client, server)
+	for _, tc := range tamperCases(sent, received) {
+		tc.corrupt = -1
+		cr, sr, _, _ := relayedHandshake(t, client, server, tc)
+		if tc.outbound && sr.err == nil {
+			t.Errorf("inbound handshake succeeded with the outbound side truncated after %d of %d bytes", tc.limit, sent)
+		}
+		if !tc.outbound && cr.err == nil {
+			t.Errorf("outbound handshake succeeded with the inbound side truncated after %d of %d bytes", tc.limit, received)
+		}
+	}
+}
+
+// testCorruptedHandshake inverts a byte sent by either side of handshakes.
+// The other side must fail.
+func testCorruptedHandshake(t *testing.T, f Factory, cfg *config) {
+	client, server := newNode(t, f), newNode(t, f)
+	sent, received := handshakeSize(t, client, server)
+	for _, tc := range tamperCases(sent, received) {
+		tc.limit = -1
+		cr, sr, _, _ := relayedHandshake(t, client, server, tc)
+		if tc.outbound && sr.err == nil {
+			t.Errorf("inbound handshake succeeded with byte %d of %d sent by the outbound side corrupted", tc.corrupt, sent)
+		}
+		if !tc.outbound && cr.err == nil {
+			t.Errorf("outbound handshake succeeded with byte %d of %d sent by the inbound side corrupted", tc.corrupt, received)
+		}
+	}
+}
@@ -4,6 +4,9 @@
 package sec
 
 import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/sec"
 )
 
@@ -20,3 +23,14 @@ type SecureTransport = sec.SecureTransport
 // and open outbound connections with simultaneous open.
 // Deprecated: use github.com/libp2p/go-libp2p/core/sec.SecureMuxer instead
 type SecureMuxer = sec.SecureMuxer
+
+// ErrPeerIDMismatch is returned by a security handshake when the remote peer
+// authenticated as a different peer than the one dialed.
+type ErrPeerIDMismatch struct {
+	Expected peer.ID
+	Actual   peer.ID
+}
+
+func (e ErrPeerIDMismatch) Error() string {
+	return fmt.Sprintf("peer id mismatch: expected %s, but remote key matches %s", e.Expected, e.Actual)
+}
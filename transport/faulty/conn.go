@@ -0,0 +1,385 @@
+package faulty
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/transport"
+)
+
+// fault is a fault triggered by the amount of data transferred on a
+// connection.
+type fault int
+
+const (
+	noFault fault = iota
+	resetFault
+	hangFault
+)
+
+type conn struct {
+	transport.CapableConn
+	t      *Transport
+	faults Faults
+	// dup is the duplicate connection established by the dial, if any.
+	dup transport.CapableConn
+
+	// hung is closed once the connection hangs, and closed once the
+	// connection is closed.
+	hung      chan struct{}
+	hangOnce  sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	bytes   int64
+	isReset bool
+	streams map[*stream]struct{}
+}
+
+var _ transport.CapableConn = (*conn)(nil)
+
+func newConn(t *Transport, c, dup transport.CapableConn, f Faults, rng *rand.Rand) *conn {
+	fc := &conn{
+		CapableConn: c,
+		t:           t,
+		faults:      f,
+		dup:         dup,
+		hung:        make(chan struct{}),
+		closed:      make(chan struct{}),
+		rng:         rng,
+		streams:     make(map[*stream]struct{}),
+	}
+	t.track(fc)
+	return fc
+}
+
+func (c *conn) OpenStream(ctx context.Context) (network.MuxedStream, error) {
+	if c.wasReset() {
+		return nil, network.ErrReset
+	}
+	s, err := c.CapableConn.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(s), nil
+}
+
+func (c *conn) AcceptStream() (network.MuxedStream, error) {
+	s, err := c.CapableConn.AcceptStream()
+	if err != nil {
+		if c.wasReset() {
+			return nil, network.ErrReset
+		}
+		return nil, err
+	}
+	return c.wrap(s), nil
+}
+
+func (c *conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.t.untrack(c)
+		if c.dup != nil {
+			c.dup.Close()
+		}
+		err = c.CapableConn.Close()
+	})
+	return err
+}
+
+func (c *conn) Transport() transport.Transport {
+	return c.t
+}
+
+func (c *conn) wrap(s network.MuxedStream) *stream {
+	fs := &stream{
+		MuxedStream:     s,
+		c:               c,
+		deadlineChanged: make(chan struct{}),
+		readClosed:      make(chan struct{}),
+		closed:          make(chan struct{}),
+	}
+	c.mu.Lock()
+	c.streams[fs] = struct{}{}
+	c.mu.Unlock()
+	return fs
+}
+
+func (c *conn) untrack(s *stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streams, s)
+}
+
+// reset resets all the streams of the connection, and closes it.
+func (c *conn) reset() {
+	c.mu.Lock()
+	if c.isReset {
+		c.mu.Unlock()
+		return
+	}
+	c.isReset = true
+	streams := make([]*stream, 0, len(c.streams))
+	for s := range c.streams {
+		streams = append(streams, s)
+	}
+	c.mu.Unlock()
+
+	for _, s := range streams {
+		s.MuxedStream.Reset()
+	}
+	c.Close()
+}
+
+func (c *conn) wasReset() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.isReset
+}
+
+func (c *conn) hang() {
+	c.hangOnce.Do(func() { close(c.hung) })
+}
+
+func (c *conn) isHung() bool {
+	select {
+	case <-c.hung:
+		return true
+	default:
+		return false
+	}
+}
+
+// delay returns d with the jitter of the connection.
+func (c *conn) delay(d time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.faults.jitter(d, c.rng)
+}
+
+// transfer accounts n bytes transferred on the connection. It returns how
+// many of them go through before a fault triggers, and the fault.
+func (c *conn) transfer(n int) (int, fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	before := c.bytes
+	c.bytes += int64(n)
+
+	allowed, f := n, noFault
+	if r := c.faults.ResetAfter; r > before && r <= c.bytes {
+		allowed, f = int(r-before), resetFault
+	}
+	if h := c.faults.HangAfter; h > before && h <= c.bytes && (f == noFault || int(h-before) < allowed) {
+		allowed, f = int(h-before), hangFault
+	}
+	return allowed, f
+}
+
+type stream struct {
+	network.MuxedStream
+	c *conn
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// deadlineChanged is closed, and replaced, whenever a deadline is set.
+	deadlineChanged chan struct{}
+
+	readClosed    chan struct{}
+	readCloseOnce sync.Once
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+// wait waits for d, or forever if d is negative. It returns early with an
+// error once the deadline of the reads or writes passes, or the stream or the
+// connection is closed.
+func (s *stream) wait(d time.Duration, write bool) error {
+	clk := s.c.t.clk
+	var end time.Time
+	if d >= 0 {
+		end = clk.Now().Add(d)
+	}
+	var readClosed <-chan struct{}
+	if !write {
+		readClosed = s.readClosed
+	}
+	for {
+		s.mu.Lock()
+		deadline, changed := s.readDeadline, s.deadlineChanged
+		if write {
+			deadline = s.writeDeadline
+		}
+		s.mu.Unlock()
+
+		var timers []clock.Timer
+		var endC, deadlineC <-chan time.Time
+		if !end.IsZero() {
+			remaining := clk.Until(end)
+			if remaining <= 0 {
+				return nil
+			}
+			t := clk.NewTimer(remaining)
+			timers = append(timers, t)
+			endC = t.C()
+		}
+		if !deadline.IsZero() {
+			remaining := clk.Until(deadline)
+			if remaining <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			t := clk.NewTimer(remaining)
+			timers = append(timers, t)
+			deadlineC = t.C()
+		}
+
+		var err error
+		again := false
+		select {
+		case <-endC:
+		case <-deadlineC:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			again = true
+		case <-readClosed:
+			err = net.ErrClosed
+		case <-s.closed:
+			err = net.ErrClosed
+		case <-s.c.closed:
+			err = net.ErrClosed
+			if s.c.wasReset() {
+				err = network.ErrReset
+			}
+		}
+		for _, t := range timers {
+			t.Stop()
+		}
+		if !again {
+			return err
+		}
+	}
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	c := s.c
+	if c.wasReset() {
+		return 0, network.ErrReset
+	}
+	if c.isHung() {
+		return 0, s.wait(-1, false)
+	}
+	if c.faults.ReadDelay > 0 {
+		if err := s.wait(c.faults.ReadDelay, false); err != nil {
+			return 0, err
+		}
+	}
+	if m := c.faults.MaxReadSize; m > 0 && len(b) > m {
+		b = b[:m]
+	}
+	n, err := s.MuxedStream.Read(b)
+	if c.isHung() {
+		// the data received by a hung connection is lost
+		return 0, s.wait(-1, false)
+	}
+	allowed, f := c.transfer(n)
+	switch f {
+	case resetFault:
+		c.reset()
+		if allowed == 0 {
+			return 0, network.ErrReset
+		}
+		return allowed, nil
+	case hangFault:
+		c.hang()
+		if allowed == 0 {
+			return 0, s.wait(-1, false)
+		}
+		return allowed, nil
+	}
+	return n, err
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	c := s.c
+	if c.wasReset() {
+		return 0, network.ErrReset
+	}
+	if c.isHung() {
+		return len(b), nil
+	}
+	if d := c.delay(c.faults.Latency); d > 0 {
+		if err := s.wait(d, true); err != nil {
+			return 0, err
+		}
+	}
+	allowed, f := c.transfer(len(b))
+	n, err := s.MuxedStream.Write(b[:allowed])
+	if err != nil {
+		return n, err
+	}
+	switch f {
+	case resetFault:
+		c.reset()
+		return n, network.ErrReset
+	case hangFault:
+		c.hang()
+		return len(b), nil
+	}
+	return n, nil
+}
+
+func (s *stream) CloseRead() error {
+	s.readCloseOnce.Do(func() { close(s.readClosed) })
+	return s.MuxedStream.CloseRead()
+}
+
+func (s *stream) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.c.untrack(s)
+	return s.MuxedStream.Close()
+}
+
+func (s *stream) Reset() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.c.untrack(s)
+	return s.MuxedStream.Reset()
+}
+
+// setDeadlines records the deadlines for the waits, and wakes them up.
+func (s *stream) setDeadlines(read, write bool, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if read {
+		s.readDeadline = t
+	}
+	if write {
+		s.writeDeadline = t
+	}
+	close(s.deadlineChanged)
+	s.deadlineChanged = make(chan struct{})
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.setDeadlines(true, true, t)
+	return s.MuxedStream.SetDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.setDeadlines(true, false, t)
+	return s.MuxedStream.SetReadDeadline(t)
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.setDeadlines(false, true, t)
+	return s.MuxedStream.SetWriteDeadline(t)
+}
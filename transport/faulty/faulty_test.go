@@ -0,0 +1,397 @@
+package faulty_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+	"github.com/libp2p/go-libp2p-core/transport/faulty"
+	"github.com/libp2p/go-libp2p-core/transport/memory"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/sec/insecure"
+	"github.com/libp2p/go-libp2p/core/transport"
+	"github.com/libp2p/go-libp2p/p2p/muxer/mplex"
+	csms "github.com/libp2p/go-libp2p/p2p/net/conn-security-multistream"
+	"github.com/libp2p/go-libp2p/p2p/net/upgrader"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var start = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// newMemoryTransport creates an in-memory transport for a new peer, with
+// plaintext security and mplex.
+func newMemoryTransport(t *testing.T) (*memory.Transport, peer.ID) {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sm csms.SSMuxer
+	sm.AddTransport(insecure.ID, insecure.NewWithIdentity(id, key))
+	u, err := upgrader.New(&sm, mplex.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt, err := memory.New(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tpt, id
+}
+
+// server is a peer listening on an in-memory address, without faults.
+type server struct {
+	id       peer.ID
+	addr     ma.Multiaddr
+	accepted chan transport.CapableConn
+}
+
+// newServer listens on a new in-memory address, and accepts connections in
+// the background. The accepted connections are closed at the end of the test.
+func newServer(t *testing.T) *server {
+	t.Helper()
+	tpt, id := newMemoryTransport(t)
+	l, err := tpt.Listen(ma.StringCast("/memory/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{id: id, addr: l.Multiaddr(), accepted: make(chan transport.CapableConn, 100)}
+	done := make(chan struct{})
+	var conns []transport.CapableConn
+	go func() {
+		defer close(done)
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+			s.accepted <- c
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return s
+}
+
+// newFaulty creates a fault-injecting transport for a new peer, timed by a
+// virtual clock.
+func newFaulty(t *testing.T, seed int64) (*faulty.Transport, *clock.Virtual) {
+	t.Helper()
+	tpt, _ := newMemoryTransport(t)
+	clk := clock.NewVirtual(start)
+	ft, err := faulty.New(tpt, seed, faulty.WithClock(clk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ft, clk
+}
+
+func dial(t *testing.T, ft *faulty.Transport, s *server) transport.CapableConn {
+	t.Helper()
+	c, err := ft.Dial(context.Background(), s.addr, s.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// streamPair dials s, and opens a stream to it. It returns the stream of the
+// dialer, and the stream accepted by s.
+func streamPair(t *testing.T, ft *faulty.Transport, s *server) (network.MuxedStream, network.MuxedStream, transport.CapableConn) {
+	t.Helper()
+	c := dial(t, ft, s)
+	cs, err := c.OpenStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := <-s.accepted
+	ss, err := sc.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs, ss, c
+}
+
+// pending returns the deadline of the next timer of clk, waiting for one to
+// be scheduled.
+func pending(t *testing.T, clk *clock.Virtual) time.Time {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if at, ok := clk.Next(); ok {
+			return at
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type result struct {
+	n   int
+	err error
+}
+
+func run(f func() (int, error)) <-chan result {
+	ch := make(chan result, 1)
+	go func() {
+		n, err := f()
+		ch <- result{n, err}
+	}()
+	return ch
+}
+
+func requireBlocked(t *testing.T, ch <-chan result) {
+	t.Helper()
+	select {
+	case r := <-ch:
+		t.Fatalf("expected the operation to wait, returned %d: %v", r.n, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDialFailure(t *testing.T) {
+	s := newServer(t)
+	other := newServer(t)
+	ft, _ := newFaulty(t, 1)
+
+	// the dials to the failing addresses fail, the others go through
+	ft.SetFaults(s.id, faulty.Faults{FailAddrs: []ma.Multiaddr{s.addr}})
+	if _, err := ft.Dial(context.Background(), s.addr, s.id); !errors.Is(err, faulty.ErrDialFailure) {
+		t.Fatalf("expected the dial to fail, got %v", err)
+	}
+	dial(t, ft, other)
+
+	// the probability applies to all the addresses
+	ft.SetFaults(other.id, faulty.Faults{DialFailure: 1})
+	if _, err := ft.Dial(context.Background(), other.addr, other.id); !errors.Is(err, faulty.ErrDialFailure) {
+		t.Fatalf("expected the dial to fail, got %v", err)
+	}
+
+	ft.ClearFaults(s.id)
+	dial(t, ft, s)
+}
+
+func TestDialLatency(t *testing.T) {
+	s := newServer(t)
+	ft, clk := newFaulty(t, 1)
+	ft.SetFaults(s.id, faulty.Faults{DialLatency: time.Second})
+
+	ch := run(func() (int, error) {
+		c, err := ft.Dial(context.Background(), s.addr, s.id)
+		if err == nil {
+			c.Close()
+		}
+		return 0, err
+	})
+	if at := pending(t, clk); !at.Equal(start.Add(time.Second)) {
+		t.Fatalf("expected the dial to wait until %s, waits until %s", start.Add(time.Second), at)
+	}
+	requireBlocked(t, ch)
+	clk.Advance(time.Second)
+	if r := <-ch; r.err != nil {
+		t.Fatal(r.err)
+	}
+}
+
+func TestDuplicateDial(t *testing.T) {
+	s := newServer(t)
+	ft, _ := newFaulty(t, 1)
+	ft.SetFaults(s.id, faulty.Faults{DuplicateDial: 1})
+
+	c := dial(t, ft, s)
+	accepted := []transport.CapableConn{<-s.accepted, <-s.accepted}
+	for _, a := range accepted {
+		if a.RemotePeer() != c.LocalPeer() {
+			t.Fatalf("expected both connections to come from %s, got %s", c.LocalPeer(), a.RemotePeer())
+		}
+	}
+
+	// the duplicate is closed along with the returned connection
+	c.Close()
+	for _, a := range accepted {
+		if _, err := a.AcceptStream(); err == nil {
+			t.Fatal("expected the accepted connections to be closed")
+		}
+	}
+
+	ft.ClearFaults(s.id)
+	dial(t, ft, s)
+	<-s.accepted
+	select {
+	case <-s.accepted:
+		t.Fatal("expected a single connection without the fault")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := newServer(t)
+	ft, clk := newFaulty(t, 1)
+	ft.SetFaults(s.id, faulty.Faults{Latency: time.Second})
+	cs, ss, _ := streamPair(t, ft, s)
+
+	ch := run(func() (int, error) { return cs.Write([]byte("hello")) })
+	if at := pending(t, clk); !at.Equal(start.Add(time.Second)) {
+		t.Fatalf("expected the write to wait until %s, waits until %s", start.Add(time.Second), at)
+	}
+	requireBlocked(t, ch)
+	clk.Advance(time.Second)
+	if r := <-ch; r.err != nil || r.n != 5 {
+		t.Fatalf("expected to write 5 bytes, wrote %d: %v", r.n, r.err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ss, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected to receive hello, got %q: %v", buf, err)
+	}
+}
+
+func TestSlowReads(t *testing.T) {
+	s := newServer(t)
+	ft, clk := newFaulty(t, 1)
+	ft.SetFaults(s.id, faulty.Faults{ReadDelay: time.Second, MaxReadSize: 3})
+	cs, ss, _ := streamPair(t, ft, s)
+
+	if _, err := ss.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	var received []byte
+	for len(received) < 10 {
+		ch := run(func() (int, error) { return cs.Read(buf) })
+		if at := pending(t, clk); !at.Equal(clk.Now().Add(time.Second)) {
+			t.Fatalf("expected the read to wait for 1s, waits until %s", at)
+		}
+		requireBlocked(t, ch)
+		clk.Advance(time.Second)
+		r := <-ch
+		if r.err != nil || r.n > 3 {
+			t.Fatalf("expected to read up to 3 bytes, read %d: %v", r.n, r.err)
+		}
+		received = append(received, buf[:r.n]...)
+	}
+	if string(received) != "0123456789" {
+		t.Fatalf("expected to receive the data in order, got %q", received)
+	}
+}
+
+func TestResetAfter(t *testing.T) {
+	s := newServer(t)
+	ft, _ := newFaulty(t, 1)
+	ft.SetFaults(s.id, faulty.Faults{ResetAfter: 10})
+	cs, ss, c := streamPair(t, ft, s)
+
+	// the bytes up to the limit go through, then the connection is reset
+	n, err := cs.Write(make([]byte, 15))
+	if n != 10 || !errors.Is(err, network.ErrReset) {
+		t.Fatalf("expected to write 10 bytes and be reset, wrote %d: %v", n, err)
+	}
+	// the remote may drop the data it did not read before the reset
+	ss.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(ss)
+	if len(b) > 10 || !errors.Is(err, network.ErrReset) {
+		t.Fatalf("expected the stream to be reset after at most 10 bytes, got %d: %v", len(b), err)
+	}
+
+	if _, err := cs.Write([]byte{0}); !errors.Is(err, network.ErrReset) {
+		t.Fatalf("expected the stream to be reset, got %v", err)
+	}
+	if _, err := c.OpenStream(context.Background()); !errors.Is(err, network.ErrReset) {
+		t.Fatalf("expected the connection to be reset, got %v", err)
+	}
+	if !c.IsClosed() {
+		t.Fatal("expected the reset connection to be closed")
+	}
+}
+
+func TestHangAfter(t *testing.T) {
+	s := newServer(t)
+	ft, clk := newFaulty(t, 1)
+	ft.SetFaults(s.id, faulty.Faults{HangAfter: 5})
+	cs, ss, c := streamPair(t, ft, s)
+
+	// the writes past the limit are silently dropped
+	if n, err := cs.Write([]byte("0123456789")); n != 10 || err != nil {
+		t.Fatalf("expected the write to succeed, wrote %d: %v", n, err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(ss, buf[:5]); err != nil || string(buf[:5]) != "01234" {
+		t.Fatalf("expected to receive the first 5 bytes, got %q: %v", buf[:5], err)
+	}
+	ss.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := ss.Read(buf); !os.IsTimeout(err) {
+		t.Fatalf("expected nothing more to be received, got %d bytes: %v", n, err)
+	}
+
+	// reads block until their deadline, although the remote writes
+	if _, err := ss.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	cs.SetReadDeadline(start.Add(time.Second))
+	ch := run(func() (int, error) { return cs.Read(buf) })
+	pending(t, clk)
+	requireBlocked(t, ch)
+	clk.Advance(time.Second)
+	if r := <-ch; r.n != 0 || !errors.Is(r.err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read to time out, read %d: %v", r.n, r.err)
+	}
+	if c.IsClosed() {
+		t.Fatal("expected the hung connection to stay open")
+	}
+}
+
+// dialOutcomes dials s n times with ft, and returns which dials failed.
+func dialOutcomes(t *testing.T, ft *faulty.Transport, s *server, n int) string {
+	t.Helper()
+	outcomes := make([]byte, n)
+	for i := range outcomes {
+		c, err := ft.Dial(context.Background(), s.addr, s.id)
+		switch {
+		case errors.Is(err, faulty.ErrDialFailure):
+			outcomes[i] = 'x'
+		case err != nil:
+			t.Fatal(err)
+		default:
+			outcomes[i] = '.'
+			c.Close()
+		}
+	}
+	return string(outcomes)
+}
+
+func TestSeedReproducible(t *testing.T) {
+	s := newServer(t)
+	outcomes := func(seed int64) string {
+		ft, _ := newFaulty(t, seed)
+		ft.SetFaults(s.id, faulty.Faults{DialFailure: 0.5})
+		return dialOutcomes(t, ft, s, 32)
+	}
+	first, second, other := outcomes(1), outcomes(1), outcomes(2)
+	if first != second {
+		t.Fatalf("expected the same seed to fail the same dials, got\n%s\n%s", first, second)
+	}
+	if first == other {
+		t.Fatalf("expected another seed to fail other dials, got %s for both", first)
+	}
+}
@@ -0,0 +1,326 @@
+// Package faulty wraps a transport.Transport to inject faults into its dials,
+// listeners and connections, for testing how protocols behave on unreliable
+// networks: failing dials, latency, duplicated dials, connections reset or
+// hanging half-open in the middle of a transfer, and slow readers.
+//
+// Faults are set per remote peer, and can be changed at runtime; connections
+// keep the faults set when they were established. ResetConns and HangConns
+// inject faults into live connections.
+//
+// The random faults are reproducible: every connection draws them from its
+// own source, seeded from the seed of the Transport, the remote peer, the
+// direction of the connection and the number of connections in that
+// direction with the peer before it. The same sequence of dials and accepts
+// thus always draws the same faults, however the goroutines interleave.
+package faulty
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/clock"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrDialFailure is returned by the dials failed on purpose.
+var ErrDialFailure = errors.New("injected dial failure")
+
+// Faults describes the faults injected into the dials of, and connections
+// with, a peer. The zero value injects no fault.
+type Faults struct {
+	// DialFailure is the probability that a dial fails with ErrDialFailure.
+	DialFailure float64
+	// FailAddrs fails the dials to the addresses starting with any of these
+	// multiaddrs, such as /ip4/1.2.3.4 for all the ports of that address.
+	FailAddrs []ma.Multiaddr
+	// DialLatency delays every dial.
+	DialLatency time.Duration
+	// DuplicateDial is the probability that a dial establishes a second
+	// connection with the peer at the same address, going through the
+	// security and multiplexer handshakes twice, like a dial racing a
+	// simultaneous or retried one. The duplicate isn't returned; it is closed
+	// along with the returned connection, so only the remote peer sees two
+	// connections.
+	DuplicateDial float64
+
+	// Latency delays every write on the streams of the connection.
+	Latency time.Duration
+	// Jitter adds a random delay, up to Jitter, to DialLatency and Latency.
+	Jitter time.Duration
+
+	// ReadDelay delays every read on the streams of the connection, and
+	// MaxReadSize bounds the number of bytes a read returns, simulating a slow
+	// reader. Zero MaxReadSize leaves reads unbounded.
+	ReadDelay   time.Duration
+	MaxReadSize int
+
+	// ResetAfter resets the connection and all its streams once that many
+	// bytes have been read and written on its streams. HangAfter hangs the
+	// connection instead: it stays open, but writes are silently dropped, and
+	// reads block until their deadline or the closing of the stream, like a
+	// connection whose remote vanished. Zero disables either fault.
+	ResetAfter int64
+	HangAfter  int64
+}
+
+// failsAddr returns true if the dials to addr must fail.
+func (f *Faults) failsAddr(addr ma.Multiaddr) bool {
+	for _, a := range f.FailAddrs {
+		if bytes.HasPrefix(addr.Bytes(), a.Bytes()) {
+			return true
+		}
+	}
+	return false
+}
+
+// jitter returns d plus a random delay up to the jitter, drawn from rng.
+func (f *Faults) jitter(d time.Duration, rng *rand.Rand) time.Duration {
+	if f.Jitter > 0 {
+		d += time.Duration(rng.Int63n(int64(f.Jitter)))
+	}
+	return d
+}
+
+// Option is an option of a fault-injecting Transport.
+type Option func(cfg *config) error
+
+type config struct {
+	clk clock.Clock
+}
+
+// WithClock sets the clock timing the injected delays and the read and write
+// deadlines of hanging connections. Defaults to clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clk = c
+		return nil
+	}
+}
+
+// Transport is a transport.Transport injecting faults into the dials,
+// listeners and connections of the transport it wraps.
+type Transport struct {
+	tpt  transport.Transport
+	seed int64
+	clk  clock.Clock
+
+	mu       sync.Mutex
+	defaults Faults
+	faults   map[peer.ID]Faults
+	// counts numbers the connections with each peer in each direction, to
+	// seed their sources of randomness.
+	counts map[connKey]uint64
+	conns  map[*conn]struct{}
+}
+
+type connKey struct {
+	p   peer.ID
+	dir network.Direction
+}
+
+var _ transport.Transport = (*Transport)(nil)
+
+// New wraps t into a Transport injecting faults, with the random faults drawn
+// from seed. No fault is injected until set.
+func New(t transport.Transport, seed int64, opts ...Option) (*Transport, error) {
+	cfg := config{clk: clock.Real}
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return &Transport{
+		tpt:    t,
+		seed:   seed,
+		clk:    cfg.clk,
+		faults: make(map[peer.ID]Faults),
+		counts: make(map[connKey]uint64),
+		conns:  make(map[*conn]struct{}),
+	}, nil
+}
+
+// SetFaults sets the faults injected into the dials of, and the connections
+// established afterwards with, p.
+func (t *Transport) SetFaults(p peer.ID, f Faults) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.faults[p] = f
+}
+
+// ClearFaults removes the faults set for p, which then gets the default
+// faults.
+func (t *Transport) ClearFaults(p peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.faults, p)
+}
+
+// SetDefaultFaults sets the faults injected for the peers without faults of
+// their own.
+func (t *Transport) SetDefaultFaults(f Faults) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.defaults = f
+}
+
+// ResetConns resets the live connections with p, and returns their number.
+func (t *Transport) ResetConns(p peer.ID) int {
+	conns := t.connsWith(p)
+	for _, c := range conns {
+		c.reset()
+	}
+	return len(conns)
+}
+
+// HangConns hangs the live connections with p, and returns their number.
+// See Faults.HangAfter.
+func (t *Transport) HangConns(p peer.ID) int {
+	conns := t.connsWith(p)
+	for _, c := range conns {
+		c.hang()
+	}
+	return len(conns)
+}
+
+func (t *Transport) connsWith(p peer.ID) []*conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var conns []*conn
+	for c := range t.conns {
+		// connections closed by the remote are only noticed here
+		if c.IsClosed() {
+			delete(t.conns, c)
+			continue
+		}
+		if c.RemotePeer() == p {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// next returns the faults of the next connection with p in the direction
+// dir, and the source of randomness of that connection.
+func (t *Transport) next(p peer.ID, dir network.Direction) (Faults, *rand.Rand) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.faults[p]
+	if !ok {
+		f = t.defaults
+	}
+	k := connKey{p, dir}
+	n := t.counts[k]
+	t.counts[k]++
+
+	h := fnv.New64a()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.seed))
+	h.Write(b[:])
+	h.Write([]byte(p))
+	h.Write([]byte{byte(dir)})
+	binary.BigEndian.PutUint64(b[:], n)
+	h.Write(b[:])
+	return f, rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+func (t *Transport) track(c *conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[c] = struct{}{}
+}
+
+func (t *Transport) untrack(c *conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+// Dial dials p at raddr with the wrapped transport, unless the dial fails on
+// purpose.
+func (t *Transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	f, rng := t.next(p, network.DirOutbound)
+	if d := f.jitter(f.DialLatency, rng); d > 0 {
+		timer := t.clk.NewTimer(d)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	if f.failsAddr(raddr) || rng.Float64() < f.DialFailure {
+		return nil, fmt.Errorf("failed to dial %s at %s: %w", p, raddr, ErrDialFailure)
+	}
+	c, err := t.tpt.Dial(ctx, raddr, p)
+	if err != nil {
+		return nil, err
+	}
+	var dup transport.CapableConn
+	if f.DuplicateDial > 0 && rng.Float64() < f.DuplicateDial {
+		// the dial succeeded, whether or not its duplicate does
+		if d, err := t.tpt.Dial(ctx, raddr, p); err == nil {
+			dup = d
+		}
+	}
+	return newConn(t, c, dup, f, rng), nil
+}
+
+// CanDial returns true if the wrapped transport can dial addr.
+func (t *Transport) CanDial(addr ma.Multiaddr) bool {
+	return t.tpt.CanDial(addr)
+}
+
+// Listen listens on laddr with the wrapped transport. The faults of the
+// accepted connections are those of their remote peer.
+func (t *Transport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	l, err := t.tpt.Listen(laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: l, t: t}, nil
+}
+
+// Protocols returns the protocols of the wrapped transport.
+func (t *Transport) Protocols() []int {
+	return t.tpt.Protocols()
+}
+
+// Proxy returns true if the wrapped transport is a proxy.
+func (t *Transport) Proxy() bool {
+	return t.tpt.Proxy()
+}
+
+// Close closes the wrapped transport, if it is an io.Closer.
+func (t *Transport) Close() error {
+	if c, ok := t.tpt.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type listener struct {
+	transport.Listener
+	t *Transport
+}
+
+func (l *listener) Accept() (transport.CapableConn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	f, rng := l.t.next(c.RemotePeer(), network.DirInbound)
+	return newConn(l.t, c, nil, f, rng), nil
+}
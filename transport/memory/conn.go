@@ -0,0 +1,230 @@
+package memory
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// pipeBufferSize is the amount of data written to a connection, and not yet
+// read by the remote, beyond which writes block.
+const pipeBufferSize = 256 << 10
+
+// addr is the net.Addr of an in-memory address.
+type addr struct {
+	id uint64
+}
+
+func (a addr) Network() string { return protoMemory.Name }
+func (a addr) String() string  { return Multiaddr(a.id).String() }
+
+// pipe carries data in one direction of a connection.
+type pipe struct {
+	mu  sync.Mutex
+	buf []byte
+	// closed is set once the writing end is closed: reads return io.EOF
+	// once the buffer is drained. broken is set once the reading end is
+	// closed: writes fail.
+	closed bool
+	broken bool
+	// wake is closed, and replaced, on every change.
+	wake chan struct{}
+}
+
+func newPipe() *pipe {
+	return &pipe{wake: make(chan struct{})}
+}
+
+// signal wakes up the readers and writers. Callers hold p.mu.
+func (p *pipe) signal() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+func (p *pipe) closeWrite() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.signal()
+}
+
+func (p *pipe) closeRead() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.broken = true
+	p.buf = nil
+	p.signal()
+}
+
+// deadline is a read or write deadline of a connection.
+type deadline struct {
+	mu sync.Mutex
+	t  time.Time
+	// changed is closed, and replaced, whenever the deadline is set.
+	changed chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{changed: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// wait waits until wake is closed. It returns os.ErrDeadlineExceeded if the
+// deadline passes first, and nil if the deadline changes.
+func (d *deadline) wait(wake <-chan struct{}) error {
+	d.mu.Lock()
+	t, changed := d.t, d.changed
+	d.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !t.IsZero() {
+		remaining := time.Until(t)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-wake:
+	case <-changed:
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// conn is one end of an in-memory connection.
+type conn struct {
+	in, out       *pipe
+	laddr, raddr  ma.Multiaddr
+	lid, rid      uint64
+	readDeadline  *deadline
+	writeDeadline *deadline
+	closeOnce     sync.Once
+}
+
+var _ manet.Conn = (*conn)(nil)
+
+// newConnPair creates the two ends of a connection between the addresses of
+// ids a and b.
+func newConnPair(a, b uint64) (*conn, *conn) {
+	ab, ba := newPipe(), newPipe()
+	ca := &conn{
+		in:            ba,
+		out:           ab,
+		laddr:         Multiaddr(a),
+		raddr:         Multiaddr(b),
+		lid:           a,
+		rid:           b,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	cb := &conn{
+		in:            ab,
+		out:           ba,
+		laddr:         Multiaddr(b),
+		raddr:         Multiaddr(a),
+		lid:           b,
+		rid:           a,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	return ca, cb
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	p := c.in
+	for {
+		p.mu.Lock()
+		switch {
+		case p.broken:
+			p.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(p.buf) > 0:
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.signal()
+			p.mu.Unlock()
+			return n, nil
+		case p.closed:
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		if err := c.readDeadline.wait(wake); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	p := c.out
+	n := 0
+	for {
+		p.mu.Lock()
+		switch {
+		case p.closed:
+			p.mu.Unlock()
+			return n, net.ErrClosed
+		case p.broken:
+			p.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if k := pipeBufferSize - len(p.buf); k > 0 {
+			if k > len(b) {
+				k = len(b)
+			}
+			p.buf = append(p.buf, b[:k]...)
+			b = b[k:]
+			n += k
+			p.signal()
+		}
+		if len(b) == 0 {
+			p.mu.Unlock()
+			return n, nil
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		if err := c.writeDeadline.wait(wake); err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.out.closeWrite()
+		c.in.closeRead()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr                { return addr{c.lid} }
+func (c *conn) RemoteAddr() net.Addr               { return addr{c.rid} }
+func (c *conn) LocalMultiaddr() ma.Multiaddr       { return c.laddr }
+func (c *conn) RemoteMultiaddr() ma.Multiaddr      { return c.raddr }
+func (c *conn) SetReadDeadline(t time.Time) error  { c.readDeadline.set(t); return nil }
+func (c *conn) SetWriteDeadline(t time.Time) error { c.writeDeadline.set(t); return nil }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,89 @@
+package memory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// P_MEMORY is the multiaddr protocol code of in-memory addresses, of the form
+// /memory/<id> with a 64-bit unsigned id.
+const P_MEMORY = 0x0309
+
+var protoMemory = ma.Protocol{
+	Name:       "memory",
+	Code:       P_MEMORY,
+	VCode:      ma.CodeToVarint(P_MEMORY),
+	Size:       64,
+	Transcoder: ma.NewTranscoderFromFunctions(memoryStB, memoryBtS, memoryValidate),
+}
+
+func init() {
+	// newer versions of go-multiaddr define the protocol themselves
+	if ma.ProtocolWithCode(P_MEMORY).Code == P_MEMORY {
+		return
+	}
+	if err := ma.AddProtocol(protoMemory); err != nil {
+		panic(err)
+	}
+}
+
+func memoryStB(s string) ([]byte, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory address id %q: %w", s, err)
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b, nil
+}
+
+func memoryBtS(b []byte) (string, error) {
+	if err := memoryValidate(b); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(binary.BigEndian.Uint64(b), 10), nil
+}
+
+func memoryValidate(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("invalid memory address id length: %d", len(b))
+	}
+	return nil
+}
+
+// Multiaddr returns the in-memory address of the given id.
+func Multiaddr(id uint64) ma.Multiaddr {
+	a, err := ma.NewComponent(protoMemory.Name, strconv.FormatUint(id, 10))
+	if err != nil {
+		panic(err) // cannot happen: every id is valid
+	}
+	return a
+}
+
+// addrID returns the id of an in-memory address.
+func addrID(a ma.Multiaddr) (uint64, error) {
+	var (
+		id  uint64
+		n   int
+		err error
+	)
+	ma.ForEach(a, func(c ma.Component) bool {
+		n++
+		if c.Protocol().Code != P_MEMORY {
+			err = fmt.Errorf("unexpected %s component", c.Protocol().Name)
+			return false
+		}
+		id = binary.BigEndian.Uint64(c.RawValue())
+		return true
+	})
+	if err == nil && n != 1 {
+		err = fmt.Errorf("expected a single %s component", protoMemory.Name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory address %s: %w", a, err)
+	}
+	return id, nil
+}
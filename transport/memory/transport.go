@@ -0,0 +1,204 @@
+// Package memory provides an in-process transport.Transport, listening and
+// dialing on /memory/<id> multiaddrs, for running real libp2p hosts in tests
+// without any OS networking. The connections are upgraded by the supplied
+// transport.Upgrader, with the security and multiplexer stack it is
+// configured with.
+//
+// All the transports of a process share the same address space: a transport
+// can dial any listener of the process. Listening on /memory/0 allocates an
+// unused id.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+var log = logging.Logger("memory-tpt")
+
+// ErrConnRefused is returned when dialing an address nobody listens on.
+var ErrConnRefused = errors.New("connection refused")
+
+// registry holds the listeners of the process, by id.
+var registry = struct {
+	mu        sync.Mutex
+	listeners map[uint64]*listener
+	// next is the next id to allocate, to listeners on /memory/0 and to the
+	// local end of dialed connections.
+	next uint64
+}{
+	listeners: make(map[uint64]*listener),
+	next:      1,
+}
+
+// allocate returns an id unused by listeners. Callers hold registry.mu.
+func allocate() uint64 {
+	for {
+		id := registry.next
+		registry.next++
+		if _, ok := registry.listeners[id]; !ok && id != 0 {
+			return id
+		}
+	}
+}
+
+// Transport is an in-memory transport.Transport.
+type Transport struct {
+	upgrader transport.Upgrader
+	rcmgr    network.ResourceManager
+}
+
+var _ transport.Transport = (*Transport)(nil)
+
+// New creates an in-memory transport upgrading its connections with
+// upgrader, and accounting its outbound connections in rcmgr. A nil rcmgr
+// defaults to network.NullResourceManager.
+func New(upgrader transport.Upgrader, rcmgr network.ResourceManager) (*Transport, error) {
+	if rcmgr == nil {
+		rcmgr = network.NullResourceManager
+	}
+	return &Transport{upgrader: upgrader, rcmgr: rcmgr}, nil
+}
+
+// CanDial returns true for /memory/<id> multiaddrs.
+func (t *Transport) CanDial(addr ma.Multiaddr) bool {
+	_, err := addrID(addr)
+	return err == nil
+}
+
+// Dial dials the peer p listening at raddr.
+func (t *Transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	connScope, err := t.rcmgr.OpenConnection(network.DirOutbound, false, raddr)
+	if err != nil {
+		log.Debugw("resource manager blocked outgoing connection", "peer", p, "addr", raddr, "error", err)
+		return nil, err
+	}
+	if err := connScope.SetPeer(p); err != nil {
+		log.Debugw("resource manager blocked outgoing connection for peer", "peer", p, "addr", raddr, "error", err)
+		connScope.Done()
+		return nil, err
+	}
+	c, err := t.dial(ctx, raddr)
+	if err != nil {
+		connScope.Done()
+		return nil, err
+	}
+	direction := network.DirOutbound
+	if ok, isClient, _ := network.GetSimultaneousConnect(ctx); ok && !isClient {
+		direction = network.DirInbound
+	}
+	return t.upgrader.Upgrade(ctx, t, c, direction, p, connScope)
+}
+
+// dial connects to the listener at raddr, and returns the local end of the
+// connection.
+func (t *Transport) dial(ctx context.Context, raddr ma.Multiaddr) (*conn, error) {
+	id, err := addrID(raddr)
+	if err != nil {
+		return nil, err
+	}
+	registry.mu.Lock()
+	l, ok := registry.listeners[id]
+	local := allocate()
+	registry.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("failed to dial %s: %w", raddr, ErrConnRefused)
+	}
+
+	c, remote := newConnPair(local, id)
+	select {
+	case l.incoming <- remote:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("failed to dial %s: %w", raddr, ErrConnRefused)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Listen listens on laddr, a /memory/<id> multiaddr. The id 0 allocates an
+// unused id.
+func (t *Transport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	id, err := addrID(laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if id == 0 {
+		id = allocate()
+	} else if _, ok := registry.listeners[id]; ok {
+		return nil, fmt.Errorf("failed to listen on %s: address already in use", laddr)
+	}
+	l := &listener{
+		id:       id,
+		addr:     Multiaddr(id),
+		incoming: make(chan *conn),
+		closed:   make(chan struct{}),
+	}
+	registry.listeners[id] = l
+	return t.upgrader.UpgradeListener(t, l), nil
+}
+
+// Protocols returns the protocol of in-memory addresses.
+func (t *Transport) Protocols() []int {
+	return []int{P_MEMORY}
+}
+
+// Proxy always returns false for the in-memory transport.
+func (t *Transport) Proxy() bool {
+	return false
+}
+
+// listener is the listener of raw in-memory connections, upgraded by the
+// upgrader of the transport.
+type listener struct {
+	id       uint64
+	addr     ma.Multiaddr
+	incoming chan *conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ manet.Listener = (*listener)(nil)
+
+func (l *listener) Accept() (manet.Conn, error) {
+	select {
+	case c := <-l.incoming:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		registry.mu.Lock()
+		delete(registry.listeners, l.id)
+		registry.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr{l.id}
+}
+
+func (l *listener) Multiaddr() ma.Multiaddr {
+	return l.addr
+}
@@ -0,0 +1,186 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/transport/transporttest"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/sec/insecure"
+	"github.com/libp2p/go-libp2p/core/transport"
+	blankhost "github.com/libp2p/go-libp2p/p2p/host/blank"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	"github.com/libp2p/go-libp2p/p2p/muxer/mplex"
+	csms "github.com/libp2p/go-libp2p/p2p/net/conn-security-multistream"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	"github.com/libp2p/go-libp2p/p2p/net/upgrader"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// newUpgrader creates an upgrader with plaintext security and mplex, for the
+// peer of key.
+func newUpgrader(key crypto.PrivKey, rcmgr network.ResourceManager) (transport.Upgrader, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var sm csms.SSMuxer
+	sm.AddTransport(insecure.ID, insecure.NewWithIdentity(id, key))
+	return upgrader.New(&sm, mplex.DefaultTransport, upgrader.WithResourceManager(rcmgr))
+}
+
+func TestConformance(t *testing.T) {
+	transporttest.TestTransport(t, func(key crypto.PrivKey, rcmgr network.ResourceManager) (transport.Transport, error) {
+		u, err := newUpgrader(key, rcmgr)
+		if err != nil {
+			return nil, err
+		}
+		return New(u, rcmgr)
+	}, ma.StringCast("/memory/0"))
+}
+
+func TestProtocolRegistered(t *testing.T) {
+	p := ma.ProtocolWithCode(P_MEMORY)
+	if p.Code != P_MEMORY || p.Name != "memory" {
+		t.Fatalf("expected the memory protocol to be registered, got %+v", p)
+	}
+	if p := ma.ProtocolWithName("memory"); p.Code != P_MEMORY {
+		t.Fatalf("expected the memory protocol to be found by name, got %+v", p)
+	}
+
+	a, err := ma.NewMultiaddr("/memory/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "/memory/42" {
+		t.Fatalf("expected /memory/42, got %s", a)
+	}
+	b, err := ma.NewMultiaddrBytes(a.Bytes())
+	if err != nil || !b.Equal(a) {
+		t.Fatalf("expected the binary form to round trip, got %v: %v", b, err)
+	}
+	for _, s := range []string{"/memory/abc", "/memory/-1", "/memory/18446744073709551616", "/memory"} {
+		if _, err := ma.NewMultiaddr(s); err == nil {
+			t.Fatalf("expected %s to be invalid", s)
+		}
+	}
+}
+
+func TestAddrID(t *testing.T) {
+	for _, id := range []uint64{0, 1, 42, 1<<64 - 1} {
+		a := Multiaddr(id)
+		if got, err := addrID(a); err != nil || got != id {
+			t.Fatalf("expected %s to have id %d, got %d: %v", a, id, got, err)
+		}
+		parsed, err := ma.NewMultiaddr(a.String())
+		if err != nil || !parsed.Equal(a) {
+			t.Fatalf("expected %s to round trip, got %v: %v", a, parsed, err)
+		}
+	}
+
+	for _, s := range []string{"/ip4/127.0.0.1/tcp/1", "/memory/1/memory/2", "/memory/1/p2p/QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC"} {
+		if _, err := addrID(ma.StringCast(s)); err == nil {
+			t.Fatalf("expected %s not to be an in-memory address", s)
+		}
+	}
+}
+
+// newHost creates a host whose swarm listens on a new in-memory address.
+func newHost(t *testing.T) *blankhost.BlankHost {
+	t.Helper()
+	key, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.AddPrivKey(id, key)
+	ps.AddPubKey(id, pub)
+
+	s, err := swarm.NewSwarm(id, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := newUpgrader(key, network.NullResourceManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpt, err := New(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddTransport(tpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(ma.StringCast("/memory/0")); err != nil {
+		t.Fatal(err)
+	}
+	h := blankhost.NewBlankHost(s)
+	t.Cleanup(func() {
+		h.Close()
+		ps.Close()
+	})
+	return h
+}
+
+func TestHosts(t *testing.T) {
+	a, b := newHost(t), newHost(t)
+	addrs := b.Addrs()
+	if len(addrs) != 1 {
+		t.Fatalf("expected a single listen address, got %v", addrs)
+	}
+	if _, err := addrID(addrs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	b.SetStreamHandler("/echo", func(s network.Stream) {
+		defer s.Close()
+		io.Copy(s, s)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.Connect(ctx, peer.AddrInfo{ID: b.ID(), Addrs: addrs}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.NewStream(ctx, b.ID(), "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Conn().RemoteMultiaddr().Equal(addrs[0]) {
+		t.Fatalf("expected the connection to be to %s, got %s", addrs[0], s.Conn().RemoteMultiaddr())
+	}
+	msg := []byte("hello")
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	s.CloseWrite()
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(s)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("expected the message to be echoed, got %q: %v", got, err)
+	}
+
+	// the connection of b comes from an in-memory address of its own
+	conns := b.Network().ConnsToPeer(a.ID())
+	if len(conns) != 1 {
+		t.Fatalf("expected a connection from %s, got %d", a.ID(), len(conns))
+	}
+	if _, err := addrID(conns[0].RemoteMultiaddr()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,631 @@
+// Package transporttest is a conformance suite for transport.Transport
+// implementations, to be run from their test files. The transports created by
+// the factory must account their connections in the given resource manager:
+//
+//	func TestConformance(t *testing.T) {
+//		transporttest.TestTransport(t, func(key crypto.PrivKey, rcmgr network.ResourceManager) (transport.Transport, error) {
+//			return NewTransport(key, rcmgr)
+//		}, ma.StringCast("/ip4/127.0.0.1/tcp/0"))
+//	}
+//
+// The suite only listens on the given address, which must be a loopback
+// address for IP transports, and only dials the listeners it creates.
+package transporttest
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network/rcmgr"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// testTimeout bounds the duration of every test of the suite: a transport
+// that deadlocks makes the test binary panic rather than hang.
+const testTimeout = 2 * time.Minute
+
+// opTimeout bounds the duration of the dials, accepts and stream operations
+// expected to succeed, and the time a cancelled or closed operation has to
+// return.
+const opTimeout = 10 * time.Second
+
+// Factory creates the transport under test for the peer of key, accounting
+// its connections in rcmgr.
+type Factory func(key crypto.PrivKey, rcmgr network.ResourceManager) (transport.Transport, error)
+
+var tests = []struct {
+	name string
+	f    func(t *testing.T, f Factory, laddr ma.Multiaddr)
+}{
+	{"Protocols", testProtocols},
+	{"Listen", testListen},
+	{"RoundTrip", testRoundTrip},
+	{"ConnProperties", testConnProperties},
+	{"ConnScope", testConnScope},
+	{"DialWrongPeer", testDialWrongPeer},
+	{"DialCancelled", testDialCancelled},
+	{"DialCancel", testDialCancel},
+	{"ConcurrentAccept", testConcurrentAccept},
+	{"CloseUnblocksAccept", testCloseUnblocksAccept},
+	{"DialClosed", testDialClosed},
+}
+
+// TestTransport runs the conformance suite against the transports created by
+// f, listening on laddr.
+func TestTransport(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	if ip, err := manet.ToIP(laddr); err == nil && !ip.IsLoopback() {
+		t.Fatalf("listen address %s is not a loopback address", laddr)
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			watchdog := time.AfterFunc(testTimeout, func() {
+				panic(fmt.Sprintf("%s timed out after %s", t.Name(), testTimeout))
+			})
+			defer watchdog.Stop()
+			tc.f(t, f, laddr)
+		})
+	}
+}
+
+// node is a transport under test, with its identity and resource manager.
+type node struct {
+	key   crypto.PrivKey
+	id    peer.ID
+	rcmgr network.ResourceManager
+	tpt   transport.Transport
+}
+
+// newNode creates a transport for a new peer. The transport and its resource
+// manager are closed at the end of the test.
+func newNode(t *testing.T, f Factory) *node {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := rcmgr.NewResourceManager(rcmgr.InfiniteLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rm.Close() })
+	tpt, err := f(key, rm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := tpt.(io.Closer); ok {
+		t.Cleanup(func() { c.Close() })
+	}
+	return &node{key: key, id: id, rcmgr: rm, tpt: tpt}
+}
+
+// listen listens on laddr. The listener is closed at the end of the test.
+func (n *node) listen(t *testing.T, laddr ma.Multiaddr) transport.Listener {
+	t.Helper()
+	l, err := n.tpt.Listen(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// dial dials p at raddr. The connection is closed at the end of the test.
+func (n *node) dial(t *testing.T, raddr ma.Multiaddr, p peer.ID) transport.CapableConn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	c, err := n.tpt.Dial(ctx, raddr, p)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %s", raddr, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+type acceptResult struct {
+	c   transport.CapableConn
+	err error
+}
+
+// acceptAsync accepts a connection on l, in the background.
+func acceptAsync(t *testing.T, l transport.Listener) <-chan acceptResult {
+	res := make(chan acceptResult, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			t.Cleanup(func() { c.Close() })
+		}
+		res <- acceptResult{c, err}
+	}()
+	return res
+}
+
+// connect dials the listener of server from client, and returns both ends of
+// the connection.
+func connect(t *testing.T, client, server *node, l transport.Listener) (dialed, accepted transport.CapableConn) {
+	t.Helper()
+	res := acceptAsync(t, l)
+	dialed = client.dial(t, l.Multiaddr(), server.id)
+	select {
+	case r := <-res:
+		if r.err != nil {
+			t.Fatalf("failed to accept: %s", r.err)
+		}
+		return dialed, r.c
+	case <-time.After(opTimeout):
+		t.Fatal("dialed connection not accepted")
+		return nil, nil
+	}
+}
+
+// serveEcho echoes the streams accepted by c, until c is closed.
+func serveEcho(c transport.CapableConn) {
+	for {
+		s, err := c.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer s.Close()
+			io.Copy(s, s)
+		}()
+	}
+}
+
+// echo writes a random message on a new stream of c, and checks that the
+// remote, which must serve echo, sends it back.
+func echo(c transport.CapableConn, size int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	s, err := c.OpenStream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(opTimeout))
+
+	msg := make([]byte, size)
+	rand.Read(msg)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.Write(msg)
+		if err == nil {
+			err = s.CloseWrite()
+		}
+		errc <- err
+	}()
+	buf, err := io.ReadAll(s)
+	if err != nil {
+		return fmt.Errorf("failed to read echo: %w", err)
+	}
+	if err := <-errc; err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if !bytes.Equal(buf, msg) {
+		return fmt.Errorf("echoed %d bytes differ from the %d written bytes", len(buf), len(msg))
+	}
+	return nil
+}
+
+// testProtocols checks that the transport dials the addresses it listens on,
+// and not those using none of its protocols.
+func testProtocols(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	n := newNode(t, f)
+	protos := n.tpt.Protocols()
+	if len(protos) == 0 {
+		t.Fatal("transport has no protocols")
+	}
+	handles := func(a ma.Multiaddr) bool {
+		for _, p := range a.Protocols() {
+			for _, code := range protos {
+				if p.Code == code {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	l := n.listen(t, laddr)
+	if !handles(l.Multiaddr()) {
+		t.Errorf("listen address %s has none of the protocols %v of the transport", l.Multiaddr(), protos)
+	}
+	if !n.tpt.CanDial(l.Multiaddr()) {
+		t.Errorf("transport cannot dial its listen address %s", l.Multiaddr())
+	}
+	for _, s := range []string{
+		"/ip4/127.0.0.1/tcp/1234",
+		"/ip4/127.0.0.1/udp/1234",
+		"/ip4/127.0.0.1/udp/1234/quic",
+		"/ip6/::1/tcp/1234/ws",
+		"/dns4/localhost/tcp/1234",
+		"/unix/tmp/transporttest.sock",
+	} {
+		a := ma.StringCast(s)
+		if !handles(a) && n.tpt.CanDial(a) {
+			t.Errorf("transport can dial %s, using none of its protocols %v", a, protos)
+		}
+	}
+}
+
+// testListen checks that listeners report the address they actually listen
+// on, rather than an unspecified port.
+func testListen(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	n := newNode(t, f)
+	l := n.listen(t, laddr)
+	if l.Addr() == nil {
+		t.Error("listener has no net.Addr")
+	}
+	ma.ForEach(l.Multiaddr(), func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_TCP, ma.P_UDP:
+			if c.Value() == "0" {
+				t.Errorf("listen address %s has an unspecified port", l.Multiaddr())
+			}
+		}
+		return true
+	})
+}
+
+func testRoundTrip(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	client, server := newNode(t, f), newNode(t, f)
+	l := server.listen(t, laddr)
+	dialed, accepted := connect(t, client, server, l)
+
+	go serveEcho(accepted)
+	if err := echo(dialed, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	// and the other way around
+	go serveEcho(dialed)
+	if err := echo(accepted, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testConnProperties checks the identities and addresses reported by both
+// ends of a connection.
+func testConnProperties(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	client, server := newNode(t, f), newNode(t, f)
+	l := server.listen(t, laddr)
+	dialed, accepted := connect(t, client, server, l)
+
+	check := func(side string, c transport.CapableConn, local, remote *node) {
+		if c.LocalPeer() != local.id {
+			t.Errorf("%s connection: local peer is %s, expected %s", side, c.LocalPeer(), local.id)
+		}
+		if c.RemotePeer() != remote.id {
+			t.Errorf("%s connection: remote peer is %s, expected %s", side, c.RemotePeer(), remote.id)
+		}
+		if pub := c.RemotePublicKey(); pub == nil || !pub.Equals(remote.key.GetPublic()) {
+			t.Errorf("%s connection: wrong remote public key", side)
+		}
+		if c.Transport() != local.tpt {
+			t.Errorf("%s connection: not reporting the transport it belongs to", side)
+		}
+		if c.Scope() == nil {
+			t.Errorf("%s connection: no scope", side)
+		}
+		if c.IsClosed() {
+			t.Errorf("%s connection: closed", side)
+		}
+	}
+	check("dialed", dialed, client, server)
+	check("accepted", accepted, server, client)
+
+	if !dialed.RemoteMultiaddr().Equal(l.Multiaddr()) {
+		t.Errorf("dialed connection: remote address is %s, expected the dialed %s", dialed.RemoteMultiaddr(), l.Multiaddr())
+	}
+	if !accepted.LocalMultiaddr().Equal(l.Multiaddr()) {
+		t.Errorf("accepted connection: local address is %s, expected the listen address %s", accepted.LocalMultiaddr(), l.Multiaddr())
+	}
+	if !accepted.RemoteMultiaddr().Equal(dialed.LocalMultiaddr()) {
+		t.Errorf("accepted connection: remote address is %s, but the dialed connection is from %s", accepted.RemoteMultiaddr(), dialed.LocalMultiaddr())
+	}
+
+	if err := dialed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !dialed.IsClosed() {
+		t.Error("dialed connection not closed by Close")
+	}
+}
+
+// testConnScope checks that connections are accounted in the peer scope of
+// the remote, and released once closed.
+func testConnScope(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	client, server := newNode(t, f), newNode(t, f)
+	l := server.listen(t, laddr)
+	dialed, accepted := connect(t, client, server, l)
+
+	check := func(side string, c transport.CapableConn, n *node, remote peer.ID, dir network.Direction) {
+		st := c.Scope().Stat()
+		if dir == network.DirOutbound && st.NumConnsOutbound != 1 || dir == network.DirInbound && st.NumConnsInbound != 1 {
+			t.Errorf("%s connection: not accounted as an %s connection in its scope: %+v", side, dir, st)
+		}
+		if ms, ok := c.Scope().(network.ConnManagementScope); ok {
+			if p := ms.PeerScope().Peer(); p != remote {
+				t.Errorf("%s connection: scope of peer %s, expected %s", side, p, remote)
+			}
+		}
+		n.rcmgr.ViewPeer(remote, func(s network.PeerScope) error {
+			if st := s.Stat(); st.NumConnsInbound+st.NumConnsOutbound != 1 {
+				t.Errorf("%s connection: %d connections accounted to the remote peer, expected 1", side, st.NumConnsInbound+st.NumConnsOutbound)
+			}
+			return nil
+		})
+	}
+	check("dialed", dialed, client, server.id, network.DirOutbound)
+	check("accepted", accepted, server, client.id, network.DirInbound)
+
+	dialed.Close()
+	accepted.Close()
+	for _, n := range []*node{client, server} {
+		if err := waitNoConns(n.rcmgr); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// waitNoConns waits until no connection is accounted in the system scope of
+// rm.
+func waitNoConns(rm network.ResourceManager) error {
+	var st network.ScopeStat
+	for deadline := time.Now().Add(opTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rm.ViewSystem(func(s network.ResourceScope) error {
+			st = s.Stat()
+			return nil
+		})
+		if st.NumConnsInbound+st.NumConnsOutbound == 0 && st.NumFD == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("connection resources not released after close: %+v", st)
+}
+
+// testDialWrongPeer checks that a dial fails when the listener is not the
+// expected peer.
+func testDialWrongPeer(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	client, server, other := newNode(t, f), newNode(t, f), newNode(t, f)
+	l := server.listen(t, laddr)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	c, err := client.tpt.Dial(ctx, l.Multiaddr(), other.id)
+	if err == nil {
+		c.Close()
+		t.Fatalf("dialed %s at the address of %s", other.id, server.id)
+	}
+	if err := waitNoConns(client.rcmgr); err != nil {
+		t.Error(err)
+	}
+}
+
+// testDialCancelled checks that dials with a cancelled context fail.
+func testDialCancelled(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	client, server := newNode(t, f), newNode(t, f)
+	l := server.listen(t, laddr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, err := client.tpt.Dial(ctx, l.Multiaddr(), server.id)
+	if err == nil {
+		c.Close()
+		t.Fatal("dial succeeded with a cancelled context")
+	}
+	if err := waitNoConns(client.rcmgr); err != nil {
+		t.Error(err)
+	}
+}
+
+// testDialCancel cancels dials at various points of the connection
+// establishment. Every dial must return shortly after the cancellation, and
+// the listener must keep accepting connections.
+func testDialCancel(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	const dials = 20
+	client, server := newNode(t, f), newNode(t, f)
+	l := server.listen(t, laddr)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for i := 0; i < dials; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Duration(i)*200*time.Microsecond, cancel)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c, err := client.tpt.Dial(ctx, l.Multiaddr(), server.id)
+			if err == nil {
+				c.Close()
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(opTimeout):
+			t.Fatalf("dial %d not returning after its context was cancelled", i)
+		}
+		cancel()
+	}
+	if err := waitNoConns(client.rcmgr); err != nil {
+		t.Error(err)
+	}
+
+	// the cancelled dials must not have wedged the listener
+	c := client.dial(t, l.Multiaddr(), server.id)
+	c.Close()
+}
+
+// testConcurrentAccept dials a listener from several peers concurrently,
+// while several goroutines accept.
+func testConcurrentAccept(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	const (
+		clients   = 4
+		dials     = 8
+		acceptors = 4
+	)
+	server := newNode(t, f)
+	l, err := server.tpt.Listen(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var acceptWg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := make(map[peer.ID]int)
+	for i := 0; i < acceptors; i++ {
+		acceptWg.Add(1)
+		go func() {
+			defer acceptWg.Done()
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				accepted[c.RemotePeer()]++
+				mu.Unlock()
+				t.Cleanup(func() { c.Close() })
+				go serveEcho(c)
+			}
+		}()
+	}
+
+	nodes := make([]*node, clients)
+	for i := range nodes {
+		nodes[i] = newNode(t, f)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, clients*dials)
+	for _, n := range nodes {
+		for i := 0; i < dials; i++ {
+			wg.Add(1)
+			go func(n *node) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+				defer cancel()
+				c, err := n.tpt.Dial(ctx, l.Multiaddr(), server.id)
+				if err != nil {
+					errs <- fmt.Errorf("failed to dial: %w", err)
+					return
+				}
+				defer c.Close()
+				if err := echo(c, 1024); err != nil {
+					errs <- err
+				}
+			}(n)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+	acceptWg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	for _, n := range nodes {
+		if accepted[n.id] != dials {
+			t.Errorf("accepted %d connections from %s, expected %d", accepted[n.id], n.id, dials)
+		}
+	}
+}
+
+// testCloseUnblocksAccept checks that closing a listener unblocks pending
+// and later calls to Accept.
+func testCloseUnblocksAccept(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	n := newNode(t, f)
+	l, err := n.tpt.Listen(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := acceptAsync(t, l)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case r := <-res:
+		t.Fatalf("Accept returned without a connection: %v", r.err)
+	default:
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-res:
+		if r.err == nil {
+			t.Fatal("Accept returned a connection")
+		}
+	case <-time.After(opTimeout):
+		t.Fatal("Accept not unblocked by Close")
+	}
+	select {
+	case r := <-acceptAsync(t, l):
+		if r.err == nil {
+			t.Fatal("Accept returned a connection after Close")
+		}
+	case <-time.After(opTimeout):
+		t.Fatal("Accept blocking after Close")
+	}
+}
+
+// testDialClosed checks that dials to a closed listener fail.
+func testDialClosed(t *testing.T, f Factory, laddr ma.Multiaddr) {
+	client, server := newNode(t, f), newNode(t, f)
+	l, err := server.tpt.Listen(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr := l.Multiaddr()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	c, err := client.tpt.Dial(ctx, raddr, server.id)
+	if err == nil {
+		c.Close()
+		t.Fatalf("dialed closed listener at %s", raddr)
+	}
+	if err := waitNoConns(client.rcmgr); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,35 @@
+package transporttest_test
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/transport/transporttest"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/sec/insecure"
+	"github.com/libp2p/go-libp2p/core/transport"
+	"github.com/libp2p/go-libp2p/p2p/muxer/mplex"
+	csms "github.com/libp2p/go-libp2p/p2p/net/conn-security-multistream"
+	"github.com/libp2p/go-libp2p/p2p/net/upgrader"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestTCP(t *testing.T) {
+	transporttest.TestTransport(t, func(key crypto.PrivKey, rcmgr network.ResourceManager) (transport.Transport, error) {
+		id, err := peer.IDFromPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		var sm csms.SSMuxer
+		sm.AddTransport(insecure.ID, insecure.NewWithIdentity(id, key))
+		u, err := upgrader.New(&sm, mplex.DefaultTransport, upgrader.WithResourceManager(rcmgr))
+		if err != nil {
+			return nil, err
+		}
+		return tcp.NewTCPTransport(u, rcmgr)
+	}, ma.StringCast("/ip4/127.0.0.1/tcp/0"))
+}